@@ -24,6 +24,8 @@ import (
 	vaultsecrets "bibbl/internal/secrets/vault"
 	"bibbl/internal/telemetry"
 	"bibbl/internal/version"
+	"bibbl/pkg/outputs"
+	"bibbl/pkg/seal"
 	bibbltls "bibbl/pkg/tls"
 )
 
@@ -115,6 +117,9 @@ func main() {
 			fmt.Fprintf(os.Stderr, "failed to resolve vault secrets: %v\n", err)
 			os.Exit(2)
 		}
+		// Spill and queue keys and destination settings may be vault:// references too
+		seal.SetRefResolver(vaultResolver.Resolve)
+		outputs.SetRefResolver(vaultResolver.Resolve)
 	}
 
 	if *printEffectiveConfig {
@@ -0,0 +1,232 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"bibbl/internal/config"
+	"bibbl/internal/metrics"
+	"bibbl/pkg/outputs"
+	"bibbl/pkg/pipeline"
+
+	"github.com/gorilla/mux"
+)
+
+// Destination status values reported while a circuit breaker is not closed.
+const (
+	statusCircuitOpen     = "circuit_open"
+	statusCircuitHalfOpen = "circuit_half_open"
+)
+
+// CircuitHealth is the API view of a destination's circuit breaker.
+type CircuitHealth struct {
+	State       string    `json:"state"` // closed | open | half-open
+	Failures    uint32    `json:"failures"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitempty"`
+	RetryAt     time.Time `json:"retryAt,omitempty"` // open only: when a trial delivery is let through
+	Calls       uint64    `json:"calls"`
+	Successes   uint64    `json:"successes"`
+	Rejected    uint64    `json:"rejected"`
+}
+
+// QueueHealth summarises a destination's disk queue.
+type QueueHealth struct {
+	Depth        int     `json:"depth"`
+	Bytes        int64   `json:"bytes"`
+	MaxBytes     int64   `json:"maxBytes"`
+	OldestAgeSec float64 `json:"oldestAgeSec"`
+	Dropped      uint64  `json:"dropped"`
+	Corrupt      uint64  `json:"corrupt"`
+	Tampered     uint64  `json:"tampered"`
+}
+
+// DestinationHealth is the response of GET /destinations/{id}/health.
+type DestinationHealth struct {
+	ID          string          `json:"id"`
+	Status      string          `json:"status"`
+	Error       string          `json:"error,omitempty"` // why the output is not running
+	Output      *outputs.Health `json:"output,omitempty"`
+	Circuit     *CircuitHealth  `json:"circuit,omitempty"`
+	Queue       *QueueHealth    `json:"queue,omitempty"`
+	DeadLetters int             `json:"deadLetters"`
+}
+
+func circuitHealth(st pipeline.CircuitStats) *CircuitHealth {
+	return &CircuitHealth{
+		State:       st.State,
+		Failures:    st.Failures,
+		LastError:   st.LastError,
+		LastErrorAt: st.LastFailure,
+		RetryAt:     st.RetryAt,
+		Calls:       st.TotalCalls,
+		Successes:   st.TotalSuccess,
+		Rejected:    st.TotalReject,
+	}
+}
+
+// withCircuitBreakers sets the breaker settings used for destination outputs.
+// Without it breakers use the pipeline package defaults.
+func withCircuitBreakers(p PipelineEngine, cfg config.CircuitBreakerConfig) {
+	m, ok := p.(*memoryEngine)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.breakerCfg = cfg
+}
+
+// breakerLocked returns the destination's circuit breaker, creating it on
+// first use. Breakers outlive output rebuilds so a config change does not
+// close a circuit that is open for good reason. Caller holds m.mu.
+func (m *memoryEngine) breakerLocked(id string) *pipeline.CircuitBreaker {
+	if cb, ok := m.breakers[id]; ok {
+		return cb
+	}
+	if m.breakers == nil {
+		m.breakers = map[string]*pipeline.CircuitBreaker{}
+	}
+	c := m.breakerCfg
+	cb := pipeline.NewCircuitBreaker(id, uint32(max(c.MaxFailures, 0)), c.OpenTimeout, uint32(max(c.HalfOpenSuccesses, 0)))
+	m.breakers[id] = cb
+	return cb
+}
+
+// dropBreakerLocked forgets a deleted destination's breaker and its gauges.
+func (m *memoryEngine) dropBreakerLocked(id string) {
+	if _, ok := m.breakers[id]; !ok {
+		return
+	}
+	delete(m.breakers, id)
+	metrics.CircuitState.DeleteLabelValues(id)
+	metrics.CircuitFailures.DeleteLabelValues(id)
+}
+
+// DestinationHealth reports a destination's output, circuit breaker, queue
+// and dead-letter state.
+func (m *memoryEngine) DestinationHealth(id string) (DestinationHealth, error) {
+	m.mu.RLock()
+	d := m.findDestLocked(id)
+	if d == nil {
+		m.mu.RUnlock()
+		return DestinationHealth{}, errDestinationNotFound
+	}
+	h := DestinationHealth{ID: d.ID, Status: d.Status, Error: d.outputErr}
+	out, cb, q := d.output, m.breakers[id], m.queues[id]
+	m.mu.RUnlock()
+
+	if out != nil {
+		oh := out.Health()
+		h.Status, h.Output = oh.Status, &oh
+	}
+	if cb != nil {
+		h.Circuit = circuitHealth(cb.Stats())
+	}
+	if q != nil {
+		st := q.Stats()
+		h.Queue = &QueueHealth{Depth: st.Depth, Bytes: st.Bytes, MaxBytes: st.MaxBytes, Dropped: st.Dropped, Corrupt: st.Corrupt, Tampered: st.Tampered}
+		if st.OldestUnix > 0 {
+			h.Queue.OldestAgeSec = time.Since(time.Unix(st.OldestUnix, 0)).Seconds()
+		}
+	}
+	h.DeadLetters = m.dlq.size(id)
+	return h, nil
+}
+
+// breakerOutput runs every delivery to an output through the destination's
+// circuit breaker. Behind a disk queue, an open circuit leaves batches in the
+// queue untouched until the breaker lets a trial batch through; without one,
+// Send fails fast instead of piling more work on a failing destination.
+// Outputs that batch Send calls in the background route those batches
+// through SendBatch too, so their failures trip the breaker and what it
+// turns away goes to the dead-letter store.
+type breakerOutput struct {
+	destID string
+	inner  outputs.Output
+	cb     *pipeline.CircuitBreaker
+}
+
+func newBreakerOutput(destID string, inner outputs.Output, cb *pipeline.CircuitBreaker) *breakerOutput {
+	o := &breakerOutput{destID: destID, inner: inner, cb: cb}
+	if bg, ok := inner.(outputs.BackgroundSender); ok {
+		bg.SetBackgroundSender(o.SendBatch)
+	}
+	o.publish()
+	return o
+}
+
+func (o *breakerOutput) Send(event map[string]interface{}) error {
+	err := o.cb.Execute(func() error { return o.inner.Send(event) })
+	o.publish()
+	return err
+}
+
+// SendBatch delivers a batch synchronously. A batch the destination rejected
+// for good does not count against the breaker: the destination answered.
+func (o *breakerOutput) SendBatch(events []map[string]interface{}) error {
+	var rejected error
+	err := o.cb.Execute(func() error {
+		err := o.sendBatch(events)
+		if _, permanent := outputs.IsPermanent(err); permanent {
+			rejected = err
+			return nil
+		}
+		return err
+	})
+	o.publish()
+	if rejected != nil {
+		return rejected
+	}
+	return err
+}
+
+func (o *breakerOutput) sendBatch(events []map[string]interface{}) error {
+	if bs, ok := o.inner.(outputs.BatchSender); ok {
+		return bs.SendBatch(events)
+	}
+	for _, ev := range events {
+		if err := o.inner.Send(ev); err != nil {
+			return err
+		}
+	}
+	return o.inner.Flush()
+}
+
+func (o *breakerOutput) Flush() error { return o.inner.Flush() }
+func (o *breakerOutput) Close() error { return o.inner.Close() }
+
+// Health reports the output's health, with the circuit state taking over
+// the status while the breaker is not closed.
+func (o *breakerOutput) Health() outputs.Health {
+	h := o.inner.Health()
+	switch o.cb.State() {
+	case pipeline.StateOpen:
+		h.Status = statusCircuitOpen
+	case pipeline.StateHalfOpen:
+		h.Status = statusCircuitHalfOpen
+	default:
+		return h
+	}
+	if st := o.cb.Stats(); st.LastError != "" && !st.LastFailure.Before(h.LastErrorAt) {
+		h.LastError, h.LastErrorAt = st.LastError, st.LastFailure
+	}
+	return h
+}
+
+// publish exports the breaker's state and failure count.
+func (o *breakerOutput) publish() {
+	metrics.CircuitState.WithLabelValues(o.destID).Set(float64(o.cb.State()))
+	metrics.CircuitFailures.WithLabelValues(o.destID).Set(float64(o.cb.Stats().Failures))
+}
+
+func (s *Server) handleDestinationHealth(w http.ResponseWriter, r *http.Request) {
+	h, err := s.pipeline.DestinationHealth(mux.Vars(r)["id"])
+	if err != nil {
+		writeDLQError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h)
+}
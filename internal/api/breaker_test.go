@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"bibbl/internal/config"
+	"bibbl/pkg/outputs"
+)
+
+func TestCircuitBreakerHoldsEventsInQueue(t *testing.T) {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.AuthTokens = map[string][]string{"admin-token": {"admin"}}
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Outputs.Queue.Enabled = true
+	cfg.Outputs.CircuitBreaker = config.CircuitBreakerConfig{MaxFailures: 1, OpenTimeout: 300 * time.Millisecond, HalfOpenSuccesses: 1}
+	srv := NewServer(cfg)
+	eng, _ := srv.engine()
+	out := &batchOutput{fakeOutput: newFakeOutput()}
+	eng.outputs.Register("flaky", func(map[string]interface{}) (outputs.Output, error) { return out, nil })
+	created, err := eng.CreateDestination("Flaky", "flaky", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("create destination: %v", err)
+	}
+	destID := created.(memDest).ID
+	running, _ := eng.destinationOutput(destID)
+	_ = running.Send(map[string]interface{}{"_raw": "one"})
+	_ = running.Send(map[string]interface{}{"_raw": "two"})
+
+	health := func() DestinationHealth {
+		t.Helper()
+		code, body := doJSON(t, srv, http.MethodGet, "/api/v1/destinations/"+destID+"/health", nil)
+		var h DestinationHealth
+		if err := json.Unmarshal(body, &h); err != nil || code != http.StatusOK {
+			t.Fatalf("health: %d %s", code, body)
+		}
+		return h
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	h := health()
+	for (h.Circuit == nil || h.Circuit.State != "open") && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		h = health()
+	}
+	if h.Status != statusCircuitOpen || h.Circuit.LastError != "endpoint unavailable" || h.Queue == nil || h.Queue.Depth != 2 {
+		t.Fatalf("expected open circuit holding 2 queued events, got %+v circuit %+v queue %+v", h, h.Circuit, h.Queue)
+	}
+	for _, d := range eng.GetDestinations() {
+		if d.ID == destID && d.Status != statusCircuitOpen {
+			t.Fatalf("GetDestinations status: got %q", d.Status)
+		}
+	}
+
+	out.mu.Lock()
+	out.up = true
+	out.mu.Unlock()
+	for (out.count() < 2 || h.Circuit.State != "closed" || h.Queue.Depth != 0) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		h = health()
+	}
+	if out.count() != 2 || h.Circuit.State != "closed" || h.Queue.Depth != 0 {
+		t.Fatalf("expected circuit to close and drain the queue, delivered %d, circuit %+v queue %+v", out.count(), h.Circuit, h.Queue)
+	}
+	if code, _ := doJSON(t, srv, http.MethodGet, "/api/v1/destinations/missing/health", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown destination: expected 404, got %d", code)
+	}
+}
+
+func TestCircuitBreakerTripsOnBackgroundBatchesWithoutQueue(t *testing.T) {
+	eng := NewMemoryEngine().(*memoryEngine)
+	eng.hub, _ = NewLogHub("")
+	withCircuitBreakers(eng, config.CircuitBreakerConfig{MaxFailures: 2, OpenTimeout: time.Minute, HalfOpenSuccesses: 1})
+	var calls atomic.Int32
+	eng.outputs.Register("batched", func(map[string]interface{}) (outputs.Output, error) {
+		return outputs.NewBatcher("batched", outputs.BatchLimits{MaxEvents: 1}, func([]map[string]interface{}) error {
+			calls.Add(1)
+			return errors.New("endpoint unavailable")
+		}), nil
+	})
+	created, err := eng.CreateDestination("Batched", "batched", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("create destination: %v", err)
+	}
+	destID := created.(memDest).ID
+	defer eng.closeOutputs()
+	running, _ := eng.destinationOutput(destID)
+	for i := 0; i < 4; i++ {
+		if err := running.Send(map[string]interface{}{"n": i}); err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+		_ = running.Flush()
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	h, _ := eng.DestinationHealth(destID)
+	for (h.Circuit.State != "open" || h.DeadLetters < 4) && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+		h, _ = eng.DestinationHealth(destID)
+	}
+	if h.Circuit.State != "open" || h.Status != statusCircuitOpen {
+		t.Fatalf("expected background failures to open the circuit, got %+v", h.Circuit)
+	}
+	if n := calls.Load(); n > 3 || h.DeadLetters != 4 {
+		t.Fatalf("expected the open circuit to turn batches away into the DLQ, got %d deliveries and %d dead letters", n, h.DeadLetters)
+	}
+}
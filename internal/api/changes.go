@@ -0,0 +1,628 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"bibbl/pkg/outputs"
+)
+
+var (
+	errNothingToCommit = errors.New("no changes to commit")
+	errVersionNotFound = errors.New("version not found")
+)
+
+// ConfigVersion is a committed configuration snapshot. Author is the
+// authenticated principal; Note is free text supplied with the request.
+// Config is omitted from listings.
+type ConfigVersion struct {
+	Version   int             `json:"version"`
+	Author    string          `json:"author"`
+	Note      string          `json:"note,omitempty"`
+	Message   string          `json:"message"`
+	Timestamp time.Time       `json:"ts"`
+	Changes   int             `json:"changes"`
+	Config    *ConfigDocument `json:"config,omitempty"`
+}
+
+// versionStore keeps committed versions, one file per version under
+// <data_dir>/versions. Snapshots carry plaintext credentials, like state.json.
+type versionStore struct {
+	mu       sync.Mutex
+	dir      string // "" = memory only
+	versions []ConfigVersion
+}
+
+func newVersionStore(dataDir string) (*versionStore, error) {
+	vs := &versionStore{}
+	if dataDir == "" {
+		return vs, nil
+	}
+	vs.dir = filepath.Join(dataDir, "versions")
+	if err := os.MkdirAll(vs.dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create versions dir: %w", err)
+	}
+	files, err := filepath.Glob(filepath.Join(vs.dir, "v*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", filepath.Base(f), err)
+		}
+		var v ConfigVersion
+		if err := json.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", filepath.Base(f), err)
+		}
+		vs.versions = append(vs.versions, v)
+	}
+	sort.Slice(vs.versions, func(i, j int) bool { return vs.versions[i].Version < vs.versions[j].Version })
+	return vs, nil
+}
+
+func (vs *versionStore) list() []ConfigVersion {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	out := make([]ConfigVersion, len(vs.versions))
+	for i, v := range vs.versions {
+		v.Config = nil
+		out[i] = v
+	}
+	return out
+}
+
+func (vs *versionStore) get(version int) (ConfigVersion, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	for _, v := range vs.versions {
+		if v.Version == version {
+			return v, true
+		}
+	}
+	return ConfigVersion{}, false
+}
+
+func (vs *versionStore) latest() (ConfigVersion, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	if len(vs.versions) == 0 {
+		return ConfigVersion{}, false
+	}
+	return vs.versions[len(vs.versions)-1], true
+}
+
+func (vs *versionStore) add(author, note, message string, changes int, doc ConfigDocument) (ConfigVersion, error) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	v := ConfigVersion{Version: 1, Author: author, Note: note, Message: message, Timestamp: time.Now().UTC(), Changes: changes, Config: &doc}
+	if n := len(vs.versions); n > 0 {
+		v.Version = vs.versions[n-1].Version + 1
+	}
+	if vs.dir != "" {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return ConfigVersion{}, fmt.Errorf("encode version: %w", err)
+		}
+		if err := writeFileAtomic(filepath.Join(vs.dir, fmt.Sprintf("v%06d.json", v.Version)), data); err != nil {
+			return ConfigVersion{}, fmt.Errorf("write version %d: %w", v.Version, err)
+		}
+	}
+	vs.versions = append(vs.versions, v)
+	return v, nil
+}
+
+// draftFileName is the staged draft kept under storage.data_dir, beside
+// versions/, so uncommitted changes survive a restart.
+const draftFileName = "draft.json"
+
+// changeControl owns the configuration history and, in staged mode, the draft
+// workspace API mutations go into until they are committed.
+type changeControl struct {
+	mu       sync.Mutex // serialises commit, rollback and discard
+	live     *memoryEngine
+	draft    *memoryEngine // nil when changes apply immediately
+	versions *versionStore
+}
+
+func newChangeControl(live *memoryEngine, staged bool, dataDir string) (*changeControl, error) {
+	vs, err := newVersionStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	c := &changeControl{live: live, versions: vs}
+	if staged {
+		c.draft = newStagingEngine(live)
+		restored, err := c.loadDraft(dataDir)
+		if err != nil {
+			return nil, err
+		}
+		if !restored {
+			if err := c.resetDraft(); err != nil {
+				return nil, fmt.Errorf("initialise draft: %w", err)
+			}
+		}
+	}
+	if _, ok := vs.latest(); !ok {
+		if _, err := vs.add("system", "", "initial configuration", 0, live.configDocument(false)); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// newStagingEngine returns an engine that holds configuration only. It shares
+// the live engine's filter mode so drafts are validated the same way.
+func newStagingEngine(live *memoryEngine) *memoryEngine {
+	m := NewMemoryEngine().(*memoryEngine)
+	m.outputs = outputs.NewRegistry()
+	m.staging = true
+	live.mu.RLock()
+	m.legacyFilters = live.legacyFilters
+	live.mu.RUnlock()
+	return m
+}
+
+// loadDraft restores the draft saved by a previous run and makes every later
+// draft change write through to it. It reports whether a draft was restored;
+// an unreadable draft is logged and replaced by a copy of live.
+func (c *changeControl) loadDraft(dataDir string) (bool, error) {
+	if dataDir == "" {
+		return false, nil
+	}
+	store, err := newStateStore(dataDir, draftFileName)
+	if err != nil {
+		return false, err
+	}
+	st, err := store.load()
+	if err != nil {
+		log.Printf("staged draft discarded: %v", err)
+		st = nil
+	}
+	c.draft.mu.Lock()
+	defer c.draft.mu.Unlock()
+	if st != nil {
+		if err := c.draft.restoreLocked(st); err != nil {
+			log.Printf("staged draft discarded: %v", err)
+			st = nil
+		}
+	}
+	c.draft.state = store
+	return st != nil, nil
+}
+
+// resetDraft makes the draft a copy of live, discarding staged changes.
+func (c *changeControl) resetDraft() error {
+	if c.draft == nil {
+		return nil
+	}
+	_, err := c.draft.ImportConfig(c.live.configDocument(false), false)
+	return err
+}
+
+// pending lists what a commit would record: the draft's changes to live in
+// staged mode, otherwise what changed on live since the last version.
+func (c *changeControl) pending() ([]ConfigChange, error) {
+	var res ConfigImportResult
+	var err error
+	if c.draft != nil {
+		res, err = c.live.ImportConfig(c.draft.configDocument(false), true)
+	} else {
+		res, err = c.sinceLatest()
+	}
+	if res.Changes == nil {
+		res.Changes = []ConfigChange{}
+	}
+	return res.Changes, err
+}
+
+// sinceLatest diffs live against the last committed version by replaying that
+// version into a scratch engine, so changes read in the direction they were
+// made (a route created since then is a create, not a delete).
+func (c *changeControl) sinceLatest() (ConfigImportResult, error) {
+	last, ok := c.versions.latest()
+	if !ok || last.Config == nil {
+		return ConfigImportResult{}, nil
+	}
+	base := newStagingEngine(c.live)
+	if _, err := base.ImportConfig(*last.Config, false); err != nil {
+		return ConfigImportResult{}, fmt.Errorf("load version %d: %w", last.Version, err)
+	}
+	return base.ImportConfig(c.live.configDocument(false), true)
+}
+
+// commit applies the draft (staged mode) and records live as a new version.
+// Without a draft it records changes made since the last version.
+func (c *changeControl) commit(author, note, message string) (ConfigVersion, []string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var res ConfigImportResult
+	var err error
+	if c.draft != nil {
+		res, err = c.live.ImportConfig(c.draft.configDocument(false), false)
+	} else {
+		res, err = c.sinceLatest()
+	}
+	if err != nil {
+		return ConfigVersion{}, nil, err
+	}
+	if len(res.Changes) == 0 {
+		return ConfigVersion{}, nil, errNothingToCommit
+	}
+	v, err := c.versions.add(author, note, message, len(res.Changes), c.live.configDocument(false))
+	if err != nil {
+		return ConfigVersion{}, res.Warnings, err
+	}
+	return v, res.Warnings, c.resetDraft()
+}
+
+// rollback restores version n on live, drops the draft and records the
+// restore as a new version.
+func (c *changeControl) rollback(n int, author, note string) (ConfigVersion, []string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	target, ok := c.versions.get(n)
+	if !ok || target.Config == nil {
+		return ConfigVersion{}, nil, errVersionNotFound
+	}
+	res, err := c.live.ImportConfig(*target.Config, false)
+	if err != nil {
+		return ConfigVersion{}, nil, err
+	}
+	v, err := c.versions.add(author, note, fmt.Sprintf("rollback to version %d", n), len(res.Changes), c.live.configDocument(false))
+	if err != nil {
+		return ConfigVersion{}, res.Warnings, err
+	}
+	return v, res.Warnings, c.resetDraft()
+}
+
+func (c *changeControl) discard() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.resetDraft()
+}
+
+// setSourceEnabled mirrors a live start/stop into a staging engine so that
+// runtime state does not show up as a pending change.
+func (m *memoryEngine) setSourceEnabled(id string, enabled bool) {
+	defer m.writeState()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.findSourceLocked(id); s != nil {
+		s.Enabled = enabled
+		m.persistLocked()
+	}
+}
+
+// stagedEngine routes configuration reads and writes to the draft while
+// runtime operations (start/stop, buffers, stats) stay on the live engine.
+type stagedEngine struct {
+	PipelineEngine // live
+	draft          *memoryEngine
+}
+
+func (e *stagedEngine) GetSources() []struct {
+	ID      string
+	Name    string
+	Type    string
+	Config  map[string]interface{}
+	Status  string
+	Enabled bool
+} {
+	status := map[string]string{}
+	for _, s := range e.PipelineEngine.GetSources() {
+		status[s.ID] = s.Status
+	}
+	out := e.draft.GetSources()
+	for i := range out {
+		if st, ok := status[out[i].ID]; ok {
+			out[i].Status = st
+		} else {
+			out[i].Status = "draft"
+		}
+	}
+	return out
+}
+
+func (e *stagedEngine) CreateSource(name, typ string, cfg map[string]interface{}) (interface{}, error) {
+	return e.draft.CreateSource(name, typ, cfg)
+}
+
+func (e *stagedEngine) UpdateSource(id, name string, cfg map[string]interface{}) error {
+	return e.draft.UpdateSource(id, name, cfg)
+}
+
+func (e *stagedEngine) DeleteSource(id string) error { return e.draft.DeleteSource(id) }
+
+func (e *stagedEngine) StartSource(id string) error {
+	if err := e.PipelineEngine.StartSource(id); err != nil {
+		return err
+	}
+	e.draft.setSourceEnabled(id, true)
+	return nil
+}
+
+func (e *stagedEngine) StopSource(id string) error {
+	if err := e.PipelineEngine.StopSource(id); err != nil {
+		return err
+	}
+	e.draft.setSourceEnabled(id, false)
+	return nil
+}
+
+func (e *stagedEngine) GetDestinations() []struct {
+	ID      string
+	Name    string
+	Type    string
+	Status  string
+	Config  map[string]interface{}
+	Enabled bool
+} {
+	status := map[string]string{}
+	for _, d := range e.PipelineEngine.GetDestinations() {
+		status[d.ID] = d.Status
+	}
+	out := e.draft.GetDestinations()
+	for i := range out {
+		if st, ok := status[out[i].ID]; ok {
+			out[i].Status = st
+		} else {
+			out[i].Status = "draft"
+		}
+	}
+	return out
+}
+
+func (e *stagedEngine) CreateDestination(name, typ string, cfg map[string]interface{}) (interface{}, error) {
+	return e.draft.CreateDestination(name, typ, cfg)
+}
+
+func (e *stagedEngine) UpdateDestination(id, name string, cfg map[string]interface{}) error {
+	return e.draft.UpdateDestination(id, name, cfg)
+}
+
+func (e *stagedEngine) DeleteDestination(id string) error { return e.draft.DeleteDestination(id) }
+
+func (e *stagedEngine) PatchDestination(id string, patch map[string]interface{}) error {
+	return e.draft.PatchDestination(id, patch)
+}
+
+func (e *stagedEngine) GetPipelines() []struct {
+	ID          string
+	Name        string
+	Description string
+	Functions   []string
+} {
+	return e.draft.GetPipelines()
+}
+
+func (e *stagedEngine) CreatePipeline(name, desc string, fns []string) (interface{}, error) {
+	return e.draft.CreatePipeline(name, desc, fns)
+}
+
+func (e *stagedEngine) UpdatePipeline(id, name, desc string, fns []string) error {
+	return e.draft.UpdatePipeline(id, name, desc, fns)
+}
+
+func (e *stagedEngine) DeletePipeline(id string) error { return e.draft.DeletePipeline(id) }
+
+func (e *stagedEngine) GetRoutes() []struct {
+	ID          string
+	Name        string
+	Filter      string
+	PipelineID  string
+	Destination string
+	Final       bool
+} {
+	return e.draft.GetRoutes()
+}
+
+func (e *stagedEngine) CreateRoute(name, filter, pipelineID, destination string, final bool) (interface{}, error) {
+	return e.draft.CreateRoute(name, filter, pipelineID, destination, final)
+}
+
+func (e *stagedEngine) UpdateRoute(id, name, filter, pipelineID, destination string, final bool) error {
+	return e.draft.UpdateRoute(id, name, filter, pipelineID, destination, final)
+}
+
+func (e *stagedEngine) DeleteRoute(id string) error { return e.draft.DeleteRoute(id) }
+
+func (e *stagedEngine) ExportConfig() ConfigDocument { return e.draft.ExportConfig() }
+
+func (e *stagedEngine) routeFilterError(filter string) string {
+	return e.draft.routeFilterError(filter)
+}
+
+func (e *stagedEngine) ImportConfig(doc ConfigDocument, dryRun bool) (ConfigImportResult, error) {
+	return e.draft.ImportConfig(doc, dryRun)
+}
+
+// engine returns the live memory engine behind s.pipeline, if any.
+func (s *Server) engine() (*memoryEngine, bool) {
+	switch p := s.pipeline.(type) {
+	case *memoryEngine:
+		return p, true
+	case *stagedEngine:
+		m, ok := p.PipelineEngine.(*memoryEngine)
+		return m, ok
+	}
+	return nil, false
+}
+
+// changeAuthor is the principal recorded for a commit, rollback or discard.
+// It comes from the bearer token the request authenticated with, never from
+// the body or client headers, and is written as a short hash of the token so
+// the history does not carry credentials.
+func (s *Server) changeAuthor(r *http.Request) string {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || tok == "" || s.cfg == nil {
+		return "anonymous"
+	}
+	if _, known := s.cfg.Server.AuthTokens[tok]; !known && tok != s.cfg.Server.AuthToken {
+		return "anonymous"
+	}
+	return tokenPrincipal(tok)
+}
+
+func tokenPrincipal(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return "token:" + hex.EncodeToString(sum[:4])
+}
+
+// changeNote is the free-form note for a commit or rollback. Older clients
+// sent it as "author"; it is kept, but only as a note.
+func changeNote(note, legacyAuthor string) string {
+	if n := strings.TrimSpace(note); n != "" {
+		return n
+	}
+	return strings.TrimSpace(legacyAuthor)
+}
+
+func (s *Server) writeChangeError(w http.ResponseWriter, r *http.Request, err error) {
+	var verr *ConfigValidationError
+	switch {
+	case errors.As(err, &verr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_ = json.NewEncoder(w).Encode(map[string]any{"error": "validation failed", "code": "invalid_config", "problems": verr.Problems, "requestId": r.Header.Get("X-Request-Id")})
+	case errors.Is(err, errNothingToCommit):
+		structuredError(w, r, http.StatusConflict, "nothing_to_commit", err.Error())
+	case errors.Is(err, errVersionNotFound):
+		structuredError(w, r, http.StatusNotFound, "version_not_found", err.Error())
+	default:
+		structuredError(w, r, http.StatusInternalServerError, "change_failed", err.Error())
+	}
+}
+
+func (s *Server) handleChangesList(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		structuredError(w, r, http.StatusNotImplemented, "unsupported", "change control unavailable")
+		return
+	}
+	changes, err := s.changes.pending()
+	if err != nil {
+		s.writeChangeError(w, r, err)
+		return
+	}
+	base := 0
+	if v, ok := s.changes.versions.latest(); ok {
+		base = v.Version
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"staged": s.changes.draft != nil, "baseVersion": base, "changes": changes})
+}
+
+func (s *Server) handleChangesDiscard(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		structuredError(w, r, http.StatusNotImplemented, "unsupported", "change control unavailable")
+		return
+	}
+	if err := s.changes.discard(); err != nil {
+		s.writeChangeError(w, r, err)
+		return
+	}
+	s.audit("config_discard", map[string]any{"author": s.changeAuthor(r), "requestId": r.Header.Get("X-Request-Id")})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleCommit(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		structuredError(w, r, http.StatusNotImplemented, "unsupported", "change control unavailable")
+		return
+	}
+	var body struct {
+		Author  string `json:"author"`
+		Note    string `json:"note"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		structuredError(w, r, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+	if strings.TrimSpace(body.Message) == "" {
+		structuredError(w, r, http.StatusBadRequest, "message_required", "commit message is required")
+		return
+	}
+	v, warnings, err := s.changes.commit(s.changeAuthor(r), changeNote(body.Note, body.Author), body.Message)
+	if err != nil {
+		s.writeChangeError(w, r, err)
+		return
+	}
+	s.audit("config_commit", map[string]any{"version": v.Version, "author": v.Author, "note": v.Note, "message": v.Message, "changes": v.Changes, "requestId": r.Header.Get("X-Request-Id")})
+	v.Config = nil
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]any{"version": v, "warnings": warnings})
+}
+
+func (s *Server) handleVersionsList(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		structuredError(w, r, http.StatusNotImplemented, "unsupported", "change control unavailable")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.changes.versions.list())
+}
+
+func (s *Server) handleVersionGet(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		structuredError(w, r, http.StatusNotImplemented, "unsupported", "change control unavailable")
+		return
+	}
+	n, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		structuredError(w, r, http.StatusBadRequest, "invalid_version", "version must be a number")
+		return
+	}
+	v, ok := s.changes.versions.get(n)
+	if !ok {
+		s.writeChangeError(w, r, errVersionNotFound)
+		return
+	}
+	if v.Config != nil {
+		doc := redactDocument(*v.Config)
+		v.Config = &doc
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		structuredError(w, r, http.StatusNotImplemented, "unsupported", "change control unavailable")
+		return
+	}
+	n, err := strconv.Atoi(mux.Vars(r)["version"])
+	if err != nil {
+		structuredError(w, r, http.StatusBadRequest, "invalid_version", "version must be a number")
+		return
+	}
+	var body struct {
+		Author string `json:"author"`
+		Note   string `json:"note"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	v, warnings, err := s.changes.rollback(n, s.changeAuthor(r), changeNote(body.Note, body.Author))
+	if err != nil {
+		s.writeChangeError(w, r, err)
+		return
+	}
+	s.audit("config_rollback", map[string]any{"version": v.Version, "restored": n, "author": v.Author, "note": v.Note, "changes": v.Changes, "requestId": r.Header.Get("X-Request-Id")})
+	v.Config = nil
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"version": v, "warnings": warnings})
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bibbl/internal/config"
+)
+
+func doJSON(t *testing.T, srv *Server, method, path string, body any) (int, []byte) {
+	var rd io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		rd = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, rd)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer admin-token")
+	req.Header.Set("X-User", "alice")
+	resp, err := srv.app.Test(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+func TestStagedChangesCommitAndRollback(t *testing.T) {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.AuthTokens = map[string][]string{"admin-token": {"admin"}}
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Changes.Staged = true
+	srv := NewServer(cfg)
+	live, _ := srv.engine()
+	liveRoutes := len(live.GetRoutes())
+	pipeID := live.GetPipelines()[0].ID
+
+	route := map[string]any{"name": "staged", "filter": `severity == "high"`, "pipelineId": pipeID, "final": true}
+	if code, body := doJSON(t, srv, http.MethodPost, "/api/v1/routes", route); code != http.StatusCreated {
+		t.Fatalf("create route: %d %s", code, body)
+	}
+	if len(live.GetRoutes()) != liveRoutes {
+		t.Fatal("staged route must not reach live before commit")
+	}
+	if len(srv.pipeline.GetRoutes()) != liveRoutes+1 {
+		t.Fatal("staged route should be visible in the draft")
+	}
+
+	code, body := doJSON(t, srv, http.MethodGet, "/api/v1/changes", nil)
+	var pending struct {
+		Staged  bool           `json:"staged"`
+		Changes []ConfigChange `json:"changes"`
+	}
+	_ = json.Unmarshal(body, &pending)
+	if code != http.StatusOK || !pending.Staged || len(pending.Changes) != 1 || pending.Changes[0].Action != "create" {
+		t.Fatalf("unexpected pending changes: %d %s", code, body)
+	}
+
+	if code, body := doJSON(t, srv, http.MethodPost, "/api/v1/commit", map[string]any{}); code != http.StatusBadRequest {
+		t.Fatalf("commit without message: expected 400, got %d %s", code, body)
+	}
+	// A body "author" is only a note; the author is the authenticated token.
+	code, body = doJSON(t, srv, http.MethodPost, "/api/v1/commit", map[string]any{"message": "add staged route", "author": "mallory"})
+	if code != http.StatusCreated {
+		t.Fatalf("commit: %d %s", code, body)
+	}
+	var committed struct {
+		Version ConfigVersion `json:"version"`
+	}
+	_ = json.Unmarshal(body, &committed)
+	if committed.Version.Version != 2 || committed.Version.Author != tokenPrincipal("admin-token") || committed.Version.Note != "mallory" {
+		t.Fatalf("unexpected version: %+v", committed.Version)
+	}
+	if len(live.GetRoutes()) != liveRoutes+1 {
+		t.Fatal("commit should apply the draft to live")
+	}
+	if code, _ := doJSON(t, srv, http.MethodPost, "/api/v1/commit", map[string]any{"message": "again"}); code != http.StatusConflict {
+		t.Fatalf("empty commit: expected 409, got %d", code)
+	}
+
+	if code, body := doJSON(t, srv, http.MethodPost, "/api/v1/rollback/1", nil); code != http.StatusOK {
+		t.Fatalf("rollback: %d %s", code, body)
+	}
+	if len(live.GetRoutes()) != liveRoutes || len(srv.pipeline.GetRoutes()) != liveRoutes {
+		t.Fatal("rollback should restore live and reset the draft")
+	}
+	if code, _ := doJSON(t, srv, http.MethodPost, "/api/v1/rollback/42", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown version: expected 404, got %d", code)
+	}
+
+	// History survives a restart.
+	vs, err := newVersionStore(cfg.Storage.DataDir)
+	if err != nil {
+		t.Fatalf("reload versions: %v", err)
+	}
+	if got := vs.list(); len(got) != 3 || got[2].Message != "rollback to version 1" {
+		t.Fatalf("unexpected history: %+v", got)
+	}
+}
+
+func TestStagedDraftSurvivesRestart(t *testing.T) {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.AuthTokens = map[string][]string{"admin-token": {"admin"}}
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Changes.Staged = true
+	srv := NewServer(cfg)
+	pipeID := srv.pipeline.GetPipelines()[0].ID
+	route := map[string]any{"name": "uncommitted", "filter": `severity == "high"`, "pipelineId": pipeID, "final": true}
+	if code, body := doJSON(t, srv, http.MethodPost, "/api/v1/routes", route); code != http.StatusCreated {
+		t.Fatalf("create route: %d %s", code, body)
+	}
+
+	restarted := NewServer(cfg)
+	if _, ok := findRouteByName(restarted.pipeline, "uncommitted"); !ok {
+		t.Fatal("staged route should still be in the draft after a restart")
+	}
+	live, _ := restarted.engine()
+	if _, ok := findRouteByName(live, "uncommitted"); ok {
+		t.Fatal("staged route must not reach live on restart")
+	}
+	if code, _ := doJSON(t, restarted, http.MethodDelete, "/api/v1/changes", nil); code != http.StatusNoContent {
+		t.Fatalf("discard: %d", code)
+	}
+	if _, ok := findRouteByName(NewServer(cfg).pipeline, "uncommitted"); ok {
+		t.Fatal("a discarded draft should stay discarded after a restart")
+	}
+}
+
+func TestUnstagedChangesListMatchesCommit(t *testing.T) {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.AuthTokens = map[string][]string{"admin-token": {"admin"}}
+	srv := NewServer(cfg)
+	pipeID := srv.pipeline.GetPipelines()[0].ID
+
+	route := map[string]any{"name": "direct", "filter": `severity == "high"`, "pipelineId": pipeID, "final": true}
+	if code, body := doJSON(t, srv, http.MethodPost, "/api/v1/routes", route); code != http.StatusCreated {
+		t.Fatalf("create route: %d %s", code, body)
+	}
+	code, body := doJSON(t, srv, http.MethodGet, "/api/v1/changes", nil)
+	var pending struct {
+		Staged  bool           `json:"staged"`
+		Changes []ConfigChange `json:"changes"`
+	}
+	_ = json.Unmarshal(body, &pending)
+	if code != http.StatusOK || pending.Staged || len(pending.Changes) != 1 || pending.Changes[0].Kind != "route" || pending.Changes[0].Action != "create" {
+		t.Fatalf("unexpected pending changes: %d %s", code, body)
+	}
+
+	code, body = doJSON(t, srv, http.MethodPost, "/api/v1/commit", map[string]any{"message": "record direct route"})
+	var committed struct {
+		Version ConfigVersion `json:"version"`
+	}
+	_ = json.Unmarshal(body, &committed)
+	if code != http.StatusCreated || committed.Version.Changes != len(pending.Changes) {
+		t.Fatalf("commit should record the listed changes: %d %s", code, body)
+	}
+	if _, body := doJSON(t, srv, http.MethodGet, "/api/v1/changes", nil); !bytes.Contains(body, []byte(`"changes":[]`)) {
+		t.Fatalf("nothing should be pending after commit: %s", body)
+	}
+}
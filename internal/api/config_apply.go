@@ -0,0 +1,592 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"bibbl/pkg/filterexpr"
+)
+
+// ExportConfig renders the current topology as a ConfigDocument with
+// credentials replaced by vault references.
+func (m *memoryEngine) ExportConfig() ConfigDocument {
+	return m.configDocument(true)
+}
+
+// configDocument renders the current topology. With redact unset the
+// document carries plaintext credentials and must not leave the process
+// except through the state directory.
+func (m *memoryEngine) configDocument(redact bool) ConfigDocument {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	secrets := func(kind, id string, cfg map[string]interface{}) map[string]interface{} {
+		if !redact {
+			return cfg
+		}
+		return redactSecrets(kind, id, cfg)
+	}
+	doc := ConfigDocument{
+		APIVersion:   configAPIVersion,
+		Sources:      make([]ConfigSource, 0, len(m.sources)),
+		Pipelines:    make([]ConfigPipeline, 0, len(m.pipelines)),
+		Routes:       make([]ConfigRoute, 0, len(m.routes)),
+		Destinations: make([]ConfigDestination, 0, len(m.dests)),
+	}
+	for _, s := range m.sources {
+		doc.Sources = append(doc.Sources, ConfigSource{ID: s.ID, Name: s.Name, Type: s.Type, Enabled: s.Enabled, Config: secrets("sources", s.ID, s.Config)})
+	}
+	for _, p := range m.pipelines {
+		fns := p.Functions
+		if fns == nil {
+			fns = []string{}
+		}
+		doc.Pipelines = append(doc.Pipelines, ConfigPipeline{ID: p.ID, Name: p.Name, Description: p.Description, Functions: fns, IPSource: p.IPSource, Filters: pipelineFiltersFromFunctions(p.Functions)})
+	}
+	for _, r := range m.routes {
+		doc.Routes = append(doc.Routes, ConfigRoute{ID: r.ID, Name: r.Name, Filter: r.Filter, PipelineID: r.PipelineID, Destination: r.Destination, Final: r.Final})
+	}
+	for _, d := range m.dests {
+		doc.Destinations = append(doc.Destinations, ConfigDestination{ID: d.ID, Name: d.Name, Type: d.Type, Enabled: d.Enabled, Config: secrets("destinations", d.ID, d.Config)})
+	}
+	return doc
+}
+
+// importPlan is a validated document ready to be swapped in.
+type importPlan struct {
+	sources   []ConfigSource
+	pipelines []memPipe
+	routes    []memRoute
+	dests     []ConfigDestination
+}
+
+// pipelineFunctions resolves the function list an imported pipeline should
+// run. Structured filters that merely mirror the filter: functions (as in an
+// export) leave the list untouched so a round trip does not reorder it.
+func pipelineFunctions(p ConfigPipeline) []string {
+	fns := p.Functions
+	if fns == nil {
+		fns = []string{}
+	}
+	if len(p.Filters) == 0 || reflect.DeepEqual(p.Filters, pipelineFiltersFromFunctions(fns)) {
+		return fns
+	}
+	return mergeFilterFunctions(fns, p.Filters)
+}
+
+// validateConfig checks every object in doc and compiles what the engine needs.
+// It does not touch engine state.
+func validateConfig(doc ConfigDocument, legacyFilters bool) (*importPlan, error) {
+	var problems []string
+	addf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	if doc.APIVersion != "" && doc.APIVersion != configAPIVersion {
+		addf("apiVersion %q is not supported (want %q)", doc.APIVersion, configAPIVersion)
+	}
+	label := func(kind string, i int, name string) string {
+		if name == "" {
+			return fmt.Sprintf("%s[%d]", kind, i)
+		}
+		return fmt.Sprintf("%s[%d] (%s)", kind, i, name)
+	}
+	seen := func() func(kind string, i int, name, id string) {
+		ids := map[string]bool{}
+		return func(kind string, i int, name, id string) {
+			if id == "" {
+				return
+			}
+			if !objectIDPattern.MatchString(id) {
+				addf("%s: id %q must start with a letter or digit and contain only letters, digits, '_' and '-'", label(kind, i, name), id)
+			}
+			if ids[id] {
+				addf("%s: duplicate id %q", label(kind, i, name), id)
+			}
+			ids[id] = true
+		}
+	}
+
+	plan := &importPlan{sources: doc.Sources, dests: doc.Destinations}
+	dupSource := seen()
+	for i, s := range doc.Sources {
+		dupSource("sources", i, s.Name, s.ID)
+		if strings.TrimSpace(s.Name) == "" {
+			addf("%s: name is required", label("sources", i, s.Name))
+		}
+		if strings.TrimSpace(s.Type) == "" {
+			addf("%s: type is required", label("sources", i, s.Name))
+		}
+	}
+
+	pipeIDs := map[string]bool{}
+	dupPipe := seen()
+	for i, p := range doc.Pipelines {
+		dupPipe("pipelines", i, p.Name, p.ID)
+		pipeIDs[p.ID] = p.ID != ""
+		if strings.TrimSpace(p.Name) == "" {
+			addf("%s: name is required", label("pipelines", i, p.Name))
+		}
+		if p.IPSource != "" && p.IPSource != "first_ipv4" && !strings.HasPrefix(p.IPSource, "field:") {
+			addf("%s: ipSource must be first_ipv4 or field:<name>", label("pipelines", i, p.Name))
+		}
+		fns := pipelineFunctions(p)
+		filters, err := compileKVFilters(fns)
+		if err != nil {
+			addf("%s: %v", label("pipelines", i, p.Name), err)
+			continue
+		}
+		plan.pipelines = append(plan.pipelines, memPipe{ID: p.ID, Name: p.Name, Description: p.Description, Functions: fns, IPSource: p.IPSource, Filters: filters})
+	}
+
+	destIDs := map[string]bool{}
+	dupDest := seen()
+	for i, d := range doc.Destinations {
+		dupDest("destinations", i, d.Name, d.ID)
+		destIDs[d.ID] = d.ID != ""
+		if strings.TrimSpace(d.Name) == "" {
+			addf("%s: name is required", label("destinations", i, d.Name))
+		}
+		if strings.TrimSpace(d.Type) == "" {
+			addf("%s: type is required", label("destinations", i, d.Name))
+		}
+	}
+
+	compile := filterexpr.Compile
+	if legacyFilters {
+		compile = filterexpr.CompileLegacy
+	}
+	dupRoute := seen()
+	for i, r := range doc.Routes {
+		dupRoute("routes", i, r.Name, r.ID)
+		if strings.TrimSpace(r.Name) == "" {
+			addf("%s: name is required", label("routes", i, r.Name))
+		}
+		if _, err := compile(r.Filter); err != nil {
+			addf("%s: %v", label("routes", i, r.Name), err)
+		}
+		if !pipeIDs[r.PipelineID] {
+			addf("%s: unknown pipeline %q", label("routes", i, r.Name), r.PipelineID)
+		}
+		if r.Destination != "" && !destIDs[r.Destination] {
+			addf("%s: unknown destination %q", label("routes", i, r.Name), r.Destination)
+		}
+		plan.routes = append(plan.routes, memRoute{ID: r.ID, Name: r.Name, Filter: r.Filter, PipelineID: r.PipelineID, Destination: r.Destination, Final: r.Final})
+	}
+
+	if len(problems) > 0 {
+		return nil, &ConfigValidationError{Problems: problems}
+	}
+	return plan, nil
+}
+
+// ImportConfig validates doc and, unless dryRun, replaces the engine topology
+// with it in one step. Objects are matched by ID; objects missing from doc are
+// deleted. On any validation problem nothing is changed.
+func (m *memoryEngine) ImportConfig(doc ConfigDocument, dryRun bool) (ConfigImportResult, error) {
+	m.mu.RLock()
+	legacy := m.legacyFilters
+	current := make(map[string]memDest, len(m.dests))
+	for _, d := range m.dests {
+		current[d.ID] = d
+	}
+	m.mu.RUnlock()
+	plan, err := validateConfig(doc, legacy)
+	if err != nil {
+		return ConfigImportResult{DryRun: dryRun}, err
+	}
+	// Keep current plaintext secrets where the document carries the exported reference.
+	for i := range plan.dests {
+		if cur, ok := current[plan.dests[i].ID]; ok && cur.ID != "" {
+			plan.dests[i].Config = restoreSecrets("destinations", cur.ID, plan.dests[i].Config, cur.Config)
+		}
+	}
+	if problems := m.checkOutputs(plan, current); len(problems) > 0 {
+		return ConfigImportResult{DryRun: dryRun}, &ConfigValidationError{Problems: problems}
+	}
+
+	m.mu.Lock()
+	for i := range plan.sources {
+		if cur := m.findSourceLocked(plan.sources[i].ID); cur != nil {
+			plan.sources[i].Config = restoreSecrets("sources", cur.ID, plan.sources[i].Config, cur.Config)
+		}
+	}
+	res := ConfigImportResult{DryRun: dryRun, Changes: m.diffLocked(plan)}
+	if res.Changes == nil {
+		res.Changes = []ConfigChange{}
+	}
+	if dryRun {
+		m.mu.Unlock()
+		return res, nil
+	}
+	toStart, warnings := m.applyLocked(plan)
+	m.mu.Unlock()
+	m.writeState()
+
+	if m.staging {
+		toStart = nil
+	}
+	for _, id := range toStart {
+		if err := m.StartSource(id); err != nil {
+			warnings = append(warnings, fmt.Sprintf("source %s: %v", id, err))
+		}
+	}
+	res.Applied = true
+	res.Warnings = warnings
+	return res, nil
+}
+
+// checkOutputs builds, and closes again, the output of every enabled
+// destination the plan adds or changes, so that a document whose destination
+// config the output rejects (bad URL, missing DSN, ...) fails validation
+// instead of leaving that destination without an output. Outputs are built
+// outside m.mu, against a throwaway staging directory so a running archive
+// output's files are never touched.
+func (m *memoryEngine) checkOutputs(plan *importPlan, current map[string]memDest) []string {
+	var problems []string
+	var scratch string
+	defer func() {
+		if scratch != "" {
+			_ = os.RemoveAll(scratch)
+		}
+	}()
+	for i, cd := range plan.dests {
+		if !cd.Enabled || !m.outputs.Has(cd.Type) {
+			continue
+		}
+		if cur, ok := current[cd.ID]; ok && cd.ID != "" &&
+			len(changedFields("type", cur.Type, cd.Type, "enabled", cur.Enabled, cd.Enabled, "config", cur.Config, cd.Config)) == 0 {
+			continue
+		}
+		if scratch == "" {
+			dir, err := os.MkdirTemp("", "bibbl-import-check-")
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("destinations: cannot check outputs: %v", err))
+				return problems
+			}
+			scratch = dir
+		}
+		cfg := make(map[string]interface{}, len(cd.Config)+1)
+		for k, v := range cd.Config {
+			cfg[k] = v
+		}
+		cfg["stagingDir"] = filepath.Join(scratch, strconv.Itoa(i))
+		out, err := m.outputs.New(cd.Type, cfg)
+		if err != nil {
+			name := fmt.Sprintf("destinations[%d]", i)
+			if cd.Name != "" {
+				name += " (" + cd.Name + ")"
+			}
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if err := out.Close(); err != nil {
+			log.Printf("destination %s: close checked output: %v", cd.Name, err)
+		}
+	}
+	return problems
+}
+
+func (m *memoryEngine) findSourceLocked(id string) *memSource {
+	if id == "" {
+		return nil
+	}
+	for _, s := range m.sources {
+		if s.ID == id {
+			return s
+		}
+	}
+	return nil
+}
+
+func (m *memoryEngine) findDestLocked(id string) *memDest {
+	if id == "" {
+		return nil
+	}
+	for i := range m.dests {
+		if m.dests[i].ID == id {
+			return &m.dests[i]
+		}
+	}
+	return nil
+}
+
+func changedFields(pairs ...interface{}) []string {
+	var fields []string
+	for i := 0; i+2 < len(pairs); i += 3 {
+		name := pairs[i].(string)
+		a, b := pairs[i+1], pairs[i+2]
+		ma, aok := a.(map[string]interface{})
+		mb, bok := b.(map[string]interface{})
+		if aok && bok {
+			if !configEqual(ma, mb) {
+				fields = append(fields, name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(a, b) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// diffLocked compares the plan against current state. Caller holds m.mu.
+func (m *memoryEngine) diffLocked(plan *importPlan) []ConfigChange {
+	var changes []ConfigChange
+	add := func(kind, id, name, action string, fields []string) {
+		changes = append(changes, ConfigChange{Kind: kind, ID: id, Name: name, Action: action, Fields: fields})
+	}
+
+	keep := map[string]bool{}
+	for _, s := range plan.sources {
+		cur := m.findSourceLocked(s.ID)
+		if cur == nil {
+			add("source", s.ID, s.Name, "create", nil)
+			continue
+		}
+		keep[s.ID] = true
+		if f := changedFields("name", cur.Name, s.Name, "type", cur.Type, s.Type, "enabled", cur.Enabled, s.Enabled, "config", cur.Config, s.Config); len(f) > 0 {
+			add("source", s.ID, s.Name, "update", f)
+		}
+	}
+	for _, s := range m.sources {
+		if !keep[s.ID] {
+			add("source", s.ID, s.Name, "delete", nil)
+		}
+	}
+
+	curPipes := map[string]memPipe{}
+	for _, p := range m.pipelines {
+		curPipes[p.ID] = p
+	}
+	keep = map[string]bool{}
+	for _, p := range plan.pipelines {
+		cur, ok := curPipes[p.ID]
+		if !ok || p.ID == "" {
+			add("pipeline", p.ID, p.Name, "create", nil)
+			continue
+		}
+		keep[p.ID] = true
+		if f := changedFields("name", cur.Name, p.Name, "description", cur.Description, p.Description, "functions", normStrings(cur.Functions), normStrings(p.Functions), "ipSource", cur.IPSource, p.IPSource); len(f) > 0 {
+			add("pipeline", p.ID, p.Name, "update", f)
+		}
+	}
+	for _, p := range m.pipelines {
+		if !keep[p.ID] {
+			add("pipeline", p.ID, p.Name, "delete", nil)
+		}
+	}
+
+	curRoutes := map[string]int{}
+	for i, r := range m.routes {
+		curRoutes[r.ID] = i
+	}
+	keep = map[string]bool{}
+	for i, r := range plan.routes {
+		idx, ok := curRoutes[r.ID]
+		if !ok || r.ID == "" {
+			add("route", r.ID, r.Name, "create", nil)
+			continue
+		}
+		keep[r.ID] = true
+		cur := m.routes[idx]
+		f := changedFields("name", cur.Name, r.Name, "filter", cur.Filter, r.Filter, "pipelineId", cur.PipelineID, r.PipelineID, "destination", cur.Destination, r.Destination, "final", cur.Final, r.Final)
+		if idx != i {
+			f = append(f, "order")
+		}
+		if len(f) > 0 {
+			add("route", r.ID, r.Name, "update", f)
+		}
+	}
+	for _, r := range m.routes {
+		if !keep[r.ID] {
+			add("route", r.ID, r.Name, "delete", nil)
+		}
+	}
+
+	keep = map[string]bool{}
+	for _, d := range plan.dests {
+		cur := m.findDestLocked(d.ID)
+		if cur == nil {
+			add("destination", d.ID, d.Name, "create", nil)
+			continue
+		}
+		keep[d.ID] = true
+		if f := changedFields("name", cur.Name, d.Name, "type", cur.Type, d.Type, "enabled", cur.Enabled, d.Enabled, "config", cur.Config, d.Config); len(f) > 0 {
+			add("destination", d.ID, d.Name, "update", f)
+		}
+	}
+	for _, d := range m.dests {
+		if !keep[d.ID] {
+			add("destination", d.ID, d.Name, "delete", nil)
+		}
+	}
+	return changes
+}
+
+func normStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+var numericIDSuffix = regexp.MustCompile(`-(\d+)$`)
+
+// objectIDPattern is the accepted form of an imported object ID. Destination
+// IDs name queue directories, DLQ files and staging directories, so anything
+// that could walk out of those (such as "..") is rejected.
+var objectIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// applyLocked swaps the plan in. Caller holds m.mu. It returns the IDs of
+// enabled sources that need (re)starting once the lock is released, and a
+// warning for every changed destination whose output failed to start.
+func (m *memoryEngine) applyLocked(plan *importPlan) ([]string, []string) {
+	// Never hand out an ID that an imported object already uses: move seq
+	// past every explicit ID before any ID is generated.
+	bump := func(id string) {
+		if mm := numericIDSuffix.FindStringSubmatch(id); mm != nil {
+			if n, err := strconv.Atoi(mm[1]); err == nil && n >= m.seq {
+				m.seq = n + 1
+			}
+		}
+	}
+	for _, s := range plan.sources {
+		bump(s.ID)
+	}
+	for _, p := range plan.pipelines {
+		bump(p.ID)
+	}
+	for _, r := range plan.routes {
+		bump(r.ID)
+	}
+	for _, d := range plan.dests {
+		bump(d.ID)
+	}
+	nextID := func(prefix string) string {
+		id := fmt.Sprintf("%s-%d", prefix, m.seq)
+		m.seq++
+		return id
+	}
+
+	// Sources: keep untouched ones running, restart changed ones.
+	var toStart []string
+	oldSources := map[string]*memSource{}
+	for _, s := range m.sources {
+		oldSources[s.ID] = s
+	}
+	sources := make([]*memSource, 0, len(plan.sources))
+	for _, cs := range plan.sources {
+		cur, ok := oldSources[cs.ID]
+		if ok && cs.ID != "" {
+			delete(oldSources, cs.ID)
+			if len(changedFields("name", cur.Name, cs.Name, "type", cur.Type, cs.Type, "enabled", cur.Enabled, cs.Enabled, "config", cur.Config, cs.Config)) == 0 {
+				sources = append(sources, cur)
+				continue
+			}
+			stopSourceRuntime(cur)
+			cur.Name, cur.Type, cur.Config, cur.Enabled = cs.Name, cs.Type, cs.Config, cs.Enabled
+			sources = append(sources, cur)
+		} else {
+			id := cs.ID
+			if id == "" {
+				id = nextID("src")
+			}
+			cur = &memSource{ID: id, Name: cs.Name, Type: cs.Type, Config: cs.Config, Status: "stopped", Enabled: cs.Enabled}
+			sources = append(sources, cur)
+		}
+		if cur.Enabled {
+			toStart = append(toStart, cur.ID)
+		}
+	}
+	for _, s := range oldSources {
+		stopSourceRuntime(s)
+	}
+	m.sources = sources
+
+	// Pipelines
+	oldPipes := map[string]bool{}
+	for _, p := range m.pipelines {
+		oldPipes[p.ID] = true
+	}
+	pipes := make([]memPipe, 0, len(plan.pipelines))
+	for _, p := range plan.pipelines {
+		if p.ID == "" {
+			p.ID = nextID("pipe")
+		}
+		delete(oldPipes, p.ID)
+		pipes = append(pipes, p)
+		m.registerPipelineStat(p)
+	}
+	for id := range oldPipes {
+		m.deletePipelineStat(id)
+	}
+	m.pipelines = pipes
+
+	// Destinations: keep running outputs for untouched ones.
+	oldDests := map[string]memDest{}
+	for _, d := range m.dests {
+		oldDests[d.ID] = d
+	}
+	dests := make([]memDest, 0, len(plan.dests))
+	var resync []int
+	for _, cd := range plan.dests {
+		if cur, ok := oldDests[cd.ID]; ok && cd.ID != "" {
+			delete(oldDests, cd.ID)
+			if len(changedFields("name", cur.Name, cd.Name, "type", cur.Type, cd.Type, "enabled", cur.Enabled, cd.Enabled, "config", cur.Config, cd.Config)) == 0 {
+				dests = append(dests, cur)
+				continue
+			}
+			cur.Name, cur.Type, cur.Config, cur.Enabled = cd.Name, cd.Type, cd.Config, cd.Enabled
+			resync = append(resync, len(dests))
+			dests = append(dests, cur)
+			continue
+		}
+		id := cd.ID
+		if id == "" {
+			id = nextID("dst")
+		}
+		resync = append(resync, len(dests))
+		dests = append(dests, memDest{ID: id, Name: cd.Name, Type: cd.Type, Status: "disconnected", Config: cd.Config, Enabled: cd.Enabled})
+	}
+	for id, d := range oldDests {
+		closeOutput(id, d.output)
+		m.dropQueueLocked(id)
+		m.dlq.drop(id)
+		m.dropBreakerLocked(id)
+	}
+	m.dests = dests
+	var warnings []string
+	for _, i := range resync {
+		closeOutput(m.dests[i].ID, m.syncOutputLocked(i))
+		if d := m.dests[i]; d.outputErr != "" {
+			warnings = append(warnings, fmt.Sprintf("destination %s (%s): %s", d.Name, d.ID, d.outputErr))
+		}
+	}
+
+	// Routes
+	oldRoutes := map[string]bool{}
+	for _, r := range m.routes {
+		oldRoutes[r.ID] = true
+	}
+	routes := make([]memRoute, 0, len(plan.routes))
+	for _, r := range plan.routes {
+		if r.ID == "" {
+			r.ID = nextID("route")
+		}
+		delete(oldRoutes, r.ID)
+		routes = append(routes, r)
+	}
+	for id := range oldRoutes {
+		m.routeStats.Delete(id)
+	}
+	m.routes = routes
+
+	m.persistLocked()
+	return toStart, warnings
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configAPIVersion identifies the declarative topology document format.
+const configAPIVersion = "bibbl/v1"
+
+// ConfigDocument is the declarative, config-as-code form of the whole routing
+// topology. Order is significant for routes (evaluation order).
+type ConfigDocument struct {
+	APIVersion   string              `json:"apiVersion" yaml:"apiVersion"`
+	Sources      []ConfigSource      `json:"sources" yaml:"sources"`
+	Pipelines    []ConfigPipeline    `json:"pipelines" yaml:"pipelines"`
+	Routes       []ConfigRoute       `json:"routes" yaml:"routes"`
+	Destinations []ConfigDestination `json:"destinations" yaml:"destinations"`
+}
+
+type ConfigSource struct {
+	ID      string                 `json:"id" yaml:"id"`
+	Name    string                 `json:"name" yaml:"name"`
+	Type    string                 `json:"type" yaml:"type"`
+	Enabled bool                   `json:"enabled" yaml:"enabled"`
+	Config  map[string]interface{} `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+type ConfigPipeline struct {
+	ID          string           `json:"id" yaml:"id"`
+	Name        string           `json:"name" yaml:"name"`
+	Description string           `json:"description,omitempty" yaml:"description,omitempty"`
+	Functions   []string         `json:"functions" yaml:"functions"`
+	IPSource    string           `json:"ipSource,omitempty" yaml:"ipSource,omitempty"`
+	Filters     []PipelineFilter `json:"filters,omitempty" yaml:"filters,omitempty"`
+}
+
+type ConfigRoute struct {
+	ID          string `json:"id" yaml:"id"`
+	Name        string `json:"name" yaml:"name"`
+	Filter      string `json:"filter" yaml:"filter"`
+	PipelineID  string `json:"pipelineId" yaml:"pipelineId"`
+	Destination string `json:"destination" yaml:"destination"`
+	Final       bool   `json:"final" yaml:"final"`
+}
+
+type ConfigDestination struct {
+	ID      string                 `json:"id" yaml:"id"`
+	Name    string                 `json:"name" yaml:"name"`
+	Type    string                 `json:"type" yaml:"type"`
+	Enabled bool                   `json:"enabled" yaml:"enabled"`
+	Config  map[string]interface{} `json:"config,omitempty" yaml:"config,omitempty"`
+}
+
+// ConfigChange is one line of an import diff.
+type ConfigChange struct {
+	Kind   string   `json:"kind"`
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Action string   `json:"action"` // create | update | delete
+	Fields []string `json:"fields,omitempty"`
+}
+
+// ConfigImportResult reports what an import changed (or would change).
+type ConfigImportResult struct {
+	DryRun   bool           `json:"dryRun"`
+	Applied  bool           `json:"applied"`
+	Changes  []ConfigChange `json:"changes"`
+	Warnings []string       `json:"warnings,omitempty"`
+}
+
+// ConfigValidationError lists every problem found in an import document.
+type ConfigValidationError struct {
+	Problems []string
+}
+
+func (e *ConfigValidationError) Error() string {
+	return fmt.Sprintf("invalid config document: %s", strings.Join(e.Problems, "; "))
+}
+
+// secretKeys are config keys (lowercased, without separators) whose values are
+// credentials and are exported as vault references.
+var secretKeys = map[string]bool{
+	"sharedkey": true, "clientsecret": true, "clienttoken": true, "accesstoken": true,
+	"secret": true, "password": true, "passwd": true, "token": true, "apikey": true,
+	"secretkey": true, "secretaccesskey": true, "accesskey": true, "accountkey": true,
+	"sastoken": true, "connectionstring": true, "privatekey": true, "hectoken": true,
+	"bearertoken": true, "authorization": true, "dsn": true,
+}
+
+func isSecretKey(key string) bool {
+	k := strings.ToLower(strings.NewReplacer("_", "", "-", "", ".", "").Replace(key))
+	return secretKeys[k]
+}
+
+// secretRef is the vault reference a secret is exported as. The path is
+// relative to the configured mount, e.g. secret/data/bibbl/destinations/dst-4.
+func secretRef(kind, id, key string) string {
+	return fmt.Sprintf("vault://bibbl/%s/%s#%s", kind, id, key)
+}
+
+func isVaultRef(v interface{}) bool {
+	s, ok := v.(string)
+	return ok && strings.HasPrefix(strings.TrimSpace(s), "vault://")
+}
+
+// redactSecrets returns a copy of cfg with plaintext credentials replaced by
+// vault references. Existing references and empty values are left as-is.
+func redactSecrets(kind, id string, cfg map[string]interface{}) map[string]interface{} {
+	if cfg == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(cfg))
+	for k, v := range cfg {
+		if s, ok := v.(string); ok && isSecretKey(k) && s != "" && !isVaultRef(s) {
+			out[k] = secretRef(kind, id, k)
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// redactDocument returns doc with every source and destination secret
+// replaced by its vault reference.
+func redactDocument(doc ConfigDocument) ConfigDocument {
+	out := doc
+	out.Sources = make([]ConfigSource, len(doc.Sources))
+	for i, s := range doc.Sources {
+		s.Config = redactSecrets("sources", s.ID, s.Config)
+		out.Sources[i] = s
+	}
+	out.Destinations = make([]ConfigDestination, len(doc.Destinations))
+	for i, d := range doc.Destinations {
+		d.Config = redactSecrets("destinations", d.ID, d.Config)
+		out.Destinations[i] = d
+	}
+	return out
+}
+
+// restoreSecrets undoes redactSecrets for an object that already exists: an
+// incoming value that is exactly the exported reference keeps the current
+// plaintext, so an export/import round trip never wipes credentials.
+func restoreSecrets(kind, id string, incoming, current map[string]interface{}) map[string]interface{} {
+	if incoming == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(incoming))
+	for k, v := range incoming {
+		out[k] = v
+		if s, ok := v.(string); ok && s == secretRef(kind, id, k) {
+			if cur, ok := current[k].(string); ok && cur != "" && !isVaultRef(cur) {
+				out[k] = cur
+			}
+		}
+	}
+	return out
+}
+
+// normalizeConfigValue makes YAML- and JSON-decoded maps comparable by
+// round-tripping through JSON.
+func normalizeConfigValue(v map[string]interface{}) map[string]interface{} {
+	if v == nil {
+		return map[string]interface{}{}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out map[string]interface{}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return v
+	}
+	return out
+}
+
+func configEqual(a, b map[string]interface{}) bool {
+	return reflect.DeepEqual(normalizeConfigValue(a), normalizeConfigValue(b))
+}
+
+func wantsYAML(r *http.Request) bool {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "yaml", "yml":
+		return true
+	case "json":
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "yaml")
+}
+
+func (s *Server) handleConfigExport(w http.ResponseWriter, r *http.Request) {
+	doc := s.pipeline.ExportConfig()
+	if wantsYAML(r) {
+		data, err := yaml.Marshal(&doc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(data)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(doc)
+}
+
+func (s *Server) handleConfigImport(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		structuredError(w, r, http.StatusBadRequest, "read_failed", err.Error())
+		return
+	}
+	var doc ConfigDocument
+	ct := strings.ToLower(r.Header.Get("Content-Type"))
+	if strings.Contains(ct, "yaml") || strings.EqualFold(r.URL.Query().Get("format"), "yaml") {
+		err = yaml.Unmarshal(body, &doc)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&doc)
+	}
+	if err != nil {
+		structuredError(w, r, http.StatusBadRequest, "invalid_document", err.Error())
+		return
+	}
+	dryRun := false
+	switch strings.ToLower(r.URL.Query().Get("dryRun")) {
+	case "1", "true", "yes":
+		dryRun = true
+	}
+	res, err := s.pipeline.ImportConfig(doc, dryRun)
+	if err != nil {
+		var verr *ConfigValidationError
+		if errors.As(err, &verr) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_ = json.NewEncoder(w).Encode(map[string]any{"error": "validation failed", "code": "invalid_config", "problems": verr.Problems, "requestId": r.Header.Get("X-Request-Id")})
+			return
+		}
+		structuredError(w, r, http.StatusInternalServerError, "import_failed", err.Error())
+		return
+	}
+	if !dryRun {
+		s.audit("config_import", map[string]any{"changes": len(res.Changes), "requestId": r.Header.Get("X-Request-Id")})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bibbl/internal/config"
+	"bibbl/pkg/outputs"
+)
+
+func newConfigTestServer(t *testing.T) *Server {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.AuthTokens = map[string][]string{"admin-token": {"admin"}}
+	return NewServer(cfg)
+}
+
+func exportConfig(t *testing.T, srv *Server) ConfigDocument {
+	resp, err := srv.app.Test(httptest.NewRequest(http.MethodGet, "/api/v1/config/export", nil))
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	defer resp.Body.Close()
+	var doc ConfigDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatalf("decode export: %v", err)
+	}
+	return doc
+}
+
+func importConfig(t *testing.T, srv *Server, doc ConfigDocument, query string) (int, []byte) {
+	body, _ := json.Marshal(doc)
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/config/import"+query, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer admin-token")
+	resp, err := srv.app.Test(req)
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+func TestConfigExportImportRoundTrip(t *testing.T) {
+	srv := newConfigTestServer(t)
+	d, err := srv.pipeline.CreateDestination("Sentinel", "sentinel", map[string]interface{}{"workspaceId": "ws", "clientSecret": "s3cr3t"})
+	if err != nil {
+		t.Fatalf("create destination: %v", err)
+	}
+	id := d.(memDest).ID
+
+	doc := exportConfig(t, srv)
+	if doc.APIVersion != configAPIVersion || len(doc.Routes) == 0 {
+		t.Fatalf("unexpected export: %+v", doc)
+	}
+	var exported ConfigDestination
+	for _, cd := range doc.Destinations {
+		if cd.ID == id {
+			exported = cd
+		}
+	}
+	if got := exported.Config["clientSecret"]; got != secretRef("destinations", id, "clientSecret") {
+		t.Fatalf("expected secret exported as vault ref, got %v", got)
+	}
+
+	code, body := importConfig(t, srv, doc, "")
+	if code != http.StatusOK {
+		t.Fatalf("import: status %d: %s", code, body)
+	}
+	var res ConfigImportResult
+	_ = json.Unmarshal(body, &res)
+	if !res.Applied || len(res.Changes) != 0 {
+		t.Fatalf("expected no-op round trip, got %+v", res)
+	}
+	for _, cur := range srv.pipeline.GetDestinations() {
+		if cur.ID == id && cur.Config["clientSecret"] != "s3cr3t" {
+			t.Fatalf("round trip lost plaintext secret: %v", cur.Config["clientSecret"])
+		}
+	}
+}
+
+func TestConfigImportDryRunAndApply(t *testing.T) {
+	srv := newConfigTestServer(t)
+	doc := exportConfig(t, srv)
+	before := len(srv.pipeline.GetRoutes())
+
+	removed := doc.Routes[len(doc.Routes)-1]
+	doc.Routes = doc.Routes[:len(doc.Routes)-1]
+	doc.Routes[0].Filter = `severity == "high"`
+	doc.Routes = append(doc.Routes, ConfigRoute{Name: "new", Filter: "true", PipelineID: doc.Pipelines[0].ID})
+
+	code, body := importConfig(t, srv, doc, "?dryRun=true")
+	if code != http.StatusOK {
+		t.Fatalf("dry run: status %d: %s", code, body)
+	}
+	var res ConfigImportResult
+	_ = json.Unmarshal(body, &res)
+	if !res.DryRun || res.Applied {
+		t.Fatalf("expected dry run result, got %+v", res)
+	}
+	actions := map[string]string{}
+	for _, c := range res.Changes {
+		actions[c.Kind+":"+c.Name] = c.Action
+	}
+	if actions["route:new"] != "create" || actions["route:"+removed.Name] != "delete" || actions["route:"+doc.Routes[0].Name] != "update" {
+		t.Fatalf("unexpected diff: %+v", res.Changes)
+	}
+	if len(srv.pipeline.GetRoutes()) != before {
+		t.Fatal("dry run must not change routes")
+	}
+
+	if code, body := importConfig(t, srv, doc, ""); code != http.StatusOK {
+		t.Fatalf("apply: status %d: %s", code, body)
+	}
+	routes := srv.pipeline.GetRoutes()
+	if len(routes) != before || routes[0].Filter != `severity == "high"` || routes[len(routes)-1].Name != "new" {
+		t.Fatalf("import not applied: %+v", routes)
+	}
+	for _, r := range routes {
+		if r.ID == removed.ID {
+			t.Fatalf("route %s should have been deleted", r.ID)
+		}
+	}
+}
+
+func TestConfigImportRejectsInvalidDocument(t *testing.T) {
+	srv := newConfigTestServer(t)
+	doc := exportConfig(t, srv)
+	before := srv.pipeline.GetRoutes()
+	doc.Routes[0].Filter = `severity ==`
+	doc.Routes[1].PipelineID = "pipe-missing"
+
+	code, body := importConfig(t, srv, doc, "")
+	if code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d: %s", code, body)
+	}
+	var out struct {
+		Problems []string `json:"problems"`
+	}
+	_ = json.Unmarshal(body, &out)
+	if len(out.Problems) != 2 || !strings.Contains(out.Problems[1], "pipe-missing") {
+		t.Fatalf("expected both problems reported, got %v", out.Problems)
+	}
+	after := srv.pipeline.GetRoutes()
+	if len(after) != len(before) || after[0].Filter != before[0].Filter {
+		t.Fatal("invalid import must leave the engine untouched")
+	}
+}
+
+func TestConfigImportRejectsPathLikeIDs(t *testing.T) {
+	srv := newConfigTestServer(t)
+	doc := exportConfig(t, srv)
+	before := len(srv.pipeline.GetDestinations())
+	doc.Destinations = append(doc.Destinations, ConfigDestination{ID: "../x", Name: "escape", Type: "sentinel", Enabled: true})
+
+	code, body := importConfig(t, srv, doc, "")
+	if code != http.StatusUnprocessableEntity || !strings.Contains(string(body), `\"../x\"`) {
+		t.Fatalf("expected 422 naming the bad id, got %d: %s", code, body)
+	}
+	if got := len(srv.pipeline.GetDestinations()); got != before {
+		t.Fatalf("rejected import must not add destinations, got %d want %d", got, before)
+	}
+}
+
+func TestConfigImportGeneratedIDsSkipExplicitOnes(t *testing.T) {
+	eng := NewMemoryEngine().(*memoryEngine)
+	taken := fmt.Sprintf("dst-%d", eng.seq)
+	doc := ConfigDocument{Destinations: []ConfigDestination{
+		{Name: "unnamed", Type: "custom"},
+		{ID: taken, Name: "explicit", Type: "custom"},
+	}}
+	if _, err := eng.ImportConfig(doc, false); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	dests := eng.GetDestinations()
+	if len(dests) != 2 || dests[0].ID == dests[1].ID {
+		t.Fatalf("destinations must get distinct IDs, got %+v", dests)
+	}
+	if dests[1].ID != taken {
+		t.Fatalf("explicit ID should be kept, got %s", dests[1].ID)
+	}
+}
+
+func TestConfigImportRejectsDestinationsThatCannotBuild(t *testing.T) {
+	eng := NewMemoryEngine().(*memoryEngine)
+	eng.outputs.Register("strict", func(cfg map[string]interface{}) (outputs.Output, error) {
+		if url, _ := cfg["url"].(string); url == "" {
+			return nil, errors.New("url is required")
+		}
+		return newFakeOutput(), nil
+	})
+	t.Cleanup(eng.closeOutputs)
+	good := ConfigDestination{ID: "dst-good", Name: "good", Type: "strict", Enabled: true, Config: map[string]interface{}{"url": "http://x"}}
+	if _, err := eng.ImportConfig(ConfigDocument{Destinations: []ConfigDestination{good}}, false); err != nil {
+		t.Fatalf("import valid destination: %v", err)
+	}
+
+	bad := ConfigDestination{ID: "dst-bad", Name: "bad", Type: "strict", Enabled: true}
+	_, err := eng.ImportConfig(ConfigDocument{Destinations: []ConfigDestination{good, bad}}, false)
+	var verr *ConfigValidationError
+	if !errors.As(err, &verr) || len(verr.Problems) != 1 || !strings.Contains(verr.Problems[0], "url is required") {
+		t.Fatalf("expected a validation error for the bad destination, got %v", err)
+	}
+	if dests := eng.GetDestinations(); len(dests) != 1 || dests[0].ID != "dst-good" {
+		t.Fatalf("rejected import must not be applied, got %+v", dests)
+	}
+}
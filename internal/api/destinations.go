@@ -16,13 +16,18 @@ type Destination struct {
 	Status string                 `json:"status"`
 	Config map[string]interface{} `json:"config"`
 	Enabled bool                  `json:"enabled"`
+	Circuit *CircuitHealth        `json:"circuit,omitempty"`
 }
 
 func (s *Server) handleDestinationsList(w http.ResponseWriter, r *http.Request) {
 	dests := s.pipeline.GetDestinations()
 	full := make([]Destination, 0, len(dests))
 	for _, d := range dests {
-		full = append(full, Destination{ID: d.ID, Name: d.Name, Type: d.Type, Status: d.Status, Config: d.Config, Enabled: d.Enabled})
+		dest := Destination{ID: d.ID, Name: d.Name, Type: d.Type, Status: d.Status, Config: d.Config, Enabled: d.Enabled}
+		if h, err := s.pipeline.DestinationHealth(d.ID); err == nil {
+			dest.Circuit = h.Circuit
+		}
+		full = append(full, dest)
 	}
 	q := r.URL.Query()
 	limit, _ := strconv.Atoi(q.Get("limit"))
@@ -0,0 +1,540 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bibbl/internal/config"
+	"bibbl/internal/metrics"
+	"bibbl/pkg/outputs"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultDLQMaxEntries = 100000
+	// dlqCompactSlack is how many stale records a log file may hold beyond
+	// its live entries before it is compacted.
+	dlqCompactSlack = 1024
+)
+
+var (
+	errDestinationNotFound = errors.New("destination not found")
+	errNoRunningOutput     = errors.New("destination has no running output")
+	errPipelineNotFound    = errors.New("pipeline not found")
+)
+
+// DLQEntry is one event a destination rejected, with why and when.
+type DLQEntry struct {
+	ID        uint64                 `json:"id"`
+	Timestamp time.Time              `json:"ts"`
+	Error     string                 `json:"error"`
+	Status    int                    `json:"status,omitempty"`
+	Event     map[string]interface{} `json:"event"`
+}
+
+// DLQReplayResult summarises a replay request.
+type DLQReplayResult struct {
+	Replayed  int    `json:"replayed"`
+	Filtered  int    `json:"filtered"`
+	Failed    int    `json:"failed"`
+	Remaining int    `json:"remaining"`
+	Error     string `json:"error,omitempty"`
+}
+
+// dlqStore keeps dead-lettered events per destination, in memory and, with a
+// directory, in <dir>/<destination id>.jsonl so they survive restarts. The
+// file is append-only: added and restored entries are appended, and evicted
+// or taken ones get a tombstone line. It is rewritten once its stale records
+// outnumber its live entries, so the I/O per dead-lettered event stays
+// constant however full the store is.
+type dlqStore struct {
+	mu    sync.Mutex
+	dir   string
+	max   int
+	dests map[string]*dlqLog
+}
+
+type dlqLog struct {
+	entries []DLQEntry // ascending ID
+	next    uint64
+	records int // entry lines and tombstoned IDs in the file
+}
+
+// dlqRecord is one line of a log file: an entry, or a tombstone listing
+// the IDs of entries that were taken out.
+type dlqRecord struct {
+	*DLQEntry
+	Deleted []uint64 `json:"deleted,omitempty"`
+}
+
+func newDLQStore(dir string, max int) *dlqStore {
+	if max <= 0 {
+		max = defaultDLQMaxEntries
+	}
+	return &dlqStore{dir: dir, max: max, dests: map[string]*dlqLog{}}
+}
+
+// withDLQ persists dead-letter stores under cfg.Directory, or <dataDir>/dlq.
+// Without either they stay in memory.
+func withDLQ(p PipelineEngine, cfg config.DLQConfig, dataDir string) error {
+	m, ok := p.(*memoryEngine)
+	if !ok {
+		return nil
+	}
+	dir := cfg.Directory
+	if dir == "" && dataDir != "" {
+		dir = filepath.Join(dataDir, "dlq")
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return fmt.Errorf("create dlq dir: %w", err)
+		}
+	}
+	m.mu.Lock()
+	m.dlq = newDLQStore(dir, cfg.MaxEntries)
+	m.mu.Unlock()
+	return nil
+}
+
+// path returns the destination's log file; it fails for an ID that would
+// place the file outside the DLQ directory.
+func (s *dlqStore) path(destID string) (string, error) {
+	return childPath(s.dir, destID+".jsonl")
+}
+
+// logLocked returns the destination's log, loading it from disk on first use.
+func (s *dlqStore) logLocked(destID string) *dlqLog {
+	if l, ok := s.dests[destID]; ok {
+		return l
+	}
+	l := &dlqLog{next: 1}
+	s.dests[destID] = l
+	if s.dir == "" {
+		return l
+	}
+	path, err := s.path(destID)
+	if err != nil {
+		log.Printf("destination %s: open dlq: %v", destID, err)
+		return l
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("destination %s: open dlq: %v", destID, err)
+		}
+		return l
+	}
+	defer f.Close()
+	live := map[uint64]DLQEntry{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for sc.Scan() {
+		r := dlqRecord{DLQEntry: &DLQEntry{}}
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			continue // torn last line after a crash
+		}
+		for _, id := range r.Deleted {
+			delete(live, id)
+		}
+		l.records += len(r.Deleted)
+		if r.ID == 0 {
+			continue
+		}
+		live[r.ID] = *r.DLQEntry
+		l.records++
+		if r.ID >= l.next {
+			l.next = r.ID + 1
+		}
+	}
+	for _, e := range live {
+		l.entries = append(l.entries, e)
+	}
+	sort.Slice(l.entries, func(i, j int) bool { return l.entries[i].ID < l.entries[j].ID })
+	if evicted := len(l.entries) - s.max; evicted > 0 {
+		l.entries = append([]DLQEntry(nil), l.entries[evicted:]...)
+	}
+	metrics.DLQSize.WithLabelValues(destID).Set(float64(len(l.entries)))
+	return l
+}
+
+// appendLocked appends entries, and a tombstone for deleted IDs, to the
+// destination's file and compacts it when it has grown well past its live
+// entries.
+func (s *dlqStore) appendLocked(destID string, l *dlqLog, entries []DLQEntry, deleted []uint64) {
+	if s.dir == "" {
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		_ = enc.Encode(e)
+	}
+	if len(deleted) > 0 {
+		_ = enc.Encode(dlqRecord{Deleted: deleted})
+	}
+	l.records += len(entries) + len(deleted)
+	if l.records > 2*len(l.entries)+dlqCompactSlack {
+		s.rewriteLocked(destID, l)
+		return
+	}
+	path, err := s.path(destID)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	}
+	if err == nil {
+		_, err = f.Write(buf.Bytes())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		log.Printf("destination %s: write dlq: %v", destID, err)
+	}
+}
+
+// add records events with the error that sent them here.
+func (s *dlqStore) add(destID string, events []map[string]interface{}, cause error) {
+	if len(events) == 0 {
+		return
+	}
+	status := 0
+	if pe, ok := outputs.IsPermanent(cause); ok {
+		status = pe.Status
+	}
+	msg := ""
+	if cause != nil {
+		msg = cause.Error()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.logLocked(destID)
+	now := time.Now().UTC()
+	added := make([]DLQEntry, 0, len(events))
+	for _, ev := range events {
+		added = append(added, DLQEntry{ID: l.next, Timestamp: now, Error: msg, Status: status, Event: ev})
+		l.next++
+	}
+	l.entries = append(l.entries, added...)
+	metrics.DLQEvents.WithLabelValues(destID, "added").Add(float64(len(events)))
+	var evictedIDs []uint64
+	if evicted := len(l.entries) - s.max; evicted > 0 {
+		for _, e := range l.entries[:evicted] {
+			evictedIDs = append(evictedIDs, e.ID)
+		}
+		l.entries = append([]DLQEntry(nil), l.entries[evicted:]...)
+		metrics.DLQEvents.WithLabelValues(destID, "evicted").Add(float64(evicted))
+	}
+	s.appendLocked(destID, l, added, evictedIDs)
+	metrics.DLQSize.WithLabelValues(destID).Set(float64(len(l.entries)))
+	log.Printf("destination %s: %d events dead-lettered: %s", destID, len(events), msg)
+}
+
+// rewriteLocked compacts the destination's file down to its current entries.
+func (s *dlqStore) rewriteLocked(destID string, l *dlqLog) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range l.entries {
+		_ = enc.Encode(e)
+	}
+	path, err := s.path(destID)
+	if err == nil {
+		err = writeFileAtomic(path, buf.Bytes())
+	}
+	if err != nil {
+		log.Printf("destination %s: write dlq: %v", destID, err)
+		return
+	}
+	l.records = len(l.entries)
+}
+
+// page returns entries [offset, offset+limit) and the total count.
+func (s *dlqStore) page(destID string, limit, offset int) ([]DLQEntry, int, int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	page, total, limit, offset := paginate(s.logLocked(destID).entries, limit, offset)
+	return append([]DLQEntry{}, page...), total, limit, offset
+}
+
+func (s *dlqStore) size(destID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.logLocked(destID).entries)
+}
+
+// take removes and returns the entries with the given IDs (all when ids is empty).
+func (s *dlqStore) take(destID string, ids []uint64) []DLQEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.logLocked(destID)
+	var taken, kept []DLQEntry
+	if len(ids) == 0 {
+		taken = l.entries
+	} else {
+		want := make(map[uint64]bool, len(ids))
+		for _, id := range ids {
+			want[id] = true
+		}
+		for _, e := range l.entries {
+			if want[e.ID] {
+				taken = append(taken, e)
+			} else {
+				kept = append(kept, e)
+			}
+		}
+	}
+	if len(taken) == 0 {
+		return nil
+	}
+	l.entries = kept
+	ids = make([]uint64, len(taken))
+	for i, e := range taken {
+		ids[i] = e.ID
+	}
+	s.appendLocked(destID, l, nil, ids)
+	metrics.DLQSize.WithLabelValues(destID).Set(float64(len(l.entries)))
+	return taken
+}
+
+// restore puts entries back that could not be replayed, keeping their IDs.
+func (s *dlqStore) restore(destID string, entries []DLQEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := s.logLocked(destID)
+	l.entries = append(l.entries, entries...)
+	sort.Slice(l.entries, func(i, j int) bool { return l.entries[i].ID < l.entries[j].ID })
+	s.appendLocked(destID, l, entries, nil)
+	metrics.DLQSize.WithLabelValues(destID).Set(float64(len(l.entries)))
+}
+
+// drop forgets a deleted destination's entries.
+func (s *dlqStore) drop(destID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, loaded := s.dests[destID]; loaded {
+		delete(s.dests, destID)
+		metrics.DLQSize.DeleteLabelValues(destID)
+	}
+	if s.dir != "" {
+		if path, err := s.path(destID); err != nil {
+			log.Printf("destination %s: dlq not removed: %v", destID, err)
+		} else if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("destination %s: remove dlq: %v", destID, err)
+		}
+	}
+}
+
+// deadLetterFor returns the sink outputs use for events they give up on.
+func (m *memoryEngine) deadLetterFor(destID string) outputs.DeadLetterFunc {
+	store := m.dlq
+	return func(events []map[string]interface{}, err error) {
+		store.add(destID, events, err)
+	}
+}
+
+// destinationOutput returns the running output of a destination.
+func (m *memoryEngine) destinationOutput(destID string) (outputs.Output, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, d := range m.dests {
+		if d.ID == destID {
+			if d.output == nil {
+				return nil, errNoRunningOutput
+			}
+			return d.output, nil
+		}
+	}
+	return nil, errDestinationNotFound
+}
+
+func (m *memoryEngine) hasDestination(destID string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.findDestLocked(destID) != nil
+}
+
+// ListDLQ pages through a destination's dead-lettered events, oldest first.
+func (m *memoryEngine) ListDLQ(destID string, limit, offset int) ([]DLQEntry, int, int, int, error) {
+	if !m.hasDestination(destID) {
+		return nil, 0, 0, 0, errDestinationNotFound
+	}
+	page, total, limit, offset := m.dlq.page(destID, limit, offset)
+	return page, total, limit, offset, nil
+}
+
+// ReplayDLQ re-sends dead-lettered events (all, or those in ids) to the
+// destination's output. With pipelineID each event's _raw is run through that
+// pipeline first; events its filters drop are discarded. Events that cannot be
+// handed to the output go back into the store.
+func (m *memoryEngine) ReplayDLQ(destID string, ids []uint64, pipelineID string) (DLQReplayResult, error) {
+	var res DLQReplayResult
+	out, err := m.destinationOutput(destID)
+	if err != nil {
+		return res, err
+	}
+	var pl memPipe
+	if pipelineID != "" {
+		m.mu.RLock()
+		found := false
+		for _, p := range m.pipelines {
+			if p.ID == pipelineID {
+				pl, found = p, true
+				break
+			}
+		}
+		m.mu.RUnlock()
+		if !found {
+			return res, errPipelineNotFound
+		}
+	}
+	entries := m.dlq.take(destID, ids)
+	for i, e := range entries {
+		ev := e.Event
+		if pipelineID != "" {
+			ev = m.buildPayload(pl, rawEvent(e.Event))
+			if !applyKVFilters(pl.Filters, ev) {
+				res.Filtered++
+				continue
+			}
+		}
+		if err := out.Send(ev); err != nil {
+			rest := entries[i:]
+			m.dlq.restore(destID, rest)
+			res.Failed = len(rest)
+			res.Error = err.Error()
+			break
+		}
+		res.Replayed++
+	}
+	if res.Replayed > 0 {
+		_ = out.Flush()
+		metrics.DLQEvents.WithLabelValues(destID, "replayed").Add(float64(res.Replayed))
+	}
+	if res.Filtered > 0 {
+		metrics.DLQEvents.WithLabelValues(destID, "purged").Add(float64(res.Filtered))
+	}
+	res.Remaining = m.dlq.size(destID)
+	return res, nil
+}
+
+// PurgeDLQ deletes dead-lettered events (all, or those in ids).
+func (m *memoryEngine) PurgeDLQ(destID string, ids []uint64) (int, error) {
+	if !m.hasDestination(destID) {
+		return 0, errDestinationNotFound
+	}
+	n := len(m.dlq.take(destID, ids))
+	if n > 0 {
+		metrics.DLQEvents.WithLabelValues(destID, "purged").Add(float64(n))
+	}
+	return n, nil
+}
+
+// rawEvent recovers the original message of a dead-lettered event.
+func rawEvent(ev map[string]interface{}) string {
+	if raw, ok := ev["_raw"].(string); ok {
+		return raw
+	}
+	b, _ := json.Marshal(ev)
+	return string(b)
+}
+
+func parseDLQIDs(s string) ([]uint64, error) {
+	var ids []uint64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dlq entry id %q", part)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func writeDLQError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errDestinationNotFound):
+		structuredError(w, r, http.StatusNotFound, "not_found", err.Error())
+	case errors.Is(err, errNoRunningOutput):
+		structuredError(w, r, http.StatusConflict, "output_not_running", err.Error())
+	case errors.Is(err, errPipelineNotFound):
+		structuredError(w, r, http.StatusBadRequest, "invalid_pipeline", err.Error())
+	default:
+		structuredError(w, r, http.StatusInternalServerError, "internal", err.Error())
+	}
+}
+
+func (s *Server) handleDLQList(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	page, total, limit, offset, err := s.pipeline.ListDLQ(id, limit, offset)
+	if err != nil {
+		writeDLQError(w, r, err)
+		return
+	}
+	w.Header().Set("Pagination-Total", strconv.Itoa(total))
+	w.Header().Set("Pagination-Limit", strconv.Itoa(limit))
+	w.Header().Set("Pagination-Offset", strconv.Itoa(offset))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"destinationId": id, "items": page, "total": total, "offset": offset, "limit": limit})
+}
+
+func (s *Server) handleDLQReplay(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	var body struct {
+		IDs        []uint64 `json:"ids"`
+		PipelineID string   `json:"pipelineId"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			structuredError(w, r, http.StatusBadRequest, "invalid_body", err.Error())
+			return
+		}
+	}
+	res, err := s.pipeline.ReplayDLQ(id, body.IDs, body.PipelineID)
+	if err != nil {
+		writeDLQError(w, r, err)
+		return
+	}
+	s.audit("dlq_replay", map[string]any{"destination": id, "pipelineId": body.PipelineID, "replayed": res.Replayed, "filtered": res.Filtered, "failed": res.Failed, "requestId": r.Header.Get("X-Request-Id")})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (s *Server) handleDLQPurge(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ids, err := parseDLQIDs(r.URL.Query().Get("ids"))
+	if err != nil {
+		structuredError(w, r, http.StatusBadRequest, "invalid_ids", err.Error())
+		return
+	}
+	n, err := s.pipeline.PurgeDLQ(id, ids)
+	if err != nil {
+		writeDLQError(w, r, err)
+		return
+	}
+	s.audit("dlq_purge", map[string]any{"destination": id, "purged": n, "requestId": r.Header.Get("X-Request-Id")})
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"purged": n})
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bibbl/internal/config"
+	"bibbl/pkg/outputs"
+)
+
+// rejectingOutput rejects every batch with a 400 until accept is set.
+type rejectingOutput struct {
+	*batchOutput
+}
+
+func (o rejectingOutput) SendBatch(events []map[string]interface{}) error {
+	o.mu.Lock()
+	up := o.up
+	o.mu.Unlock()
+	if !up {
+		return outputs.Permanent(http.StatusBadRequest, errors.New("InvalidDataFormat"))
+	}
+	return o.batchOutput.SendBatch(events)
+}
+
+func TestDLQInspectReplayPurge(t *testing.T) {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Server.AuthTokens = map[string][]string{"admin-token": {"admin"}}
+	cfg.Storage.DataDir = t.TempDir()
+	cfg.Outputs.Queue.Enabled = true
+	srv := NewServer(cfg)
+	eng, _ := srv.engine()
+	// Stop the queue pumps before TempDir cleanup removes their segments.
+	t.Cleanup(eng.closeOutputs)
+	out := rejectingOutput{&batchOutput{fakeOutput: newFakeOutput()}}
+	eng.outputs.Register("reject", func(map[string]interface{}) (outputs.Output, error) { return out, nil })
+	created, err := eng.CreateDestination("Rejecting", "reject", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("create destination: %v", err)
+	}
+	destID := created.(memDest).ID
+	running, _ := eng.destinationOutput(destID)
+	_ = running.Send(map[string]interface{}{"_raw": "first"})
+	_ = running.Send(map[string]interface{}{"_raw": "second"})
+
+	deadline := time.Now().Add(3 * time.Second)
+	for eng.dlq.size(destID) < 2 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	code, body := doJSON(t, srv, http.MethodGet, "/api/v1/destinations/"+destID+"/dlq?limit=1", nil)
+	var page struct {
+		Items []DLQEntry `json:"items"`
+		Total int        `json:"total"`
+	}
+	_ = json.Unmarshal(body, &page)
+	if code != http.StatusOK || page.Total != 2 || len(page.Items) != 1 {
+		t.Fatalf("list dlq: %d %s", code, body)
+	}
+	if e := page.Items[0]; e.Status != http.StatusBadRequest || e.Error == "" || e.Event["_raw"] != "first" {
+		t.Fatalf("unexpected entry: %+v", e)
+	}
+	if eng.queues[destID].Stats().Depth != 0 {
+		t.Fatal("rejected batch should not stay in the queue")
+	}
+
+	out.mu.Lock()
+	out.up = true
+	out.mu.Unlock()
+	code, body = doJSON(t, srv, http.MethodPost, "/api/v1/destinations/"+destID+"/dlq/replay", map[string]any{"ids": []uint64{page.Items[0].ID}})
+	var res DLQReplayResult
+	_ = json.Unmarshal(body, &res)
+	if code != http.StatusOK || res.Replayed != 1 || res.Remaining != 1 {
+		t.Fatalf("replay: %d %s", code, body)
+	}
+	for out.count() < 1 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if out.count() != 1 {
+		t.Fatalf("replayed event not delivered")
+	}
+	if code, _ := doJSON(t, srv, http.MethodPost, "/api/v1/destinations/"+destID+"/dlq/replay", map[string]any{"pipelineId": "nope"}); code != http.StatusBadRequest {
+		t.Fatalf("unknown pipeline: expected 400, got %d", code)
+	}
+
+	code, body = doJSON(t, srv, http.MethodDelete, "/api/v1/destinations/"+destID+"/dlq", nil)
+	if code != http.StatusOK || eng.dlq.size(destID) != 0 {
+		t.Fatalf("purge: %d %s", code, body)
+	}
+	if code, _ := doJSON(t, srv, http.MethodGet, "/api/v1/destinations/missing/dlq", nil); code != http.StatusNotFound {
+		t.Fatalf("unknown destination: expected 404, got %d", code)
+	}
+}
+
+func TestDLQStoreAppendsAndCompacts(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dst-1.jsonl")
+	lines := func() int {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Count(data, []byte("\n"))
+	}
+	ids := func(entries []DLQEntry) []uint64 {
+		out := make([]uint64, len(entries))
+		for i, e := range entries {
+			out[i] = e.ID
+		}
+		return out
+	}
+	cause := errors.New("rejected")
+
+	s := newDLQStore(dir, 3)
+	for i := 0; i < 5; i++ {
+		s.add("dst-1", []map[string]interface{}{{"n": i}}, cause)
+	}
+	// Five entries and two eviction tombstones, appended rather than rewritten.
+	if n := lines(); n != 7 {
+		t.Fatalf("expected 7 appended lines, got %d", n)
+	}
+	taken := s.take("dst-1", []uint64{4})
+	s.restore("dst-1", taken)
+	s.take("dst-1", []uint64{5})
+
+	reloaded := newDLQStore(dir, 3)
+	got, total, _, _ := reloaded.page("dst-1", 10, 0)
+	if total != 2 || fmt.Sprint(ids(got)) != "[3 4]" {
+		t.Fatalf("reload: expected entries [3 4], got %v", ids(got))
+	}
+	reloaded.take("dst-1", nil)
+	if n := newDLQStore(dir, 3).size("dst-1"); n != 0 {
+		t.Fatalf("taken or evicted entries came back after a reload: %d", n)
+	}
+
+	for i := 0; i < 3000; i++ {
+		s.add("dst-1", []map[string]interface{}{{"n": i}}, cause)
+	}
+	if n := lines(); n > 2*3+dlqCompactSlack+2 {
+		t.Fatalf("expected the file compacted, got %d lines", n)
+	}
+	if got, _, _, _ := newDLQStore(dir, 3).page("dst-1", 10, 0); fmt.Sprint(ids(got)) != "[3003 3004 3005]" {
+		t.Fatalf("after compaction: got %v", ids(got))
+	}
+}
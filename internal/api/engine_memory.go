@@ -14,11 +14,16 @@ import (
 	"sync/atomic"
 	"time"
 
+	"bibbl/internal/config"
 	akamaiinput "bibbl/internal/inputs/akamai"
 	syninput "bibbl/internal/inputs/synthetic"
 	sysloginput "bibbl/internal/inputs/syslog"
 	"bibbl/internal/metrics"
+	"bibbl/pkg/filterexpr"
 	"bibbl/pkg/filters"
+	"bibbl/pkg/outputs"
+	"bibbl/pkg/pipeline"
+	"bibbl/pkg/queue"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -34,11 +39,17 @@ type memoryEngine struct {
 	seq           int
 	hub           *LogHub
 	pipelineStats sync.Map
+	routeStats    sync.Map
 	// optional enrichment hook provided by server
 	geo func(ip string) (map[string]interface{}, bool)
 	asn func(ip string) (map[string]interface{}, bool)
-	// cache for compiled route filters (regex)
-	filterCache map[string]*regexp.Regexp
+	// cache for compiled route filter expressions, and for the errors of
+	// filters that do not compile so they are not retried per event
+	filterCache map[string]*filterexpr.Program
+	filterErrs  map[string]error
+	// legacyFilters accepts route filters that are not valid expressions as
+	// regular expressions over _raw (pre-expression behaviour)
+	legacyFilters bool
 	// buffer config state (auto sizing, capacity overrides)
 	bufferAuto map[string]bool
 	bufferCap  map[string]int
@@ -48,6 +59,25 @@ type memoryEngine struct {
 	versaParser       *filters.VersaKVPParser
 	paloAltoParser    *filters.PaloAltoCSVParser
 	universalKVParser *filters.UniversalKVParser
+	// output factories keyed by destination type
+	outputs *outputs.Registry
+	// state is the write-through store for user configuration (nil = memory only)
+	state *stateStore
+	// staging engines hold a draft configuration only: they build no outputs
+	// and never start sources
+	staging bool
+	// queueCfg, when set, puts a disk queue in front of every destination
+	// output; queues holds the open queue per destination ID.
+	queueCfg *queueSettings
+	queues   map[string]*queue.DiskQueue
+	// dlq holds events outputs rejected, per destination
+	dlq *dlqStore
+	// breakers holds the circuit breaker per destination ID, built with breakerCfg
+	breakers   map[string]*pipeline.CircuitBreaker
+	breakerCfg config.CircuitBreakerConfig
+	// archiveDir, when set, holds a local staging directory per destination
+	// for the archive outputs (s3, azure_datalake)
+	archiveDir string
 }
 
 type memSource struct {
@@ -72,6 +102,9 @@ type memDest struct {
 	Status  string
 	Config  map[string]interface{}
 	Enabled bool
+	// runtime fields (not exported via JSON)
+	output    outputs.Output
+	outputErr string
 }
 
 type memPipe struct {
@@ -93,6 +126,35 @@ type pipelineCounter struct {
 	processed atomic.Uint64
 }
 
+type routeCounter struct {
+	name      atomic.Value
+	matched   atomic.Uint64
+	cloned    atomic.Uint64
+	filtered  atomic.Uint64
+	delivered atomic.Uint64
+}
+
+type routeEvent int
+
+const (
+	routeEventMatched routeEvent = iota
+	routeEventCloned
+	routeEventFiltered
+	routeEventDelivered
+)
+
+func (e routeEvent) String() string {
+	switch e {
+	case routeEventCloned:
+		return "cloned"
+	case routeEventFiltered:
+		return "filtered"
+	case routeEventDelivered:
+		return "delivered"
+	}
+	return "matched"
+}
+
 type filterOp int
 
 const (
@@ -353,6 +415,50 @@ func (m *memoryEngine) GetPipelineStats() []PipelineStats {
 	return stats
 }
 
+func (m *memoryEngine) recordRouteEvent(r memRoute, ev routeEvent) {
+	metrics.RouteEvents.WithLabelValues(r.Name, ev.String()).Inc()
+	if r.ID == "" {
+		return
+	}
+	rc := &routeCounter{}
+	if val, loaded := m.routeStats.LoadOrStore(r.ID, rc); loaded {
+		rc = val.(*routeCounter)
+	}
+	rc.name.Store(r.Name)
+	switch ev {
+	case routeEventMatched:
+		rc.matched.Add(1)
+	case routeEventCloned:
+		rc.cloned.Add(1)
+	case routeEventFiltered:
+		rc.filtered.Add(1)
+	case routeEventDelivered:
+		rc.delivered.Add(1)
+	}
+}
+
+func (m *memoryEngine) GetRouteStats() []RouteStats {
+	stats := make([]RouteStats, 0)
+	m.routeStats.Range(func(key, value any) bool {
+		id, _ := key.(string)
+		rc := value.(*routeCounter)
+		name, _ := rc.name.Load().(string)
+		stats = append(stats, RouteStats{
+			ID:        id,
+			Name:      name,
+			Matched:   rc.matched.Load(),
+			Cloned:    rc.cloned.Load(),
+			Filtered:  rc.filtered.Load(),
+			Delivered: rc.delivered.Load(),
+		})
+		return true
+	})
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
 type memRoute struct {
 	ID          string
 	Name        string
@@ -365,10 +471,12 @@ type memRoute struct {
 func NewMemoryEngine() PipelineEngine {
 	return &memoryEngine{
 		seq:               1,
-		filterCache:       map[string]*regexp.Regexp{},
+		filterCache:       map[string]*filterexpr.Program{},
 		versaParser:       filters.NewVersaKVPParser(),
 		paloAltoParser:    filters.NewPaloAltoCSVParser(),
 		universalKVParser: filters.NewUniversalKVParser(),
+		outputs:           newOutputRegistry(),
+		dlq:               newDLQStore("", 0),
 	}
 }
 
@@ -396,8 +504,21 @@ func withASN(p PipelineEngine, fn func(string) (map[string]interface{}, bool)) P
 	return p
 }
 
+// withLegacyFilters lets route filters that are not valid expressions fall
+// back to regex matching against the raw message.
+func withLegacyFilters(p PipelineEngine) PipelineEngine {
+	if m, ok := p.(*memoryEngine); ok {
+		m.mu.Lock()
+		m.legacyFilters = true
+		m.filterCache = map[string]*filterexpr.Program{}
+		m.filterErrs = nil
+		m.mu.Unlock()
+	}
+	return p
+}
+
 func NewMemoryEngineWithSamples() PipelineEngine {
-	m := &memoryEngine{seq: 1, filterCache: map[string]*regexp.Regexp{}}
+	m := &memoryEngine{seq: 1, filterCache: map[string]*filterexpr.Program{}, dlq: newDLQStore("", 0)}
 	m.sources = []*memSource{
 		{ID: "syslog-udp", Type: "syslog", Name: "Syslog UDP", Enabled: true, Status: "healthy", Config: map[string]interface{}{"port": 9514}},
 		{ID: "http-bulk", Type: "http", Name: "HTTP Bulk", Enabled: false, Status: "disabled", Config: map[string]interface{}{"port": 10080}},
@@ -459,22 +580,26 @@ func (m *memoryEngine) GetSources() []struct {
 }
 
 func (m *memoryEngine) CreateSource(name, typ string, cfg map[string]interface{}) (interface{}, error) {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	id := fmt.Sprintf("src-%d", m.seq)
 	m.seq++
 	s := &memSource{ID: id, Name: name, Type: typ, Config: cfg, Status: "stopped", Enabled: false}
 	m.sources = append(m.sources, s)
+	m.persistLocked()
 	return s, nil
 }
 
 func (m *memoryEngine) UpdateSource(id, name string, cfg map[string]interface{}) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.sources {
 		if m.sources[i].ID == id {
 			m.sources[i].Name = name
 			m.sources[i].Config = cfg
+			m.persistLocked()
 			return nil
 		}
 	}
@@ -482,11 +607,13 @@ func (m *memoryEngine) UpdateSource(id, name string, cfg map[string]interface{})
 }
 
 func (m *memoryEngine) DeleteSource(id string) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.sources {
 		if m.sources[i].ID == id {
 			m.sources = append(m.sources[:i], m.sources[i+1:]...)
+			m.persistLocked()
 			return nil
 		}
 	}
@@ -494,11 +621,15 @@ func (m *memoryEngine) DeleteSource(id string) error {
 }
 
 func (m *memoryEngine) StartSource(id string) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.sources {
 		if m.sources[i].ID == id {
-			m.sources[i].Enabled = true
+			if !m.sources[i].Enabled {
+				m.sources[i].Enabled = true
+				m.persistLocked()
+			}
 			// If this is a syslog source, start the listener and wire to LogHub
 			if m.sources[i].Type == "syslog" {
 				// Build address and TLS
@@ -646,34 +777,43 @@ func (m *memoryEngine) StartSource(id string) error {
 }
 
 func (m *memoryEngine) StopSource(id string) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.sources {
 		if m.sources[i].ID == id {
-			m.sources[i].Enabled = false
-			// Stop any running syslog server
-			if m.sources[i].syslogSrv != nil {
-				_ = m.sources[i].syslogSrv.Stop()
-				m.sources[i].syslogSrv = nil
+			if m.sources[i].Enabled {
+				m.sources[i].Enabled = false
+				m.persistLocked()
 			}
-			if m.sources[i].synthGen != nil {
-				m.sources[i].synthGen.Stop()
-			}
-			if m.sources[i].akamaiPoll != nil {
-				m.sources[i].akamaiPoll.Stop()
-				m.sources[i].akamaiPoll = nil
-			}
-			if m.sources[i].cancel != nil {
-				m.sources[i].cancel()
-				m.sources[i].cancel = nil
-			}
-			m.sources[i].Status = "stopped"
+			stopSourceRuntime(m.sources[i])
 			return nil
 		}
 	}
 	return errors.New("source not found")
 }
 
+// stopSourceRuntime tears down whatever listener or generator backs a source.
+func stopSourceRuntime(src *memSource) {
+	// Stop any running syslog server
+	if src.syslogSrv != nil {
+		_ = src.syslogSrv.Stop()
+		src.syslogSrv = nil
+	}
+	if src.synthGen != nil {
+		src.synthGen.Stop()
+	}
+	if src.akamaiPoll != nil {
+		src.akamaiPoll.Stop()
+		src.akamaiPoll = nil
+	}
+	if src.cancel != nil {
+		src.cancel()
+		src.cancel = nil
+	}
+	src.Status = "stopped"
+}
+
 // syslogHandler adapts incoming syslog messages to a callback.
 type syslogHandler struct{ on func(string) }
 
@@ -724,59 +864,166 @@ func (m *memoryEngine) applyParsers(functions []string, event map[string]interfa
 	return event, true
 }
 
-// processAndAppend performs a minimal in-memory routing and optional enrichment,
-// then appends a rendered string to the hub for preview/UI purposes.
-func (m *memoryEngine) processAndAppend(sourceID, msg string) {
-	start := time.Now()
-	ctx := context.Background()
-	tr := otel.Tracer("bibbl/pipeline")
-	ctx, span := tr.Start(ctx, "processAndAppend", trace.WithAttributes(
-		attribute.String("source.id", sourceID),
-		attribute.Int("msg.len", len(msg)),
-	))
-	_ = ctx
-	// pick first matching route by regex, fallback to default (true)
+// routeSnapshot captures routing state once so an event (or a whole batch) is
+// evaluated against a consistent view without holding m.mu.
+type routeSnapshot struct {
+	routes       []memRoute
+	pipes        map[string]memPipe
+	outs         map[string]outputs.Output
+	filters      map[string]*filterexpr.Program
+	defaultRoute *memRoute
+}
+
+func (m *memoryEngine) snapshotRoutes() *routeSnapshot {
 	m.mu.RLock()
-	routes := append([]memRoute(nil), m.routes...)
-	pipes := append([]memPipe(nil), m.pipelines...)
+	snap := &routeSnapshot{
+		routes: append([]memRoute(nil), m.routes...),
+		pipes:  make(map[string]memPipe, len(m.pipelines)),
+		outs:   m.outputSnapshotLocked(),
+	}
+	for _, p := range m.pipelines {
+		snap.pipes[p.ID] = p
+	}
 	m.mu.RUnlock()
-	matched := memRoute{}
-	found := false
-	for _, r := range routes {
-		if r.Filter == "" || r.Filter == "true" {
-			matched = r
-			found = true
-			break
+
+	// Resolve compiled filters once; routes whose filter does not compile never match
+	snap.filters = make(map[string]*filterexpr.Program)
+	for i, r := range snap.routes {
+		if prog, err := m.compileFilter(r.Filter); err == nil {
+			snap.filters[r.Filter] = prog
 		}
-		if re := m.getFilterRegex(r.Filter); re != nil && re.MatchString(msg) {
-			matched = r
-			found = true
-			break
+		if snap.defaultRoute == nil && r.Name == "default" {
+			snap.defaultRoute = &snap.routes[i]
 		}
 	}
-	if !found {
-		// try default route by name
-		for _, r := range routes {
-			if r.Name == "default" {
-				matched = r
-				found = true
-				break
+	return snap
+}
+
+// routeFilterEvent is the view of an event that route filters evaluate. Fields
+// are parsed from the raw message only when a filter actually reads them.
+type routeFilterEvent struct {
+	fields map[string]interface{}
+	parsed bool
+}
+
+func newRouteFilterEvent(msg string) *routeFilterEvent {
+	return &routeFilterEvent{fields: map[string]interface{}{"_raw": msg}}
+}
+
+func (m *memoryEngine) matches(snap *routeSnapshot, r memRoute, ev *routeFilterEvent) bool {
+	prog, ok := snap.filters[r.Filter]
+	if !ok {
+		return false
+	}
+	if prog.UsesFields() && !ev.parsed {
+		m.parseRouteFields(ev)
+	}
+	return prog.Match(ev.fields)
+}
+
+// parseRouteFields exposes JSON object keys, or key=value pairs for syslog
+// style messages, as fields for route filters. Pipelines still receive the
+// raw message and do their own parsing.
+func (m *memoryEngine) parseRouteFields(ev *routeFilterEvent) {
+	ev.parsed = true
+	raw, _ := ev.fields["_raw"].(string)
+	if trimmed := strings.TrimSpace(raw); strings.HasPrefix(trimmed, "{") {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(trimmed), &obj); err == nil {
+			for k, v := range obj {
+				if _, exists := ev.fields[k]; !exists {
+					ev.fields[k] = v
+				}
 			}
+			return
 		}
 	}
-	if !found || m.hub == nil {
-		m.hub.Append(sourceID, msg)
-		metrics.IngestEvents.WithLabelValues(sourceID, "", "").Inc()
+	if m.universalKVParser == nil {
 		return
 	}
-	// resolve pipeline
-	var pl memPipe
-	for _, p := range pipes {
-		if p.ID == matched.PipelineID {
-			pl = p
-			break
+	kv := map[string]interface{}{"message": raw}
+	_ = m.universalKVParser.Parse(kv)
+	delete(kv, "message")
+	for k, v := range kv {
+		if _, exists := ev.fields[k]; !exists {
+			ev.fields[k] = v
 		}
 	}
+}
+
+// routeResult describes what happened to one event after route evaluation.
+type routeResult struct {
+	rendered  string   // hub rendering of the first delivered clone
+	delivered bool     // at least one route passed its pipeline filters
+	first     memRoute // first matching route (for metrics/tracing)
+	firstPipe memPipe
+	matched   int
+}
+
+// dispatch evaluates routes in order, Cribl style: every matching non-final
+// route receives its own clone of the event through its own pipeline, and
+// evaluation stops at the first matching final route, which consumes the
+// original. When nothing matches, the route named "default" (if any) is used.
+func (m *memoryEngine) dispatch(snap *routeSnapshot, sourceID, msg string) routeResult {
+	res := routeResult{}
+	ev := newRouteFilterEvent(msg)
+	for _, r := range snap.routes {
+		if !m.matches(snap, r, ev) {
+			continue
+		}
+		m.recordRouteEvent(r, routeEventMatched)
+		if !r.Final {
+			m.recordRouteEvent(r, routeEventCloned)
+		}
+		m.runRoute(snap, r, sourceID, msg, &res)
+		if r.Final {
+			return res
+		}
+	}
+	if res.matched == 0 && snap.defaultRoute != nil {
+		m.recordRouteEvent(*snap.defaultRoute, routeEventMatched)
+		m.runRoute(snap, *snap.defaultRoute, sourceID, msg, &res)
+	}
+	return res
+}
+
+// runRoute builds a fresh payload from msg, runs it through r's pipeline and
+// hands the result to r's destination.
+func (m *memoryEngine) runRoute(snap *routeSnapshot, r memRoute, sourceID, msg string, res *routeResult) {
+	pl := snap.pipes[r.PipelineID]
+	if res.matched == 0 {
+		res.first = r
+		res.firstPipe = pl
+	}
+	res.matched++
+
+	payload := m.buildPayload(pl, msg)
+	if !applyKVFilters(pl.Filters, payload) {
+		m.recordPipelineEvent(pl.ID, pl.Name, true)
+		m.recordRouteEvent(r, routeEventFiltered)
+		metrics.PipelineThroughput.WithLabelValues(pl.Name, r.Name, sourceID, "filtered").Inc()
+		metrics.PipelineFiltered.WithLabelValues(pl.Name, r.Name, sourceID).Inc()
+		return
+	}
+	m.recordPipelineEvent(pl.ID, pl.Name, false)
+
+	if !res.delivered {
+		// Render as JSON
+		res.rendered = msg
+		if b, err := json.Marshal(payload); err == nil {
+			res.rendered = string(b)
+		}
+		res.delivered = true
+	}
+	m.recordRouteEvent(r, routeEventDelivered)
+	metrics.IngestEvents.WithLabelValues(sourceID, r.Name, r.Destination).Inc()
+	m.deliver(snap.outs, r, payload)
+}
+
+// buildPayload turns a raw message into the event pl produces: parser
+// functions first, then GeoIP/ASN enrichment when the pipeline asks for it.
+// Pipeline filters are left to the caller.
+func (m *memoryEngine) buildPayload(pl memPipe, msg string) map[string]interface{} {
 	// Create initial payload
 	payload := map[string]interface{}{"_raw": msg}
 
@@ -820,27 +1067,41 @@ func (m *memoryEngine) processAndAppend(sourceID, msg string) {
 			}
 		}
 	}
+	return payload
+}
 
-	if !applyKVFilters(pl.Filters, payload) {
-		m.recordPipelineEvent(pl.ID, pl.Name, true)
-		metrics.PipelineThroughput.WithLabelValues(pl.Name, matched.Name, sourceID, "filtered").Inc()
-		metrics.PipelineFiltered.WithLabelValues(pl.Name, matched.Name, sourceID).Inc()
-		span.AddEvent("payload_filtered", trace.WithAttributes(attribute.String("pipeline", pl.Name), attribute.String("route", matched.Name)))
+// processAndAppend performs in-memory routing and optional enrichment for a
+// single event, then appends a rendered string to the hub for preview/UI purposes.
+func (m *memoryEngine) processAndAppend(sourceID, msg string) {
+	start := time.Now()
+	ctx := context.Background()
+	tr := otel.Tracer("bibbl/pipeline")
+	ctx, span := tr.Start(ctx, "processAndAppend", trace.WithAttributes(
+		attribute.String("source.id", sourceID),
+		attribute.Int("msg.len", len(msg)),
+	))
+	_ = ctx
+	defer span.End()
+
+	snap := m.snapshotRoutes()
+	res := m.dispatch(snap, sourceID, msg)
+	if res.matched == 0 {
+		if m.hub != nil {
+			m.hub.Append(sourceID, msg)
+		}
+		metrics.IngestEvents.WithLabelValues(sourceID, "", "").Inc()
 		return
 	}
-	m.recordPipelineEvent(pl.ID, pl.Name, false)
-
-	// Render as JSON
-	out := msg
-	if b, err := json.Marshal(payload); err == nil {
-		out = string(b)
+	if !res.delivered {
+		span.AddEvent("payload_filtered", trace.WithAttributes(attribute.String("pipeline", res.firstPipe.Name), attribute.String("route", res.first.Name)))
+		return
+	}
+	if m.hub != nil {
+		m.hub.Append(sourceID, res.rendered)
 	}
-	m.hub.Append(sourceID, out)
-	metrics.IngestEvents.WithLabelValues(sourceID, matched.Name, matched.Destination).Inc()
 	lat := time.Since(start).Seconds()
-	metrics.PipelineLatency.WithLabelValues(pl.Name, matched.Name, sourceID).Observe(lat)
-	span.SetAttributes(attribute.String("pipeline", pl.Name), attribute.String("route", matched.Name), attribute.Bool("geo", wantGeo), attribute.Bool("asn", wantASN))
-	span.End()
+	metrics.PipelineLatency.WithLabelValues(res.firstPipe.Name, res.first.Name, sourceID).Observe(lat)
+	span.SetAttributes(attribute.String("pipeline", res.firstPipe.Name), attribute.String("route", res.first.Name), attribute.Int("routes.matched", res.matched))
 }
 
 var reIPv4 = regexp.MustCompile(`\b\d+\.\d+\.\d+\.\d+\b`)
@@ -868,144 +1129,33 @@ func (m *memoryEngine) processAndAppendBatch(sourceID string, messages []string)
 	))
 	defer span.End()
 
-	// Acquire route/pipeline snapshot once for entire batch
-	m.mu.RLock()
-	routes := append([]memRoute(nil), m.routes...)
-	pipes := append([]memPipe(nil), m.pipelines...)
-	m.mu.RUnlock()
-
-	// Pre-compile all filter regexes to avoid repeated compilation
-	filterRegexes := make(map[string]*regexp.Regexp)
-	for _, r := range routes {
-		if r.Filter != "" && r.Filter != "true" {
-			if re := m.getFilterRegex(r.Filter); re != nil {
-				filterRegexes[r.Filter] = re
-			}
-		}
-	}
-
-	// Find default route once
-	var defaultRoute *memRoute
-	for i := range routes {
-		if routes[i].Name == "default" {
-			defaultRoute = &routes[i]
-			break
-		}
-	}
+	// Acquire route/pipeline/output snapshot once for entire batch
+	snap := m.snapshotRoutes()
 
 	// Process each message with minimal overhead
 	for _, msg := range messages {
 		if strings.TrimSpace(msg) == "" {
 			continue
 		}
-
-		// Fast route matching with cached regexes
-		matched := memRoute{}
-		found := false
-		for _, r := range routes {
-			if r.Filter == "" || r.Filter == "true" {
-				matched = r
-				found = true
-				break
-			}
-			if re, ok := filterRegexes[r.Filter]; ok && re.MatchString(msg) {
-				matched = r
-				found = true
-				break
-			}
-		}
-		if !found && defaultRoute != nil {
-			matched = *defaultRoute
-			found = true
-		}
-
-		if !found || m.hub == nil {
+		res := m.dispatch(snap, sourceID, msg)
+		if res.matched == 0 {
 			if m.hub != nil {
 				m.hub.Append(sourceID, msg)
 			}
 			metrics.IngestEvents.WithLabelValues(sourceID, "", "").Inc()
 			continue
 		}
-
-		// Resolve pipeline
-		var pl memPipe
-		for _, p := range pipes {
-			if p.ID == matched.PipelineID {
-				pl = p
-				break
-			}
-		}
-
-		// Create initial payload
-		payload := map[string]interface{}{"_raw": msg}
-
-		// Apply parsers first
-		if len(pl.Functions) > 0 {
-			payload, _ = m.applyParsers(pl.Functions, payload)
+		if res.delivered && m.hub != nil {
+			m.hub.Append(sourceID, res.rendered)
 		}
-
-		// Check enrichment requirements
-		wantGeo := false
-		wantASN := false
-		for _, f := range pl.Functions {
-			if f == "geoip_enrich" || f == "GeoIP Enrich" {
-				wantGeo = true
-			}
-			if f == "asn_enrich" || f == "ASN Enrich" {
-				wantASN = true
-			}
-		}
-
-		// Apply enrichment if requested
-		if (wantGeo && m.geo != nil) || (wantASN && m.asn != nil) {
-			ip := ""
-			if pl.IPSource == "" || pl.IPSource == "first_ipv4" {
-				ip = extractFirstIPv4(msg)
-			} else {
-				ip = m.extractIPBySource(pl.IPSource, msg)
-			}
-			if ip != "" {
-				payload["ip"] = ip
-			}
-			if ip != "" && wantGeo && m.geo != nil {
-				if geo, ok := m.geo(ip); ok && geo != nil {
-					payload["geo"] = geo
-				}
-			}
-			if ip != "" && wantASN && m.asn != nil {
-				if asn, ok := m.asn(ip); ok && asn != nil {
-					payload["asn"] = asn
-				}
-			}
-		}
-
-		if !applyKVFilters(pl.Filters, payload) {
-			m.recordPipelineEvent(pl.ID, pl.Name, true)
-			metrics.PipelineThroughput.WithLabelValues(pl.Name, matched.Name, sourceID, "filtered").Inc()
-			metrics.PipelineFiltered.WithLabelValues(pl.Name, matched.Name, sourceID).Inc()
-			continue
-		}
-		m.recordPipelineEvent(pl.ID, pl.Name, false)
-
-		// Render as JSON
-		out := msg
-		if b, err := json.Marshal(payload); err == nil {
-			out = string(b)
-		}
-
-		m.hub.Append(sourceID, out)
-		metrics.IngestEvents.WithLabelValues(sourceID, matched.Name, matched.Destination).Inc()
 	}
 
 	// Record batch metrics
 	batchLatency := time.Since(start).Seconds()
-	for _, r := range routes {
+	for _, r := range snap.routes {
 		// Find any pipeline used by this route
-		for _, p := range pipes {
-			if p.ID == r.PipelineID {
-				metrics.PipelineLatency.WithLabelValues(p.Name, r.Name, sourceID).Observe(batchLatency / float64(len(messages)))
-				break
-			}
+		if p, ok := snap.pipes[r.PipelineID]; ok {
+			metrics.PipelineLatency.WithLabelValues(p.Name, r.Name, sourceID).Observe(batchLatency / float64(len(messages)))
 		}
 	}
 
@@ -1040,33 +1190,82 @@ func (m *memoryEngine) extractIPBySource(src, raw string) string {
 	return extractFirstIPv4(raw)
 }
 
-// getFilterRegex returns a cached compiled regex for a route filter, compiling
-// it on first use. If compilation fails, nil is cached is not stored (to allow
-// later changes) and nil returned.
-func (m *memoryEngine) getFilterRegex(pattern string) *regexp.Regexp {
-	if pattern == "" || pattern == "true" {
-		return nil
-	}
+// compileFilter returns the cached program for a route filter, compiling it on
+// first use. Compile failures are cached too: they are keyed by the filter
+// text, so a corrected filter is still compiled afresh.
+func (m *memoryEngine) compileFilter(filter string) (*filterexpr.Program, error) {
 	m.mu.RLock()
-	if m.filterCache != nil {
-		if re, ok := m.filterCache[pattern]; ok {
-			m.mu.RUnlock()
-			return re
-		}
+	if prog, ok := m.filterCache[filter]; ok {
+		m.mu.RUnlock()
+		return prog, nil
+	}
+	if err, ok := m.filterErrs[filter]; ok {
+		m.mu.RUnlock()
+		return nil, err
 	}
+	legacy := m.legacyFilters
 	m.mu.RUnlock()
 	// compile outside lock
-	re, err := regexp.Compile(pattern)
-	if err != nil {
+	prog, err := compileRouteFilter(filter, legacy)
+	m.mu.Lock()
+	m.storeFilterLocked(filter, prog, err)
+	m.mu.Unlock()
+	return prog, err
+}
+
+// cacheFilterLocked compiles a filter into the cache with m.mu held.
+func (m *memoryEngine) cacheFilterLocked(filter string) error {
+	if _, ok := m.filterCache[filter]; ok {
 		return nil
 	}
-	m.mu.Lock()
+	if err, ok := m.filterErrs[filter]; ok {
+		return err
+	}
+	prog, err := compileRouteFilter(filter, m.legacyFilters)
+	m.storeFilterLocked(filter, prog, err)
+	return err
+}
+
+func (m *memoryEngine) storeFilterLocked(filter string, prog *filterexpr.Program, err error) {
+	if err != nil {
+		if m.filterErrs == nil {
+			m.filterErrs = map[string]error{}
+		}
+		m.filterErrs[filter] = err
+		return
+	}
 	if m.filterCache == nil {
-		m.filterCache = map[string]*regexp.Regexp{}
+		m.filterCache = map[string]*filterexpr.Program{}
 	}
-	m.filterCache[pattern] = re
-	m.mu.Unlock()
-	return re
+	m.filterCache[filter] = prog
+}
+
+func compileRouteFilter(filter string, legacy bool) (*filterexpr.Program, error) {
+	if legacy {
+		return filterexpr.CompileLegacy(filter)
+	}
+	return filterexpr.Compile(filter)
+}
+
+// validateFilter checks a filter submitted through the API. A rejected filter
+// is not kept in the error cache, so bad input does not accumulate there.
+func (m *memoryEngine) validateFilter(filter string) error {
+	if _, err := m.compileFilter(filter); err != nil {
+		m.mu.Lock()
+		delete(m.filterErrs, filter)
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// routeFilterError returns why a route filter does not compile, or "" when it
+// does. Such routes never match.
+func (m *memoryEngine) routeFilterError(filter string) string {
+	if _, err := m.compileFilter(filter); err != nil {
+		return err.Error()
+	}
+	return ""
 }
 
 // Buffers
@@ -1295,6 +1494,10 @@ func (m *memoryEngine) GetDestinations() []struct {
 		Enabled bool
 	}, 0, len(m.dests))
 	for _, d := range m.dests {
+		status := d.Status
+		if d.output != nil {
+			status = d.output.Health().Status
+		}
 		res = append(res, struct {
 			ID      string
 			Name    string
@@ -1302,12 +1505,13 @@ func (m *memoryEngine) GetDestinations() []struct {
 			Status  string
 			Config  map[string]interface{}
 			Enabled bool
-		}{ID: d.ID, Name: d.Name, Type: d.Type, Status: d.Status, Config: d.Config, Enabled: d.Enabled})
+		}{ID: d.ID, Name: d.Name, Type: d.Type, Status: status, Config: d.Config, Enabled: d.Enabled})
 	}
 	return res
 }
 
 func (m *memoryEngine) CreateDestination(name, typ string, cfg map[string]interface{}) (interface{}, error) {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	id := fmt.Sprintf("dst-%d", m.seq)
@@ -1321,16 +1525,21 @@ func (m *memoryEngine) CreateDestination(name, typ string, cfg map[string]interf
 	}
 	d := memDest{ID: id, Name: name, Type: typ, Status: status, Enabled: true, Config: cfg}
 	m.dests = append(m.dests, d)
-	return d, nil
+	m.syncOutputLocked(len(m.dests) - 1)
+	m.persistLocked()
+	return m.dests[len(m.dests)-1], nil
 }
 
 func (m *memoryEngine) UpdateDestination(id, name string, cfg map[string]interface{}) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.dests {
 		if m.dests[i].ID == id {
 			m.dests[i].Name = name
 			m.dests[i].Config = cfg
+			closeOutput(id, m.syncOutputLocked(i))
+			m.persistLocked()
 			return nil
 		}
 	}
@@ -1338,11 +1547,17 @@ func (m *memoryEngine) UpdateDestination(id, name string, cfg map[string]interfa
 }
 
 func (m *memoryEngine) DeleteDestination(id string) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.dests {
 		if m.dests[i].ID == id {
+			closeOutput(id, m.dests[i].output)
+			m.dropQueueLocked(id)
+			m.dlq.drop(id)
+			m.dropBreakerLocked(id)
 			m.dests = append(m.dests[:i], m.dests[i+1:]...)
+			m.persistLocked()
 			return nil
 		}
 	}
@@ -1350,10 +1565,12 @@ func (m *memoryEngine) DeleteDestination(id string) error {
 }
 
 func (m *memoryEngine) PatchDestination(id string, patch map[string]interface{}) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.dests {
 		if m.dests[i].ID == id {
+			restart := false
 			if v, ok := patch["name"].(string); ok {
 				m.dests[i].Name = v
 			}
@@ -1362,10 +1579,16 @@ func (m *memoryEngine) PatchDestination(id string, patch map[string]interface{})
 			}
 			if v, ok := patch["config"].(map[string]interface{}); ok {
 				m.dests[i].Config = v
+				restart = true
 			}
 			if v, ok := patch["enabled"].(bool); ok {
+				restart = restart || v != m.dests[i].Enabled
 				m.dests[i].Enabled = v
 			}
+			if restart {
+				closeOutput(id, m.syncOutputLocked(i))
+			}
+			m.persistLocked()
 			return nil
 		}
 	}
@@ -1399,6 +1622,7 @@ func (m *memoryEngine) GetPipelines() []struct {
 }
 
 func (m *memoryEngine) CreatePipeline(name, desc string, fns []string) (interface{}, error) {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	id := fmt.Sprintf("pipe-%d", m.seq)
@@ -1410,10 +1634,12 @@ func (m *memoryEngine) CreatePipeline(name, desc string, fns []string) (interfac
 	p := memPipe{ID: id, Name: name, Description: desc, Functions: fns, Filters: filters}
 	m.pipelines = append(m.pipelines, p)
 	m.registerPipelineStat(p)
+	m.persistLocked()
 	return p, nil
 }
 
 func (m *memoryEngine) UpdatePipeline(id, name, desc string, fns []string) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	filters, err := compileKVFilters(fns)
@@ -1427,6 +1653,7 @@ func (m *memoryEngine) UpdatePipeline(id, name, desc string, fns []string) error
 			m.pipelines[i].Functions = fns
 			m.pipelines[i].Filters = filters
 			m.registerPipelineStat(m.pipelines[i])
+			m.persistLocked()
 			return nil
 		}
 	}
@@ -1434,12 +1661,14 @@ func (m *memoryEngine) UpdatePipeline(id, name, desc string, fns []string) error
 }
 
 func (m *memoryEngine) DeletePipeline(id string) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.pipelines {
 		if m.pipelines[i].ID == id {
 			m.pipelines = append(m.pipelines[:i], m.pipelines[i+1:]...)
 			m.deletePipelineStat(id)
+			m.persistLocked()
 			return nil
 		}
 	}
@@ -1479,16 +1708,25 @@ func (m *memoryEngine) GetRoutes() []struct {
 }
 
 func (m *memoryEngine) CreateRoute(name, filter, pipelineID, destination string, final bool) (interface{}, error) {
+	if err := m.validateFilter(filter); err != nil {
+		return nil, err
+	}
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	id := fmt.Sprintf("route-%d", m.seq)
 	m.seq++
 	r := memRoute{ID: id, Name: name, Filter: filter, PipelineID: pipelineID, Destination: destination, Final: final}
 	m.routes = append(m.routes, r)
+	m.persistLocked()
 	return r, nil
 }
 
 func (m *memoryEngine) UpdateRoute(id, name, filter, pipelineID, destination string, final bool) error {
+	if err := m.validateFilter(filter); err != nil {
+		return err
+	}
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.routes {
@@ -1498,6 +1736,7 @@ func (m *memoryEngine) UpdateRoute(id, name, filter, pipelineID, destination str
 			m.routes[i].PipelineID = pipelineID
 			m.routes[i].Destination = destination
 			m.routes[i].Final = final
+			m.persistLocked()
 			return nil
 		}
 	}
@@ -1505,11 +1744,14 @@ func (m *memoryEngine) UpdateRoute(id, name, filter, pipelineID, destination str
 }
 
 func (m *memoryEngine) DeleteRoute(id string) error {
+	defer m.writeState()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	for i := range m.routes {
 		if m.routes[i].ID == id {
 			m.routes = append(m.routes[:i], m.routes[i+1:]...)
+			m.routeStats.Delete(id)
+			m.persistLocked()
 			return nil
 		}
 	}
@@ -3,10 +3,11 @@ package api
 import (
 	"context"
 	"fmt"
-	"regexp"
 	"sync"
 	"testing"
 	"time"
+
+	"bibbl/pkg/filterexpr"
 )
 
 // benchEngine builds a memory engine wired with the current severity filter logic
@@ -24,7 +25,7 @@ func benchEngine() *memoryEngine {
 		pipelines:   []memPipe{{ID: "default", Name: "default", Functions: pipeFns, Filters: filters}},
 		routes:      []memRoute{{Name: "default", PipelineID: "default", Filter: "true"}},
 		hub:         hub,
-		filterCache: make(map[string]*regexp.Regexp),
+		filterCache: make(map[string]*filterexpr.Program),
 	}
 }
 
@@ -3,6 +3,9 @@ package api
 import (
 	"strings"
 	"testing"
+
+	"bibbl/internal/config"
+	"bibbl/pkg/outputs"
 )
 
 // fake geo/ASN lookup for testing
@@ -56,15 +59,15 @@ func TestFilterCache(t *testing.T) {
 	eng.pipelines = []memPipe{{ID: "p1", Name: "P", IPSource: "first_ipv4", Filters: mustCompileFilters(t, nil)}}
 	eng.routes = []memRoute{{ID: "r1", Name: "r1", Filter: "alpha", PipelineID: "p1", Final: true}}
 	// first call compiles
-	if re := eng.getFilterRegex("alpha"); re == nil {
-		t.Fatal("expected compiled regex")
+	if prog, err := eng.compileFilter("alpha"); err != nil || prog == nil {
+		t.Fatalf("expected compiled filter: %v", err)
 	}
 	if _, ok := eng.filterCache["alpha"]; !ok {
 		t.Fatalf("expected cache entry")
 	}
 	// second call hits cache
-	if re := eng.getFilterRegex("alpha"); re == nil {
-		t.Fatal("expected cached regex")
+	if prog, err := eng.compileFilter("alpha"); err != nil || prog == nil {
+		t.Fatalf("expected cached filter: %v", err)
 	}
 }
 
@@ -124,3 +127,117 @@ func mustCompileFilters(t *testing.T, fns []string) []kvFilter {
 	}
 	return filters
 }
+
+func TestRouteFanOutHonorsFinal(t *testing.T) {
+	eng := NewMemoryEngine().(*memoryEngine)
+	eng.hub, _ = NewLogHub("")
+	built := map[string]*fakeOutput{}
+	eng.outputs.Register("fake", func(cfg map[string]interface{}) (outputs.Output, error) {
+		o := newFakeOutput()
+		built[cfg["name"].(string)] = o
+		return o, nil
+	})
+	destID := func(name string) string {
+		d, err := eng.CreateDestination(name, "fake", map[string]interface{}{"name": name})
+		if err != nil {
+			t.Fatalf("create destination: %v", err)
+		}
+		return d.(memDest).ID
+	}
+	archive, sentinel, other := destID("archive"), destID("sentinel"), destID("other")
+	eng.pipelines = []memPipe{
+		{ID: "p1", Name: "Archive"},
+		{ID: "p2", Name: "Critical", Functions: []string{"Parse Versa KVP", "filter:severity=critical"}, Filters: mustCompileFilters(t, []string{"filter:severity=critical"})},
+	}
+	eng.routes = []memRoute{
+		{ID: "r1", Name: "archive", Filter: "true", PipelineID: "p1", Destination: archive},
+		{ID: "r2", Name: "sentinel", Filter: "severity", PipelineID: "p2", Destination: sentinel, Final: true},
+		{ID: "r3", Name: "after-final", Filter: "true", PipelineID: "p1", Destination: other},
+	}
+
+	eng.processAndAppendBatch("src", []string{"severity=critical user=a", "severity=low user=b", "plain"})
+
+	if got := built["archive"].count(); got != 3 {
+		t.Fatalf("archive route should clone every event, got %d", got)
+	}
+	if got := built["sentinel"].count(); got != 1 {
+		t.Fatalf("sentinel pipeline should only pass critical events, got %d", got)
+	}
+	if got := built["other"].count(); got != 1 {
+		t.Fatalf("route after final should only see events the final route skipped, got %d", got)
+	}
+	if tail := eng.hub.Tail("src", 10); len(tail) != 3 {
+		t.Fatalf("expected one hub entry per event, got %d", len(tail))
+	}
+
+	stats := map[string]RouteStats{}
+	for _, s := range eng.GetRouteStats() {
+		stats[s.ID] = s
+	}
+	if s := stats["r1"]; s.Matched != 3 || s.Cloned != 3 || s.Delivered != 3 {
+		t.Fatalf("unexpected archive stats: %+v", s)
+	}
+	if s := stats["r2"]; s.Matched != 2 || s.Cloned != 0 || s.Filtered != 1 || s.Delivered != 1 {
+		t.Fatalf("unexpected sentinel stats: %+v", s)
+	}
+	if s := stats["r3"]; s.Matched != 1 {
+		t.Fatalf("unexpected after-final stats: %+v", s)
+	}
+}
+
+func TestRouteFilterExpressions(t *testing.T) {
+	eng := NewMemoryEngine().(*memoryEngine)
+	eng.hub, _ = NewLogHub("")
+	if _, err := eng.CreateRoute("bad", `severity === "high" &&`, "p1", "", true); err == nil || !strings.Contains(err.Error(), "position 23") {
+		t.Fatalf("expected compile error with position, got %v", err)
+	}
+	if _, err := eng.CreateRoute("legacy", `^\d+ CEF:`, "p1", "", true); err == nil {
+		t.Fatal("expected bare regex rejected without legacy mode")
+	}
+	eng.pipelines = []memPipe{{ID: "p1", Name: "P"}}
+	eng.routes = nil
+	for _, f := range []string{`_raw?.includes('CEF:')`, `event.severity_level_d >= 6 && cidr(src, "10.0.0.0/8")`} {
+		if _, err := eng.CreateRoute(f, f, "p1", "", true); err != nil {
+			t.Fatalf("create route %q: %v", f, err)
+		}
+	}
+	eng.processAndAppendBatch("src", []string{
+		"CEF:0|Vendor|Product|1",
+		"severity_level_d=7 src=10.2.3.4",
+		"severity_level_d=7 src=192.0.2.1",
+	})
+	stats := map[string]uint64{}
+	for _, s := range eng.GetRouteStats() {
+		stats[s.Name] = s.Matched
+	}
+	if stats[`_raw?.includes('CEF:')`] != 1 || stats[`event.severity_level_d >= 6 && cidr(src, "10.0.0.0/8")`] != 1 {
+		t.Fatalf("unexpected route matches: %v", stats)
+	}
+
+	legacy := withLegacyFilters(NewMemoryEngine()).(*memoryEngine)
+	if _, err := legacy.CreateRoute("legacy", `^\d+ CEF:`, "p1", "", true); err != nil {
+		t.Fatalf("legacy mode should accept regex filters: %v", err)
+	}
+}
+
+func TestSeededRoutesReachADLSAndDefault(t *testing.T) {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	srv := NewServer(cfg)
+	eng, _ := srv.engine()
+
+	routes := eng.GetRoutes()
+	if n := len(routes); n == 0 || routes[n-1].Name != "default" {
+		t.Fatalf("default route should be seeded last: %+v", routes)
+	}
+	eng.processAndAppend("src", "severity=low user=a")
+
+	matched := map[string]uint64{}
+	for _, s := range eng.GetRouteStats() {
+		matched[s.Name] = s.Matched
+	}
+	if matched["adls-all"] != 1 || matched["default"] != 1 {
+		t.Fatalf("event should reach adls-all and then default, got %v", matched)
+	}
+}
@@ -92,7 +92,7 @@ func (s *Server) handleLoadTestStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// The produced counter is now tracked internally; we expose a lightweight snapshot via a synthetic metric API on the engine when available.
-	if me, ok := s.pipeline.(*memoryEngine); ok {
+	if me, ok := s.engine(); ok {
 		// find source and read atomic counter
 		me.mu.RLock()
 		for _, ms := range me.sources {
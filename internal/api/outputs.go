@@ -0,0 +1,184 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"path/filepath"
+
+	"bibbl/internal/metrics"
+	"bibbl/pkg/outputs"
+	"bibbl/pkg/outputs/azuredataexplorer"
+	"bibbl/pkg/outputs/azuredatalake"
+	"bibbl/pkg/outputs/azureloganalytics"
+	"bibbl/pkg/outputs/azurelogsingestion"
+	"bibbl/pkg/outputs/elasticsearch"
+	"bibbl/pkg/outputs/file"
+	"bibbl/pkg/outputs/kafka"
+	"bibbl/pkg/outputs/loki"
+	"bibbl/pkg/outputs/otlplogs"
+	"bibbl/pkg/outputs/s3"
+	"bibbl/pkg/outputs/splunkhec"
+	"bibbl/pkg/outputs/sqldb"
+	"bibbl/pkg/outputs/syslog"
+	"bibbl/pkg/outputs/webhook"
+	"bibbl/pkg/pipeline"
+)
+
+// newOutputRegistry returns the destination types that have a running output
+// implementation. Destinations of other types are kept as configuration only.
+func newOutputRegistry() *outputs.Registry {
+	r := outputs.NewRegistry()
+	r.Register("azure_loganalytics", azureloganalytics.NewOutput)
+	r.Register("splunk_hec", splunkhec.NewOutput)
+	r.Register("elasticsearch", elasticsearch.NewOutput)
+	r.Register("http", webhook.NewOutput)
+	r.Register("azure_logs_ingestion", azurelogsingestion.NewOutput)
+	r.Register("azure_data_explorer", azuredataexplorer.NewOutput)
+	r.Register("s3", s3.NewOutput)
+	r.Register("azure_datalake", azuredatalake.NewOutput)
+	r.Register("syslog", syslog.NewOutput)
+	r.Register("kafka", kafka.NewOutput)
+	r.Register("file", file.NewOutput)
+	r.Register("loki", loki.NewOutput)
+	r.Register("otlp_logs", otlplogs.NewOutput)
+	r.Register("sql", sqldb.NewOutput)
+	return r
+}
+
+// withArchiveStaging gives archive outputs a staging directory per
+// destination under <dataDir>/staging, so objects that were not uploaded
+// yet survive a restart. A stagingDir in the destination config wins.
+func withArchiveStaging(p PipelineEngine, dataDir string) {
+	m, ok := p.(*memoryEngine)
+	if !ok || dataDir == "" {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.archiveDir = filepath.Join(dataDir, "staging")
+}
+
+// outputConfigLocked returns the config d's output is built from. Caller
+// holds m.mu.
+func (m *memoryEngine) outputConfigLocked(d *memDest) map[string]interface{} {
+	if m.archiveDir == "" {
+		return d.Config
+	}
+	if _, set := d.Config["stagingDir"]; set {
+		return d.Config
+	}
+	cfg := make(map[string]interface{}, len(d.Config)+1)
+	for k, v := range d.Config {
+		cfg[k] = v
+	}
+	cfg["stagingDir"] = filepath.Join(m.archiveDir, d.ID)
+	return cfg
+}
+
+// syncOutputLocked makes the running output for m.dests[i] match its current
+// config and enabled flag. The output it replaces (if any) is returned so the
+// caller can close it; Close flushes pending batches and may block on network
+// I/O, so callers hand it to closeOutput rather than closing under m.mu.
+func (m *memoryEngine) syncOutputLocked(i int) outputs.Output {
+	d := &m.dests[i]
+	old := d.output
+	d.output = nil
+	d.outputErr = ""
+	if !m.outputs.Has(d.Type) {
+		return old
+	}
+	if !d.Enabled {
+		d.Status = outputs.StatusDisconnected
+		return old
+	}
+	built, err := m.outputs.New(d.Type, m.outputConfigLocked(d))
+	if err != nil {
+		d.Status = outputs.StatusError
+		d.outputErr = err.Error()
+		log.Printf("destination %s (%s): output not started: %v", d.Name, d.ID, err)
+		return old
+	}
+	if dl, ok := built.(outputs.DeadLetterer); ok {
+		dl.SetDeadLetter(m.deadLetterFor(d.ID))
+	}
+	built = newBreakerOutput(d.ID, built, m.breakerLocked(d.ID))
+	out, err := m.queueOutputLocked(d, built, old)
+	if err != nil {
+		d.Status = outputs.StatusError
+		d.outputErr = err.Error()
+		log.Printf("destination %s (%s): queue not opened: %v", d.Name, d.ID, err)
+		closeOutput(d.ID, built)
+		return old
+	}
+	d.output = out
+	d.Status = out.Health().Status
+	return old
+}
+
+// closeOutput closes a replaced or deleted output in the background. A
+// queued output's pump is stopped right away, so it stops reading the queue
+// and publishing its metrics before the caller moves on; only the flush and
+// close of the output behind it happen in the background.
+func closeOutput(destID string, o outputs.Output) {
+	if o == nil {
+		return
+	}
+	if qo, ok := o.(*queuedOutput); ok {
+		qo.halt()
+	}
+	go func() {
+		if err := o.Close(); err != nil {
+			log.Printf("destination %s: output close: %v", destID, err)
+		}
+	}()
+}
+
+// outputSnapshotLocked returns destination ID -> running output. Caller holds m.mu.
+func (m *memoryEngine) outputSnapshotLocked() map[string]outputs.Output {
+	outs := make(map[string]outputs.Output, len(m.dests))
+	for _, d := range m.dests {
+		if d.output != nil {
+			outs[d.ID] = d.output
+		}
+	}
+	return outs
+}
+
+// deliver hands a processed payload to the output behind the route's destination.
+// Routes that point at destinations without a running output are a no-op.
+func (m *memoryEngine) deliver(outs map[string]outputs.Output, route memRoute, payload map[string]interface{}) {
+	out, ok := outs[route.Destination]
+	if !ok {
+		return
+	}
+	if err := out.Send(payload); err != nil {
+		if errors.Is(err, pipeline.ErrCircuitOpen) {
+			metrics.OutputEvents.WithLabelValues(route.Destination, "circuit_open").Inc()
+			return
+		}
+		metrics.OutputEvents.WithLabelValues(route.Destination, "error").Inc()
+		log.Printf("destination %s: send failed: %v", route.Destination, err)
+		return
+	}
+	metrics.OutputEvents.WithLabelValues(route.Destination, "accepted").Inc()
+}
+
+// closeOutputs flushes and closes every running output, then its queue.
+// Used on shutdown.
+func (m *memoryEngine) closeOutputs() {
+	m.mu.Lock()
+	running := make(map[string]outputs.Output)
+	for i := range m.dests {
+		if m.dests[i].output != nil {
+			running[m.dests[i].ID] = m.dests[i].output
+			m.dests[i].output = nil
+		}
+	}
+	m.mu.Unlock()
+	for id, o := range running {
+		if err := o.Close(); err != nil {
+			log.Printf("destination %s: output close: %v", id, err)
+		}
+	}
+	m.closeQueues()
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"bibbl/pkg/outputs"
+)
+
+type fakeOutput struct {
+	mu     sync.Mutex
+	events []map[string]interface{}
+	closed chan struct{}
+}
+
+func newFakeOutput() *fakeOutput { return &fakeOutput{closed: make(chan struct{})} }
+
+func (f *fakeOutput) Send(event map[string]interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, event)
+	return nil
+}
+func (f *fakeOutput) Flush() error { return nil }
+func (f *fakeOutput) Close() error { close(f.closed); return nil }
+func (f *fakeOutput) Health() outputs.Health {
+	return outputs.Health{Status: outputs.StatusConnected}
+}
+func (f *fakeOutput) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.events)
+}
+
+func TestRoutedEventsReachOutput(t *testing.T) {
+	eng := NewMemoryEngine().(*memoryEngine)
+	eng.hub, _ = NewLogHub("")
+	var built []*fakeOutput
+	eng.outputs.Register("fake", func(cfg map[string]interface{}) (outputs.Output, error) {
+		o := newFakeOutput()
+		built = append(built, o)
+		return o, nil
+	})
+	created, err := eng.CreateDestination("Fake", "fake", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("create destination: %v", err)
+	}
+	destID := created.(memDest).ID
+	eng.pipelines = []memPipe{{ID: "p1", Name: "P"}}
+	eng.routes = []memRoute{{ID: "r1", Name: "all", Filter: "true", PipelineID: "p1", Destination: destID, Final: true}}
+
+	eng.processAndAppendBatch("src", []string{"one", "two"})
+	if len(built) != 1 || built[0].count() != 2 {
+		t.Fatalf("expected 2 events delivered to one output, got %d outputs", len(built))
+	}
+	if got := eng.GetDestinations()[0].Status; got != outputs.StatusConnected {
+		t.Fatalf("expected status from output health, got %q", got)
+	}
+
+	if err := eng.PatchDestination(destID, map[string]interface{}{"enabled": false}); err != nil {
+		t.Fatalf("disable: %v", err)
+	}
+	select {
+	case <-built[0].closed:
+	case <-time.After(time.Second):
+		t.Fatal("expected output closed after disable")
+	}
+	eng.processAndAppendBatch("src", []string{"three"})
+	if built[0].count() != 2 {
+		t.Fatalf("disabled destination should not receive events")
+	}
+
+	if err := eng.PatchDestination(destID, map[string]interface{}{"enabled": true}); err != nil {
+		t.Fatalf("enable: %v", err)
+	}
+	if len(built) != 2 {
+		t.Fatalf("expected a fresh output on re-enable, got %d", len(built))
+	}
+}
+
+func TestOutputStartFailureMarksError(t *testing.T) {
+	eng := NewMemoryEngine().(*memoryEngine)
+	if _, err := eng.CreateDestination("LA", "azure_loganalytics", map[string]interface{}{"logType": "X"}); err != nil {
+		t.Fatalf("create destination: %v", err)
+	}
+	d := eng.dests[0]
+	if d.output != nil || d.Status != outputs.StatusError || d.outputErr == "" {
+		t.Fatalf("expected error status without workspaceID, got %q (%q)", d.Status, d.outputErr)
+	}
+}
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+
+	"bibbl/internal/metrics"
+)
+
+// pipelinesDirStateFile records, under storage.data_dir, which objects the
+// directory declared, so files deleted while the server is down are still
+// pruned on the next start.
+const pipelinesDirStateFile = "pipelines_dir.json"
+
+// reloadDebounce coalesces the bursts of events editors and `git pull`
+// produce for a single logical change.
+const reloadDebounce = 250 * time.Millisecond
+
+// pipelinesFile is one YAML file in the pipelines directory. It uses the
+// config export layout; sources are not managed from the directory.
+type pipelinesFile struct {
+	APIVersion   string              `yaml:"apiVersion"`
+	Pipelines    []ConfigPipeline    `yaml:"pipelines"`
+	Routes       []ConfigRoute       `yaml:"routes"`
+	Destinations []ConfigDestination `yaml:"destinations"`
+}
+
+// pipelinesDirWatcher reconciles the YAML files in a directory into the
+// engine. Objects are matched by ID: declared ones are created or updated in
+// place, and ones a previous reload declared but no file declares any more are
+// deleted. Everything else (API-managed objects, sources) is left alone.
+//
+// Files are applied to the live engine straight away, even with staged change
+// control: they are reviewed where they are versioned. draft, when set, gets
+// the same reconcile so a later commit of API edits does not revert them.
+type pipelinesDirWatcher struct {
+	dir     string
+	engine  PipelineEngine
+	draft   PipelineEngine
+	state   string // managed IDs file; "" = memory only
+	audit   func(event string, meta map[string]any)
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	managed map[string]map[string]bool // kind -> IDs declared by the last successful reload
+}
+
+func newPipelinesDirWatcher(dir string, engine PipelineEngine, audit func(string, map[string]any)) *pipelinesDirWatcher {
+	return &pipelinesDirWatcher{dir: dir, engine: engine, audit: audit, done: make(chan struct{}), managed: map[string]map[string]bool{}}
+}
+
+// Start loads the directory once and then watches it for changes.
+func (w *pipelinesDirWatcher) Start() error {
+	if err := os.MkdirAll(w.dir, 0o755); err != nil {
+		return fmt.Errorf("create pipelines dir: %w", err)
+	}
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watch pipelines dir: %w", err)
+	}
+	if err := fw.Add(w.dir); err != nil {
+		fw.Close()
+		return fmt.Errorf("watch pipelines dir: %w", err)
+	}
+	w.watcher = fw
+	w.loadManaged()
+	w.reloadAndRecord()
+	w.wg.Add(1)
+	go w.run()
+	return nil
+}
+
+// Close stops watching. It is safe to call on a watcher that never started.
+func (w *pipelinesDirWatcher) Close() {
+	if w.watcher == nil {
+		return
+	}
+	select {
+	case <-w.done:
+		return
+	default:
+		close(w.done)
+	}
+	_ = w.watcher.Close()
+	w.wg.Wait()
+}
+
+func (w *pipelinesDirWatcher) run() {
+	defer w.wg.Done()
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+	for {
+		select {
+		case <-w.done:
+			debounce.Stop()
+			return
+		case ev, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if isPipelinesFile(ev.Name) {
+				debounce.Reset(reloadDebounce)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("pipelines dir %s: watch error: %v", w.dir, err)
+		case <-debounce.C:
+			w.reloadAndRecord()
+		}
+	}
+}
+
+func isPipelinesFile(name string) bool {
+	base := filepath.Base(name)
+	if strings.HasPrefix(base, ".") {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(base))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// reloadAndRecord runs one reload and records its outcome in the
+// config_reloads_total metric and the audit log.
+func (w *pipelinesDirWatcher) reloadAndRecord() {
+	files, res, err := w.reload()
+	meta := map[string]any{"dir": w.dir, "files": files, "changes": len(res.Changes)}
+	status := "success"
+	if err != nil {
+		status = "failure"
+		meta["error"] = err.Error()
+		var verr *ConfigValidationError
+		if errors.As(err, &verr) {
+			meta["problems"] = verr.Problems
+		}
+		log.Printf("pipelines dir %s: reload failed, keeping running configuration: %v", w.dir, err)
+	} else if len(res.Changes) > 0 {
+		log.Printf("pipelines dir %s: applied %d change(s) from %d file(s)", w.dir, len(res.Changes), len(files))
+	}
+	for _, warn := range res.Warnings {
+		log.Printf("pipelines dir %s: %s", w.dir, warn)
+	}
+	meta["status"] = status
+	metrics.ConfigReloads.WithLabelValues(status).Inc()
+	if w.audit != nil {
+		w.audit("config_reload", meta)
+	}
+}
+
+// reload reads every definition file and applies them in one atomic import.
+// On error the engine is left untouched.
+func (w *pipelinesDirWatcher) reload() ([]string, ConfigImportResult, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	files, declared, err := readPipelinesDir(w.dir)
+	if err != nil {
+		return files, ConfigImportResult{}, err
+	}
+	res, err := w.engine.ImportConfig(w.reconcile(w.engine.ExportConfig(), declared), false)
+	if err != nil {
+		return files, res, err
+	}
+	if w.draft != nil {
+		if _, err := w.draft.ImportConfig(w.reconcile(w.draft.ExportConfig(), declared), false); err != nil {
+			res.Warnings = append(res.Warnings, fmt.Sprintf("applied to live but not to the staged draft: %v", err))
+		}
+	}
+	w.managed = map[string]map[string]bool{
+		"pipeline":    idSet(declared.Pipelines, func(p ConfigPipeline) string { return p.ID }),
+		"route":       idSet(declared.Routes, func(r ConfigRoute) string { return r.ID }),
+		"destination": idSet(declared.Destinations, func(d ConfigDestination) string { return d.ID }),
+	}
+	w.saveManaged()
+	return files, res, nil
+}
+
+// loadManaged restores the IDs the last run's directory declared. A missing
+// or unreadable file leaves the set empty: nothing is pruned that was not
+// seen declared.
+func (w *pipelinesDirWatcher) loadManaged() {
+	if w.state == "" {
+		return
+	}
+	data, err := os.ReadFile(w.state)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var ids map[string][]string
+	if err == nil {
+		err = json.Unmarshal(data, &ids)
+	}
+	if err != nil {
+		log.Printf("pipelines dir %s: managed objects not restored: %v", w.dir, err)
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for kind, list := range ids {
+		w.managed[kind] = idSet(list, func(id string) string { return id })
+	}
+}
+
+// saveManaged writes the managed IDs. Caller holds w.mu.
+func (w *pipelinesDirWatcher) saveManaged() {
+	if w.state == "" {
+		return
+	}
+	ids := map[string][]string{}
+	for kind, set := range w.managed {
+		list := make([]string, 0, len(set))
+		for id := range set {
+			list = append(list, id)
+		}
+		sort.Strings(list)
+		ids[kind] = list
+	}
+	data, err := json.MarshalIndent(ids, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(w.state, data)
+	}
+	if err != nil {
+		log.Printf("pipelines dir %s: record managed objects: %v", w.dir, err)
+	}
+}
+
+// reconcile merges the declared objects into doc, dropping ones the previous
+// reload declared that no file declares any more.
+func (w *pipelinesDirWatcher) reconcile(doc ConfigDocument, declared pipelinesFile) ConfigDocument {
+	doc.Pipelines = reconcileObjects(doc.Pipelines, declared.Pipelines, w.managed["pipeline"], func(p ConfigPipeline) string { return p.ID })
+	doc.Routes = reconcileObjects(doc.Routes, declared.Routes, w.managed["route"], func(r ConfigRoute) string { return r.ID })
+	doc.Destinations = reconcileObjects(doc.Destinations, declared.Destinations, w.managed["destination"], func(d ConfigDestination) string { return d.ID })
+	return doc
+}
+
+// readPipelinesDir decodes the definition files in name order and merges them.
+// Every object needs an ID, unique across all files, so that a reload updates
+// it in place instead of creating a copy.
+func readPipelinesDir(dir string) ([]string, pipelinesFile, error) {
+	var merged pipelinesFile
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, merged, fmt.Errorf("read pipelines dir: %w", err)
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && isPipelinesFile(e.Name()) {
+			files = append(files, e.Name())
+		}
+	}
+	sort.Strings(files)
+
+	var problems []string
+	seen := map[string]string{} // kind/id -> file
+	claim := func(file, kind, id, name string) {
+		if id == "" {
+			problems = append(problems, fmt.Sprintf("%s: %s %q has no id", file, kind, name))
+			return
+		}
+		key := kind + "/" + id
+		if prev, ok := seen[key]; ok {
+			problems = append(problems, fmt.Sprintf("%s: %s id %q already declared in %s", file, kind, id, prev))
+			return
+		}
+		seen[key] = file
+	}
+	for _, name := range files {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return files, merged, fmt.Errorf("read %s: %w", name, err)
+		}
+		var f pipelinesFile
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		if f.APIVersion != "" && f.APIVersion != configAPIVersion {
+			problems = append(problems, fmt.Sprintf("%s: apiVersion %q is not supported (want %q)", name, f.APIVersion, configAPIVersion))
+		}
+		for _, p := range f.Pipelines {
+			claim(name, "pipeline", p.ID, p.Name)
+		}
+		for _, r := range f.Routes {
+			claim(name, "route", r.ID, r.Name)
+		}
+		for _, d := range f.Destinations {
+			claim(name, "destination", d.ID, d.Name)
+		}
+		merged.Pipelines = append(merged.Pipelines, f.Pipelines...)
+		merged.Routes = append(merged.Routes, f.Routes...)
+		merged.Destinations = append(merged.Destinations, f.Destinations...)
+	}
+	if len(problems) > 0 {
+		return files, merged, &ConfigValidationError{Problems: problems}
+	}
+	return files, merged, nil
+}
+
+// reconcileObjects replaces live objects with their declared versions in
+// place, drops objects that were previously declared but no longer are, and
+// appends newly declared ones.
+func reconcileObjects[T any](live, declared []T, prevManaged map[string]bool, id func(T) string) []T {
+	byID := make(map[string]T, len(declared))
+	for _, d := range declared {
+		byID[id(d)] = d
+	}
+	out := make([]T, 0, len(live)+len(declared))
+	placed := map[string]bool{}
+	for _, obj := range live {
+		if d, ok := byID[id(obj)]; ok {
+			out = append(out, d)
+			placed[id(obj)] = true
+			continue
+		}
+		if prevManaged[id(obj)] {
+			continue
+		}
+		out = append(out, obj)
+	}
+	for _, d := range declared {
+		if !placed[id(d)] {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+func idSet[T any](objs []T, id func(T) string) map[string]bool {
+	set := make(map[string]bool, len(objs))
+	for _, o := range objs {
+		set[id(o)] = true
+	}
+	return set
+}
@@ -0,0 +1,153 @@
+package api
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bibbl/internal/config"
+)
+
+const edgeRoutesYAML = `apiVersion: bibbl/v1
+pipelines:
+  - id: pipe-edge
+    name: Edge
+    functions: ["filter:severity=high"]
+routes:
+  - id: route-edge
+    name: edge-high
+    filter: severity == "high"
+    pipelineId: pipe-edge
+    final: true
+`
+
+func findRoute(eng PipelineEngine, id string) (string, bool) {
+	for _, r := range eng.GetRoutes() {
+		if r.ID == id {
+			return r.Filter, true
+		}
+	}
+	return "", false
+}
+
+func TestPipelinesDirReconcile(t *testing.T) {
+	dir := t.TempDir()
+	eng := NewMemoryEngine()
+	p, _ := eng.CreatePipeline("API", "", nil)
+	if _, err := eng.CreateRoute("api-route", "true", p.(memPipe).ID, "", false); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+	var audited []map[string]any
+	w := newPipelinesDirWatcher(dir, eng, func(event string, meta map[string]any) { audited = append(audited, meta) })
+
+	path := filepath.Join(dir, "edge.yaml")
+	if err := os.WriteFile(path, []byte(edgeRoutesYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w.reloadAndRecord()
+	if f, ok := findRoute(eng, "route-edge"); !ok || f != `severity == "high"` {
+		t.Fatalf("declared route not loaded: %v", eng.GetRoutes())
+	}
+
+	// A broken file is rejected and the running configuration kept.
+	if err := os.WriteFile(path, []byte(edgeRoutesYAML+"    bogus: 1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w.reloadAndRecord()
+	if _, ok := findRoute(eng, "route-edge"); !ok {
+		t.Fatal("failed reload must not remove the route")
+	}
+	if len(audited) != 2 || audited[0]["status"] != "success" || audited[1]["status"] != "failure" {
+		t.Fatalf("unexpected audit entries: %v", audited)
+	}
+
+	// Removing the file deletes what it declared but nothing else.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	w.reloadAndRecord()
+	if _, ok := findRoute(eng, "route-edge"); ok {
+		t.Fatal("route from removed file should be deleted")
+	}
+	routes := eng.GetRoutes()
+	if len(routes) != 1 || routes[0].Name != "api-route" {
+		t.Fatalf("API-managed route should survive, got %v", routes)
+	}
+}
+
+func TestPipelinesDirPrunesFilesRemovedWhileDown(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(t.TempDir(), pipelinesDirStateFile)
+	eng := NewMemoryEngine()
+	w := newPipelinesDirWatcher(dir, eng, nil)
+	w.state = state
+	path := filepath.Join(dir, "edge.yaml")
+	if err := os.WriteFile(path, []byte(edgeRoutesYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w.reloadAndRecord()
+	if _, ok := findRoute(eng, "route-edge"); !ok {
+		t.Fatal("declared route not loaded")
+	}
+
+	// The file goes away while nothing is watching; a new watcher over the
+	// same engine state must still know the route came from the directory.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newPipelinesDirWatcher(dir, eng, nil)
+	restarted.state = state
+	if err := restarted.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if _, ok := findRoute(eng, "route-edge"); ok {
+		t.Fatal("route from a file removed while down should be pruned on start")
+	}
+}
+
+func TestPipelinesDirWatch(t *testing.T) {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Routing.PipelinesDir = t.TempDir()
+	srv := NewServer(cfg)
+	defer srv.pipelinesDir.Close()
+
+	if err := os.WriteFile(filepath.Join(cfg.Routing.PipelinesDir, "edge.yml"), []byte(edgeRoutesYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := findRoute(srv.pipeline, "route-edge"); ok {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("route from new file was not picked up by the watcher")
+}
+
+func TestPipelinesDirAppliesToLiveWhenStaged(t *testing.T) {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Changes.Staged = true
+	cfg.Routing.PipelinesDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(cfg.Routing.PipelinesDir, "edge.yaml"), []byte(edgeRoutesYAML), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(cfg)
+	defer srv.pipelinesDir.Close()
+
+	live, _ := srv.engine()
+	if _, ok := findRoute(live, "route-edge"); !ok {
+		t.Fatal("directory route should be live without a commit")
+	}
+	if _, ok := findRoute(srv.pipeline, "route-edge"); !ok {
+		t.Fatal("directory route should be mirrored into the draft")
+	}
+	if changes, err := srv.changes.pending(); err != nil || len(changes) != 0 {
+		t.Fatalf("directory reload should leave nothing pending, got %v %v", changes, err)
+	}
+}
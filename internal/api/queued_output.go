@@ -0,0 +1,391 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bibbl/internal/config"
+	"bibbl/internal/metrics"
+	"bibbl/pkg/outputs"
+	"bibbl/pkg/pipeline"
+	"bibbl/pkg/queue"
+	"bibbl/pkg/seal"
+)
+
+const (
+	queueBatchSize    = 500
+	queuePollInterval = time.Second
+	queueRetryMin     = time.Second
+	queueRetryMax     = 30 * time.Second
+)
+
+// queueSettings are the engine-wide defaults for destination disk queues.
+type queueSettings struct {
+	dir      string // parent directory; each destination gets <dir>/<id>
+	defaults queue.DiskConfig
+}
+
+// destQueueOverride is the optional "queue" block of a destination config.
+type destQueueOverride struct {
+	Enabled         *bool  `json:"enabled"`
+	MaxBytes        int64  `json:"maxBytes"`
+	SegmentBytes    int64  `json:"segmentBytes"`
+	FullPolicy      string `json:"fullPolicy"`
+	BlockTimeoutSec int    `json:"blockTimeoutSec"`
+}
+
+// withQueues puts a durable disk queue in front of every destination output.
+// Queues live under cfg.Directory, or <dataDir>/queues when that is empty.
+func withQueues(p PipelineEngine, cfg config.QueueConfig, dataDir string) error {
+	m, ok := p.(*memoryEngine)
+	if !ok || !cfg.Enabled {
+		return nil
+	}
+	dir := cfg.Directory
+	if dir == "" {
+		if dataDir == "" {
+			return nil
+		}
+		dir = filepath.Join(dataDir, "queues")
+	}
+	policy, err := queue.ParsePolicy(cfg.FullPolicy)
+	if err != nil {
+		return err
+	}
+	// Never fall back to plaintext: without a usable key there are no queues.
+	var keys *seal.Keyring
+	if cfg.Encrypt {
+		if keys, err = seal.FromEnv(cfg.KeyEnv); err != nil {
+			return fmt.Errorf("queue encryption: %w", err)
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queueCfg = &queueSettings{dir: dir, defaults: queue.DiskConfig{
+		MaxBytes:       cfg.MaxBytes,
+		SegmentBytes:   cfg.SegmentBytes,
+		Policy:         policy,
+		BlockTimeout:   cfg.BlockTimeout,
+		Keys:           keys,
+		AllowPlaintext: cfg.AllowPlaintext,
+	}}
+	m.queues = map[string]*queue.DiskQueue{}
+	return nil
+}
+
+// queueConfigLocked resolves the queue settings for a destination. Caller holds m.mu.
+func (m *memoryEngine) queueConfigLocked(d *memDest) (queue.DiskConfig, bool, error) {
+	if m.queueCfg == nil {
+		return queue.DiskConfig{}, false, nil
+	}
+	qc := m.queueCfg.defaults
+	dir, err := childPath(m.queueCfg.dir, d.ID)
+	if err != nil {
+		return qc, false, fmt.Errorf("queue dir: %w", err)
+	}
+	qc.Dir = dir
+	var wrapper struct {
+		Queue destQueueOverride `json:"queue"`
+	}
+	if err := outputs.DecodeConfig(d.Config, &wrapper); err != nil {
+		return qc, false, fmt.Errorf("queue config: %w", err)
+	}
+	o := wrapper.Queue
+	if o.Enabled != nil && !*o.Enabled {
+		return qc, false, nil
+	}
+	if o.MaxBytes > 0 {
+		qc.MaxBytes = o.MaxBytes
+	}
+	if o.SegmentBytes > 0 {
+		qc.SegmentBytes = o.SegmentBytes
+	}
+	if o.FullPolicy != "" {
+		policy, err := queue.ParsePolicy(o.FullPolicy)
+		if err != nil {
+			return qc, false, err
+		}
+		qc.Policy = policy
+	}
+	if o.BlockTimeoutSec > 0 {
+		qc.BlockTimeout = time.Duration(o.BlockTimeoutSec) * time.Second
+	}
+	return qc, true, nil
+}
+
+// queueOutputLocked wraps out in the destination's disk queue when queues
+// are enabled for it. The queue outlives output rebuilds so a config change
+// does not lose what is still waiting; prev is the output being replaced,
+// whose pump must exit before the new one reads the shared queue. Caller
+// holds m.mu.
+func (m *memoryEngine) queueOutputLocked(d *memDest, out, prev outputs.Output) (outputs.Output, error) {
+	qc, enabled, err := m.queueConfigLocked(d)
+	if err != nil {
+		return nil, err
+	}
+	if !enabled {
+		m.closeQueueLocked(d.ID)
+		return out, nil
+	}
+	q := m.queues[d.ID]
+	if q != nil {
+		q.Reconfigure(qc)
+	} else {
+		if q, err = queue.OpenDisk(qc); err != nil {
+			return nil, err
+		}
+		m.queues[d.ID] = q
+	}
+	var after <-chan struct{}
+	if p, ok := prev.(*queuedOutput); ok && p.q == q {
+		p.halt()
+		after = p.done
+	}
+	return newQueuedOutput(d.ID, out, q, m.deadLetterFor(d.ID), after), nil
+}
+
+// closeQueueLocked closes a destination's queue, keeping its files.
+func (m *memoryEngine) closeQueueLocked(id string) {
+	q, ok := m.queues[id]
+	if !ok {
+		return
+	}
+	delete(m.queues, id)
+	if err := q.Close(); err != nil {
+		log.Printf("destination %s: close queue: %v", id, err)
+	}
+}
+
+// dropQueueLocked closes a deleted destination's queue and removes its files;
+// nothing can drain them any more.
+func (m *memoryEngine) dropQueueLocked(id string) {
+	if m.queueCfg == nil {
+		return
+	}
+	m.closeQueueLocked(id)
+	if dir, err := childPath(m.queueCfg.dir, id); err != nil {
+		log.Printf("destination %s: queue not removed: %v", id, err)
+	} else if err := os.RemoveAll(dir); err != nil {
+		log.Printf("destination %s: remove queue: %v", id, err)
+	}
+	metrics.QueueDepth.DeleteLabelValues(id)
+	metrics.QueueBytes.DeleteLabelValues(id)
+	metrics.QueueOldestAge.DeleteLabelValues(id)
+}
+
+// closeQueues closes every open queue. Used on shutdown after the outputs.
+func (m *memoryEngine) closeQueues() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id := range m.queues {
+		m.closeQueueLocked(id)
+	}
+}
+
+// queuedOutput puts a durable disk queue in front of an output. Send only
+// appends to the queue; a pump goroutine reads batches, hands them to the
+// output and commits the queue cursor once the output has acknowledged them,
+// or has rejected them for good and they went to the dead-letter store.
+// The queue has one consumer: when an output is rebuilt, the new pump waits
+// for the old one to finish its batch in flight and exit.
+type queuedOutput struct {
+	destID     string
+	inner      outputs.Output
+	q          *queue.DiskQueue
+	deadLetter outputs.DeadLetterFunc
+	wake       chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+	done       chan struct{}
+
+	mu           sync.Mutex
+	halted       bool // no more metrics once stopped; a delete removes them
+	lastDropped  uint64
+	lastCorrupt  uint64
+	lastTampered uint64
+}
+
+func newQueuedOutput(destID string, inner outputs.Output, q *queue.DiskQueue, deadLetter outputs.DeadLetterFunc, after <-chan struct{}) *queuedOutput {
+	o := &queuedOutput{
+		destID:     destID,
+		inner:      inner,
+		q:          q,
+		deadLetter: deadLetter,
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	st := q.Stats()
+	o.lastDropped, o.lastCorrupt, o.lastTampered = st.Dropped, st.Corrupt, st.Tampered
+	go o.pump(after)
+	return o
+}
+
+func (o *queuedOutput) Send(event map[string]interface{}) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+	if err := o.q.Append(data, time.Now()); err != nil {
+		o.publish()
+		return err
+	}
+	o.signal()
+	return nil
+}
+
+func (o *queuedOutput) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Flush nudges the pump; queued events are delivered in the background.
+func (o *queuedOutput) Flush() error {
+	o.signal()
+	return nil
+}
+
+// halt tells the pump to exit after the batch in flight and stops metric
+// updates. It does not wait; done is closed once the pump has exited.
+func (o *queuedOutput) halt() {
+	o.stopOnce.Do(func() { close(o.stop) })
+	o.mu.Lock()
+	o.halted = true
+	o.mu.Unlock()
+}
+
+// Close stops the pump after the batch in flight and closes the output.
+// Undelivered events stay in the queue.
+func (o *queuedOutput) Close() error {
+	o.halt()
+	<-o.done
+	return o.inner.Close()
+}
+
+func (o *queuedOutput) Health() outputs.Health { return o.inner.Health() }
+
+// pump starts once after is closed, the previous pump on the same queue.
+func (o *queuedOutput) pump(after <-chan struct{}) {
+	defer close(o.done)
+	if after != nil {
+		select {
+		case <-after:
+		case <-o.stop:
+			return
+		}
+	}
+	var backoff time.Duration
+	for {
+		select {
+		case <-o.stop:
+			return
+		default:
+		}
+		o.publish()
+		items, cur, err := o.q.Read(queueBatchSize)
+		if errors.Is(err, queue.ErrClosed) {
+			return
+		}
+		if err == nil && len(items) > 0 {
+			if err = o.deliver(items); err == nil {
+				backoff = 0
+				if err := o.q.Commit(cur); err != nil && !errors.Is(err, queue.ErrStaleCursor) && !errors.Is(err, queue.ErrClosed) {
+					log.Printf("destination %s: commit queue: %v", o.destID, err)
+				}
+				continue
+			}
+			if !errors.Is(err, pipeline.ErrCircuitOpen) {
+				log.Printf("destination %s: delivery failed, %d events stay queued: %v", o.destID, len(items), err)
+			}
+		} else if err != nil {
+			log.Printf("destination %s: read queue: %v", o.destID, err)
+		}
+		if err != nil {
+			// An open circuit rejects without touching the destination, so
+			// poll it rather than backing off past its trial window.
+			wait := queuePollInterval
+			if !errors.Is(err, pipeline.ErrCircuitOpen) {
+				backoff = min(max(backoff*2, queueRetryMin), queueRetryMax)
+				wait = backoff
+			}
+			select {
+			case <-o.stop:
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		select {
+		case <-o.stop:
+			return
+		case <-o.wake:
+		case <-time.After(queuePollInterval):
+		}
+	}
+}
+
+// deliver hands a batch to the output and reports whether it was acknowledged.
+// Outputs without a synchronous batch API count as acknowledged once Flush
+// succeeds. A batch the destination rejected for good is dead-lettered and
+// counts as handled, so it does not block the queue behind it.
+func (o *queuedOutput) deliver(items []queue.Item) error {
+	events := make([]map[string]interface{}, 0, len(items))
+	for _, it := range items {
+		var ev map[string]interface{}
+		if err := json.Unmarshal(it.Data, &ev); err != nil {
+			log.Printf("destination %s: skipping undecodable queued event: %v", o.destID, err)
+			continue
+		}
+		events = append(events, ev)
+	}
+	if bs, ok := o.inner.(outputs.BatchSender); ok {
+		err := bs.SendBatch(events)
+		if _, permanent := outputs.IsPermanent(err); permanent && o.deadLetter != nil {
+			o.deadLetter(events, err)
+			return nil
+		}
+		return err
+	}
+	for _, ev := range events {
+		if err := o.inner.Send(ev); err != nil {
+			return err
+		}
+	}
+	return o.inner.Flush()
+}
+
+// publish exports the queue's depth, size, age and drop counters, unless
+// the output was stopped.
+func (o *queuedOutput) publish() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.halted {
+		return
+	}
+	st := o.q.Stats()
+	metrics.QueueDepth.WithLabelValues(o.destID).Set(float64(st.Depth))
+	metrics.QueueBytes.WithLabelValues(o.destID).Set(float64(st.Bytes))
+	age := 0.0
+	if st.OldestUnix > 0 {
+		age = time.Since(time.Unix(st.OldestUnix, 0)).Seconds()
+	}
+	metrics.QueueOldestAge.WithLabelValues(o.destID).Set(age)
+	if st.Dropped > o.lastDropped {
+		metrics.QueueDropped.WithLabelValues(o.destID, "full").Add(float64(st.Dropped - o.lastDropped))
+	}
+	if st.Corrupt > o.lastCorrupt {
+		metrics.QueueDropped.WithLabelValues(o.destID, "corrupt").Add(float64(st.Corrupt - o.lastCorrupt))
+	}
+	if st.Tampered > o.lastTampered {
+		metrics.QueueDropped.WithLabelValues(o.destID, "tampered").Add(float64(st.Tampered - o.lastTampered))
+	}
+	o.lastDropped, o.lastCorrupt, o.lastTampered = st.Dropped, st.Corrupt, st.Tampered
+}
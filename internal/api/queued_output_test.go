@@ -0,0 +1,220 @@
+package api
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"bibbl/internal/config"
+	"bibbl/internal/metrics"
+	"bibbl/pkg/outputs"
+)
+
+// batchOutput acknowledges batches only while up is set.
+type batchOutput struct {
+	*fakeOutput
+	mu sync.Mutex
+	up bool
+}
+
+func (b *batchOutput) SendBatch(events []map[string]interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.up {
+		return errors.New("endpoint unavailable")
+	}
+	for _, ev := range events {
+		_ = b.fakeOutput.Send(ev)
+	}
+	return nil
+}
+
+func newQueuedTestEngine(t *testing.T, dataDir string, out *batchOutput) (*memoryEngine, string) {
+	t.Helper()
+	eng := NewMemoryEngine().(*memoryEngine)
+	eng.hub, _ = NewLogHub("")
+	if err := withQueues(eng, config.QueueConfig{Enabled: true, FullPolicy: "block"}, dataDir); err != nil {
+		t.Fatalf("queues: %v", err)
+	}
+	eng.outputs.Register("batch", func(cfg map[string]interface{}) (outputs.Output, error) { return out, nil })
+	created, err := eng.CreateDestination("Batch", "batch", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("create destination: %v", err)
+	}
+	destID := created.(memDest).ID
+	eng.pipelines = []memPipe{{ID: "p1", Name: "P"}}
+	eng.routes = []memRoute{{ID: "r1", Name: "all", Filter: "true", PipelineID: "p1", Destination: destID, Final: true}}
+	return eng, destID
+}
+
+func TestQueuedOutputSurvivesOutageAndRestart(t *testing.T) {
+	dataDir := t.TempDir()
+	down := &batchOutput{fakeOutput: newFakeOutput()}
+	eng, destID := newQueuedTestEngine(t, dataDir, down)
+	eng.processAndAppendBatch("src", []string{"one", "two", "three"})
+	if depth := eng.queues[destID].Stats().Depth; depth != 3 {
+		t.Fatalf("expected 3 queued events while the endpoint is down, got %d", depth)
+	}
+	eng.closeOutputs()
+	if down.count() != 0 {
+		t.Fatal("nothing should be acknowledged while the endpoint is down")
+	}
+
+	// Restart with the same data dir: the queued events are replayed.
+	up := &batchOutput{fakeOutput: newFakeOutput(), up: true}
+	eng, destID = newQueuedTestEngine(t, dataDir, up)
+	defer eng.closeOutputs()
+	deadline := time.Now().Add(3 * time.Second)
+	for up.count() < 3 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if up.count() != 3 {
+		t.Fatalf("expected 3 replayed events, got %d", up.count())
+	}
+	for eng.queues[destID].Stats().Depth != 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if depth := eng.queues[destID].Stats().Depth; depth != 0 {
+		t.Fatalf("expected queue drained after acknowledgement, got depth %d", depth)
+	}
+
+	if err := eng.DeleteDestination(destID); err != nil {
+		t.Fatalf("delete destination: %v", err)
+	}
+	if _, ok := eng.queues[destID]; ok {
+		t.Fatal("deleted destination should drop its queue")
+	}
+}
+
+// gatedOutput holds its first batch until release is closed.
+type gatedOutput struct {
+	*fakeOutput
+	first   *sync.Once
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedOutput) SendBatch(events []map[string]interface{}) error {
+	g.first.Do(func() {
+		close(g.entered)
+		<-g.release
+	})
+	for _, ev := range events {
+		_ = g.fakeOutput.Send(ev)
+	}
+	return nil
+}
+
+func TestRebuildWaitsForPumpInFlight(t *testing.T) {
+	eng := NewMemoryEngine().(*memoryEngine)
+	eng.hub, _ = NewLogHub("")
+	if err := withQueues(eng, config.QueueConfig{Enabled: true}, t.TempDir()); err != nil {
+		t.Fatalf("queues: %v", err)
+	}
+	gate := &gatedOutput{first: &sync.Once{}, entered: make(chan struct{}), release: make(chan struct{})}
+	var mu sync.Mutex
+	var built []*gatedOutput
+	eng.outputs.Register("gated", func(cfg map[string]interface{}) (outputs.Output, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		o := &gatedOutput{fakeOutput: newFakeOutput(), first: gate.first, entered: gate.entered, release: gate.release}
+		built = append(built, o)
+		return o, nil
+	})
+	created, err := eng.CreateDestination("Gated", "gated", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("create destination: %v", err)
+	}
+	destID := created.(memDest).ID
+	defer eng.closeOutputs()
+	eng.pipelines = []memPipe{{ID: "p1", Name: "P"}}
+	eng.routes = []memRoute{{ID: "r1", Name: "all", Filter: "true", PipelineID: "p1", Destination: destID, Final: true}}
+	eng.processAndAppendBatch("src", []string{"one", "two", "three"})
+	<-gate.entered
+
+	// The rebuilt output must not read the batch the old pump still holds.
+	if err := eng.UpdateDestination(destID, "Gated", map[string]interface{}{"v": 2}); err != nil {
+		t.Fatalf("update destination: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if n := built[1].count(); n != 0 {
+		t.Fatalf("new pump delivered %d events while the old one was in flight", n)
+	}
+	close(gate.release)
+	deadline := time.Now().Add(3 * time.Second)
+	for eng.queues[destID].Stats().Depth != 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if a, b := built[0].count(), built[1].count(); a+b != 3 {
+		t.Fatalf("expected each event delivered once, got %d + %d", a, b)
+	}
+}
+
+func TestQueueOpenErrorClosesBuiltOutput(t *testing.T) {
+	eng := NewMemoryEngine().(*memoryEngine)
+	eng.hub, _ = NewLogHub("")
+	if err := withQueues(eng, config.QueueConfig{Enabled: true}, t.TempDir()); err != nil {
+		t.Fatalf("queues: %v", err)
+	}
+	out := newFakeOutput()
+	eng.outputs.Register("fake", func(cfg map[string]interface{}) (outputs.Output, error) { return out, nil })
+	created, _ := eng.CreateDestination("Fake", "fake", map[string]interface{}{"queue": map[string]interface{}{"fullPolicy": "bogus"}})
+	if d := created.(memDest); d.output != nil || d.outputErr == "" {
+		t.Fatalf("expected the queue error recorded, got output %v, error %q", d.output, d.outputErr)
+	}
+	select {
+	case <-out.closed:
+	case <-time.After(time.Second):
+		t.Fatal("the output built before the queue failed was not closed")
+	}
+}
+
+func TestDeleteDestinationKeepsQueueMetricsGone(t *testing.T) {
+	out := &batchOutput{fakeOutput: newFakeOutput(), up: true}
+	eng, destID := newQueuedTestEngine(t, t.TempDir(), out)
+	eng.processAndAppendBatch("src", []string{"one"})
+	if err := eng.DeleteDestination(destID); err != nil {
+		t.Fatalf("delete destination: %v", err)
+	}
+	select {
+	case <-out.closed:
+	case <-time.After(time.Second):
+		t.Fatal("output not closed")
+	}
+	if metrics.QueueDepth.DeleteLabelValues(destID) {
+		t.Fatal("closing the output published queue metrics for a deleted destination")
+	}
+}
+
+func TestDropRefusesPathsOutsideStoreDirs(t *testing.T) {
+	dataDir := t.TempDir()
+	eng := NewMemoryEngine().(*memoryEngine)
+	if err := withQueues(eng, config.QueueConfig{Enabled: true}, dataDir); err != nil {
+		t.Fatalf("queues: %v", err)
+	}
+	keep := filepath.Join(dataDir, "keep")
+	if err := os.WriteFile(keep, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	eng.mu.Lock()
+	eng.dropQueueLocked("..")
+	eng.dropQueueLocked("")
+	eng.mu.Unlock()
+	if _, err := os.Stat(keep); err != nil {
+		t.Fatalf("dropping a queue must not remove anything outside the queue dir: %v", err)
+	}
+
+	victim := filepath.Join(dataDir, "victim.jsonl")
+	if err := os.WriteFile(victim, []byte("{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	dlq := newDLQStore(filepath.Join(dataDir, "dlq"), 0)
+	dlq.drop("../victim")
+	if _, err := os.Stat(victim); err != nil {
+		t.Fatalf("dropping a dlq must not remove anything outside the dlq dir: %v", err)
+	}
+}
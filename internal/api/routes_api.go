@@ -2,10 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
 
+	"bibbl/pkg/filterexpr"
+
 	"github.com/gorilla/mux"
 )
 
@@ -16,12 +19,39 @@ type Route struct {
 	PipelineID  string `json:"pipelineId"`
 	Destination string `json:"destination"`
 	Final       bool   `json:"final"`
+	// FilterError is set in listings when the filter does not compile
+	// (for example after a filter mode change); such a route never matches.
+	FilterError string `json:"filterError,omitempty"`
+}
+
+// routeFilterChecker is implemented by engines that can report route
+// filters that fail to compile.
+type routeFilterChecker interface {
+	routeFilterError(filter string) string
+}
+
+// RouteStats counts what each route did with the events it saw. Cloned counts
+// matches on non-final routes, i.e. copies that let evaluation continue.
+type RouteStats struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Matched   uint64 `json:"matched"`
+	Cloned    uint64 `json:"cloned"`
+	Filtered  uint64 `json:"filtered"`
+	Delivered uint64 `json:"delivered"`
 }
 
 func (s *Server) handleRoutesList(w http.ResponseWriter, r *http.Request) {
 	rs := s.pipeline.GetRoutes()
 	full := make([]Route, 0, len(rs))
-	for _, r0 := range rs { full = append(full, Route{ID: r0.ID, Name: r0.Name, Filter: r0.Filter, PipelineID: r0.PipelineID, Destination: r0.Destination, Final: r0.Final}) }
+	checker, _ := s.pipeline.(routeFilterChecker)
+	for _, r0 := range rs {
+		route := Route{ID: r0.ID, Name: r0.Name, Filter: r0.Filter, PipelineID: r0.PipelineID, Destination: r0.Destination, Final: r0.Final}
+		if checker != nil {
+			route.FilterError = checker.routeFilterError(r0.Filter)
+		}
+		full = append(full, route)
+	}
 	q := r.URL.Query()
 	limit, _ := strconv.Atoi(q.Get("limit"))
 	offset, _ := strconv.Atoi(q.Get("offset"))
@@ -49,7 +79,7 @@ func (s *Server) handleRouteCreate(w http.ResponseWriter, r *http.Request) {
 	}
 	created, err := s.pipeline.CreateRoute(route.Name, route.Filter, route.PipelineID, route.Destination, route.Final)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), routeErrorStatus(err))
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -66,7 +96,7 @@ func (s *Server) handleRouteUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := s.pipeline.UpdateRoute(id, route.Name, route.Filter, route.PipelineID, route.Destination, route.Final); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), routeErrorStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -81,3 +111,18 @@ func (s *Server) handleRouteDelete(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
+
+func (s *Server) handleRouteStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.pipeline.GetRouteStats())
+}
+
+// routeErrorStatus maps filter compile errors to 400 so clients can surface the
+// reported position; anything else is a server-side failure.
+func routeErrorStatus(err error) int {
+	var ferr *filterexpr.Error
+	if errors.As(err, &ferr) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
@@ -12,6 +12,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,6 +33,7 @@ import (
 	"bibbl/internal/platform/logger"
 	"bibbl/internal/version"
 	"bibbl/internal/web"
+	"bibbl/pkg/filterexpr"
 	tlsutil "bibbl/pkg/tls"
 )
 
@@ -121,6 +123,16 @@ type PipelineEngine interface {
 	CreateRoute(name, filter, pipelineID, destination string, final bool) (interface{}, error)
 	UpdateRoute(id, name, filter, pipelineID, destination string, final bool) error
 	DeleteRoute(id string) error
+	GetRouteStats() []RouteStats
+	// Config as code
+	ExportConfig() ConfigDocument
+	ImportConfig(doc ConfigDocument, dryRun bool) (ConfigImportResult, error)
+	// Dead-letter store
+	ListDLQ(destID string, limit, offset int) ([]DLQEntry, int, int, int, error)
+	ReplayDLQ(destID string, ids []uint64, pipelineID string) (DLQReplayResult, error)
+	PurgeDLQ(destID string, ids []uint64) (int, error)
+	// Destination health: output, circuit breaker, queue and dead letters
+	DestinationHealth(id string) (DestinationHealth, error)
 }
 
 type Server struct {
@@ -134,6 +146,10 @@ type Server struct {
 	auditFile *os.File
 	workers   sync.WaitGroup
 	tracer    trace.Tracer
+	// Declarative pipelines directory (routing.pipelines_dir)
+	pipelinesDir *pipelinesDirWatcher
+	// Version history and, when changes.staged is set, the draft workspace
+	changes *changeControl
 	// Enrichment assets (in-memory)
 	geoMu     sync.RWMutex
 	geoIP     any
@@ -468,6 +484,17 @@ func NewServer(cfg *config.Config) *Server {
 		return map[string]interface{}{"asn": res.Number, "org": res.Org}, true
 	}
 	eng := withASN(withGeo(withHub(base, hub), geoHook), asnHook)
+	if cfg.Routing.LegacyRegexFilters {
+		eng = withLegacyFilters(eng)
+	}
+	withCircuitBreakers(eng, cfg.Outputs.CircuitBreaker)
+	withArchiveStaging(eng, cfg.Storage.DataDir)
+	if err := withQueues(eng, cfg.Outputs.Queue, cfg.Storage.DataDir); err != nil {
+		log.Warn("destination queues disabled", "err", err)
+	}
+	if err := withDLQ(eng, cfg.Outputs.DLQ, cfg.Storage.DataDir); err != nil {
+		log.Warn("dead-letter store kept in memory", "err", err)
+	}
 	srv.pipeline = eng
 
 	// Periodic buffer metrics scrape (best-effort; simple polling)
@@ -538,9 +565,106 @@ func NewServer(cfg *config.Config) *Server {
 		return nil
 	})
 
-	// Seed sensible defaults
 	// Only route /api to Gorilla Mux; UI/static served by Fiber below
 	app.Use("/api", adaptor.HTTPHandler(muxRouter))
+	// Load persisted configuration; seed sensible defaults only on first boot
+	firstBoot := true
+	if dir := cfg.Storage.DataDir; dir != "" {
+		loaded, err := withStateStore(srv.pipeline, dir)
+		if err != nil {
+			log.Warn("engine state unavailable; continuing with in-memory configuration", "dir", dir, "err", err)
+		} else if loaded {
+			firstBoot = false
+			srv.restartEnabledSources()
+		}
+	}
+	if firstBoot {
+		seedDefaults(srv, cfg, skipDefaults)
+	}
+	if live, ok := srv.pipeline.(*memoryEngine); ok {
+		cc, err := newChangeControl(live, cfg.Changes.Staged, cfg.Storage.DataDir)
+		if err != nil {
+			log.Warn("change control unavailable", "err", err)
+		} else {
+			srv.changes = cc
+			if cc.draft != nil {
+				srv.pipeline = &stagedEngine{PipelineEngine: live, draft: cc.draft}
+			}
+		}
+	}
+	srv.RegisterRoutes(muxRouter)
+	// Only route /api/* to Gorilla Mux; leave / to the SPA/static handler
+	app.Use("/api", adaptor.HTTPHandler(muxRouter))
+
+	// Serve index.html with no-cache to avoid stale builds
+	serveIndex := func(c *fiber.Ctx) error {
+		index, err := web.ReadIndex()
+		if err != nil {
+			return fiber.ErrNotFound
+		}
+		c.Set("Content-Type", "text/html; charset=utf-8")
+		c.Set("Cache-Control", "no-store, max-age=0")
+		return c.Send(index)
+	}
+	app.Get("/", serveIndex)
+	app.Get("/index.html", serveIndex)
+	app.Get("/sources", serveIndex)
+	app.Get("/routes", serveIndex)
+	app.Get("/pipelines", serveIndex)
+	app.Get("/destinations", serveIndex)
+	app.Get("/buffers", serveIndex)
+	app.Get("/preview", serveIndex)
+	app.Get("/azure", serveIndex)
+	app.Get("/loadtest", serveIndex)
+
+	// Static UI (embedded assets)
+	app.Use("/", filesystem.New(filesystem.Config{
+		Root:       web.Static(),
+		PathPrefix: "",
+		Browse:     false,
+		// Keep default cache headers for hashed assets
+	}))
+
+	// Note: Real API routes are handled by Gorilla Mux mounted above.
+
+	// Regex preview endpoint: applies a named-capture regex to a sample string
+	// Regex preview handler is provided via Gorilla Mux API under /api/v1
+
+	// SPA fallback to index.html
+	app.Use(func(c *fiber.Ctx) error {
+		if c.Method() == http.MethodGet {
+			return serveIndex(c)
+		}
+		return fiber.ErrNotFound
+	})
+
+	// open audit log file (append)
+	if f, err := os.OpenFile("audit.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
+		srv.auditFile = f
+	}
+	// Reconcile and watch declarative definitions once the audit log is open
+	if dir := cfg.Routing.PipelinesDir; dir != "" {
+		engine := srv.pipeline
+		if staged, ok := engine.(*stagedEngine); ok {
+			engine = staged.PipelineEngine
+		}
+		srv.pipelinesDir = newPipelinesDirWatcher(dir, engine, srv.audit)
+		if srv.changes != nil && srv.changes.draft != nil {
+			srv.pipelinesDir.draft = srv.changes.draft
+		}
+		if cfg.Storage.DataDir != "" {
+			srv.pipelinesDir.state = filepath.Join(cfg.Storage.DataDir, pipelinesDirStateFile)
+		}
+		if err := srv.pipelinesDir.Start(); err != nil {
+			log.Warn("pipelines directory not watched", "dir", dir, "err", err)
+		}
+	}
+	return srv
+}
+
+// seedDefaults creates the default sources, pipelines, destinations and example
+// routes. It only runs on first boot; afterwards the persisted state is authoritative.
+func seedDefaults(srv *Server, cfg *config.Config, skipDefaults bool) {
 	if !skipDefaults && cfg.Inputs.Syslog.Enabled {
 		// Only create default syslog if explicitly enabled via config/flag
 		haveSyslog := false
@@ -700,7 +824,7 @@ func NewServer(cfg *config.Config) *Server {
 		"filesystem":       "logs",
 		"directory":        "bibbl/raw/$(yyyy)/$(MM)/$(dd)/",
 		"pathTemplate":     "bibbl/raw/$(yyyy)/$(MM)/$(dd)/$(HH)/data-$(mm).jsonl",
-		"format":           "jsonl", // future: parquet
+		"format":           "jsonl", // or "parquet"
 		"compression":      "gzip",
 		"batchMaxEvents":   1000,
 		"batchMaxBytes":    1024 * 1024, // 1MB
@@ -897,6 +1021,15 @@ func NewServer(cfg *config.Config) *Server {
 		}
 	}
 
+	// With legacy filters an unprefixed filter is a regex, so the example
+	// expressions are marked as such.
+	expr := func(filter string) string {
+		if cfg.Routing.LegacyRegexFilters {
+			return filterexpr.ExprPrefix + filter
+		}
+		return filter
+	}
+
 	// Example Route 1: Versa Critical to Sentinel
 	if versaPipeID != "" && criticalAlertDestID != "" {
 		checkAndCreateRoute := func(name, filter, pipeID, destID string, final bool) {
@@ -915,7 +1048,7 @@ func NewServer(cfg *config.Config) *Server {
 
 		checkAndCreateRoute(
 			"Example: Versa Critical → Sentinel",
-			`event.severity === "Critical" || event.severity === "critical"`,
+			expr(`event.severity === "Critical" || event.severity === "critical"`),
 			versaPipeID,
 			criticalAlertDestID,
 			false, // Don't stop - allow other routes to process
@@ -934,7 +1067,7 @@ func NewServer(cfg *config.Config) *Server {
 		if !exists {
 			_, _ = srv.pipeline.CreateRoute(
 				"Example: Palo Alto High → Sentinel",
-				`event.threat_severity === "high" || (event.severity_level_d >= 6 && event.severity_level_d <= 8)`,
+				expr(`event.threat_severity === "high" || (event.severity_level_d >= 6 && event.severity_level_d <= 8)`),
 				paloAltoPipeID,
 				highAlertDestID,
 				false,
@@ -989,20 +1122,8 @@ func NewServer(cfg *config.Config) *Server {
 	_ = adlsVersaDestID   // Reserved for additional routes
 	_ = mediumAlertDestID // Reserved for additional routes
 
-	// 4) Default route to sentinel via passthrough (create only if absent)
-	if passthruID != "" && sentID != "" {
-		haveDefault := false
-		for _, r := range srv.pipeline.GetRoutes() {
-			if r.Name == "default" {
-				haveDefault = true
-				break
-			}
-		}
-		if !haveDefault {
-			_, _ = srv.pipeline.CreateRoute("default", "true", passthruID, sentID, true)
-		}
-	}
-	// 4b) Route all to ADLS Normalize -> ADLS destination (create only if absent and we have IDs)
+	// 4) Route all to ADLS Normalize -> ADLS destination (create only if absent and we have IDs).
+	// It is not final and must come before the default route, which is final.
 	if adlsPipeID != "" && adlsID != "" {
 		haveAdls := false
 		for _, r := range srv.pipeline.GetRoutes() {
@@ -1015,57 +1136,20 @@ func NewServer(cfg *config.Config) *Server {
 			_, _ = srv.pipeline.CreateRoute("adls-all", "true", adlsPipeID, adlsID, false)
 		}
 	}
-	srv.RegisterRoutes(muxRouter)
-	// Only route /api/* to Gorilla Mux; leave / to the SPA/static handler
-	app.Use("/api", adaptor.HTTPHandler(muxRouter))
-
-	// Serve index.html with no-cache to avoid stale builds
-	serveIndex := func(c *fiber.Ctx) error {
-		index, err := web.ReadIndex()
-		if err != nil {
-			return fiber.ErrNotFound
+	// 4b) Default route to sentinel via passthrough (create only if absent). It is
+	// final, so it is seeded last to stay the fallback after every other route.
+	if passthruID != "" && sentID != "" {
+		haveDefault := false
+		for _, r := range srv.pipeline.GetRoutes() {
+			if r.Name == "default" {
+				haveDefault = true
+				break
+			}
 		}
-		c.Set("Content-Type", "text/html; charset=utf-8")
-		c.Set("Cache-Control", "no-store, max-age=0")
-		return c.Send(index)
-	}
-	app.Get("/", serveIndex)
-	app.Get("/index.html", serveIndex)
-	app.Get("/sources", serveIndex)
-	app.Get("/routes", serveIndex)
-	app.Get("/pipelines", serveIndex)
-	app.Get("/destinations", serveIndex)
-	app.Get("/buffers", serveIndex)
-	app.Get("/preview", serveIndex)
-	app.Get("/azure", serveIndex)
-	app.Get("/loadtest", serveIndex)
-
-	// Static UI (embedded assets)
-	app.Use("/", filesystem.New(filesystem.Config{
-		Root:       web.Static(),
-		PathPrefix: "",
-		Browse:     false,
-		// Keep default cache headers for hashed assets
-	}))
-
-	// Note: Real API routes are handled by Gorilla Mux mounted above.
-
-	// Regex preview endpoint: applies a named-capture regex to a sample string
-	// Regex preview handler is provided via Gorilla Mux API under /api/v1
-
-	// SPA fallback to index.html
-	app.Use(func(c *fiber.Ctx) error {
-		if c.Method() == http.MethodGet {
-			return serveIndex(c)
+		if !haveDefault {
+			_, _ = srv.pipeline.CreateRoute("default", "true", passthruID, sentID, true)
 		}
-		return fiber.ErrNotFound
-	})
-
-	// open audit log file (append)
-	if f, err := os.OpenFile("audit.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err == nil {
-		srv.auditFile = f
 	}
-	return srv
 }
 
 func (s *Server) Start() error {
@@ -1127,6 +1211,18 @@ func (s *Server) ShutdownWithContext(ctx context.Context) error {
 	case <-done:
 	case <-c.Done():
 	}
+	if s.pipelinesDir != nil {
+		s.pipelinesDir.Close()
+	}
+	// flush and close destination outputs
+	if m, ok := s.engine(); ok {
+		closed := make(chan struct{})
+		go func() { m.closeOutputs(); close(closed) }()
+		select {
+		case <-closed:
+		case <-c.Done():
+		}
+	}
 	// close app
 	_ = s.app.ShutdownWithContext(c)
 	if s.auditFile != nil {
@@ -1196,6 +1292,10 @@ func (s *Server) RegisterRoutes(router *mux.Router) {
 	v1.HandleFunc("/destinations/{id}", s.handleDestinationUpdate).Methods("PUT")
 	v1.HandleFunc("/destinations/{id}", s.handleDestinationDelete).Methods("DELETE")
 	v1.HandleFunc("/destinations/{id}", s.handleDestinationPatch).Methods("PATCH")
+	v1.HandleFunc("/destinations/{id}/health", s.handleDestinationHealth).Methods("GET")
+	v1.HandleFunc("/destinations/{id}/dlq", s.handleDLQList).Methods("GET")
+	v1.HandleFunc("/destinations/{id}/dlq", s.handleDLQPurge).Methods("DELETE")
+	v1.HandleFunc("/destinations/{id}/dlq/replay", s.handleDLQReplay).Methods("POST")
 
 	// Pipelines
 	v1.HandleFunc("/pipelines", s.handlePipelinesList).Methods("GET")
@@ -1211,10 +1311,23 @@ func (s *Server) RegisterRoutes(router *mux.Router) {
 	v1.HandleFunc("/buffers/{sourceId}", s.handleBufferGet).Methods("GET")
 	v1.HandleFunc("/buffers/{sourceId}", s.handleBufferUpdate).Methods("PATCH")
 	v1.HandleFunc("/routes", s.handleRoutesList).Methods("GET")
+	v1.HandleFunc("/routes/stats", s.handleRouteStats).Methods("GET")
 	v1.HandleFunc("/routes", s.handleRouteCreate).Methods("POST")
 	v1.HandleFunc("/routes/{id}", s.handleRouteUpdate).Methods("PUT")
 	v1.HandleFunc("/routes/{id}", s.handleRouteDelete).Methods("DELETE")
 
+	// Config as code
+	v1.HandleFunc("/config/export", s.handleConfigExport).Methods("GET")
+	v1.HandleFunc("/config/import", s.handleConfigImport).Methods("POST")
+
+	// Change control
+	v1.HandleFunc("/changes", s.handleChangesList).Methods("GET")
+	v1.HandleFunc("/changes", s.handleChangesDiscard).Methods("DELETE")
+	v1.HandleFunc("/commit", s.handleCommit).Methods("POST")
+	v1.HandleFunc("/versions", s.handleVersionsList).Methods("GET")
+	v1.HandleFunc("/versions/{version}", s.handleVersionGet).Methods("GET")
+	v1.HandleFunc("/rollback/{version}", s.handleRollback).Methods("POST")
+
 	// Tools & Preview
 	v1.HandleFunc("/preview/regex", s.handleRegexPreview).Methods("POST")
 	v1.HandleFunc("/preview/enrich", s.handleEnrichPreview).Methods("POST")
@@ -0,0 +1,328 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// stateFileName is the engine state file kept under storage.data_dir.
+const stateFileName = "state.json"
+
+// stateSchemaVersion is the current on-disk layout. Bump it when the layout
+// changes and add the upgrade step to stateMigrations.
+const stateSchemaVersion = 1
+
+// stateMigrations upgrades a decoded state document one version at a time:
+// stateMigrations[v] turns a version v document into version v+1.
+var stateMigrations = map[int]func(doc map[string]interface{}) error{}
+
+// engineState is the persisted form of the user-managed engine configuration.
+// Runtime data (outputs, listeners, counters, buffers) is never persisted.
+type engineState struct {
+	SchemaVersion int                `json:"schemaVersion"`
+	Seq           int                `json:"seq"`
+	Sources       []stateSource      `json:"sources"`
+	Pipelines     []statePipeline    `json:"pipelines"`
+	Routes        []stateRoute       `json:"routes"`
+	Destinations  []stateDestination `json:"destinations"`
+}
+
+type stateSource struct {
+	ID      string                 `json:"id"`
+	Name    string                 `json:"name"`
+	Type    string                 `json:"type"`
+	Config  map[string]interface{} `json:"config"`
+	Enabled bool                   `json:"enabled"`
+}
+
+type statePipeline struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Functions   []string `json:"functions"`
+	IPSource    string   `json:"ipSource,omitempty"`
+}
+
+type stateRoute struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Filter      string `json:"filter"`
+	PipelineID  string `json:"pipelineId"`
+	Destination string `json:"destination"`
+	Final       bool   `json:"final"`
+}
+
+type stateDestination struct {
+	ID      string                 `json:"id"`
+	Name    string                 `json:"name"`
+	Type    string                 `json:"type"`
+	Status  string                 `json:"status"`
+	Config  map[string]interface{} `json:"config"`
+	Enabled bool                   `json:"enabled"`
+}
+
+// stateStore reads and atomically rewrites the state file. Snapshots are
+// staged under the engine lock and written after it is released, so the
+// fsync never blocks event routing; concurrent changes share one write.
+type stateStore struct {
+	path string
+
+	mu      sync.Mutex // guards pending
+	pending []byte     // newest encoded snapshot not yet written
+	writeMu sync.Mutex // serialises writes to path
+}
+
+func newStateStore(dataDir, name string) (*stateStore, error) {
+	if err := os.MkdirAll(dataDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create data dir: %w", err)
+	}
+	return &stateStore{path: filepath.Join(dataDir, name)}, nil
+}
+
+// load returns the stored state, or nil when no state has been written yet.
+func (s *stateStore) load() (*engineState, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read state: %w", err)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("decode state %s: %w", s.path, err)
+	}
+	version := 0
+	if v, ok := doc["schemaVersion"].(float64); ok {
+		version = int(v)
+	}
+	if version > stateSchemaVersion {
+		return nil, fmt.Errorf("state %s has schema version %d; this build supports up to %d", s.path, version, stateSchemaVersion)
+	}
+	for version < stateSchemaVersion {
+		migrate, ok := stateMigrations[version]
+		if !ok {
+			return nil, fmt.Errorf("state %s: no migration from schema version %d", s.path, version)
+		}
+		if err := migrate(doc); err != nil {
+			return nil, fmt.Errorf("migrate state from schema version %d: %w", version, err)
+		}
+		version++
+		doc["schemaVersion"] = version
+	}
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("encode migrated state: %w", err)
+	}
+	st := &engineState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("decode state %s: %w", s.path, err)
+	}
+	return st, nil
+}
+
+// stage encodes st as the next state to write, replacing any staged one.
+func (s *stateStore) stage(st *engineState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode state: %w", err)
+	}
+	s.mu.Lock()
+	s.pending = data
+	s.mu.Unlock()
+	return nil
+}
+
+// flush writes the staged state atomically; readers never observe a partial
+// write. A caller whose snapshot was already written by a concurrent flush
+// still waits for that write, so the change is on disk when flush returns.
+func (s *stateStore) flush() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	data := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if data == nil {
+		return nil
+	}
+	if err := writeFileAtomic(s.path, data); err != nil {
+		return fmt.Errorf("write state: %w", err)
+	}
+	return nil
+}
+
+// childPath joins name onto dir and checks the result is strictly inside dir,
+// so an ID such as ".." or "a/../../b" can never address dir itself or
+// anything outside it.
+func childPath(dir, name string) (string, error) {
+	p := filepath.Join(dir, name)
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is not a valid name inside %s", name, dir)
+	}
+	return p, nil
+}
+
+// writeFileAtomic writes data to a temp file in the same directory, syncs it
+// and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("replace %s: %w", filepath.Base(path), err)
+	}
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// snapshotStateLocked captures the persistable engine configuration. Caller holds m.mu.
+func (m *memoryEngine) snapshotStateLocked() *engineState {
+	st := &engineState{SchemaVersion: stateSchemaVersion, Seq: m.seq}
+	for _, s := range m.sources {
+		st.Sources = append(st.Sources, stateSource{ID: s.ID, Name: s.Name, Type: s.Type, Config: s.Config, Enabled: s.Enabled})
+	}
+	for _, p := range m.pipelines {
+		st.Pipelines = append(st.Pipelines, statePipeline{ID: p.ID, Name: p.Name, Description: p.Description, Functions: p.Functions, IPSource: p.IPSource})
+	}
+	for _, r := range m.routes {
+		st.Routes = append(st.Routes, stateRoute{ID: r.ID, Name: r.Name, Filter: r.Filter, PipelineID: r.PipelineID, Destination: r.Destination, Final: r.Final})
+	}
+	for _, d := range m.dests {
+		st.Destinations = append(st.Destinations, stateDestination{ID: d.ID, Name: d.Name, Type: d.Type, Status: d.Status, Config: d.Config, Enabled: d.Enabled})
+	}
+	return st
+}
+
+// persistLocked stages the current configuration for the state store. Caller
+// holds m.mu and must have deferred writeState before taking it, so the write
+// happens once the lock is released. Failures are logged; the in-memory
+// change stands.
+func (m *memoryEngine) persistLocked() {
+	if m.state == nil {
+		return
+	}
+	if err := m.state.stage(m.snapshotStateLocked()); err != nil {
+		log.Printf("persist engine state: %v", err)
+	}
+}
+
+// writeState writes any configuration staged by persistLocked. Mutators defer
+// it ahead of taking m.mu.
+func (m *memoryEngine) writeState() {
+	m.mu.RLock()
+	store := m.state
+	m.mu.RUnlock()
+	if store == nil {
+		return
+	}
+	if err := store.flush(); err != nil {
+		log.Printf("persist engine state: %v", err)
+	}
+}
+
+// restoreLocked replaces the engine configuration with st. Caller holds m.mu.
+func (m *memoryEngine) restoreLocked(st *engineState) error {
+	pipes := make([]memPipe, 0, len(st.Pipelines))
+	for _, p := range st.Pipelines {
+		filters, err := compileKVFilters(p.Functions)
+		if err != nil {
+			return fmt.Errorf("pipeline %s: %w", p.Name, err)
+		}
+		pipes = append(pipes, memPipe{ID: p.ID, Name: p.Name, Description: p.Description, Functions: p.Functions, IPSource: p.IPSource, Filters: filters})
+	}
+	srcs := make([]*memSource, 0, len(st.Sources))
+	for _, s := range st.Sources {
+		// Sources come back stopped; the caller restarts the enabled ones.
+		srcs = append(srcs, &memSource{ID: s.ID, Name: s.Name, Type: s.Type, Config: s.Config, Status: "stopped", Enabled: s.Enabled})
+	}
+	routes := make([]memRoute, 0, len(st.Routes))
+	for _, r := range st.Routes {
+		routes = append(routes, memRoute{ID: r.ID, Name: r.Name, Filter: r.Filter, PipelineID: r.PipelineID, Destination: r.Destination, Final: r.Final})
+		// A filter saved under another filter mode may no longer compile; the
+		// route is kept but never matches until it is fixed.
+		if err := m.cacheFilterLocked(r.Filter); err != nil {
+			log.Printf("route %s (%s): filter does not compile, route will not match: %v", r.Name, r.ID, err)
+		}
+	}
+	m.sources = srcs
+	m.pipelines = pipes
+	m.routes = routes
+	m.dests = m.dests[:0]
+	for _, d := range st.Destinations {
+		m.dests = append(m.dests, memDest{ID: d.ID, Name: d.Name, Type: d.Type, Status: d.Status, Config: d.Config, Enabled: d.Enabled})
+		m.syncOutputLocked(len(m.dests) - 1)
+	}
+	if st.Seq > m.seq {
+		m.seq = st.Seq
+	}
+	for _, p := range m.pipelines {
+		m.registerPipelineStat(p)
+	}
+	return nil
+}
+
+// withStateStore loads persisted configuration from dataDir into the engine
+// and makes every later mutation write through to it. It reports whether a
+// previous state was found; when it was not, the caller seeds defaults.
+func withStateStore(p PipelineEngine, dataDir string) (bool, error) {
+	m, ok := p.(*memoryEngine)
+	if !ok {
+		return false, nil
+	}
+	store, err := newStateStore(dataDir, stateFileName)
+	if err != nil {
+		return false, err
+	}
+	st, err := store.load()
+	if err != nil {
+		return false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st != nil {
+		if err := m.restoreLocked(st); err != nil {
+			return false, err
+		}
+	}
+	m.state = store
+	return st != nil, nil
+}
+
+// restartEnabledSources starts the sources that were running when the state
+// was last written.
+func (s *Server) restartEnabledSources() {
+	for _, src := range s.pipeline.GetSources() {
+		if !src.Enabled {
+			continue
+		}
+		if err := s.pipeline.StartSource(src.ID); err != nil {
+			log.Printf("restore source %s (%s): %v", src.Name, src.ID, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bibbl/internal/config"
+)
+
+func TestStatePersistsAcrossRestart(t *testing.T) {
+	t.Setenv("BIBBL_TEST", "1")
+	cfg := &config.Config{}
+	cfg.Server.Host = "127.0.0.1"
+	cfg.Storage.DataDir = t.TempDir()
+
+	first := NewServer(cfg)
+	seeded := len(first.pipeline.GetRoutes())
+	if seeded == 0 {
+		t.Fatal("expected default routes on first boot")
+	}
+	p, err := first.pipeline.CreatePipeline("Hand built", "", []string{"filter:severity=high"})
+	if err != nil {
+		t.Fatalf("create pipeline: %v", err)
+	}
+	if _, err := first.pipeline.CreateRoute("mine", `severity == "high"`, p.(memPipe).ID, "", true); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.Storage.DataDir, stateFileName)); err != nil {
+		t.Fatalf("expected state file: %v", err)
+	}
+
+	second := NewServer(cfg)
+	routes := second.pipeline.GetRoutes()
+	if len(routes) != seeded+1 {
+		t.Fatalf("expected %d routes after restart without reseeding, got %d", seeded+1, len(routes))
+	}
+	if last := routes[len(routes)-1]; last.Name != "mine" || last.Filter != `severity == "high"` {
+		t.Fatalf("hand-built route not restored: %+v", last)
+	}
+	eng := second.pipeline.(*memoryEngine)
+	for _, pl := range eng.pipelines {
+		if pl.Name == "Hand built" && len(pl.Filters) != 1 {
+			t.Fatalf("expected pipeline filters recompiled on load")
+		}
+	}
+	// New IDs must not collide with restored ones.
+	created, err := second.pipeline.CreateDestination("after restart", "sentinel", map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("create destination: %v", err)
+	}
+	for _, d := range second.pipeline.GetDestinations()[:len(second.pipeline.GetDestinations())-1] {
+		if d.ID == created.(memDest).ID {
+			t.Fatalf("destination id %s reused after restart", d.ID)
+		}
+	}
+}
+
+func TestStateRejectsNewerSchema(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, stateFileName), []byte(`{"schemaVersion": 99}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := withStateStore(NewMemoryEngine(), dir)
+	if err == nil || !strings.Contains(err.Error(), "schema version 99") {
+		t.Fatalf("expected schema version error, got %v", err)
+	}
+}
+
+func TestStateFlagsRouteFiltersThatNoLongerCompile(t *testing.T) {
+	dir := t.TempDir()
+	legacy := withLegacyFilters(NewMemoryEngine())
+	if _, err := withStateStore(legacy, dir); err != nil {
+		t.Fatal(err)
+	}
+	const filter = `^\d+ CEF:`
+	if _, err := legacy.CreateRoute("legacy", filter, "", "", true); err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+
+	// Reloaded without legacy filters the route is kept but errored.
+	strict := NewMemoryEngine().(*memoryEngine)
+	if _, err := withStateStore(strict, dir); err != nil {
+		t.Fatal(err)
+	}
+	if strict.filterErrs[filter] == nil {
+		t.Fatal("compile error should be cached at load time")
+	}
+	if snap := strict.snapshotRoutes(); snap.filters[filter] != nil {
+		t.Fatal("errored route must not get a filter program")
+	}
+
+	srv := &Server{pipeline: strict}
+	rec := httptest.NewRecorder()
+	srv.handleRoutesList(rec, httptest.NewRequest("GET", "/api/v1/routes", nil))
+	var body struct {
+		Items []Route `json:"items"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Items) != 1 || body.Items[0].FilterError == "" {
+		t.Fatalf("route listing should flag the filter error: %s", rec.Body.String())
+	}
+}
+
+func TestStateWriteDoesNotHoldEngineLock(t *testing.T) {
+	dir := t.TempDir()
+	eng := NewMemoryEngine().(*memoryEngine)
+	if _, err := withStateStore(eng, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stall the file write, as a slow fsync would.
+	eng.state.writeMu.Lock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := eng.CreateRoute("slow disk", "true", "", "", false)
+		done <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := findRouteByName(eng, "slow disk"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("route should be readable while its state write is pending")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("CreateRoute should wait for the state write")
+	default:
+	}
+	eng.state.writeMu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("create route: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if err != nil || !strings.Contains(string(data), "slow disk") {
+		t.Fatalf("route should be on disk once CreateRoute returns: %v", err)
+	}
+}
+
+func findRouteByName(eng PipelineEngine, name string) (string, bool) {
+	for _, r := range eng.GetRoutes() {
+		if r.Name == name {
+			return r.ID, true
+		}
+	}
+	return "", false
+}
@@ -45,6 +45,41 @@ type VaultTLSConfig struct {
 
 type OutputsConfig struct {
 	AzureLogAnalytics AzureLogAnalyticsOutputConfig `mapstructure:"azure_log_analytics" json:"azure_log_analytics" yaml:"azure_log_analytics"`
+	Queue             QueueConfig                   `mapstructure:"queue" json:"queue" yaml:"queue"`
+	DLQ               DLQConfig                     `mapstructure:"dlq" json:"dlq" yaml:"dlq"`
+	CircuitBreaker    CircuitBreakerConfig          `mapstructure:"circuit_breaker" json:"circuit_breaker" yaml:"circuit_breaker"`
+}
+
+// CircuitBreakerConfig tunes the circuit breaker in front of every
+// destination output. While a circuit is open, events wait in the
+// destination's disk queue instead of being retried.
+type CircuitBreakerConfig struct {
+	MaxFailures       int           `mapstructure:"max_failures" json:"max_failures" yaml:"max_failures"`
+	OpenTimeout       time.Duration `mapstructure:"open_timeout" json:"open_timeout" yaml:"open_timeout"`
+	HalfOpenSuccesses int           `mapstructure:"half_open_successes" json:"half_open_successes" yaml:"half_open_successes"`
+}
+
+// DLQConfig controls the per-destination dead-letter store for events an
+// output rejected or gave up on.
+type DLQConfig struct {
+	Directory  string `mapstructure:"directory" json:"directory" yaml:"directory"` // default <storage.data_dir>/dlq
+	MaxEntries int    `mapstructure:"max_entries" json:"max_entries" yaml:"max_entries"`
+}
+
+// QueueConfig sets the defaults for the durable disk queue in front of every
+// destination output. Destinations can override them with a "queue" block.
+type QueueConfig struct {
+	Enabled      bool          `mapstructure:"enabled" json:"enabled" yaml:"enabled"`
+	Directory    string        `mapstructure:"directory" json:"directory" yaml:"directory"` // default <storage.data_dir>/queues
+	MaxBytes     int64         `mapstructure:"max_bytes" json:"max_bytes" yaml:"max_bytes"`
+	SegmentBytes int64         `mapstructure:"segment_bytes" json:"segment_bytes" yaml:"segment_bytes"`
+	FullPolicy   string        `mapstructure:"full_policy" json:"full_policy" yaml:"full_policy"` // block | drop_oldest | drop_newest
+	BlockTimeout time.Duration `mapstructure:"block_timeout" json:"block_timeout" yaml:"block_timeout"`
+	Encrypt      bool          `mapstructure:"encrypt" json:"encrypt" yaml:"encrypt"`
+	KeyEnv       string        `mapstructure:"key_env" json:"key_env" yaml:"key_env"`
+	// AllowPlaintext replays unencrypted segments while Encrypt is on. Only
+	// for migrating queues written before encryption was enabled.
+	AllowPlaintext bool `mapstructure:"allow_plaintext" json:"allow_plaintext" yaml:"allow_plaintext"`
 }
 
 type AzureLogAnalyticsOutputConfig struct {
@@ -85,6 +120,30 @@ type OTLPConfig struct {
 	SampleRatio float64           `mapstructure:"sample_ratio" json:"sample_ratio" yaml:"sample_ratio"`
 }
 
+// RoutingConfig controls route evaluation.
+type RoutingConfig struct {
+	// LegacyRegexFilters treats route filters as regular expressions over
+	// the raw event unless they carry the "expr:" prefix.
+	LegacyRegexFilters bool `mapstructure:"legacy_regex_filters" json:"legacy_regex_filters" yaml:"legacy_regex_filters"`
+	// PipelinesDir, when set, is a directory of YAML route/pipeline/destination
+	// definitions that is loaded at startup and watched for changes.
+	PipelinesDir string `mapstructure:"pipelines_dir" json:"pipelines_dir" yaml:"pipelines_dir"`
+}
+
+// StorageConfig controls where engine state is persisted.
+type StorageConfig struct {
+	// DataDir holds state.json with sources, pipelines, routes and
+	// destinations. Empty keeps configuration in memory only.
+	DataDir string `mapstructure:"data_dir" json:"data_dir" yaml:"data_dir"`
+}
+
+// ChangesConfig controls how configuration changes made through the API go live.
+type ChangesConfig struct {
+	// Staged collects API mutations in a draft that only takes effect on
+	// POST /api/v1/commit. When false, changes apply immediately.
+	Staged bool `mapstructure:"staged" json:"staged" yaml:"staged"`
+}
+
 type AutoCertConfig struct {
 	Enabled         bool     `mapstructure:"enabled" json:"enabled" yaml:"enabled"`
 	Hosts           []string `mapstructure:"hosts" json:"hosts" yaml:"hosts"`
@@ -126,6 +185,9 @@ type Config struct {
 	Outputs   OutputsConfig   `mapstructure:"outputs" json:"outputs" yaml:"outputs"`
 	Secrets   SecretsConfig   `mapstructure:"secrets" json:"secrets" yaml:"secrets"`
 	Telemetry TelemetryConfig `mapstructure:"telemetry" json:"telemetry" yaml:"telemetry"`
+	Routing   RoutingConfig   `mapstructure:"routing" json:"routing" yaml:"routing"`
+	Storage   StorageConfig   `mapstructure:"storage" json:"storage" yaml:"storage"`
+	Changes   ChangesConfig   `mapstructure:"changes" json:"changes" yaml:"changes"`
 	Inputs    struct {
 		Syslog struct {
 			Enabled        bool          `mapstructure:"enabled" json:"enabled" yaml:"enabled"`
@@ -246,6 +308,29 @@ func loadConfig(configPath string) (*Config, error) {
 	v.SetDefault("outputs.azure_log_analytics.spill.encrypt", false)
 	v.SetDefault("outputs.azure_log_analytics.spill.key_env", "BIBBL_SPILL_KEY")
 
+	v.SetDefault("outputs.queue.enabled", true)
+	v.SetDefault("outputs.queue.directory", "")
+	v.SetDefault("outputs.queue.max_bytes", int64(1024*1024*1024))
+	v.SetDefault("outputs.queue.segment_bytes", int64(16*1024*1024))
+	// A destination that is down must not stall ingest for every other route,
+	// so a full queue sheds its oldest data unless block is chosen; block then
+	// gives up on an event after block_timeout.
+	v.SetDefault("outputs.queue.full_policy", "drop_oldest")
+	v.SetDefault("outputs.queue.block_timeout", "5s")
+	v.SetDefault("outputs.queue.encrypt", false)
+	v.SetDefault("outputs.queue.allow_plaintext", false)
+	v.SetDefault("outputs.dlq.directory", "")
+	v.SetDefault("outputs.dlq.max_entries", 100000)
+	v.SetDefault("outputs.queue.key_env", "BIBBL_SPILL_KEY")
+	v.SetDefault("outputs.circuit_breaker.max_failures", 5)
+	v.SetDefault("outputs.circuit_breaker.open_timeout", "30s")
+	v.SetDefault("outputs.circuit_breaker.half_open_successes", 2)
+
+	v.SetDefault("routing.legacy_regex_filters", false)
+	v.SetDefault("routing.pipelines_dir", "")
+	v.SetDefault("storage.data_dir", "./data")
+	v.SetDefault("changes.staged", false)
+
 	// Syslog input defaults (TLS on 6514)
 	v.SetDefault("inputs.syslog.enabled", false)
 	v.SetDefault("inputs.syslog.host", "127.0.0.1")
@@ -404,6 +489,24 @@ func loadConfig(configPath string) (*Config, error) {
 	if cfg.Telemetry.OTLP.SampleRatio <= 0 {
 		cfg.Telemetry.OTLP.SampleRatio = 1
 	}
+	cfg.Outputs.Queue.Enabled = v.GetBool("outputs.queue.enabled")
+	cfg.Outputs.Queue.Directory = v.GetString("outputs.queue.directory")
+	cfg.Outputs.Queue.MaxBytes = v.GetInt64("outputs.queue.max_bytes")
+	cfg.Outputs.Queue.SegmentBytes = v.GetInt64("outputs.queue.segment_bytes")
+	cfg.Outputs.Queue.FullPolicy = v.GetString("outputs.queue.full_policy")
+	cfg.Outputs.Queue.BlockTimeout = v.GetDuration("outputs.queue.block_timeout")
+	cfg.Outputs.Queue.Encrypt = v.GetBool("outputs.queue.encrypt")
+	cfg.Outputs.Queue.KeyEnv = v.GetString("outputs.queue.key_env")
+	cfg.Outputs.Queue.AllowPlaintext = v.GetBool("outputs.queue.allow_plaintext")
+	cfg.Outputs.DLQ.Directory = v.GetString("outputs.dlq.directory")
+	cfg.Outputs.DLQ.MaxEntries = v.GetInt("outputs.dlq.max_entries")
+	cfg.Outputs.CircuitBreaker.MaxFailures = v.GetInt("outputs.circuit_breaker.max_failures")
+	cfg.Outputs.CircuitBreaker.OpenTimeout = v.GetDuration("outputs.circuit_breaker.open_timeout")
+	cfg.Outputs.CircuitBreaker.HalfOpenSuccesses = v.GetInt("outputs.circuit_breaker.half_open_successes")
+	cfg.Routing.LegacyRegexFilters = v.GetBool("routing.legacy_regex_filters")
+	cfg.Routing.PipelinesDir = v.GetString("routing.pipelines_dir")
+	cfg.Storage.DataDir = v.GetString("storage.data_dir")
+	cfg.Changes.Staged = v.GetBool("changes.staged")
 
 	// Inputs.Syslog
 	cfg.Inputs.Syslog.Enabled = v.GetBool("inputs.syslog.enabled")
@@ -501,6 +604,20 @@ func (c *Config) Validate() (errors []string, warnings []string) {
 			errors = append(errors, "inputs.syslog.tls.auto_cert.renew_before_days must be less than valid_days")
 		}
 	}
+	switch c.Outputs.Queue.FullPolicy {
+	case "", "block", "drop_oldest", "drop_newest":
+	default:
+		errors = append(errors, "outputs.queue.full_policy must be block|drop_oldest|drop_newest")
+	}
+	if c.Outputs.Queue.Encrypt && strings.TrimSpace(c.Outputs.Queue.KeyEnv) == "" {
+		errors = append(errors, "outputs.queue.key_env required when encrypt enabled")
+	}
+	if c.Outputs.DLQ.MaxEntries < 0 {
+		errors = append(errors, "outputs.dlq.max_entries must be >= 0")
+	}
+	if cb := c.Outputs.CircuitBreaker; cb.MaxFailures < 0 || cb.OpenTimeout < 0 || cb.HalfOpenSuccesses < 0 {
+		errors = append(errors, "outputs.circuit_breaker values must be >= 0")
+	}
 	if c.Outputs.AzureLogAnalytics.Enabled {
 		if strings.TrimSpace(c.Outputs.AzureLogAnalytics.WorkspaceID) == "" {
 			errors = append(errors, "outputs.azure_log_analytics.workspace_id required when enabled")
@@ -521,6 +638,9 @@ func (c *Config) Validate() (errors []string, warnings []string) {
 			if c.Outputs.AzureLogAnalytics.Spill.SegmentSize > c.Outputs.AzureLogAnalytics.Spill.MaxBytes {
 				errors = append(errors, "outputs.azure_log_analytics.spill.segment_size cannot exceed max_bytes")
 			}
+			if c.Outputs.AzureLogAnalytics.Spill.Encrypt && strings.TrimSpace(c.Outputs.AzureLogAnalytics.Spill.KeyEnv) == "" {
+				errors = append(errors, "outputs.azure_log_analytics.spill.key_env required when encrypt enabled")
+			}
 		}
 	}
 	if c.Secrets.Vault.Enabled {
@@ -15,3 +15,10 @@ func TestEnvOverrides(t *testing.T) {
 		if cfg.Server.Port != 9555 { t.Fatalf("expected 9555 got %d", cfg.Server.Port) }
 	}
 }
+
+func TestQueueDefaultsDoNotBlockForever(t *testing.T) {
+	cfg := Load()
+	if q := cfg.Outputs.Queue; q.FullPolicy != "drop_oldest" || q.BlockTimeout <= 0 {
+		t.Fatalf("expected drop_oldest with a finite block timeout by default, got %q / %v", q.FullPolicy, q.BlockTimeout)
+	}
+}
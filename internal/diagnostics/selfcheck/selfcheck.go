@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"bibbl/internal/config"
+	"bibbl/pkg/seal"
 )
 
 // Dependencies surfaces optional clients required for checks.
@@ -38,6 +39,16 @@ func Run(ctx context.Context, cfg *config.Config, deps Dependencies) error {
 			if err := ensureWritableDir(cfg.Outputs.AzureLogAnalytics.Spill.Directory); err != nil {
 				return err
 			}
+			if cfg.Outputs.AzureLogAnalytics.Spill.Encrypt {
+				if _, err := seal.FromEnv(cfg.Outputs.AzureLogAnalytics.Spill.KeyEnv); err != nil {
+					return fmt.Errorf("spill encryption key: %w", err)
+				}
+			}
+		}
+	}
+	if cfg.Outputs.Queue.Enabled && cfg.Outputs.Queue.Encrypt {
+		if _, err := seal.FromEnv(cfg.Outputs.Queue.KeyEnv); err != nil {
+			return fmt.Errorf("queue encryption key: %w", err)
 		}
 	}
 	return nil
@@ -101,6 +101,13 @@ var (
 		Help:      "Total events dropped by pipeline filters.",
 	}, []string{"pipeline", "route", "source"})
 
+	RouteEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bibbl",
+		Subsystem: "route",
+		Name:      "events_total",
+		Help:      "Total route evaluations by outcome (matched, cloned, filtered, delivered).",
+	}, []string{"route", "status"})
+
 	PipelineErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "bibbl",
 		Subsystem: "pipeline",
@@ -131,6 +138,72 @@ var (
 		Buckets:   []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60},
 	}, []string{"destination"})
 
+	// Output Metrics
+	OutputEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bibbl",
+		Subsystem: "output",
+		Name:      "events_total",
+		Help:      "Events handed to destination outputs, by acceptance status.",
+	}, []string{"destination", "status"})
+
+	// Destination queue Metrics
+	QueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bibbl",
+		Subsystem: "queue",
+		Name:      "depth",
+		Help:      "Events waiting in a destination's disk queue.",
+	}, []string{"destination"})
+
+	QueueBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bibbl",
+		Subsystem: "queue",
+		Name:      "bytes",
+		Help:      "On-disk size of a destination's queue segments.",
+	}, []string{"destination"})
+
+	QueueOldestAge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bibbl",
+		Subsystem: "queue",
+		Name:      "oldest_age_seconds",
+		Help:      "Age of the oldest unacknowledged event in a destination's queue.",
+	}, []string{"destination"})
+
+	QueueDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bibbl",
+		Subsystem: "queue",
+		Name:      "dropped_total",
+		Help:      "Events dropped by a destination's queue, by reason (full, corrupt, tampered).",
+	}, []string{"destination", "reason"})
+
+	CircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bibbl",
+		Subsystem: "output",
+		Name:      "circuit_state",
+		Help:      "Circuit breaker state per destination (0 closed, 1 open, 2 half-open).",
+	}, []string{"destination"})
+
+	CircuitFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bibbl",
+		Subsystem: "output",
+		Name:      "circuit_failures",
+		Help:      "Consecutive failed deliveries counted by a destination's circuit breaker.",
+	}, []string{"destination"})
+
+	// Dead-letter Metrics
+	DLQSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "bibbl",
+		Subsystem: "dlq",
+		Name:      "entries",
+		Help:      "Events held in a destination's dead-letter store.",
+	}, []string{"destination"})
+
+	DLQEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "bibbl",
+		Subsystem: "dlq",
+		Name:      "events_total",
+		Help:      "Dead-letter store activity by action (added, replayed, purged, evicted).",
+	}, []string{"destination", "action"})
+
 	// System Metrics
 	SystemInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "bibbl",
@@ -146,12 +219,12 @@ var (
 		Help:      "System uptime in seconds.",
 	})
 
-	ConfigReloads = prometheus.NewCounter(prometheus.CounterOpts{
+	ConfigReloads = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: "bibbl",
 		Subsystem: "system",
 		Name:      "config_reloads_total",
-		Help:      "Total configuration reloads.",
-	})
+		Help:      "Total configuration reloads by status.",
+	}, []string{"status"})
 
 	// Authentication Metrics
 	AuthAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -207,7 +280,12 @@ func Init() {
 			HTTPLatency, HTTPInFlight, HTTPRequests, HTTPRequestSize, HTTPResponseSize,
 			BufferSize, BufferDropped, BufferDroppedCurrent, BufferCapacity,
 			PipelineLatency, PipelineThroughput, PipelineFiltered, PipelineErrors,
+			RouteEvents,
 			IngestEvents, IngestBytes, IngestLatency,
+			OutputEvents,
+			QueueDepth, QueueBytes, QueueOldestAge, QueueDropped,
+			DLQSize, DLQEvents,
+			CircuitState, CircuitFailures,
 			SystemInfo, SystemUptime, ConfigReloads,
 			AuthAttempts, AuthSessions,
 			AzureCost, AzureIngestionEvents,
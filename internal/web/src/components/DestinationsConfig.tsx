@@ -16,7 +16,7 @@ interface Destination {
   name: string;
   type: 'sentinel' | 'splunk' | 's3' | 'azure_blob' | 'elasticsearch' | 'azure_datalake' | 'azure_loganalytics';
   config: Record<string, any>;
-  status: 'connected' | 'disconnected' | 'error';
+  status: 'connected' | 'disconnected' | 'error' | 'circuit_open' | 'circuit_half_open';
   enabled: boolean;
 }
 
@@ -607,7 +607,8 @@ export default function DestinationsConfig() {
                           size="small"
                           color={
                             dest.status === 'connected' ? 'success' : 
-                            dest.status === 'error' ? 'error' : 'default'
+                            dest.status === 'error' || dest.status === 'circuit_open' ? 'error' :
+                            dest.status === 'circuit_half_open' ? 'warning' : 'default'
                           }
                           sx={{ fontWeight: 600, fontSize: 10 }}
                         />
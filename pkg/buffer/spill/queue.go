@@ -1,7 +1,9 @@
 package spill
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -10,12 +12,19 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"bibbl/pkg/seal"
 )
 
 type Config struct {
 	Directory   string
 	MaxBytes    int64
 	SegmentSize int64
+	// Keys, when set, seals every spill file with AES-256-GCM. Plaintext
+	// files are then refused as tampered unless AllowPlaintext is set, to
+	// replay files left from before encryption was enabled.
+	Keys           *seal.Keyring
+	AllowPlaintext bool
 }
 
 type Queue struct {
@@ -77,7 +86,16 @@ func (q *Queue) Append(events []map[string]interface{}) error {
 	if err := os.MkdirAll(q.cfg.Directory, 0o750); err != nil {
 		return err
 	}
-	fname := fmt.Sprintf("spill-%d-%d.json", time.Now().UnixNano(), fileSeq.Add(1))
+	ext := ".json"
+	if q.cfg.Keys != nil {
+		sealer, err := q.cfg.Keys.NewSegment()
+		if err != nil {
+			return err
+		}
+		data = append(append([]byte{}, sealer.Header()...), sealer.Seal(0, data, nil)...)
+		ext = ".seal"
+	}
+	fname := fmt.Sprintf("spill-%d-%d%s", time.Now().UnixNano(), fileSeq.Add(1), ext)
 	full := filepath.Join(q.cfg.Directory, fname)
 	if err := os.WriteFile(full, data, 0o640); err != nil {
 		return err
@@ -87,11 +105,14 @@ func (q *Queue) Append(events []map[string]interface{}) error {
 }
 
 // Replay replays buffered batches until the handler returns an error or the queue is empty.
+// Sealed files that fail authentication are never handed to the handler; they are
+// renamed with a "tampered-" prefix and reported in the returned error.
 func (q *Queue) Replay(handler func([]map[string]interface{}) error) error {
 	files, err := q.listFiles()
 	if err != nil {
 		return err
 	}
+	var tampered []error
 	for _, f := range files {
 		full := filepath.Join(q.cfg.Directory, f.Name())
 		info, err := f.Info()
@@ -102,6 +123,16 @@ func (q *Queue) Replay(handler func([]map[string]interface{}) error) error {
 		if err != nil {
 			return err
 		}
+		if data, err = q.open(data); errors.Is(err, seal.ErrTampered) {
+			if err := os.Rename(full, filepath.Join(q.cfg.Directory, "tampered-"+f.Name())); err != nil {
+				return err
+			}
+			q.release(info.Size())
+			tampered = append(tampered, fmt.Errorf("spill batch %s: %w", f.Name(), err))
+			continue
+		} else if err != nil {
+			return fmt.Errorf("spill batch %s: %w", f.Name(), err)
+		}
 		var batch []map[string]interface{}
 		if err := json.Unmarshal(data, &batch); err != nil {
 			return fmt.Errorf("decode spill batch %s: %w", f.Name(), err)
@@ -112,14 +143,34 @@ func (q *Queue) Replay(handler func([]map[string]interface{}) error) error {
 		if err := os.Remove(full); err != nil {
 			return err
 		}
-		q.mu.Lock()
-		q.totalBytes -= info.Size()
-		if q.totalBytes < 0 {
-			q.totalBytes = 0
+		q.release(info.Size())
+	}
+	return errors.Join(tampered...)
+}
+
+// open returns the JSON payload of a spill file, authenticating sealed ones.
+func (q *Queue) open(data []byte) ([]byte, error) {
+	r := bytes.NewReader(data)
+	if !seal.IsSealed(r) {
+		if q.cfg.Keys != nil && !q.cfg.AllowPlaintext {
+			return nil, fmt.Errorf("plaintext file in an encrypted spill directory: %w", seal.ErrTampered)
 		}
-		q.mu.Unlock()
+		return data, nil
 	}
-	return nil
+	sealer, err := q.cfg.Keys.OpenSegment(r)
+	if err != nil {
+		return nil, err
+	}
+	return sealer.Open(0, data[len(sealer.Header()):], nil)
+}
+
+func (q *Queue) release(n int64) {
+	q.mu.Lock()
+	q.totalBytes -= n
+	if q.totalBytes < 0 {
+		q.totalBytes = 0
+	}
+	q.mu.Unlock()
 }
 
 func (q *Queue) listFiles() ([]os.DirEntry, error) {
@@ -0,0 +1,40 @@
+package spill
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bibbl/pkg/seal"
+)
+
+func TestReplayRefusesPlaintextWhenEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	plain, _ := NewQueue(Config{Directory: dir})
+	if err := plain.Append([]map[string]interface{}{{"forged": true}}); err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := seal.ParseKeyring("k1:" + strings.Repeat("11", 32))
+
+	var replayed int
+	count := func(batch []map[string]interface{}) error { replayed += len(batch); return nil }
+	q, _ := NewQueue(Config{Directory: dir, Keys: keys})
+	if err := q.Replay(count); !errors.Is(err, seal.ErrTampered) || replayed != 0 {
+		t.Fatalf("expected the plaintext file refused as tampered, got %v after %d events", err, replayed)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "tampered-spill-*")); len(files) != 1 {
+		t.Fatalf("expected the plaintext file kept aside, got %v", files)
+	}
+
+	// With the migration flag plaintext files are replayed.
+	_ = plain.Append([]map[string]interface{}{{"legacy": true}})
+	q, _ = NewQueue(Config{Directory: dir, Keys: keys, AllowPlaintext: true})
+	if err := q.Replay(count); err != nil || replayed != 1 {
+		t.Fatalf("allowPlaintext: %v, %d events", err, replayed)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("expected only the quarantined file left, got %d entries", len(entries))
+	}
+}
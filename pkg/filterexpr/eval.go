@@ -0,0 +1,393 @@
+package filterexpr
+
+import (
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type node interface {
+	eval(event map[string]interface{}) interface{}
+}
+
+type literalNode struct{ v interface{} }
+
+func (n *literalNode) eval(map[string]interface{}) interface{} { return n.v }
+
+// fieldNode reads event fields. An empty path is the event itself.
+type fieldNode struct{ path []string }
+
+func (n *fieldNode) eval(event map[string]interface{}) interface{} {
+	if len(n.path) == 0 {
+		return event
+	}
+	// Flattened keys such as "geo.country" win over nested lookups.
+	if len(n.path) > 1 {
+		if v, ok := event[strings.Join(n.path, ".")]; ok {
+			return v
+		}
+	}
+	var cur interface{} = event
+	for _, key := range n.path {
+		cur = member(cur, key)
+		if cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+type memberNode struct {
+	obj node
+	key node
+}
+
+func (n *memberNode) eval(event map[string]interface{}) interface{} {
+	return member(n.obj.eval(event), n.key.eval(event))
+}
+
+func member(obj, key interface{}) interface{} {
+	switch o := obj.(type) {
+	case map[string]interface{}:
+		return o[toString(key)]
+	case map[string]string:
+		if v, ok := o[toString(key)]; ok {
+			return v
+		}
+	case []interface{}:
+		if f, ok := toNumber(key); ok && f >= 0 && int(f) < len(o) {
+			return o[int(f)]
+		}
+		if toString(key) == "length" {
+			return float64(len(o))
+		}
+	case string:
+		if toString(key) == "length" {
+			return float64(len(o))
+		}
+	}
+	return nil
+}
+
+type listNode struct{ items []node }
+
+func (n *listNode) eval(event map[string]interface{}) interface{} {
+	out := make([]interface{}, len(n.items))
+	for i, it := range n.items {
+		out[i] = it.eval(event)
+	}
+	return out
+}
+
+type orNode struct{ left, right node }
+
+func (n *orNode) eval(event map[string]interface{}) interface{} {
+	return truthy(n.left.eval(event)) || truthy(n.right.eval(event))
+}
+
+type andNode struct{ left, right node }
+
+func (n *andNode) eval(event map[string]interface{}) interface{} {
+	return truthy(n.left.eval(event)) && truthy(n.right.eval(event))
+}
+
+type notNode struct{ operand node }
+
+func (n *notNode) eval(event map[string]interface{}) interface{} {
+	return !truthy(n.operand.eval(event))
+}
+
+type negNode struct{ operand node }
+
+func (n *negNode) eval(event map[string]interface{}) interface{} {
+	if f, ok := toNumber(n.operand.eval(event)); ok {
+		return -f
+	}
+	return nil
+}
+
+type equalNode struct {
+	left, right node
+	negate      bool
+}
+
+func (n *equalNode) eval(event map[string]interface{}) interface{} {
+	return equal(n.left.eval(event), n.right.eval(event)) != n.negate
+}
+
+type compareNode struct {
+	op          string
+	left, right node
+}
+
+func (n *compareNode) eval(event map[string]interface{}) interface{} {
+	a, b := n.left.eval(event), n.right.eval(event)
+	if a == nil || b == nil {
+		return false
+	}
+	var c int
+	if x, ok := toNumber(a); ok {
+		if y, ok := toNumber(b); ok {
+			switch {
+			case x < y:
+				c = -1
+			case x > y:
+				c = 1
+			}
+			return cmpResult(n.op, c)
+		}
+	}
+	c = strings.Compare(toString(a), toString(b))
+	return cmpResult(n.op, c)
+}
+
+func cmpResult(op string, c int) bool {
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+type inNode struct{ left, right node }
+
+func (n *inNode) eval(event map[string]interface{}) interface{} {
+	needle := n.left.eval(event)
+	switch hay := n.right.eval(event).(type) {
+	case []interface{}:
+		for _, v := range hay {
+			if equal(needle, v) {
+				return true
+			}
+		}
+	case string:
+		return needle != nil && strings.Contains(hay, toString(needle))
+	case map[string]interface{}:
+		_, ok := hay[toString(needle)]
+		return ok
+	}
+	return false
+}
+
+type arithNode struct {
+	op          byte
+	left, right node
+}
+
+func (n *arithNode) eval(event map[string]interface{}) interface{} {
+	a, b := n.left.eval(event), n.right.eval(event)
+	x, xok := toNumber(a)
+	y, yok := toNumber(b)
+	if !xok || !yok {
+		if n.op == '+' {
+			return toString(a) + toString(b)
+		}
+		return nil
+	}
+	switch n.op {
+	case '+':
+		return x + y
+	case '-':
+		return x - y
+	case '*':
+		return x * y
+	case '/':
+		if y == 0 {
+			return nil
+		}
+		return x / y
+	case '%':
+		if y == 0 {
+			return nil
+		}
+		return math.Mod(x, y)
+	}
+	return nil
+}
+
+type stringTestNode struct {
+	method   string
+	obj, arg node
+}
+
+func (n *stringTestNode) eval(event map[string]interface{}) interface{} {
+	obj := n.obj.eval(event)
+	arg := n.arg.eval(event)
+	if list, ok := obj.([]interface{}); ok && n.method == "includes" {
+		for _, v := range list {
+			if equal(v, arg) {
+				return true
+			}
+		}
+		return false
+	}
+	if obj == nil || arg == nil {
+		return false
+	}
+	s, sub := toString(obj), toString(arg)
+	switch n.method {
+	case "startsWith":
+		return strings.HasPrefix(s, sub)
+	case "endsWith":
+		return strings.HasSuffix(s, sub)
+	}
+	return strings.Contains(s, sub)
+}
+
+type stringFuncNode struct {
+	method string
+	obj    node
+}
+
+func (n *stringFuncNode) eval(event map[string]interface{}) interface{} {
+	v := n.obj.eval(event)
+	if v == nil {
+		return nil
+	}
+	s := toString(v)
+	switch n.method {
+	case "toLowerCase":
+		return strings.ToLower(s)
+	case "toUpperCase":
+		return strings.ToUpper(s)
+	}
+	return strings.TrimSpace(s)
+}
+
+type regexNode struct {
+	subject node
+	re      *regexp.Regexp
+}
+
+func (n *regexNode) eval(event map[string]interface{}) interface{} {
+	v := n.subject.eval(event)
+	if v == nil {
+		return false
+	}
+	return n.re.MatchString(toString(v))
+}
+
+type cidrNode struct {
+	addr node
+	nets []*net.IPNet
+}
+
+func (n *cidrNode) eval(event map[string]interface{}) interface{} {
+	ip := net.ParseIP(strings.TrimSpace(toString(n.addr.eval(event))))
+	if ip == nil {
+		return false
+	}
+	for _, nw := range n.nets {
+		if nw.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type existsNode struct{ operand node }
+
+func (n *existsNode) eval(event map[string]interface{}) interface{} {
+	return n.operand.eval(event) != nil
+}
+
+func truthy(v interface{}) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0 && !math.IsNaN(x)
+	case int:
+		return x != 0
+	case int64:
+		return x != 0
+	case string:
+		return x != ""
+	case []interface{}:
+		return true
+	}
+	return true
+}
+
+func parseNumber(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+func toNumber(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case float64:
+		return x, true
+	case float32:
+		return float64(x), true
+	case int:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	case uint64:
+		return float64(x), true
+	case string:
+		s := strings.TrimSpace(x)
+		if s == "" {
+			return 0, false
+		}
+		return parseNumber(s)
+	}
+	return 0, false
+}
+
+func toString(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case bool:
+		return strconv.FormatBool(x)
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64)
+	case int:
+		return strconv.Itoa(x)
+	case int64:
+		return strconv.FormatInt(x, 10)
+	}
+	if f, ok := toNumber(v); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return ""
+}
+
+// equal is loose in the way route authors expect from log data: field values
+// parsed from key=value text are strings, so "6" == 6 holds.
+func equal(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if x, ok := a.(bool); ok {
+		y, ok := b.(bool)
+		return ok && x == y
+	}
+	if _, ok := b.(bool); ok {
+		return false
+	}
+	_, aStr := a.(string)
+	_, bStr := b.(string)
+	if !aStr || !bStr {
+		if x, ok := toNumber(a); ok {
+			if y, ok := toNumber(b); ok {
+				return x == y
+			}
+		}
+	}
+	return toString(a) == toString(b)
+}
@@ -0,0 +1,562 @@
+// Package filterexpr implements the boolean expression language used by route
+// filters. Expressions are JavaScript-like and evaluate against a parsed event:
+//
+//	event.severity === "critical" && src_ip in ["10.0.0.1", "10.0.0.2"]
+//	_raw.includes("CEF:") || cidr(event.src_ip, "10.0.0.0/8", "192.168.0.0/16")
+//	event.severity_level_d >= 6 && !event.user.startsWith("svc_")
+//
+// Programs are compiled once and are side-effect free: there are no loops,
+// assignments or host calls, and regular expressions use RE2.
+package filterexpr
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// Limits that keep compiled programs small and evaluation bounded.
+const (
+	MaxLength = 4096
+	MaxDepth  = 64
+)
+
+// RegexPrefix selects the legacy form where the remainder of the filter is a
+// regular expression matched against the raw event text.
+const RegexPrefix = "regex:"
+
+// ExprPrefix marks the remainder of the filter as an expression. Compile
+// accepts it anywhere; CompileLegacy needs it, since there a filter without
+// a prefix is a regular expression.
+const ExprPrefix = "expr:"
+
+// Error reports a compile failure. Pos is the 1-based character column in the
+// filter source.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("filter error at position %d: %s", e.Pos, e.Msg)
+}
+
+func errorf(offset int, format string, args ...interface{}) *Error {
+	return &Error{Pos: offset + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Program is a compiled filter.
+type Program struct {
+	src    string
+	root   node
+	fields bool // references fields other than _raw
+}
+
+// String returns the source the program was compiled from.
+func (p *Program) String() string { return p.src }
+
+// UsesFields reports whether the program reads parsed event fields. Programs
+// that only look at _raw can be evaluated without parsing the event.
+func (p *Program) UsesFields() bool { return p.fields }
+
+// Match evaluates the program against an event. The raw message is expected
+// under "_raw".
+func (p *Program) Match(event map[string]interface{}) bool {
+	if p == nil || p.root == nil {
+		return true
+	}
+	return truthy(p.root.eval(event))
+}
+
+// Compile parses a filter. An empty filter and "true" match everything, and
+// "regex:<pattern>" matches the pattern against _raw.
+func Compile(src string) (*Program, error) {
+	trimmed := strings.TrimSpace(src)
+	if trimmed == "" || trimmed == "true" {
+		return &Program{src: src}, nil
+	}
+	if len(src) > MaxLength {
+		return nil, &Error{Pos: MaxLength + 1, Msg: fmt.Sprintf("filter longer than %d characters", MaxLength)}
+	}
+	if strings.HasPrefix(trimmed, ExprPrefix) {
+		// Blank the prefix rather than cutting it so error positions still
+		// point into src.
+		prog, err := Compile(strings.Replace(src, ExprPrefix, strings.Repeat(" ", len(ExprPrefix)), 1))
+		if err != nil {
+			return nil, err
+		}
+		prog.src = src
+		return prog, nil
+	}
+	if strings.HasPrefix(trimmed, RegexPrefix) {
+		pattern := strings.TrimPrefix(trimmed, RegexPrefix)
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errorf(strings.Index(src, RegexPrefix)+len(RegexPrefix), "invalid regex: %v", err)
+		}
+		return &Program{src: src, root: &regexNode{subject: &fieldNode{path: []string{"_raw"}}, re: re}}, nil
+	}
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	root, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, errorf(t.pos, "unexpected %s", describe(t))
+	}
+	return &Program{src: src, root: root, fields: p.fields}, nil
+}
+
+// CompileLegacy interprets a filter the way route filters were before the
+// expression language existed: as a regular expression over _raw. Only an
+// empty filter, "true" and filters with the regex: or expr: prefix are
+// handed to Compile. Whether the text would also parse as an expression does
+// not matter; "CEF" or "error|warn" must keep meaning what they meant.
+func CompileLegacy(src string) (*Program, error) {
+	trimmed := strings.TrimSpace(src)
+	if trimmed == "" || trimmed == "true" || strings.HasPrefix(trimmed, RegexPrefix) || strings.HasPrefix(trimmed, ExprPrefix) {
+		return Compile(src)
+	}
+	if len(src) > MaxLength {
+		return nil, &Error{Pos: MaxLength + 1, Msg: fmt.Sprintf("filter longer than %d characters", MaxLength)}
+	}
+	re, err := regexp.Compile(src)
+	if err != nil {
+		return nil, errorf(1, "invalid regex: %v", err)
+	}
+	return &Program{src: src, root: &regexNode{subject: &fieldNode{path: []string{"_raw"}}, re: re}}, nil
+}
+
+type parser struct {
+	toks   []token
+	i      int
+	depth  int
+	fields bool
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) isOp(text string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == text
+}
+
+func (p *parser) expectOp(text string) (token, error) {
+	t := p.next()
+	if t.kind != tokOp || t.text != text {
+		return t, errorf(t.pos, "expected %q, found %s", text, describe(t))
+	}
+	return t, nil
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of filter"
+	case tokString:
+		return fmt.Sprintf("string %q", t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func (p *parser) enter(pos int) error {
+	p.depth++
+	if p.depth > MaxDepth {
+		return errorf(pos, "expression nested deeper than %d levels", MaxDepth)
+	}
+	return nil
+}
+
+func (p *parser) leave() { p.depth-- }
+
+func (p *parser) parseExpr() (node, error) { return p.parseOr() }
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseEquality()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseEquality()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseEquality() (node, error) {
+	left, err := p.parseRelational()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("==") || p.isOp("===") || p.isOp("!=") || p.isOp("!==") {
+		op := p.next().text
+		right, err := p.parseRelational()
+		if err != nil {
+			return nil, err
+		}
+		left = &equalNode{left: left, right: right, negate: op[0] == '!'}
+	}
+	return left, nil
+}
+
+func (p *parser) parseRelational() (node, error) {
+	left, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		switch {
+		case t.kind == tokOp && (t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+			p.next()
+			right, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			left = &compareNode{op: t.text, left: left, right: right}
+		case t.kind == tokIdent && t.text == "in":
+			p.next()
+			right, err := p.parseAdditive()
+			if err != nil {
+				return nil, err
+			}
+			left = &inNode{left, right}
+		default:
+			return left, nil
+		}
+	}
+}
+
+func (p *parser) parseAdditive() (node, error) {
+	left, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("+") || p.isOp("-") {
+		op := p.next().text
+		right, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{op: op[0], left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseMultiplicative() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("*") || p.isOp("/") || p.isOp("%") {
+		op := p.next().text
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &arithNode{op: op[0], left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	if p.isOp("!") || p.isOp("-") {
+		t := p.next()
+		if err := p.enter(t.pos); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "!" {
+			return &notNode{operand}, nil
+		}
+		return &negNode{operand}, nil
+	}
+	return p.parsePostfix()
+}
+
+func (p *parser) parsePostfix() (node, error) {
+	n, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.isOp(".") || p.isOp("?."):
+			p.next()
+			name := p.next()
+			if name.kind != tokIdent {
+				return nil, errorf(name.pos, "expected field or method name, found %s", describe(name))
+			}
+			if p.isOp("(") {
+				args, err := p.parseArgs()
+				if err != nil {
+					return nil, err
+				}
+				n, err = newMethod(n, name, args)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if f, ok := n.(*fieldNode); ok {
+				f.path = append(f.path, name.text)
+				p.noteField(f)
+				continue
+			}
+			n = &memberNode{obj: n, key: &literalNode{name.text}}
+		case p.isOp("["):
+			open := p.next()
+			if err := p.enter(open.pos); err != nil {
+				return nil, err
+			}
+			key, err := p.parseExpr()
+			p.leave()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expectOp("]"); err != nil {
+				return nil, err
+			}
+			if f, ok := n.(*fieldNode); ok {
+				if lit, ok := key.(*literalNode); ok {
+					if s, ok := lit.v.(string); ok {
+						f.path = append(f.path, s)
+						p.noteField(f)
+						continue
+					}
+				}
+			}
+			n = &memberNode{obj: n, key: key}
+		default:
+			return n, nil
+		}
+	}
+}
+
+func (p *parser) noteField(f *fieldNode) {
+	if !(len(f.path) == 1 && f.path[0] == "_raw") {
+		p.fields = true
+	}
+}
+
+func (p *parser) parseArgs() ([]argument, error) {
+	open, err := p.expectOp("(")
+	if err != nil {
+		return nil, err
+	}
+	if err := p.enter(open.pos); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	var args []argument
+	if p.isOp(")") {
+		p.next()
+		return args, nil
+	}
+	for {
+		pos := p.peek().pos
+		arg, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, argument{node: arg, pos: pos})
+		if p.isOp(",") {
+			p.next()
+			continue
+		}
+		if _, err := p.expectOp(")"); err != nil {
+			return nil, err
+		}
+		return args, nil
+	}
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return &literalNode{t.num}, nil
+	case tokString:
+		return &literalNode{t.text}, nil
+	case tokIdent:
+		switch t.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null", "undefined":
+			return &literalNode{nil}, nil
+		case "in":
+			return nil, errorf(t.pos, "unexpected %q", t.text)
+		}
+		if p.isOp("(") {
+			args, err := p.parseArgs()
+			if err != nil {
+				return nil, err
+			}
+			return newFunction(t, args)
+		}
+		f := &fieldNode{}
+		if t.text != "event" {
+			f.path = []string{t.text}
+			p.noteField(f)
+		}
+		return f, nil
+	case tokOp:
+		switch t.text {
+		case "(":
+			if err := p.enter(t.pos); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			n, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		case "[":
+			if err := p.enter(t.pos); err != nil {
+				return nil, err
+			}
+			defer p.leave()
+			var items []node
+			if p.isOp("]") {
+				p.next()
+				return &listNode{items}, nil
+			}
+			for {
+				item, err := p.parseExpr()
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+				if p.isOp(",") {
+					p.next()
+					continue
+				}
+				if _, err := p.expectOp("]"); err != nil {
+					return nil, err
+				}
+				return &listNode{items}, nil
+			}
+		}
+	}
+	return nil, errorf(t.pos, "unexpected %s", describe(t))
+}
+
+type argument struct {
+	node node
+	pos  int
+}
+
+func literalString(a argument, what string) (string, error) {
+	if lit, ok := a.node.(*literalNode); ok {
+		if s, ok := lit.v.(string); ok {
+			return s, nil
+		}
+	}
+	return "", errorf(a.pos, "%s must be a string literal", what)
+}
+
+func newMethod(obj node, name token, args []argument) (node, error) {
+	arity := func(n int) error {
+		if len(args) != n {
+			return errorf(name.pos, "%s expects %d argument(s), got %d", name.text, n, len(args))
+		}
+		return nil
+	}
+	switch name.text {
+	case "startsWith", "endsWith", "includes":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		return &stringTestNode{method: name.text, obj: obj, arg: args[0].node}, nil
+	case "match", "test":
+		if err := arity(1); err != nil {
+			return nil, err
+		}
+		pattern, err := literalString(args[0], "regex")
+		if err != nil {
+			return nil, err
+		}
+		re, reErr := regexp.Compile(pattern)
+		if reErr != nil {
+			return nil, errorf(args[0].pos, "invalid regex: %v", reErr)
+		}
+		return &regexNode{subject: obj, re: re}, nil
+	case "toLowerCase", "toUpperCase", "trim":
+		if err := arity(0); err != nil {
+			return nil, err
+		}
+		return &stringFuncNode{method: name.text, obj: obj}, nil
+	}
+	return nil, errorf(name.pos, "unknown method %q", name.text)
+}
+
+func newFunction(name token, args []argument) (node, error) {
+	switch name.text {
+	case "cidr":
+		if len(args) < 2 {
+			return nil, errorf(name.pos, "cidr expects an address and at least one network")
+		}
+		nets := make([]*net.IPNet, 0, len(args)-1)
+		for _, a := range args[1:] {
+			s, err := literalString(a, "cidr network")
+			if err != nil {
+				return nil, err
+			}
+			_, n, parseErr := net.ParseCIDR(strings.TrimSpace(s))
+			if parseErr != nil {
+				return nil, errorf(a.pos, "invalid network %q", s)
+			}
+			nets = append(nets, n)
+		}
+		return &cidrNode{addr: args[0].node, nets: nets}, nil
+	case "exists":
+		if len(args) != 1 {
+			return nil, errorf(name.pos, "exists expects 1 argument, got %d", len(args))
+		}
+		return &existsNode{args[0].node}, nil
+	}
+	return nil, errorf(name.pos, "unknown function %q", name.text)
+}
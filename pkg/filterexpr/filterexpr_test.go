@@ -0,0 +1,130 @@
+package filterexpr
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	event := map[string]interface{}{
+		"_raw":             "CEF:0|Versa|FW|1|severity=critical src_ip=10.1.2.3",
+		"severity":         "Critical",
+		"severity_level_d": "7",
+		"src_ip":           "10.1.2.3",
+		"user":             "svc_backup",
+		"bytes":            1500.0,
+		"geo":              map[string]interface{}{"country": "NZ"},
+		"tags":             []interface{}{"fw", "edge"},
+	}
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"true", true},
+		{`_raw?.includes('CEF:')`, true},
+		{`event.severity === "Critical" || event.severity === "critical"`, true},
+		{`event.severity_level_d >= 6 && event.severity_level_d <= 8`, true},
+		{`severity_level_d == 7`, true},
+		{`severity.toLowerCase() in ["critical", "high"]`, true},
+		{`!user.startsWith("svc_")`, false},
+		{`user.endsWith("backup") && geo.country == "NZ"`, true},
+		{`event["geo"]["country"] != "AU"`, true},
+		{`cidr(src_ip, "192.168.0.0/16", "10.0.0.0/8")`, true},
+		{`cidr(src_ip, "192.168.0.0/16")`, false},
+		{`bytes / 1000 > 1 && bytes % 2 == 0`, true},
+		{`tags.includes("edge") && tags.length == 2`, true},
+		{`_raw.match("src_ip=10\\.\\d+")`, true},
+		{`missing == null && !exists(missing) && !missing`, true},
+		{`missing > 1`, false},
+		{`regex:^CEF:\d`, true},
+		{`regex:^LEEF`, false},
+	}
+	for _, tc := range cases {
+		prog, err := Compile(tc.expr)
+		if err != nil {
+			t.Fatalf("compile %q: %v", tc.expr, err)
+		}
+		if got := prog.Match(event); got != tc.want {
+			t.Fatalf("%q: got %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestCompileErrorPositions(t *testing.T) {
+	cases := []struct {
+		expr string
+		pos  int
+	}{
+		{`severity == `, 13},
+		{`severity === "x" &&& y`, 20},
+		{`user.explode()`, 6},
+		{`nope(src_ip)`, 1},
+		{`cidr(src_ip, "10.0.0.0/33")`, 14},
+		{`_raw.match("(")`, 12},
+		{`severity == 'open`, 13},
+		{`(a || b`, 8},
+	}
+	for _, tc := range cases {
+		_, err := Compile(tc.expr)
+		var ferr *Error
+		if !errors.As(err, &ferr) {
+			t.Fatalf("%q: expected *Error, got %v", tc.expr, err)
+		}
+		if ferr.Pos != tc.pos {
+			t.Fatalf("%q: got position %d (%v), want %d", tc.expr, ferr.Pos, ferr, tc.pos)
+		}
+	}
+}
+
+func TestCompileLegacy(t *testing.T) {
+	if _, err := Compile(`^\d+ CEF:`); err == nil {
+		t.Fatal("expected plain regex to be rejected by Compile")
+	}
+	prog, err := CompileLegacy(`^\d+ CEF:`)
+	if err != nil {
+		t.Fatalf("legacy compile: %v", err)
+	}
+	if !prog.Match(map[string]interface{}{"_raw": "12 CEF:0|x"}) {
+		t.Fatal("expected legacy regex to match _raw")
+	}
+	if prog.UsesFields() {
+		t.Fatal("legacy regex should not need parsed fields")
+	}
+
+	// Sources that also parse as expressions stay regexes in legacy mode.
+	for src, cases := range map[string]map[string]bool{
+		"CEF":        {"CEF:0|Palo Alto": true, "syslog line": false},
+		"error|warn": {"disk warn 90%": true, "all good": false},
+	} {
+		prog, err := CompileLegacy(src)
+		if err != nil {
+			t.Fatalf("legacy compile %q: %v", src, err)
+		}
+		for raw, want := range cases {
+			// The event has a CEF field so an expression would match it.
+			if got := prog.Match(map[string]interface{}{"_raw": raw, "CEF": "1", "error": true}); got != want {
+				t.Fatalf("%q on %q: got %v, want %v", src, raw, got, want)
+			}
+		}
+	}
+	prog, err = CompileLegacy(`expr:severity == "high"`)
+	if err != nil || !prog.Match(map[string]interface{}{"severity": "high"}) || prog.Match(map[string]interface{}{"_raw": `severity == "high"`}) {
+		t.Fatalf("expr: prefix should select the expression language in legacy mode: %v", err)
+	}
+	if _, err := Compile(`expr:severity ==`); err == nil {
+		t.Fatal("expected an incomplete expression to be rejected")
+	} else if ferr := err.(*Error); ferr.Pos <= len(ExprPrefix) {
+		t.Fatalf("error position should point past the prefix, got %d", ferr.Pos)
+	}
+}
+
+func TestDepthLimit(t *testing.T) {
+	expr := ""
+	for i := 0; i <= MaxDepth; i++ {
+		expr += "("
+	}
+	if _, err := Compile(expr + "true"); err == nil {
+		t.Fatal("expected nesting limit error")
+	}
+}
@@ -0,0 +1,137 @@
+package filterexpr
+
+import (
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string // operator/identifier text, or the decoded string literal
+	num  float64
+	pos  int // 0-based byte offset into the source
+}
+
+// operators are matched longest first.
+var operators = []string{
+	"===", "!==",
+	"==", "!=", "<=", ">=", "&&", "||", "?.",
+	"(", ")", "[", "]", ",", ".", "!", "<", ">", "+", "-", "*", "/", "%",
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '@' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && isIdentPart(src[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: tokIdent, text: src[start:i], pos: start})
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				for i < len(src) && isDigit(src[i]) {
+					i++
+				}
+			}
+			n, ok := parseNumber(src[start:i])
+			if !ok {
+				return nil, errorf(start, "invalid number %q", src[start:i])
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[start:i], num: n, pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			s, next, err := lexString(src, i)
+			if err != nil {
+				return nil, err
+			}
+			i = next
+			toks = append(toks, token{kind: tokString, text: s, pos: start})
+		default:
+			matched := ""
+			for _, op := range operators {
+				if strings.HasPrefix(src[i:], op) {
+					matched = op
+					break
+				}
+			}
+			if matched == "" {
+				return nil, errorf(i, "unexpected character %q", c)
+			}
+			toks = append(toks, token{kind: tokOp, text: matched, pos: i})
+			i += len(matched)
+		}
+	}
+	toks = append(toks, token{kind: tokEOF, pos: len(src)})
+	return toks, nil
+}
+
+func lexString(src string, start int) (string, int, error) {
+	quote := src[start]
+	var b strings.Builder
+	i := start + 1
+	for i < len(src) {
+		c := src[i]
+		if c == quote {
+			return b.String(), i + 1, nil
+		}
+		if c == '\\' {
+			if i+1 >= len(src) {
+				break
+			}
+			i++
+			switch src[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			default:
+				// Escaped quotes and backslashes lose the backslash; anything
+				// else (e.g. regex escapes like \d) is kept verbatim.
+				if src[i] != quote && src[i] != '\\' {
+					b.WriteByte('\\')
+				}
+				b.WriteByte(src[i])
+			}
+			i++
+			continue
+		}
+		b.WriteByte(c)
+		i++
+	}
+	return "", 0, errorf(start, "unterminated string")
+}
@@ -0,0 +1,732 @@
+// Package archive is the staging and rollover engine behind the object
+// storage outputs (S3, ADLS). Events are appended to per-partition staging
+// files on local disk, fsynced before a batch is acknowledged, and sealed
+// into compressed objects when they reach a size or age limit. Sealed
+// objects are handed to an Uploader and deleted only once it succeeds, so a
+// crash or an unreachable bucket never loses data: whatever is on disk is
+// picked up again when the output restarts.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bibbl/pkg/outputs"
+	"bibbl/pkg/outputs/parquet"
+)
+
+// Uploader stores a sealed object under key. body is positioned at the
+// start and holds size bytes; Upload may seek and re-read it.
+type Uploader interface {
+	Upload(key string, body *os.File, size int64) error
+}
+
+// Config is embedded in the configs of archive outputs.
+type Config struct {
+	// Prefix is prepended to every key unless PathTemplate already starts
+	// with it.
+	Prefix string `json:"prefix"`
+	// PathTemplate partitions objects by event time and fields, e.g.
+	// logs/year=${yyyy}/month=${MM}/day=${dd}/${source}/data.jsonl.gz.
+	// A unique id is inserted before the extension of every object.
+	PathTemplate string `json:"pathTemplate"`
+	TimeField    string `json:"timeField"` // event time for the template, default "timestamp"
+
+	Format      string `json:"format"`      // ndjson (default; jsonl is an alias) | parquet
+	Compression string `json:"compression"` // gzip (default) | zstd | none; parquet: snappy (default) | zstd | gzip | none
+
+	// ParquetSchema fixes the Parquet columns to a parser's field list
+	// (versa, paloalto) so every file has the same schema; empty infers the
+	// columns from the first events of each file. Other fields land in the
+	// _extra JSON column.
+	ParquetSchema        string `json:"parquetSchema"`
+	ParquetRowGroupBytes int64  `json:"parquetRowGroupBytes"` // default 32 MiB uncompressed
+
+	// An object is sealed and uploaded when its staged (uncompressed) size
+	// reaches RolloverBytes or it has been open RolloverSec seconds.
+	RolloverBytes  int64 `json:"rolloverBytes"`
+	RolloverSec    int   `json:"rolloverSec"`
+	MaxOpenObjects int   `json:"maxOpenObjects"`
+
+	// StagingDir holds open and sealed objects until they are uploaded.
+	// The engine sets a per-destination directory under the data dir.
+	StagingDir     string `json:"stagingDir"`
+	UploadRetrySec int    `json:"uploadRetrySec"`
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+}
+
+// Defaults.
+const (
+	DefaultRolloverBytes  = 64 << 20
+	DefaultRolloverSec    = 300
+	DefaultMaxOpenObjects = 32
+	DefaultPathTemplate   = "${yyyy}/${MM}/${dd}/${HH}/bibbl"
+)
+
+const (
+	stagedExt   = ".staged"
+	objectExt   = ".obj"
+	manifestExt = ".json"
+)
+
+// manifest describes a staged object on disk.
+type manifest struct {
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+	Sealed  bool      `json:"sealed"`
+	Events  int       `json:"events,omitempty"`
+	Bytes   int64     `json:"bytes,omitempty"` // sealed object size
+}
+
+// object is an open staging file for one partition.
+type object struct {
+	id      string
+	base    string // rendered partition key
+	key     string
+	f       *os.File
+	bytes   int64
+	events  int
+	created time.Time
+}
+
+// Writer is an outputs.Output that archives events through an Uploader.
+type Writer struct {
+	*outputs.Batcher
+
+	name          string
+	cfg           Config
+	tmpl          *outputs.Template
+	ext           string
+	parquetFields []string
+	uploader      Uploader
+
+	mu      sync.Mutex
+	open    map[string]*object
+	upMu    sync.Mutex // one upload pass at a time
+	pending []string   // sealed object ids, oldest first
+	closed  bool
+
+	statsMu       sync.Mutex
+	uploaded      uint64
+	uploadedBytes uint64
+	lastUpload    time.Time
+	lastUploadErr string
+	lastErrAt     time.Time
+
+	kick     chan struct{}
+	stop     chan struct{}
+	loops    sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// NewWriter validates cfg, recovers objects left in the staging directory
+// by a previous run and starts the rollover and upload loops. name prefixes
+// log lines.
+func NewWriter(name string, cfg Config, up Uploader) (*Writer, error) {
+	if cfg.PathTemplate == "" {
+		cfg.PathTemplate = DefaultPathTemplate
+	}
+	if cfg.Prefix != "" && !strings.HasPrefix(cfg.PathTemplate, cfg.Prefix) {
+		cfg.PathTemplate = strings.TrimSuffix(cfg.Prefix, "/") + "/" + strings.TrimPrefix(cfg.PathTemplate, "/")
+	}
+	tmpl, err := outputs.ParseTemplate(strings.TrimPrefix(cfg.PathTemplate, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TimeField == "" {
+		cfg.TimeField = "timestamp"
+	}
+	var parquetFields []string
+	cfg.Compression = strings.ToLower(cfg.Compression)
+	switch cfg.Format = strings.ToLower(cfg.Format); cfg.Format {
+	case "", "ndjson", "jsonl", "json":
+		cfg.Format = "ndjson"
+		switch cfg.Compression {
+		case "":
+			cfg.Compression = "gzip"
+		case "gzip", "zstd", "none":
+		default:
+			return nil, fmt.Errorf("compression must be gzip, zstd or none, got %q", cfg.Compression)
+		}
+	case "parquet":
+		switch cfg.Compression {
+		case "":
+			cfg.Compression = "snappy"
+		case "snappy", "gzip", "zstd", "none":
+		default:
+			return nil, fmt.Errorf("parquet compression must be snappy, zstd, gzip or none, got %q", cfg.Compression)
+		}
+		if cfg.ParquetSchema != "" {
+			fields, err := parquet.FieldSet(cfg.ParquetSchema)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(fields, cfg.TimeField) {
+				fields = append([]string{cfg.TimeField}, fields...)
+			}
+			parquetFields = fields
+		}
+	default:
+		return nil, fmt.Errorf("format must be ndjson or parquet, got %q", cfg.Format)
+	}
+	if cfg.RolloverBytes <= 0 {
+		cfg.RolloverBytes = DefaultRolloverBytes
+	}
+	if cfg.RolloverSec <= 0 {
+		cfg.RolloverSec = DefaultRolloverSec
+	}
+	if cfg.MaxOpenObjects <= 0 {
+		cfg.MaxOpenObjects = DefaultMaxOpenObjects
+	}
+	if cfg.UploadRetrySec <= 0 {
+		cfg.UploadRetrySec = 30
+	}
+	if cfg.StagingDir == "" {
+		sum := sha256.Sum256([]byte(name + "\x00" + cfg.PathTemplate))
+		cfg.StagingDir = filepath.Join(os.TempDir(), "bibbl-staging", hex.EncodeToString(sum[:8]))
+	}
+	if err := os.MkdirAll(cfg.StagingDir, 0o700); err != nil {
+		return nil, fmt.Errorf("create staging dir: %w", err)
+	}
+	w := &Writer{
+		name:          name,
+		cfg:           cfg,
+		tmpl:          tmpl,
+		ext:           extension(cfg.Format, cfg.Compression),
+		parquetFields: parquetFields,
+		uploader:      up,
+		open:          make(map[string]*object),
+		kick:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+	}
+	if err := w.recover(); err != nil {
+		return nil, err
+	}
+	w.Batcher = outputs.NewBatcher(name, outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, w.stage)
+	w.loops.Add(2)
+	go w.rolloverLoop()
+	go w.uploadLoop()
+	w.signal()
+	return w, nil
+}
+
+// Config returns the effective configuration, defaults applied.
+func (w *Writer) Config() Config { return w.cfg }
+
+func extension(format, compression string) string {
+	if format == "parquet" {
+		return ".parquet" // compression is inside the file
+	}
+	ext := "." + format
+	switch compression {
+	case "gzip":
+		ext += ".gz"
+	case "zstd":
+		ext += ".zst"
+	}
+	return ext
+}
+
+// objectKey turns a rendered partition into a unique object key: the id
+// goes before the extension of the last path segment, and the default
+// extension is added when the template has none.
+func (w *Writer) objectKey(base, id string) string {
+	dir, file := path.Split(base)
+	if file == "" {
+		file = "bibbl"
+	}
+	if i := strings.IndexByte(file, '.'); i > 0 {
+		return dir + file[:i] + "-" + id + file[i:]
+	}
+	return dir + file + "-" + id + w.ext
+}
+
+// stage appends events to their partitions' staging files and fsyncs them,
+// so a batch is on disk before the caller (usually the destination queue)
+// lets go of it.
+func (w *Writer) stage(events []map[string]interface{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return outputs.ErrClosed
+	}
+	touched := map[*object]bool{}
+	for _, ev := range events {
+		line, err := json.Marshal(ev)
+		if err != nil {
+			w.DeadLetter([]map[string]interface{}{ev}, outputs.Permanent(0, fmt.Errorf("failed to marshal event: %w", err)))
+			continue
+		}
+		ts, ok := outputs.EventTime(ev, w.cfg.TimeField)
+		if !ok {
+			ts = time.Now()
+		}
+		base := w.tmpl.Execute(ev, ts)
+		obj, err := w.objectLocked(base)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if _, err := obj.f.Write(line); err != nil {
+			return fmt.Errorf("write staging file: %w", err)
+		}
+		obj.bytes += int64(len(line))
+		obj.events++
+		touched[obj] = true
+	}
+	sealed := false
+	for obj := range touched {
+		if w.open[obj.base] != obj {
+			continue // sealed to make room for another partition
+		}
+		if err := obj.f.Sync(); err != nil {
+			return fmt.Errorf("sync staging file: %w", err)
+		}
+		if obj.bytes >= w.cfg.RolloverBytes {
+			w.sealLocked(obj)
+			sealed = true
+		}
+	}
+	if sealed {
+		w.signal()
+	}
+	return nil
+}
+
+// objectLocked returns the open object for a partition, opening one (and
+// sealing the oldest when too many are open) as needed.
+func (w *Writer) objectLocked(base string) (*object, error) {
+	if obj := w.open[base]; obj != nil {
+		return obj, nil
+	}
+	if len(w.open) >= w.cfg.MaxOpenObjects {
+		var oldest *object
+		for _, o := range w.open {
+			if oldest == nil || o.created.Before(oldest.created) {
+				oldest = o
+			}
+		}
+		w.sealLocked(oldest)
+		w.signal()
+	}
+	id := newID()
+	obj := &object{id: id, base: base, key: w.objectKey(base, id), created: time.Now().UTC()}
+	if err := writeManifest(w.file(id, manifestExt), manifest{Key: obj.key, Created: obj.created}); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(w.file(id, stagedExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open staging file: %w", err)
+	}
+	obj.f = f
+	w.open[base] = obj
+	return obj, nil
+}
+
+// sealLocked closes an open object and turns it into an upload candidate.
+// A seal failure leaves the staging file in place for the next start.
+func (w *Writer) sealLocked(obj *object) {
+	delete(w.open, obj.base)
+	if err := obj.f.Close(); err != nil {
+		log.Printf("%s: close staging file %s: %v", w.name, obj.id, err)
+	}
+	if err := w.seal(obj.id, manifest{Key: obj.key, Created: obj.created}); err != nil {
+		log.Printf("%s: seal %s: %v", w.name, obj.key, err)
+		return
+	}
+	w.pending = append(w.pending, obj.id)
+}
+
+// seal encodes the staged lines into the final object: write to a temp
+// file, fsync, rename, mark the manifest sealed, then drop the staged file.
+// Each step leaves a state recover understands.
+func (w *Writer) seal(id string, m manifest) error {
+	src, err := os.Open(w.file(id, stagedExt))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := w.file(id, objectExt+".tmp")
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	events, err := w.encode(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.file(id, objectExt)); err != nil {
+		return err
+	}
+	m.Sealed, m.Events, m.Bytes = true, events, info.Size()
+	if err := writeManifest(w.file(id, manifestExt), m); err != nil {
+		return err
+	}
+	return os.Remove(w.file(id, stagedExt))
+}
+
+// encode writes the complete lines of src to dst in the configured format
+// and compression and returns how many events it wrote. A torn last line
+// from a crash mid-write is dropped.
+func (w *Writer) encode(dst io.Writer, src io.Reader) (int, error) {
+	if w.cfg.Format == "parquet" {
+		return w.encodeParquet(dst, src)
+	}
+	zw, err := compressor(dst, w.cfg.Compression)
+	if err != nil {
+		return 0, err
+	}
+	events := 0
+	r := bufio.NewReaderSize(src, 64*1024)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break // an unterminated line is torn
+		}
+		if err != nil {
+			return 0, err
+		}
+		if _, err := zw.Write(line); err != nil {
+			return 0, err
+		}
+		events++
+	}
+	return events, zw.Close()
+}
+
+// encodeParquet writes the complete lines of src to dst as one Parquet
+// file. Without a fixed field list the columns are typed from the first
+// parquet.SampleSize events.
+func (w *Writer) encodeParquet(dst io.Writer, src io.Reader) (int, error) {
+	var (
+		pw     *parquet.Writer
+		sample []map[string]interface{}
+		events int
+	)
+	start := func() error {
+		var err error
+		pw, err = parquet.NewWriter(dst, parquet.InferSchema(sample, w.parquetFields), parquet.Options{
+			Compression:   w.cfg.Compression,
+			RowGroupBytes: w.cfg.ParquetRowGroupBytes,
+		})
+		if err != nil {
+			return err
+		}
+		for _, ev := range sample {
+			if err := pw.Write(ev); err != nil {
+				return err
+			}
+		}
+		sample = nil
+		return nil
+	}
+	r := bufio.NewReaderSize(src, 64*1024)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break // an unterminated line is torn
+		}
+		if err != nil {
+			return 0, err
+		}
+		var ev map[string]interface{}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(&ev); err != nil {
+			log.Printf("%s: skip unreadable staged line: %v", w.name, err)
+			continue
+		}
+		events++
+		if pw != nil {
+			if err := pw.Write(ev); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if sample = append(sample, ev); len(sample) == parquet.SampleSize {
+			if err := start(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if pw == nil {
+		if err := start(); err != nil {
+			return 0, err
+		}
+	}
+	return events, pw.Close()
+}
+
+// recover picks up what a previous run left in the staging directory:
+// sealed objects are queued for upload, open ones are sealed first.
+func (w *Writer) recover() error {
+	entries, err := os.ReadDir(w.cfg.StagingDir)
+	if err != nil {
+		return fmt.Errorf("read staging dir: %w", err)
+	}
+	type found struct {
+		id string
+		m  manifest
+	}
+	var all []found
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			_ = os.Remove(filepath.Join(w.cfg.StagingDir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, manifestExt) {
+			continue
+		}
+		id := strings.TrimSuffix(name, manifestExt)
+		m, err := readManifest(w.file(id, manifestExt))
+		if err != nil {
+			log.Printf("%s: skip staged object %s: %v", w.name, id, err)
+			continue
+		}
+		all = append(all, found{id, m})
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].m.Created.Before(all[j].m.Created) })
+	for _, f := range all {
+		_, stagedErr := os.Stat(w.file(f.id, stagedExt))
+		_, objErr := os.Stat(w.file(f.id, objectExt))
+		switch {
+		case f.m.Sealed && objErr == nil:
+			_ = os.Remove(w.file(f.id, stagedExt))
+		case stagedErr == nil:
+			if err := w.seal(f.id, f.m); err != nil {
+				log.Printf("%s: seal recovered object %s: %v", w.name, f.m.Key, err)
+				continue
+			}
+			log.Printf("%s: recovered staged object %s", w.name, f.m.Key)
+		default:
+			_ = os.Remove(w.file(f.id, manifestExt))
+			continue
+		}
+		w.pending = append(w.pending, f.id)
+	}
+	return nil
+}
+
+func (w *Writer) rolloverLoop() {
+	defer w.loops.Done()
+	every := time.Duration(w.cfg.RolloverSec) * time.Second / 10
+	every = min(max(every, 100*time.Millisecond), 5*time.Second)
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+			w.Rollover(time.Duration(w.cfg.RolloverSec) * time.Second)
+		}
+	}
+}
+
+// Rollover seals every open object older than age; 0 seals all of them.
+func (w *Writer) Rollover(age time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sealed := false
+	for _, obj := range w.open {
+		if time.Since(obj.created) >= age {
+			w.sealLocked(obj)
+			sealed = true
+		}
+	}
+	if sealed {
+		w.signal()
+	}
+}
+
+func (w *Writer) signal() {
+	select {
+	case w.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Writer) uploadLoop() {
+	defer w.loops.Done()
+	t := time.NewTicker(time.Duration(w.cfg.UploadRetrySec) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.kick:
+		case <-t.C:
+		}
+		w.UploadPending()
+	}
+}
+
+// UploadPending uploads sealed objects oldest first and stops at the first
+// failure; the rest wait for the next attempt.
+func (w *Writer) UploadPending() {
+	w.upMu.Lock()
+	defer w.upMu.Unlock()
+	for {
+		w.mu.Lock()
+		if len(w.pending) == 0 {
+			w.mu.Unlock()
+			return
+		}
+		id := w.pending[0]
+		w.mu.Unlock()
+
+		if err := w.upload(id); err != nil {
+			log.Printf("%s: upload: %v", w.name, err)
+			w.statsMu.Lock()
+			w.lastUploadErr, w.lastErrAt = err.Error(), time.Now()
+			w.statsMu.Unlock()
+			return
+		}
+		w.mu.Lock()
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+	}
+}
+
+func (w *Writer) upload(id string) error {
+	m, err := readManifest(w.file(id, manifestExt))
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(w.file(id, objectExt))
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = w.uploader.Upload(m.Key, f, info.Size())
+	}
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", m.Key, err)
+	}
+	_ = os.Remove(w.file(id, objectExt))
+	_ = os.Remove(w.file(id, manifestExt))
+	w.statsMu.Lock()
+	w.uploaded++
+	w.uploadedBytes += uint64(info.Size())
+	w.lastUpload = time.Now()
+	w.statsMu.Unlock()
+	return nil
+}
+
+// Health reports staging writes as the delivery health, turned to error
+// while uploads are failing, with the upload state in Details.
+func (w *Writer) Health() outputs.Health {
+	h := w.Batcher.Health()
+	w.mu.Lock()
+	open, pending := len(w.open), len(w.pending)
+	var staged int64
+	for _, obj := range w.open {
+		staged += obj.bytes
+	}
+	w.mu.Unlock()
+	w.statsMu.Lock()
+	defer w.statsMu.Unlock()
+	d := map[string]interface{}{
+		"openObjects":    open,
+		"stagedBytes":    staged,
+		"pendingUploads": pending,
+		"uploaded":       w.uploaded,
+		"uploadedBytes":  w.uploadedBytes,
+	}
+	if !w.lastUpload.IsZero() {
+		d["lastUpload"] = w.lastUpload
+	}
+	if w.lastUploadErr != "" && w.lastErrAt.After(w.lastUpload) {
+		d["lastUploadError"] = w.lastUploadErr
+		h.Status = outputs.StatusError
+		h.LastError, h.LastErrorAt = w.lastUploadErr, w.lastErrAt
+	}
+	h.Details = map[string]interface{}{"archive": d}
+	return h
+}
+
+// Close stages what is still batched, seals every open object and makes
+// one last upload attempt. Objects that fail stay on disk for the next run.
+func (w *Writer) Close() error {
+	err := w.Batcher.Close()
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		w.loops.Wait()
+		w.mu.Lock()
+		for _, obj := range w.open {
+			w.sealLocked(obj)
+		}
+		w.closed = true
+		w.mu.Unlock()
+		w.UploadPending()
+	})
+	return err
+}
+
+func (w *Writer) file(id, ext string) string {
+	return filepath.Join(w.cfg.StagingDir, id+ext)
+}
+
+func writeManifest(p string, m manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func readManifest(p string) (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return m, err
+	}
+	return m, json.Unmarshal(data, &m)
+}
+
+func newID() string {
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b[:])
+}
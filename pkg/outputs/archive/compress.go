@@ -0,0 +1,25 @@
+package archive
+
+import (
+	"compress/gzip"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// compressor wraps w for the given compression; Close finishes the stream
+// but leaves w open.
+func compressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	default:
+		return nopCloser{w}, nil
+	}
+}
@@ -0,0 +1,693 @@
+// Package azuredataexplorer sends events to Azure Data Explorer (Kusto),
+// either through the streaming ingest endpoint for low-latency small batches
+// or through queued ingestion (blob upload plus queue message) for volume.
+package azuredataexplorer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bibbl/pkg/outputs"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// Ingestion modes.
+const (
+	ModeStreaming = "streaming"
+	ModeQueued    = "queued"
+	// ModeAuto streams batches up to StreamingMaxBytes and queues larger ones.
+	ModeAuto = "auto"
+)
+
+const (
+	defaultStreamingMaxBytes = 4 * 1024 * 1024 // service limit per streaming request
+	resourcesTTL             = time.Hour
+	storageVersion           = "2021-08-06"
+	// pendingTTL bounds how long a queued ingestion is tracked without a
+	// final status.
+	pendingTTL = 2 * time.Hour
+)
+
+var tableName = regexp.MustCompile(`^[A-Za-z0-9_.\- ]{1,256}$`)
+
+// Config holds configuration for an Azure Data Explorer destination.
+type Config struct {
+	ClusterURL string `json:"clusterUrl"` // https://<cluster>.<region>.kusto.windows.net
+	// IngestURL is the data management endpoint used by queued ingestion.
+	// Default: the cluster URL with an "ingest-" host prefix.
+	IngestURL string `json:"ingestUrl"`
+	Database  string `json:"database"`
+	Table     string `json:"table"`
+	// TableField routes each event to the table named by this field, falling
+	// back to Table when it is missing or not a valid table name.
+	TableField string `json:"tableField"`
+	// Mapping is the ingestion mapping reference (a JSON mapping created
+	// with .create table ... ingestion json mapping); Mappings overrides it
+	// per table.
+	Mapping  string            `json:"mapping"`
+	Mappings map[string]string `json:"mappings"`
+
+	Mode              string `json:"mode"` // streaming (default) | queued | auto
+	StreamingMaxBytes int    `json:"streamingMaxBytes"`
+	// FlushImmediately skips the service-side batching of queued ingestion.
+	FlushImmediately bool `json:"flushImmediately"`
+	StatusPollSec    int  `json:"statusPollSec"` // queued ingestion status checks, default 30
+
+	outputs.EntraConfig
+	Scope string `json:"scope"` // default <clusterUrl>/.default
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+	TimeoutSec       int `json:"timeoutSec"`
+	MaxRetries       int `json:"maxRetries"`
+	RetryDelayMs     int `json:"retryDelayMs"`
+
+	TLS outputs.TLSConfig `json:"tls"`
+}
+
+// ADXOutput ingests batches into Azure Data Explorer tables.
+type ADXOutput struct {
+	*outputs.Batcher
+
+	cfg    Config
+	cred   azcore.TokenCredential
+	client *http.Client
+
+	resMu     sync.Mutex
+	res       *resources
+	resExpiry time.Time
+	next      atomic.Uint64
+
+	statusMu  sync.Mutex
+	pending   map[string]pendingIngestion
+	succeeded uint64
+	failed    uint64
+	lastFail  map[string]interface{}
+	streamed  uint64
+	queued    uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// resources are the storage endpoints handed out by the data management
+// service for queued ingestion. All URLs carry their own SAS.
+type resources struct {
+	containers []string
+	queues     []string
+	tables     []string
+	authCtx    string
+}
+
+type pendingIngestion struct {
+	table     string
+	entityURL string
+	events    int
+	at        time.Time
+}
+
+// NewADXOutput validates cfg, applies defaults and starts the output.
+func NewADXOutput(cfg Config) (*ADXOutput, error) {
+	cfg.ClusterURL = strings.TrimRight(strings.TrimSpace(cfg.ClusterURL), "/")
+	u, err := url.Parse(cfg.ClusterURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("clusterUrl must be an https URL, got %q", cfg.ClusterURL)
+	}
+	if cfg.Database == "" {
+		return nil, fmt.Errorf("database is required")
+	}
+	if cfg.Table == "" && cfg.TableField == "" {
+		return nil, fmt.Errorf("table or tableField is required")
+	}
+	if cfg.Table != "" && !tableName.MatchString(cfg.Table) {
+		return nil, fmt.Errorf("invalid table name %q", cfg.Table)
+	}
+	if cfg.IngestURL == "" {
+		ingest := *u
+		ingest.Host = "ingest-" + u.Host
+		cfg.IngestURL = ingest.String()
+	}
+	cfg.IngestURL = strings.TrimRight(cfg.IngestURL, "/")
+	switch cfg.Mode = strings.ToLower(cfg.Mode); cfg.Mode {
+	case "":
+		cfg.Mode = ModeStreaming
+	case ModeStreaming, ModeQueued, ModeAuto:
+	default:
+		return nil, fmt.Errorf("mode must be streaming, queued or auto, got %q", cfg.Mode)
+	}
+	if cfg.StreamingMaxBytes <= 0 || cfg.StreamingMaxBytes > defaultStreamingMaxBytes {
+		cfg.StreamingMaxBytes = defaultStreamingMaxBytes
+	}
+	if cfg.StatusPollSec <= 0 {
+		cfg.StatusPollSec = 30
+	}
+	if cfg.Scope == "" {
+		cfg.Scope = cfg.ClusterURL + "/.default"
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 60
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryDelayMs <= 0 {
+		cfg.RetryDelayMs = 1000
+	}
+	tlsCfg, err := cfg.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+	var credTLS *tls.Config
+	if cfg.TLS.Configured() {
+		credTLS = tlsCfg
+	}
+	cred, err := cfg.EntraConfig.Credential(credTLS)
+	if err != nil {
+		return nil, fmt.Errorf("entra credential: %w", err)
+	}
+	o := &ADXOutput{
+		cfg:  cfg,
+		cred: cred,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.TimeoutSec) * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+				TLSClientConfig:     tlsCfg,
+			},
+		},
+		pending: make(map[string]pendingIngestion),
+		stop:    make(chan struct{}),
+	}
+	o.Batcher = outputs.NewBatcher("adx", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.deliver)
+	if cfg.Mode != ModeStreaming {
+		go o.pollStatus()
+	}
+	return o, nil
+}
+
+// NewOutput builds an ADXOutput from a destination config map. It is the
+// factory registered for the "azure_data_explorer" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewADXOutput(c)
+}
+
+// Close flushes pending events and stops status polling.
+func (o *ADXOutput) Close() error {
+	o.stopOnce.Do(func() { close(o.stop) })
+	return o.Batcher.Close()
+}
+
+// Health adds the ingestion counters to the delivery health. Queued
+// ingestion is asynchronous, so a failure reported by the service after the
+// upload also turns the status to error.
+func (o *ADXOutput) Health() outputs.Health {
+	h := o.Batcher.Health()
+	o.statusMu.Lock()
+	defer o.statusMu.Unlock()
+	ingestion := map[string]interface{}{
+		"mode":      o.cfg.Mode,
+		"streamed":  o.streamed,
+		"queued":    o.queued,
+		"pending":   len(o.pending),
+		"succeeded": o.succeeded,
+		"failed":    o.failed,
+	}
+	if o.lastFail != nil {
+		ingestion["lastFailure"] = o.lastFail
+	}
+	h.Details = map[string]interface{}{"ingestion": ingestion}
+	return h
+}
+
+// group is the events bound for one table, encoded as gzipped
+// newline-delimited JSON (Kusto's multijson format).
+type group struct {
+	table  string
+	events []map[string]interface{}
+	raw    []byte
+}
+
+// deliver routes the batch to tables and ingests each table's events.
+func (o *ADXOutput) deliver(events []map[string]interface{}) error {
+	var order []string
+	groups := map[string]*group{}
+	for _, ev := range events {
+		table := o.cfg.Table
+		if o.cfg.TableField != "" {
+			if t := outputs.FieldString(ev, o.cfg.TableField); tableName.MatchString(t) {
+				table = t
+			}
+		}
+		if table == "" {
+			o.DeadLetter([]map[string]interface{}{ev}, outputs.Permanent(0, fmt.Errorf("event has no valid %q field and no default table is set", o.cfg.TableField)))
+			continue
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			o.DeadLetter([]map[string]interface{}{ev}, outputs.Permanent(0, fmt.Errorf("failed to marshal event: %w", err)))
+			continue
+		}
+		g := groups[table]
+		if g == nil {
+			g = &group{table: table}
+			groups[table] = g
+			order = append(order, table)
+		}
+		// Streaming requests are capped, so cut a table's events into
+		// several groups when they would exceed the limit.
+		if o.cfg.Mode == ModeStreaming && len(g.raw) > 0 && len(g.raw)+len(data)+1 > o.cfg.StreamingMaxBytes {
+			if err := o.ingest(g); err != nil {
+				return err
+			}
+			g.events, g.raw = nil, nil
+		}
+		g.events = append(g.events, ev)
+		g.raw = append(append(g.raw, data...), '\n')
+	}
+	for _, table := range order {
+		if g := groups[table]; len(g.events) > 0 {
+			if err := o.ingest(g); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ingest sends one table's events, dead-lettering them when the service
+// rejects them for good.
+func (o *ADXOutput) ingest(g *group) error {
+	var err error
+	if o.cfg.Mode == ModeQueued || (o.cfg.Mode == ModeAuto && len(g.raw) > o.cfg.StreamingMaxBytes) {
+		err = o.retry(func() error { return o.queue(g) })
+	} else {
+		err = o.retry(func() error { return o.stream(g) })
+	}
+	if _, permanent := outputs.IsPermanent(err); permanent {
+		o.DeadLetter(g.events, err)
+		return nil
+	}
+	return err
+}
+
+func (o *ADXOutput) mapping(table string) string {
+	if m, ok := o.cfg.Mappings[table]; ok {
+		return m
+	}
+	return o.cfg.Mapping
+}
+
+// stream posts the events to the streaming ingest endpoint.
+func (o *ADXOutput) stream(g *group) error {
+	q := url.Values{"streamFormat": {"MultiJSON"}}
+	if m := o.mapping(g.table); m != "" {
+		q.Set("mappingName", m)
+	}
+	target := fmt.Sprintf("%s/v1/rest/ingest/%s/%s?%s", o.cfg.ClusterURL, url.PathEscape(o.cfg.Database), url.PathEscape(g.table), q.Encode())
+	body, err := gzipBytes(g.raw)
+	if err != nil {
+		return err
+	}
+	if _, err := o.call(http.MethodPost, target, body, true, map[string]string{
+		"Content-Type":     "application/json; charset=utf-8",
+		"Content-Encoding": "gzip",
+	}); err != nil {
+		return err
+	}
+	o.statusMu.Lock()
+	o.streamed += uint64(len(g.events))
+	o.statusMu.Unlock()
+	return nil
+}
+
+// queue uploads the events to a temporary storage blob, records a pending
+// status row and posts the ingestion message for the data management
+// service to pick up.
+func (o *ADXOutput) queue(g *group) error {
+	res, err := o.resources()
+	if err != nil {
+		return err
+	}
+	n := o.next.Add(1)
+	container := res.containers[int(n%uint64(len(res.containers)))]
+	queueURL := res.queues[int(n%uint64(len(res.queues)))]
+
+	id := newID()
+	blobURL, err := childURL(container, fmt.Sprintf("/%s__%s__%s.multijson.gz", o.cfg.Database, g.table, id))
+	if err != nil {
+		return err
+	}
+	body, err := gzipBytes(g.raw)
+	if err != nil {
+		return err
+	}
+	if _, err := o.call(http.MethodPut, blobURL, body, false, map[string]string{
+		"x-ms-blob-type": "BlockBlob",
+		"Content-Type":   "application/octet-stream",
+	}); err != nil {
+		return fmt.Errorf("upload blob: %w", err)
+	}
+
+	msg := map[string]interface{}{
+		"Id":                        id,
+		"BlobPath":                  blobURL,
+		"RawDataSize":               len(g.raw),
+		"DatabaseName":              o.cfg.Database,
+		"TableName":                 g.table,
+		"RetainBlobOnSuccess":       false,
+		"FlushImmediately":          o.cfg.FlushImmediately,
+		"ReportLevel":               1, // do not report, unless a status table is available
+		"SourceMessageCreationTime": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	props := map[string]interface{}{"authorizationContext": res.authCtx, "format": "multijson"}
+	if m := o.mapping(g.table); m != "" {
+		props["ingestionMappingReference"] = m
+		props["ingestionMappingType"] = "Json"
+	}
+	msg["AdditionalProperties"] = props
+
+	var entityURL string
+	if len(res.tables) > 0 {
+		tableURL := res.tables[int(n%uint64(len(res.tables)))]
+		if entityURL, err = o.insertStatus(tableURL, id, g.table); err != nil {
+			return err
+		}
+		msg["ReportLevel"] = 2  // failures and successes
+		msg["ReportMethod"] = 1 // table
+		msg["IngestionStatusInTable"] = map[string]interface{}{"TableConnectionString": tableURL, "PartitionKey": id, "RowKey": id}
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	xmlBody := "<QueueMessage><MessageText>" + base64.StdEncoding.EncodeToString(data) + "</MessageText></QueueMessage>"
+	msgURL, err := childURL(queueURL, "/messages")
+	if err != nil {
+		return err
+	}
+	if _, err := o.call(http.MethodPost, msgURL, []byte(xmlBody), false, map[string]string{"Content-Type": "application/xml"}); err != nil {
+		return fmt.Errorf("post ingestion message: %w", err)
+	}
+
+	o.statusMu.Lock()
+	o.queued += uint64(len(g.events))
+	if entityURL != "" {
+		o.pending[id] = pendingIngestion{table: g.table, entityURL: entityURL, events: len(g.events), at: time.Now()}
+	}
+	o.statusMu.Unlock()
+	return nil
+}
+
+// insertStatus creates the Pending row the service updates once the blob
+// has been ingested, and returns the row's URL.
+func (o *ADXOutput) insertStatus(tableURL, id, table string) (string, error) {
+	row, err := json.Marshal(map[string]interface{}{
+		"PartitionKey":      id,
+		"RowKey":            id,
+		"IngestionSourceId": id,
+		"Database":          o.cfg.Database,
+		"Table":             table,
+		"Status":            "Pending",
+		"UpdatedOn":         time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := o.call(http.MethodPost, tableURL, row, false, map[string]string{
+		"Content-Type": "application/json",
+		"Accept":       "application/json;odata=nometadata",
+		"Prefer":       "return-no-content",
+	}); err != nil {
+		return "", fmt.Errorf("create ingestion status row: %w", err)
+	}
+	return childURL(tableURL, fmt.Sprintf("(PartitionKey='%s',RowKey='%s')", id, id))
+}
+
+// pollStatus checks the status rows of queued ingestions until Close.
+func (o *ADXOutput) pollStatus() {
+	t := time.NewTicker(time.Duration(o.cfg.StatusPollSec) * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-t.C:
+			o.checkStatus()
+		}
+	}
+}
+
+// checkStatus reads the status row of every pending ingestion and records
+// the final ones.
+func (o *ADXOutput) checkStatus() {
+	o.statusMu.Lock()
+	ids := make(map[string]pendingIngestion, len(o.pending))
+	for id, p := range o.pending {
+		ids[id] = p
+	}
+	o.statusMu.Unlock()
+
+	for id, p := range ids {
+		body, err := o.call(http.MethodGet, p.entityURL, nil, false, map[string]string{"Accept": "application/json;odata=nometadata"})
+		if err != nil {
+			log.Printf("adx: ingestion status %s: %v", id, err)
+			continue
+		}
+		var row struct {
+			Status        string `json:"Status"`
+			Details       string `json:"Details"`
+			ErrorCode     string `json:"ErrorCode"`
+			FailureStatus string `json:"FailureStatus"`
+		}
+		if err := json.Unmarshal(body, &row); err != nil {
+			continue
+		}
+		o.statusMu.Lock()
+		switch row.Status {
+		case "Succeeded", "Skipped":
+			o.succeeded++
+			delete(o.pending, id)
+		case "Failed", "PartiallySucceeded":
+			o.failed++
+			delete(o.pending, id)
+			o.lastFail = map[string]interface{}{
+				"id":            id,
+				"table":         p.table,
+				"events":        p.events,
+				"status":        row.Status,
+				"errorCode":     row.ErrorCode,
+				"failureStatus": row.FailureStatus,
+				"details":       row.Details,
+				"at":            time.Now().UTC(),
+			}
+		default:
+			if time.Since(p.at) > pendingTTL {
+				delete(o.pending, id)
+			}
+		}
+		o.statusMu.Unlock()
+		if row.Status == "Failed" || row.Status == "PartiallySucceeded" {
+			err := fmt.Errorf("ingestion %s into %s %s: %s %s", id, p.table, strings.ToLower(row.Status), row.ErrorCode, row.Details)
+			log.Printf("adx: %v", err)
+			o.Record(0, err)
+		}
+	}
+}
+
+// resources returns the cached ingestion resources, refreshing them from
+// the data management service every hour.
+func (o *ADXOutput) resources() (*resources, error) {
+	o.resMu.Lock()
+	defer o.resMu.Unlock()
+	if o.res != nil && time.Now().Before(o.resExpiry) {
+		return o.res, nil
+	}
+	rows, err := o.mgmt(".get ingestion resources")
+	if err != nil {
+		return nil, fmt.Errorf("get ingestion resources: %w", err)
+	}
+	res := &resources{}
+	for _, r := range rows {
+		if len(r) < 2 {
+			continue
+		}
+		kind, _ := r[0].(string)
+		root, _ := r[1].(string)
+		switch kind {
+		case "TempStorage":
+			res.containers = append(res.containers, root)
+		case "SecuredReadyForAggregationQueue":
+			res.queues = append(res.queues, root)
+		case "IngestionsStatusTable":
+			res.tables = append(res.tables, root)
+		}
+	}
+	if len(res.containers) == 0 || len(res.queues) == 0 {
+		return nil, fmt.Errorf("get ingestion resources: no temp storage or ingestion queue returned")
+	}
+	rows, err = o.mgmt(".get kusto identity token")
+	if err != nil {
+		return nil, fmt.Errorf("get kusto identity token: %w", err)
+	}
+	if len(rows) > 0 && len(rows[0]) > 0 {
+		res.authCtx, _ = rows[0][0].(string)
+	}
+	o.res, o.resExpiry = res, time.Now().Add(resourcesTTL)
+	return res, nil
+}
+
+// mgmt runs a management command against the data management endpoint and
+// returns the rows of its first table.
+func (o *ADXOutput) mgmt(csl string) ([][]interface{}, error) {
+	body, _ := json.Marshal(map[string]string{"db": "NetDefaultDB", "csl": csl})
+	resp, err := o.call(http.MethodPost, o.cfg.IngestURL+"/v1/rest/mgmt", body, true, map[string]string{
+		"Content-Type": "application/json; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Tables []struct {
+			Rows [][]interface{} `json:"Rows"`
+		} `json:"Tables"`
+	}
+	if err := json.Unmarshal(resp, &out); err != nil {
+		return nil, fmt.Errorf("decode %s response: %w", csl, err)
+	}
+	if len(out.Tables) == 0 {
+		return nil, nil
+	}
+	return out.Tables[0].Rows, nil
+}
+
+// retry runs fn with exponential backoff until it succeeds, fails for good
+// or runs out of attempts.
+func (o *ADXOutput) retry(fn func() error) error {
+	delay := time.Duration(o.cfg.RetryDelayMs) * time.Millisecond
+	var err error
+	for attempt := 0; attempt <= o.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if _, permanent := outputs.IsPermanent(err); permanent {
+			return err
+		}
+	}
+	return fmt.Errorf("failed after %d retries: %w", o.cfg.MaxRetries, err)
+}
+
+// call performs one request; auth adds the Entra bearer token (storage URLs
+// authorise with their SAS instead). Non-2xx answers are classified with
+// outputs.HTTPError.
+func (o *ADXOutput) call(method, target string, body []byte, auth bool, headers map[string]string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.cfg.TimeoutSec)*time.Second)
+	defer cancel()
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, rd)
+	if err != nil {
+		return nil, err
+	}
+	if auth {
+		tok, err := o.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{o.cfg.Scope}})
+		if err != nil {
+			return nil, fmt.Errorf("acquire token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tok.Token)
+		req.Header.Set("x-ms-client-request-id", "bibbl;"+newID())
+	} else {
+		req.Header.Set("x-ms-version", storageVersion)
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 8<<20))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := strings.TrimSpace(string(respBody))
+		if len(msg) > 512 {
+			msg = msg[:512]
+		}
+		return nil, outputs.HTTPError(resp.StatusCode, fmt.Errorf("%s %s returned status %d: %s", method, redact(target), resp.StatusCode, msg))
+	}
+	return respBody, nil
+}
+
+// childURL appends suffix to the path of a SAS URL, keeping its query.
+func childURL(base, suffix string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("invalid storage URL: %w", err)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + suffix
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// redact drops the query string, which carries SAS signatures.
+func redact(target string) string {
+	if i := strings.IndexByte(target, '?'); i >= 0 {
+		return target[:i]
+	}
+	return target
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
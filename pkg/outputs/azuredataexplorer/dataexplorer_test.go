@@ -0,0 +1,243 @@
+package azuredataexplorer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"bibbl/pkg/outputs"
+)
+
+// fakeKusto stands in for Entra ID, the engine and data management
+// endpoints, and the storage account behind queued ingestion.
+type fakeKusto struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	streamed map[string][]map[string]interface{} // table -> rows
+	mappings map[string]string
+	blobs    map[string][]byte
+	messages []map[string]interface{}
+	status   map[string]map[string]interface{}
+}
+
+func newFakeKusto(t *testing.T) *fakeKusto {
+	f := &fakeKusto{
+		streamed: map[string][]map[string]interface{}{},
+		mappings: map[string]string{},
+		blobs:    map[string][]byte{},
+		status:   map[string]map[string]interface{}{},
+	}
+	entity := regexp.MustCompile(`^/status\(PartitionKey='([^']+)',RowKey='[^']+'\)$`)
+	f.srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		p := r.URL.Path
+		switch {
+		case p == "/tenant-1/v2.0/.well-known/openid-configuration":
+			base := f.srv.URL + "/tenant-1"
+			_ = json.NewEncoder(w).Encode(map[string]string{"token_endpoint": base + "/token", "authorization_endpoint": base + "/authorize", "issuer": base + "/v2.0"})
+		case p == "/tenant-1/token":
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"tok-1"}`))
+		case strings.HasPrefix(p, "/v1/"):
+			if r.Header.Get("Authorization") != "Bearer tok-1" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			f.kusto(t, w, r)
+		case r.URL.Query().Get("sig") != "x":
+			w.WriteHeader(http.StatusForbidden)
+		case strings.HasPrefix(p, "/temp/") && r.Method == http.MethodPut:
+			f.blobs[p], _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		case p == "/ready/messages" && r.Method == http.MethodPost:
+			body, _ := io.ReadAll(r.Body)
+			text := strings.TrimSuffix(strings.TrimPrefix(string(body), "<QueueMessage><MessageText>"), "</MessageText></QueueMessage>")
+			data, _ := base64.StdEncoding.DecodeString(text)
+			var msg map[string]interface{}
+			_ = json.Unmarshal(data, &msg)
+			f.messages = append(f.messages, msg)
+			w.WriteHeader(http.StatusCreated)
+		case p == "/status" && r.Method == http.MethodPost:
+			var row map[string]interface{}
+			_ = json.NewDecoder(r.Body).Decode(&row)
+			f.status[row["RowKey"].(string)] = row
+			w.WriteHeader(http.StatusNoContent)
+		case entity.MatchString(p) && r.Method == http.MethodGet:
+			row, ok := f.status[entity.FindStringSubmatch(p)[1]]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(row)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func (f *fakeKusto) kusto(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/rest/mgmt" {
+		var cmd map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&cmd)
+		var rows [][]string
+		switch cmd["csl"] {
+		case ".get ingestion resources":
+			rows = [][]string{
+				{"TempStorage", f.srv.URL + "/temp?sig=x"},
+				{"SecuredReadyForAggregationQueue", f.srv.URL + "/ready?sig=x"},
+				{"IngestionsStatusTable", f.srv.URL + "/status?sig=x"},
+			}
+		case ".get kusto identity token":
+			rows = [][]string{{"auth-ctx"}}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"Tables": []map[string]interface{}{{"TableName": "Table_0", "Rows": rows}}})
+		return
+	}
+	// /v1/rest/ingest/{db}/{table}
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 6 || parts[4] != "SecurityDB" || r.URL.Query().Get("streamFormat") != "MultiJSON" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	table := parts[5]
+	if table == "Broken" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":{"code":"BadRequest","@permanent":true}}`))
+		return
+	}
+	f.mappings[table] = r.URL.Query().Get("mappingName")
+	f.streamed[table] = append(f.streamed[table], readRows(t, r.Body)...)
+}
+
+func readRows(t *testing.T, body io.Reader) []map[string]interface{} {
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		t.Errorf("body is not gzip: %v", err)
+		return nil
+	}
+	var rows []map[string]interface{}
+	sc := bufio.NewScanner(zr)
+	for sc.Scan() {
+		var row map[string]interface{}
+		_ = json.Unmarshal(sc.Bytes(), &row)
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func (f *fakeKusto) config(mode string) map[string]interface{} {
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.srv.Certificate().Raw})
+	return map[string]interface{}{
+		"clusterUrl":    f.srv.URL,
+		"ingestUrl":     f.srv.URL,
+		"database":      "SecurityDB",
+		"table":         "Logs",
+		"tableField":    "log_type",
+		"mapping":       "logs_json",
+		"mappings":      map[string]interface{}{"Threat": "threat_json"},
+		"mode":          mode,
+		"tenantId":      "tenant-1",
+		"clientId":      "app-1",
+		"clientSecret":  "s3cret",
+		"authorityHost": f.srv.URL,
+		"retryDelayMs":  1,
+		"tls":           map[string]interface{}{"caPem": string(ca)},
+	}
+}
+
+func TestStreamingRoutesTablesAndMappings(t *testing.T) {
+	f := newFakeKusto(t)
+	out, err := NewOutput(f.config(ModeStreaming))
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dead []map[string]interface{}
+	out.(outputs.DeadLetterer).SetDeadLetter(func(events []map[string]interface{}, err error) { dead = append(dead, events...) })
+
+	err = out.(outputs.BatchSender).SendBatch([]map[string]interface{}{
+		{"log_type": "Threat", "name": "eicar"},
+		{"log_type": "Traffic", "bytes": 10},
+		{"msg": "no type"},
+		{"log_type": "Broken"},
+		{"log_type": "bad;table", "msg": "invalid name"},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(f.streamed["Threat"]) != 1 || f.mappings["Threat"] != "threat_json" {
+		t.Fatalf("Threat rows/mapping wrong: %v %q", f.streamed["Threat"], f.mappings["Threat"])
+	}
+	if len(f.streamed["Traffic"]) != 1 || f.mappings["Traffic"] != "logs_json" {
+		t.Fatalf("Traffic rows/mapping wrong: %v %q", f.streamed["Traffic"], f.mappings["Traffic"])
+	}
+	if len(f.streamed["Logs"]) != 2 {
+		t.Fatalf("events without a valid table should go to the default table: %v", f.streamed["Logs"])
+	}
+	if len(dead) != 1 || dead[0]["log_type"] != "Broken" {
+		t.Fatalf("rejected table should be dead-lettered: %v", dead)
+	}
+	if d := out.Health().Details["ingestion"].(map[string]interface{}); d["streamed"] != uint64(4) {
+		t.Fatalf("unexpected ingestion details: %v", d)
+	}
+}
+
+func TestQueuedIngestionReportsStatusInHealth(t *testing.T) {
+	f := newFakeKusto(t)
+	o, err := NewOutput(f.config(ModeQueued))
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	out := o.(*ADXOutput)
+	defer out.Close()
+
+	if err := out.SendBatch([]map[string]interface{}{{"log_type": "Threat", "name": "a"}, {"log_type": "Threat", "name": "b"}, {"name": "c"}}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(f.messages) != 2 || len(f.blobs) != 2 {
+		t.Fatalf("expected one blob and message per table, got %d messages %d blobs", len(f.messages), len(f.blobs))
+	}
+	msg := f.messages[0]
+	props := msg["AdditionalProperties"].(map[string]interface{})
+	if msg["TableName"] != "Threat" || props["ingestionMappingReference"] != "threat_json" || props["authorizationContext"] != "auth-ctx" || msg["ReportMethod"] != float64(1) {
+		t.Fatalf("unexpected ingestion message: %v", msg)
+	}
+	blobPath := msg["BlobPath"].(string)
+	if rows := readRows(t, strings.NewReader(string(f.blobs[strings.TrimPrefix(strings.Split(blobPath, "?")[0], f.srv.URL)]))); len(rows) != 2 {
+		t.Fatalf("blob should hold the two Threat rows, got %v", rows)
+	}
+	if d := out.Health().Details["ingestion"].(map[string]interface{}); d["pending"] != 2 {
+		t.Fatalf("expected two pending ingestions: %v", d)
+	}
+
+	f.mu.Lock()
+	f.status[msg["Id"].(string)]["Status"] = "Succeeded"
+	failed := f.status[f.messages[1]["Id"].(string)]
+	failed["Status"], failed["ErrorCode"], failed["FailureStatus"] = "Failed", "BadRequest_NoRecordsOrWrongFormat", "Permanent"
+	f.mu.Unlock()
+	out.checkStatus()
+
+	h := out.Health()
+	d := h.Details["ingestion"].(map[string]interface{})
+	if d["pending"] != 0 || d["succeeded"] != uint64(1) || d["failed"] != uint64(1) {
+		t.Fatalf("status not picked up: %v", d)
+	}
+	if lf := d["lastFailure"].(map[string]interface{}); lf["table"] != "Logs" || lf["errorCode"] != "BadRequest_NoRecordsOrWrongFormat" {
+		t.Fatalf("unexpected last failure: %v", lf)
+	}
+	if h.Status != outputs.StatusError {
+		t.Fatalf("a failed ingestion should turn health to error, got %s", h.Status)
+	}
+}
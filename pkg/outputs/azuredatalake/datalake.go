@@ -0,0 +1,367 @@
+// Package azuredatalake archives events to Azure Data Lake Storage Gen2 or
+// Blob Storage. Staging, partitioning and rollover come from package
+// archive; this package uploads the sealed objects through the DFS API
+// (create, append, flush) or the Blob block API, and resumes an upload that
+// was cut short by a restart instead of starting it over.
+package azuredatalake
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bibbl/pkg/outputs"
+	"bibbl/pkg/outputs/archive"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// Storage APIs.
+const (
+	APIDFS  = "dfs"  // ADLS Gen2 (hierarchical namespace) accounts
+	APIBlob = "blob" // any storage account, and Azurite
+)
+
+const (
+	storageVersion    = "2021-08-06"
+	storageScope      = "https://storage.azure.com/.default"
+	defaultChunkBytes = 4 << 20
+)
+
+// Config holds configuration for an azure_datalake destination. The archive
+// settings (pathTemplate, compression, rollover, staging) sit at the top
+// level.
+type Config struct {
+	StorageAccount string `json:"storageAccount"`
+	Filesystem     string `json:"filesystem"` // ADLS filesystem or blob container
+	Container      string `json:"container"`  // alias of filesystem for the blob API
+	// Directory is prepended to every path, like prefix, unless
+	// pathTemplate already starts with it.
+	Directory string `json:"directory"`
+	// Endpoint overrides https://<account>.<api>.core.windows.net, e.g.
+	// http://127.0.0.1:10000/devstoreaccount1 for Azurite.
+	Endpoint string `json:"endpoint"`
+	API      string `json:"api"` // dfs (default) | blob
+
+	// Auth: accountKey (shared key), sasToken, or else Microsoft Entra ID
+	// with the settings shared by the Azure outputs.
+	AccountKey string `json:"accountKey"`
+	SASToken   string `json:"sasToken"`
+	outputs.EntraConfig
+
+	// ChunkBytes is the size of each DFS append or block; progress is
+	// committed per chunk so a restart resumes from the last one.
+	ChunkBytes   int64 `json:"chunkBytes"`
+	TimeoutSec   int   `json:"timeoutSec"`
+	MaxOpenFiles int   `json:"maxOpenFiles"` // alias of maxOpenObjects
+
+	archive.Config
+	TLS outputs.TLSConfig `json:"tls"`
+}
+
+// DataLakeOutput archives events into one filesystem or container.
+type DataLakeOutput struct {
+	*archive.Writer
+	client *Client
+}
+
+// NewDataLakeOutput validates cfg, applies defaults and starts the output.
+func NewDataLakeOutput(cfg Config) (*DataLakeOutput, error) {
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ac := cfg.Config
+	if ac.Prefix == "" {
+		ac.Prefix = cfg.Directory
+	}
+	if ac.MaxOpenObjects == 0 {
+		ac.MaxOpenObjects = cfg.MaxOpenFiles
+	}
+	w, err := archive.NewWriter("adls", ac, client)
+	if err != nil {
+		return nil, err
+	}
+	return &DataLakeOutput{Writer: w, client: client}, nil
+}
+
+// NewOutput builds a DataLakeOutput from a destination config map. It is
+// the factory registered for the "azure_datalake" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewDataLakeOutput(c)
+}
+
+// Client uploads files to one filesystem or container.
+type Client struct {
+	cfg  Config
+	base *url.URL // endpoint + filesystem
+	key  []byte
+	sas  url.Values
+	cred azcore.TokenCredential
+	http *http.Client
+}
+
+// NewClient validates the account, endpoint and auth settings.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Filesystem == "" {
+		cfg.Filesystem = cfg.Container
+	}
+	if cfg.Filesystem == "" {
+		return nil, fmt.Errorf("filesystem is required")
+	}
+	switch cfg.API = strings.ToLower(cfg.API); cfg.API {
+	case "":
+		cfg.API = APIDFS
+	case APIDFS, APIBlob:
+	default:
+		return nil, fmt.Errorf("api must be dfs or blob, got %q", cfg.API)
+	}
+	endpoint := strings.TrimRight(cfg.Endpoint, "/")
+	if endpoint == "" {
+		if cfg.StorageAccount == "" || strings.ContainsAny(cfg.StorageAccount, "<>") {
+			return nil, fmt.Errorf("storageAccount is required")
+		}
+		endpoint = "https://" + cfg.StorageAccount + "." + cfg.API + ".core.windows.net"
+	}
+	base, err := url.Parse(endpoint + "/" + url.PathEscape(cfg.Filesystem))
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an absolute http(s) URL, got %q", cfg.Endpoint)
+	}
+	if cfg.ChunkBytes <= 0 {
+		cfg.ChunkBytes = defaultChunkBytes
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 300
+	}
+	tlsCfg, err := cfg.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		cfg:  cfg,
+		base: base,
+		http: &http.Client{
+			Timeout: time.Duration(cfg.TimeoutSec) * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+				TLSClientConfig:     tlsCfg,
+			},
+		},
+	}
+	switch {
+	case cfg.AccountKey != "":
+		if cfg.StorageAccount == "" {
+			return nil, fmt.Errorf("storageAccount is required with accountKey")
+		}
+		if c.key, err = base64.StdEncoding.DecodeString(cfg.AccountKey); err != nil {
+			return nil, fmt.Errorf("accountKey must be base64: %w", err)
+		}
+	case cfg.SASToken != "":
+		if c.sas, err = url.ParseQuery(strings.TrimPrefix(cfg.SASToken, "?")); err != nil {
+			return nil, fmt.Errorf("invalid sasToken: %w", err)
+		}
+	default:
+		var credTLS *tls.Config
+		if cfg.TLS.Configured() {
+			credTLS = tlsCfg
+		}
+		if c.cred, err = cfg.EntraConfig.Credential(credTLS); err != nil {
+			return nil, fmt.Errorf("entra credential: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Upload implements archive.Uploader.
+func (c *Client) Upload(key string, body *os.File, size int64) error {
+	if c.cfg.API == APIBlob {
+		return c.uploadBlob(key, body, size)
+	}
+	return c.uploadDFS(key, body, size)
+}
+
+// uploadDFS creates the file, or picks up one a previous attempt left
+// behind, and appends the rest chunk by chunk, flushing after each so the
+// committed length records the progress.
+func (c *Client) uploadDFS(key string, body *os.File, size int64) error {
+	committed, exists, err := c.length(key)
+	if err != nil {
+		return err
+	}
+	if !exists || committed > size {
+		if _, _, err := c.do(http.MethodPut, key, url.Values{"resource": {"file"}}, nil, nil); err != nil {
+			return fmt.Errorf("create file: %w", err)
+		}
+		committed = 0
+	}
+	for off := committed; off < size; {
+		n := min(c.cfg.ChunkBytes, size-off)
+		q := url.Values{"action": {"append"}, "position": {strconv.FormatInt(off, 10)}}
+		if _, _, err := c.do(http.MethodPatch, key, q, io.NewSectionReader(body, off, n), nil); err != nil {
+			return fmt.Errorf("append at %d: %w", off, err)
+		}
+		off += n
+		q = url.Values{"action": {"flush"}, "position": {strconv.FormatInt(off, 10)}}
+		if _, _, err := c.do(http.MethodPatch, key, q, nil, nil); err != nil {
+			return fmt.Errorf("flush at %d: %w", off, err)
+		}
+	}
+	return nil
+}
+
+type blockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Latest  []string `xml:"Latest"`
+}
+
+type uncommittedBlocks struct {
+	Blocks []struct {
+		Name string `xml:"Name"`
+		Size int64  `xml:"Size"`
+	} `xml:"UncommittedBlocks>Block"`
+}
+
+// uploadBlob puts small objects in one request. Larger ones are staged as
+// blocks with IDs derived from their index, so after a restart the blocks
+// the service already holds are skipped, then committed with one block
+// list.
+func (c *Client) uploadBlob(key string, body *os.File, size int64) error {
+	if committed, exists, err := c.length(key); err != nil {
+		return err
+	} else if exists && committed == size {
+		return nil // committed before the restart
+	}
+	if size <= c.cfg.ChunkBytes {
+		_, _, err := c.do(http.MethodPut, key, nil, io.NewSectionReader(body, 0, size), map[string]string{"x-ms-blob-type": "BlockBlob"})
+		return err
+	}
+	have := map[string]int64{}
+	resp, _, err := c.do(http.MethodGet, key, url.Values{"comp": {"blocklist"}, "blocklisttype": {"uncommitted"}}, nil, nil)
+	if err == nil {
+		var ub uncommittedBlocks
+		if xml.Unmarshal(resp, &ub) == nil {
+			for _, b := range ub.Blocks {
+				have[b.Name] = b.Size
+			}
+		}
+	}
+	var list blockList
+	for i, off := 0, int64(0); off < size; i, off = i+1, off+c.cfg.ChunkBytes {
+		n := min(c.cfg.ChunkBytes, size-off)
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("bibbl-%08d", i)))
+		list.Latest = append(list.Latest, id)
+		if have[id] == n {
+			continue
+		}
+		if _, _, err := c.do(http.MethodPut, key, url.Values{"comp": {"block"}, "blockid": {id}}, io.NewSectionReader(body, off, n), nil); err != nil {
+			return fmt.Errorf("put block %d: %w", i, err)
+		}
+	}
+	data, err := xml.Marshal(list)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.do(http.MethodPut, key, url.Values{"comp": {"blocklist"}}, bytes.NewReader(data), map[string]string{"Content-Type": "application/xml"}); err != nil {
+		return fmt.Errorf("put block list: %w", err)
+	}
+	return nil
+}
+
+// length returns the committed size of a file or blob.
+func (c *Client) length(key string) (int64, bool, error) {
+	_, h, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if pe, ok := outputs.IsPermanent(err); ok && pe.Status == http.StatusNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	n, _ := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	return n, true, nil
+}
+
+// do sends one authorised request and returns the response body and
+// headers.
+func (c *Client) do(method, key string, query url.Values, body io.ReadSeeker, headers map[string]string) ([]byte, http.Header, error) {
+	u := *c.base
+	segs := strings.Split(strings.Trim(key, "/"), "/")
+	for i, s := range segs {
+		segs[i] = url.PathEscape(s)
+	}
+	u.RawPath = strings.TrimRight(c.base.EscapedPath(), "/") + "/" + strings.Join(segs, "/")
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	for k, v := range c.sas {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+
+	var size int64
+	var rd io.Reader = http.NoBody
+	if body != nil {
+		n, err := body.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		size, rd = n, body
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.cfg.TimeoutSec)*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), rd)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = size
+	req.Header.Set("x-ms-version", storageVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case c.key != nil:
+		signSharedKey(req, c.cfg.StorageAccount, c.key)
+	case c.cred != nil:
+		tok, err := c.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{storageScope}})
+		if err != nil {
+			return nil, nil, fmt.Errorf("acquire token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+tok.Token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := resp.Header.Get("x-ms-error-code")
+		if msg == "" {
+			msg = strings.TrimSpace(string(respBody))
+		}
+		return nil, nil, outputs.HTTPError(resp.StatusCode, fmt.Errorf("%s %s returned status %d: %s", method, key, resp.StatusCode, msg))
+	}
+	return respBody, resp.Header, nil
+}
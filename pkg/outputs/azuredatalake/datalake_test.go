@@ -0,0 +1,277 @@
+package azuredatalake
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"bibbl/pkg/outputs/archive"
+)
+
+// The well-known Azurite development account.
+const (
+	devAccount = "devstoreaccount1"
+	devKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+)
+
+// fakeStorage implements enough of the DFS and Blob APIs of one account:
+// it checks the SharedKey signature (or the SAS sig), keeps committed files
+// and uncommitted blocks, and records every write.
+type fakeStorage struct {
+	mu     sync.Mutex
+	files  map[string][]byte
+	blocks map[string]map[string][]byte
+	writes []string
+	sasSig string
+}
+
+func (f *fakeStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	q := r.URL.Query()
+	if f.sasSig != "" {
+		if q.Get("sig") != f.sasSig || r.Header.Get("Authorization") != "" {
+			w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	} else {
+		check, _ := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+		check.Header = r.Header.Clone()
+		check.ContentLength = int64(len(body))
+		key, _ := base64.StdEncoding.DecodeString(devKey)
+		signSharedKey(check, devAccount, key)
+		if got := r.Header.Get("Authorization"); got == "" || got != check.Header.Get("Authorization") {
+			w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	name, ok := strings.CutPrefix(r.URL.Path, "/"+devAccount+"/logs/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodHead:
+		data, ok := f.files[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	case r.Method == http.MethodPut && q.Get("resource") == "file":
+		f.files[name] = nil
+		f.writes = append(f.writes, "create")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPatch && q.Get("action") == "append":
+		if pos, _ := strconv.Atoi(q.Get("position")); pos != len(f.files[name]) {
+			w.Header().Set("x-ms-error-code", "InvalidFlushPosition")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.files[name] = append(f.files[name], body...) // committed by the flush that follows
+		f.writes = append(f.writes, "append@"+q.Get("position"))
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPatch && q.Get("action") == "flush":
+		if q.Get("position") != strconv.Itoa(len(f.files[name])) {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	case r.Method == http.MethodGet && q.Get("comp") == "blocklist":
+		var b strings.Builder
+		b.WriteString("<BlockList><UncommittedBlocks>")
+		for id, data := range f.blocks[name] {
+			fmt.Fprintf(&b, "<Block><Name>%s</Name><Size>%d</Size></Block>", id, len(data))
+		}
+		b.WriteString("</UncommittedBlocks></BlockList>")
+		_, _ = w.Write([]byte(b.String()))
+	case r.Method == http.MethodPut && q.Get("comp") == "block":
+		if f.blocks[name] == nil {
+			f.blocks[name] = map[string][]byte{}
+		}
+		f.blocks[name][q.Get("blockid")] = body
+		f.writes = append(f.writes, "block")
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && q.Get("comp") == "blocklist":
+		var list blockList
+		_ = xml.Unmarshal(body, &list)
+		var data []byte
+		for _, id := range list.Latest {
+			data = append(data, f.blocks[name][id]...)
+		}
+		f.files[name] = data
+		delete(f.blocks, name)
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && r.Header.Get("x-ms-blob-type") == "BlockBlob":
+		f.files[name] = body
+		f.writes = append(f.writes, "put")
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func newFakeStorage(t *testing.T) (*fakeStorage, *httptest.Server) {
+	f := &fakeStorage{files: map[string][]byte{}, blocks: map[string]map[string][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func testConfig(endpoint, api string) Config {
+	return Config{
+		StorageAccount: devAccount,
+		Filesystem:     "logs",
+		Directory:      "palo/",
+		Endpoint:       endpoint + "/" + devAccount,
+		API:            api,
+		AccountKey:     devKey,
+	}
+}
+
+// stagedFile writes n bytes of newline-terminated data to a temp file.
+func stagedFile(t *testing.T, n int) (*os.File, []byte) {
+	t.Helper()
+	data := bytes.Repeat([]byte("0123456789abcde\n"), n/16)
+	fh, err := os.Create(filepath.Join(t.TempDir(), "obj"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	t.Cleanup(func() { fh.Close() })
+	if _, err := fh.Write(data); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return fh, data
+}
+
+func TestDataLakeWritesPartitionedFiles(t *testing.T) {
+	f, srv := newFakeStorage(t)
+	cfg := testConfig(srv.URL, "")
+	cfg.Config = archive.Config{PathTemplate: "${yyyy}/${MM}/${dd}/${device}.jsonl.gz", StagingDir: t.TempDir()}
+	out, err := NewDataLakeOutput(cfg)
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	err = out.SendBatch([]map[string]interface{}{
+		{"device": "fw-1", "timestamp": "2024-05-01T10:00:00Z", "n": 1},
+		{"device": "fw-1", "timestamp": "2024-05-01T10:00:01Z", "n": 2},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	out.Rollover(0)
+	out.UploadPending()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.files) != 1 {
+		t.Fatalf("expected one file, got %d: %v", len(f.files), f.writes)
+	}
+	for name, data := range f.files {
+		if !strings.HasPrefix(name, "palo/2024/05/01/fw-1-") || !strings.HasSuffix(name, ".jsonl.gz") {
+			t.Fatalf("unexpected path %q", name)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("file is not gzip: %v", err)
+		}
+		var lines int
+		for sc := bufio.NewScanner(zr); sc.Scan(); lines++ {
+		}
+		if lines != 2 {
+			t.Fatalf("expected 2 lines, got %d", lines)
+		}
+	}
+	if f.writes[0] != "create" || f.writes[1] != "append@0" {
+		t.Fatalf("expected create then append, got %v", f.writes)
+	}
+}
+
+func TestDFSResumesPartiallyWrittenFile(t *testing.T) {
+	f, srv := newFakeStorage(t)
+	cfg := testConfig(srv.URL, APIDFS)
+	cfg.ChunkBytes = 1024
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	fh, data := stagedFile(t, 3000)
+	// A previous attempt committed the first chunk before the restart.
+	f.files["palo/obj.jsonl"] = append([]byte(nil), data[:1024]...)
+
+	if err := c.Upload("palo/obj.jsonl", fh, int64(len(data))); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if want := []string{"append@1024", "append@2048"}; strings.Join(f.writes, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected resume from the committed length, got %v", f.writes)
+	}
+	if !bytes.Equal(f.files["palo/obj.jsonl"], data) {
+		t.Fatalf("file content mismatch after resume")
+	}
+}
+
+func TestBlobSkipsUploadedBlocks(t *testing.T) {
+	f, srv := newFakeStorage(t)
+	cfg := testConfig(srv.URL, APIBlob)
+	cfg.ChunkBytes = 1024
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	fh, data := stagedFile(t, 3000)
+	first := base64.StdEncoding.EncodeToString([]byte("bibbl-00000000"))
+	f.blocks["obj.jsonl"] = map[string][]byte{first: append([]byte(nil), data[:1024]...)}
+
+	if err := c.Upload("obj.jsonl", fh, int64(len(data))); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if len(f.writes) != 2 {
+		t.Fatalf("expected only the two missing blocks to be sent, got %v", f.writes)
+	}
+	if !bytes.Equal(f.files["obj.jsonl"], data) {
+		t.Fatalf("blob content mismatch after commit")
+	}
+	// A retry after the commit finds the blob complete and sends nothing.
+	if err := c.Upload("obj.jsonl", fh, int64(len(data))); err != nil || len(f.writes) != 2 {
+		t.Fatalf("expected a no-op retry, got err=%v writes=%v", err, f.writes)
+	}
+}
+
+func TestSASTokenAuth(t *testing.T) {
+	f, srv := newFakeStorage(t)
+	f.sasSig = "c2lnbmF0dXJl"
+	cfg := testConfig(srv.URL, APIBlob)
+	cfg.AccountKey = ""
+	cfg.SASToken = "?sv=2021-08-06&ss=b&srt=co&sp=rwc&sig=c2lnbmF0dXJl"
+	c, err := NewClient(cfg)
+	if err != nil {
+		t.Fatalf("new client: %v", err)
+	}
+	fh, data := stagedFile(t, 64)
+	if err := c.Upload("a b/obj.json", fh, int64(len(data))); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if !bytes.Equal(f.files["a b/obj.json"], data) {
+		t.Fatalf("expected a single put, got %v", f.writes)
+	}
+
+	cfg.SASToken = "sv=2021-08-06&sig=wrong"
+	c, _ = NewClient(cfg)
+	if err := c.Upload("x.json", fh, int64(len(data))); err == nil || !strings.Contains(err.Error(), "AuthenticationFailed") {
+		t.Fatalf("expected an auth failure, got %v", err)
+	}
+}
@@ -13,9 +13,12 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"bibbl/pkg/buffer/spill"
+	"bibbl/pkg/outputs"
+	"bibbl/pkg/seal"
 
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
@@ -54,6 +57,15 @@ type LogAnalyticsOutput struct {
 	tracer       trace.Tracer
 	spillQueue   *spill.Queue
 	replayTicker *time.Ticker
+
+	// Delivery health
+	healthMu    sync.Mutex
+	lastErr     string
+	lastErrAt   time.Time
+	lastSuccess time.Time
+	sent        atomic.Uint64
+	failed      atomic.Uint64
+	deadLetter  outputs.DeadLetterFunc
 }
 
 // Config holds configuration for Azure Log Analytics output
@@ -79,6 +91,13 @@ type SpillSettings struct {
 	Directory   string `json:"directory"`
 	MaxBytes    int64  `json:"maxBytes"`
 	SegmentSize int64  `json:"segmentSize"`
+	// Encrypt seals spill files with the keyring named by KeyEnv
+	// (default BIBBL_SPILL_KEY).
+	Encrypt bool   `json:"encrypt"`
+	KeyEnv  string `json:"keyEnv"`
+	// AllowPlaintext replays unencrypted spill files despite Encrypt, to
+	// migrate files written before it was turned on.
+	AllowPlaintext bool `json:"allowPlaintext"`
 }
 
 // NewLogAnalyticsOutput creates a new Azure Log Analytics output with sensible defaults
@@ -122,6 +141,9 @@ func NewLogAnalyticsOutput(cfg Config) (*LogAnalyticsOutput, error) {
 		if cfg.Spill.SegmentSize <= 0 {
 			cfg.Spill.SegmentSize = 1 * 1024 * 1024
 		}
+		if cfg.Spill.Encrypt && strings.TrimSpace(cfg.Spill.KeyEnv) == "" {
+			cfg.Spill.KeyEnv = "BIBBL_SPILL_KEY"
+		}
 	}
 
 	// Remove _CL suffix if user provided it (Azure adds it automatically)
@@ -156,10 +178,19 @@ func NewLogAnalyticsOutput(cfg Config) (*LogAnalyticsOutput, error) {
 	output.flushTimer = time.AfterFunc(time.Duration(output.FlushIntervalSec)*time.Second, output.periodicFlush)
 
 	if cfg.Spill.Enabled {
+		var keys *seal.Keyring
+		if cfg.Spill.Encrypt {
+			var err error
+			if keys, err = seal.FromEnv(cfg.Spill.KeyEnv); err != nil {
+				return nil, fmt.Errorf("spill encryption: %w", err)
+			}
+		}
 		queue, err := spill.NewQueue(spill.Config{
-			Directory:   cfg.Spill.Directory,
-			MaxBytes:    cfg.Spill.MaxBytes,
-			SegmentSize: cfg.Spill.SegmentSize,
+			Directory:      cfg.Spill.Directory,
+			MaxBytes:       cfg.Spill.MaxBytes,
+			SegmentSize:    cfg.Spill.SegmentSize,
+			Keys:           keys,
+			AllowPlaintext: cfg.Spill.AllowPlaintext,
 		})
 		if err != nil {
 			return nil, fmt.Errorf("init spill queue: %w", err)
@@ -173,6 +204,16 @@ func NewLogAnalyticsOutput(cfg Config) (*LogAnalyticsOutput, error) {
 	return output, nil
 }
 
+// NewOutput builds a LogAnalyticsOutput from a destination config map. It is
+// the factory registered for the "azure_loganalytics" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewLogAnalyticsOutput(c)
+}
+
 // Send adds an event to the batch and flushes if batch is full
 func (o *LogAnalyticsOutput) Send(event map[string]interface{}) error {
 	o.batchMu.Lock()
@@ -245,19 +286,41 @@ func (o *LogAnalyticsOutput) deliverBatch(events []map[string]interface{}, allow
 		return nil
 	}
 	err := o.transmitBatch(events)
+	o.recordResult(len(events), err)
 	if err == nil {
 		return nil
 	}
-	if allowSpill && o.spillQueue != nil {
-		if spillErr := o.spillQueue.Append(events); spillErr != nil {
-			log.Printf("azureloganalytics: spill append failed: %v", spillErr)
+	if _, permanent := outputs.IsPermanent(err); !permanent && allowSpill && o.spillQueue != nil {
+		spillErr := o.spillQueue.Append(events)
+		if spillErr == nil {
+			log.Printf("azureloganalytics: buffered %d events for retry", len(events))
 			return err
 		}
-		log.Printf("azureloganalytics: buffered %d events for retry", len(events))
+		log.Printf("azureloganalytics: spill append failed: %v", spillErr)
 	}
+	o.deadLetterEvents(events, err)
 	return err
 }
 
+// SetDeadLetter implements outputs.DeadLetterer. Rejected batches, and
+// batches that exhausted their retries with nowhere to spill, go to fn.
+func (o *LogAnalyticsOutput) SetDeadLetter(fn outputs.DeadLetterFunc) {
+	o.healthMu.Lock()
+	defer o.healthMu.Unlock()
+	o.deadLetter = fn
+}
+
+func (o *LogAnalyticsOutput) deadLetterEvents(events []map[string]interface{}, err error) {
+	o.healthMu.Lock()
+	fn := o.deadLetter
+	o.healthMu.Unlock()
+	if fn == nil {
+		log.Printf("azureloganalytics: dropped %d events: %v", len(events), err)
+		return
+	}
+	fn(events, err)
+}
+
 func (o *LogAnalyticsOutput) replayLoop() {
 	defer o.wg.Done()
 	for {
@@ -277,10 +340,65 @@ func (o *LogAnalyticsOutput) drainSpill() error {
 		return nil
 	}
 	return o.spillQueue.Replay(func(events []map[string]interface{}) error {
-		return o.transmitBatch(events)
+		err := o.transmitBatch(events)
+		o.recordResult(len(events), err)
+		if _, permanent := outputs.IsPermanent(err); permanent {
+			// Retrying a rejected batch forever would block the spill behind it.
+			o.deadLetterEvents(events, err)
+			return nil
+		}
+		return err
 	})
 }
 
+// SendBatch transmits events synchronously, bypassing batching and spill, and
+// reports whether Log Analytics accepted them. It implements outputs.BatchSender.
+func (o *LogAnalyticsOutput) SendBatch(events []map[string]interface{}) error {
+	if len(events) == 0 {
+		return nil
+	}
+	err := o.transmitBatch(events)
+	o.recordResult(len(events), err)
+	return err
+}
+
+// recordResult updates delivery health after a transmit attempt.
+func (o *LogAnalyticsOutput) recordResult(n int, err error) {
+	o.healthMu.Lock()
+	defer o.healthMu.Unlock()
+	if err != nil {
+		o.failed.Add(uint64(n))
+		o.lastErr = err.Error()
+		o.lastErrAt = time.Now()
+		return
+	}
+	o.sent.Add(uint64(n))
+	o.lastSuccess = time.Now()
+}
+
+// Health reports the live delivery state. The output is "connected" once a
+// batch has been accepted and no later batch has failed, "error" when the most
+// recent attempt failed, and "disconnected" before anything was sent.
+func (o *LogAnalyticsOutput) Health() outputs.Health {
+	o.healthMu.Lock()
+	defer o.healthMu.Unlock()
+	h := outputs.Health{
+		Status:      outputs.StatusDisconnected,
+		LastError:   o.lastErr,
+		LastErrorAt: o.lastErrAt,
+		LastSuccess: o.lastSuccess,
+		Sent:        o.sent.Load(),
+		Failed:      o.failed.Load(),
+	}
+	switch {
+	case !o.lastErrAt.IsZero() && o.lastErrAt.After(o.lastSuccess):
+		h.Status = outputs.StatusError
+	case !o.lastSuccess.IsZero():
+		h.Status = outputs.StatusConnected
+	}
+	return h
+}
+
 // transmitBatch sends a batch of events to Azure Log Analytics with retry
 func (o *LogAnalyticsOutput) transmitBatch(events []map[string]interface{}) error {
 	ctx, span := o.tracer.Start(context.Background(), "transmitBatch", trace.WithAttributes(
@@ -355,10 +473,10 @@ func (o *LogAnalyticsOutput) transmitBatch(events []map[string]interface{}) erro
 
 		lastErr = fmt.Errorf("azure log analytics returned status %d: %s", resp.StatusCode, string(respBody))
 
-		// Don't retry on 4xx errors (except 429)
-		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != 429 {
+		// Don't retry on 4xx errors (except 408/429); the batch will never be accepted
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != 408 && resp.StatusCode != 429 {
 			span.RecordError(lastErr)
-			return lastErr
+			return outputs.Permanent(resp.StatusCode, lastErr)
 		}
 	}
 
@@ -0,0 +1,292 @@
+// Package azurelogsingestion sends events to Azure Monitor through the Logs
+// Ingestion API: a Data Collection Endpoint (DCE) and a Data Collection Rule
+// (DCR) stream, authenticated with Microsoft Entra ID. It replaces the
+// retiring HTTP Data Collector API used by azureloganalytics and can target
+// DCR-based and standard tables.
+package azurelogsingestion
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"bibbl/pkg/outputs"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+const (
+	apiVersion   = "2023-01-01"
+	defaultScope = "https://monitor.azure.com/.default"
+	// maxCallBytes is the service limit for one upload call.
+	maxCallBytes = 1000000
+)
+
+// Config holds configuration for an Azure Monitor Logs Ingestion destination.
+type Config struct {
+	Endpoint       string `json:"endpoint"`       // DCE logs ingestion URI
+	DCRImmutableID string `json:"dcrImmutableId"` // dcr-...
+	StreamName     string `json:"streamName"`     // e.g. Custom-BibblLogs_CL
+	outputs.EntraConfig
+	Scope string `json:"scope"` // token scope, default https://monitor.azure.com/.default
+
+	// TimeField is copied into TimeGenerated when the event has none.
+	TimeField   string `json:"timeField"`
+	Compression string `json:"compression"` // gzip | none
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+	TimeoutSec       int `json:"timeoutSec"`
+	MaxRetries       int `json:"maxRetries"`
+	RetryDelayMs     int `json:"retryDelayMs"`
+	RetryMaxDelayMs  int `json:"retryMaxDelayMs"`
+
+	TLS outputs.TLSConfig `json:"tls"`
+}
+
+// IngestionOutput uploads batches to one DCR stream.
+type IngestionOutput struct {
+	*outputs.Batcher
+
+	cfg    Config
+	url    string
+	cred   azcore.TokenCredential
+	client *http.Client
+}
+
+// NewIngestionOutput validates cfg, applies defaults and starts the output.
+func NewIngestionOutput(cfg Config) (*IngestionOutput, error) {
+	endpoint := strings.TrimRight(strings.TrimSpace(cfg.Endpoint), "/")
+	if u, err := url.Parse(endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("endpoint must be the https URL of a data collection endpoint, got %q", cfg.Endpoint)
+	}
+	if cfg.DCRImmutableID == "" || cfg.StreamName == "" {
+		return nil, fmt.Errorf("dcrImmutableId and streamName are required")
+	}
+	if cfg.Scope == "" {
+		cfg.Scope = defaultScope
+	}
+	if cfg.TimeField == "" {
+		cfg.TimeField = "timestamp"
+	}
+	switch cfg.Compression = strings.ToLower(cfg.Compression); cfg.Compression {
+	case "", "none", "gzip":
+	default:
+		return nil, fmt.Errorf("compression must be gzip or none, got %q", cfg.Compression)
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 30
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryDelayMs <= 0 {
+		cfg.RetryDelayMs = 1000
+	}
+	if cfg.RetryMaxDelayMs <= 0 {
+		cfg.RetryMaxDelayMs = 60000
+	}
+	tlsCfg, err := cfg.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+	// Token requests only need the custom TLS settings when some were given.
+	var credTLS *tls.Config
+	if cfg.TLS.Configured() {
+		credTLS = tlsCfg
+	}
+	cred, err := cfg.EntraConfig.Credential(credTLS)
+	if err != nil {
+		return nil, fmt.Errorf("entra credential: %w", err)
+	}
+	o := &IngestionOutput{
+		cfg:  cfg,
+		url:  fmt.Sprintf("%s/dataCollectionRules/%s/streams/%s?api-version=%s", endpoint, url.PathEscape(cfg.DCRImmutableID), url.PathEscape(cfg.StreamName), apiVersion),
+		cred: cred,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.TimeoutSec) * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+				TLSClientConfig:     tlsCfg,
+			},
+		},
+	}
+	o.Batcher = outputs.NewBatcher("logs-ingestion", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.deliver)
+	return o, nil
+}
+
+// NewOutput builds an IngestionOutput from a destination config map. It is
+// the factory registered for the "azure_logs_ingestion" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewIngestionOutput(c)
+}
+
+// chunk is one upload call: a JSON array body and the events in it.
+type chunk struct {
+	body   []byte
+	events []map[string]interface{}
+}
+
+// deliver splits the batch into calls under the 1 MB limit and uploads them
+// in order. Events the service rejects for good, and single events too big
+// for any call, are dead-lettered so the rest still go out.
+func (o *IngestionOutput) deliver(events []map[string]interface{}) error {
+	chunks, oversized := o.split(events)
+	for _, ev := range oversized {
+		o.DeadLetter([]map[string]interface{}{ev}, outputs.Permanent(http.StatusRequestEntityTooLarge,
+			fmt.Errorf("event exceeds the %d byte limit of one Logs Ingestion call", maxCallBytes)))
+	}
+	for _, c := range chunks {
+		err := o.upload(c.body)
+		if _, permanent := outputs.IsPermanent(err); permanent {
+			o.DeadLetter(c.events, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *IngestionOutput) split(events []map[string]interface{}) (chunks []chunk, oversized []map[string]interface{}) {
+	var cur chunk
+	for _, ev := range events {
+		if _, ok := ev["TimeGenerated"]; !ok {
+			if ts, ok := outputs.EventTime(ev, o.cfg.TimeField); ok {
+				copied := make(map[string]interface{}, len(ev)+1)
+				for k, v := range ev {
+					copied[k] = v
+				}
+				copied["TimeGenerated"] = ts.UTC().Format(time.RFC3339Nano)
+				ev = copied
+			}
+		}
+		data, err := json.Marshal(ev)
+		if err != nil || len(data)+2 > maxCallBytes {
+			oversized = append(oversized, ev)
+			continue
+		}
+		// '[' + items joined by ',' + ']'
+		if len(cur.events) > 0 && len(cur.body)+1+len(data)+1 > maxCallBytes {
+			cur.body = append(cur.body, ']')
+			chunks = append(chunks, cur)
+			cur = chunk{}
+		}
+		if len(cur.events) == 0 {
+			cur.body = append(cur.body, '[')
+		} else {
+			cur.body = append(cur.body, ',')
+		}
+		cur.body = append(cur.body, data...)
+		cur.events = append(cur.events, ev)
+	}
+	if len(cur.events) > 0 {
+		cur.body = append(cur.body, ']')
+		chunks = append(chunks, cur)
+	}
+	return chunks, oversized
+}
+
+// upload sends one call, retrying throttling, server errors and transport
+// errors. A 429 or 503 waits for the Retry-After the service asked for.
+func (o *IngestionOutput) upload(body []byte) error {
+	if o.cfg.Compression == "gzip" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	delay := time.Duration(o.cfg.RetryDelayMs) * time.Millisecond
+	maxDelay := time.Duration(o.cfg.RetryMaxDelayMs) * time.Millisecond
+	var lastErr error
+	for attempt := 0; attempt <= o.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay = min(delay*2, maxDelay)
+		}
+		status, retryAfter, err := o.do(body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if status != 0 && status < 500 && status != http.StatusTooManyRequests && status != http.StatusRequestTimeout {
+			return outputs.HTTPError(status, err)
+		}
+		if retryAfter > 0 {
+			delay = min(retryAfter, maxDelay)
+		}
+	}
+	return fmt.Errorf("failed after %d retries: %w", o.cfg.MaxRetries, lastErr)
+}
+
+// do performs one attempt. status is 0 for token and transport errors.
+func (o *IngestionOutput) do(body []byte) (status int, retryAfter time.Duration, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.cfg.TimeoutSec)*time.Second)
+	defer cancel()
+	tok, err := o.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{o.cfg.Scope}})
+	if err != nil {
+		return 0, 0, fmt.Errorf("acquire token: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.Token)
+	req.Header.Set("Content-Type", "application/json")
+	if o.cfg.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, 0, nil
+	}
+	return resp.StatusCode, parseRetryAfter(resp.Header),
+		fmt.Errorf("logs ingestion returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+}
+
+// parseRetryAfter reads Retry-After as seconds or an HTTP date.
+func parseRetryAfter(h http.Header) time.Duration {
+	v := strings.TrimSpace(h.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package azurelogsingestion
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"bibbl/pkg/outputs"
+)
+
+// fakeAzure stands in for the Entra token endpoint and a DCE.
+type fakeAzure struct {
+	srv *httptest.Server
+
+	mu        sync.Mutex
+	tokens    int
+	calls     int
+	throttled bool
+	sizes     []int
+	rows      []map[string]interface{}
+}
+
+func newFakeAzure(t *testing.T) *fakeAzure {
+	f := &fakeAzure{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tenant-1/v2.0/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		base := f.srv.URL + "/tenant-1"
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"token_endpoint":         base + "/oauth2/v2.0/token",
+			"authorization_endpoint": base + "/oauth2/v2.0/authorize",
+			"issuer":                 base + "/v2.0",
+		})
+	})
+	mux.HandleFunc("/tenant-1/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		if r.PostForm.Get("client_id") != "app-1" || r.PostForm.Get("client_secret") != "s3cret" || !strings.Contains(r.PostForm.Get("scope"), defaultScope) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		f.tokens++
+		f.mu.Unlock()
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"tok-1"}`))
+	})
+	mux.HandleFunc("/dataCollectionRules/dcr-123/streams/Custom-Bibbl_CL", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok-1" || r.URL.Query().Get("api-version") != apiVersion {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.calls++
+		if !f.throttled {
+			f.throttled = true
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if len(body) > maxCallBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		var rows []map[string]interface{}
+		if err := json.Unmarshal(body, &rows); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.sizes = append(f.sizes, len(body))
+		f.rows = append(f.rows, rows...)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	f.srv = httptest.NewTLSServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+func TestLogsIngestionSplitsCallsAndHonoursRetryAfter(t *testing.T) {
+	f := newFakeAzure(t)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.srv.Certificate().Raw})
+	out, err := NewOutput(map[string]interface{}{
+		"endpoint":        f.srv.URL,
+		"dcrImmutableId":  "dcr-123",
+		"streamName":      "Custom-Bibbl_CL",
+		"tenantId":        "tenant-1",
+		"clientId":        "app-1",
+		"clientSecret":    "s3cret",
+		"authorityHost":   f.srv.URL,
+		"retryMaxDelayMs": 5,
+		"tls":             map[string]interface{}{"caPem": string(ca)},
+	})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dead []map[string]interface{}
+	out.(outputs.DeadLetterer).SetDeadLetter(func(events []map[string]interface{}, err error) { dead = append(dead, events...) })
+
+	pad := strings.Repeat("x", 100*1024)
+	var batch []map[string]interface{}
+	for i := 0; i < 25; i++ {
+		batch = append(batch, map[string]interface{}{"seq": i, "msg": pad, "timestamp": "2024-05-01T10:00:00Z"})
+	}
+	batch = append(batch, map[string]interface{}{"seq": 99, "msg": strings.Repeat("y", 2*maxCallBytes)})
+	if err := out.(outputs.BatchSender).SendBatch(batch); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if f.tokens != 1 {
+		t.Fatalf("expected one token request, got %d", f.tokens)
+	}
+	if len(f.sizes) < 3 || f.calls != len(f.sizes)+1 {
+		t.Fatalf("expected the batch split into >=3 calls after one 429, sizes=%v calls=%d", f.sizes, f.calls)
+	}
+	for _, n := range f.sizes {
+		if n > maxCallBytes {
+			t.Fatalf("call of %d bytes exceeds the limit", n)
+		}
+	}
+	if len(f.rows) != 25 || f.rows[24]["seq"] != float64(24) || f.rows[0]["TimeGenerated"] != "2024-05-01T10:00:00Z" {
+		t.Fatalf("rows not delivered in order with TimeGenerated: %d rows", len(f.rows))
+	}
+	if len(dead) != 1 || dead[0]["seq"] != 99 {
+		t.Fatalf("the oversized event should be dead-lettered: %d", len(dead))
+	}
+}
@@ -0,0 +1,234 @@
+package outputs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by Send after the output was closed.
+var ErrClosed = errors.New("output closed")
+
+// HTTPError classifies a non-2xx HTTP response. 4xx answers mean the
+// request will never be accepted and come back as a PermanentError, except
+// 408 and 429, which are worth retrying, and 401 and 403: bad credentials
+// are a configuration problem, so the events wait until it is fixed.
+func HTTPError(status int, err error) error {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusUnauthorized, http.StatusForbidden:
+		return err
+	}
+	if status >= 400 && status < 500 {
+		return Permanent(status, err)
+	}
+	return err
+}
+
+// HealthTracker records delivery results and reports them as Health. The
+// output is "connected" once a batch was accepted and nothing failed since,
+// "error" when the latest attempt failed, and "disconnected" before anything
+// was sent.
+type HealthTracker struct {
+	mu          sync.Mutex
+	lastErr     string
+	lastErrAt   time.Time
+	lastSuccess time.Time
+	sent        uint64
+	failed      uint64
+}
+
+// Record updates the health after an attempt to deliver n events.
+func (t *HealthTracker) Record(n int, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil {
+		t.failed += uint64(n)
+		t.lastErr = err.Error()
+		t.lastErrAt = time.Now()
+		return
+	}
+	t.sent += uint64(n)
+	t.lastSuccess = time.Now()
+}
+
+// Health implements the Output health report.
+func (t *HealthTracker) Health() Health {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	h := Health{
+		Status:      StatusDisconnected,
+		LastError:   t.lastErr,
+		LastErrorAt: t.lastErrAt,
+		LastSuccess: t.lastSuccess,
+		Sent:        t.sent,
+		Failed:      t.failed,
+	}
+	switch {
+	case !t.lastErrAt.IsZero() && t.lastErrAt.After(t.lastSuccess):
+		h.Status = StatusError
+	case !t.lastSuccess.IsZero():
+		h.Status = StatusConnected
+	}
+	return h
+}
+
+// BatchLimits bound the batches a Batcher hands to its deliver function.
+type BatchLimits struct {
+	MaxEvents     int
+	MaxBytes      int // JSON-encoded size
+	FlushInterval time.Duration
+}
+
+// Batcher implements Send, Flush, SendBatch, Close, Health and SetDeadLetter
+// for outputs built around a synchronous deliver function, so an output only
+// has to know how to ship one batch. Batches from Send are delivered in the
+// background; ones that fail go to the dead-letter function, as nothing
+// retries them (the destination's disk queue uses SendBatch instead).
+type Batcher struct {
+	HealthTracker
+
+	name    string
+	limits  BatchLimits
+	deliver func(events []map[string]interface{}) error
+
+	mu         sync.Mutex
+	batch      []map[string]interface{}
+	batchBytes int
+	closed     bool
+	deadLetter DeadLetterFunc
+	via        func(events []map[string]interface{}) error // background deliveries; nil means SendBatch
+	timer      *time.Timer
+	wg         sync.WaitGroup
+}
+
+// NewBatcher starts a batcher. name prefixes its log lines. Zero limits
+// default to 500 events, 1 MiB and a 5s flush interval.
+func NewBatcher(name string, limits BatchLimits, deliver func(events []map[string]interface{}) error) *Batcher {
+	if limits.MaxEvents <= 0 {
+		limits.MaxEvents = 500
+	}
+	if limits.MaxBytes <= 0 {
+		limits.MaxBytes = 1024 * 1024
+	}
+	if limits.FlushInterval <= 0 {
+		limits.FlushInterval = 5 * time.Second
+	}
+	b := &Batcher{name: name, limits: limits, deliver: deliver}
+	b.timer = time.AfterFunc(limits.FlushInterval, b.periodicFlush)
+	return b
+}
+
+// Send adds an event to the current batch, flushing first when the event
+// would push it past the limits.
+func (b *Batcher) Send(event map[string]interface{}) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	if len(b.batch) > 0 && (len(b.batch) >= b.limits.MaxEvents || b.batchBytes+len(data) > b.limits.MaxBytes) {
+		b.flushLocked()
+	}
+	b.batch = append(b.batch, event)
+	b.batchBytes += len(data)
+	return nil
+}
+
+// Flush hands the current batch to the deliver function in the background.
+func (b *Batcher) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+	return nil
+}
+
+func (b *Batcher) flushLocked() {
+	if len(b.batch) == 0 {
+		return
+	}
+	events := b.batch
+	b.batch, b.batchBytes = nil, 0
+	send := b.via
+	if send == nil {
+		send = b.SendBatch
+	}
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		if err := send(events); err != nil {
+			b.DeadLetter(events, err)
+		}
+	}()
+}
+
+// DeadLetter hands events the output gave up on to the dead-letter
+// function, or logs and drops them when there is none. Outputs use it for
+// the part of a batch the destination rejected item by item.
+func (b *Batcher) DeadLetter(events []map[string]interface{}, err error) {
+	b.mu.Lock()
+	fn := b.deadLetter
+	b.mu.Unlock()
+	if fn == nil {
+		log.Printf("%s: dropped %d events: %v", b.name, len(events), err)
+		return
+	}
+	fn(events, err)
+}
+
+func (b *Batcher) periodicFlush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.flushLocked()
+	b.timer.Reset(b.limits.FlushInterval)
+}
+
+// SendBatch delivers events synchronously and records the result. It
+// implements BatchSender.
+func (b *Batcher) SendBatch(events []map[string]interface{}) error {
+	if len(events) == 0 {
+		return nil
+	}
+	err := b.deliver(events)
+	b.Record(len(events), err)
+	return err
+}
+
+// SetDeadLetter implements DeadLetterer.
+func (b *Batcher) SetDeadLetter(fn DeadLetterFunc) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deadLetter = fn
+}
+
+// SetBackgroundSender implements BackgroundSender.
+func (b *Batcher) SetBackgroundSender(fn func(events []map[string]interface{}) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.via = fn
+}
+
+// Close flushes what is left and waits for batches in flight.
+func (b *Batcher) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.timer.Stop()
+	b.flushLocked()
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
@@ -0,0 +1,340 @@
+// Package elasticsearch writes events to Elasticsearch or OpenSearch with
+// the _bulk API.
+package elasticsearch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"bibbl/pkg/outputs"
+)
+
+// Config holds configuration for an Elasticsearch destination.
+type Config struct {
+	// URLs are cluster base URLs; requests rotate over them and fail over
+	// on transport errors. URL is shorthand for a single node.
+	URLs []string `json:"urls"`
+	URL  string   `json:"url"`
+
+	// Index is a template: strftime verbs expand from the event time
+	// (logs-versa-%Y.%m.%d) and ${field} from the event.
+	Index      string `json:"index"`
+	DataStream bool   `json:"dataStream"` // write with op "create" and add @timestamp
+	Pipeline   string `json:"pipeline"`   // ingest pipeline
+	IDField    string `json:"idField"`    // event field used as _id for idempotent writes
+	TimeField  string `json:"timeField"`  // default "timestamp"
+
+	Username string `json:"username"`
+	Password string `json:"password"`
+	APIKey   string `json:"apiKey"` // base64 "id:key" as issued by the security API
+
+	Compression      string `json:"compression"` // gzip | none
+	BatchMaxEvents   int    `json:"batchMaxEvents"`
+	BatchMaxBytes    int    `json:"batchMaxBytes"`
+	FlushIntervalSec int    `json:"flushIntervalSec"`
+	TimeoutSec       int    `json:"timeoutSec"`
+	MaxRetries       int    `json:"maxRetries"` // for items rejected with 429/5xx
+	RetryDelayMs     int    `json:"retryDelayMs"`
+	InsecureTLS      bool   `json:"insecureSkipVerify"`
+}
+
+// BulkOutput delivers batches through the _bulk API.
+type BulkOutput struct {
+	*outputs.Batcher
+
+	cfg    Config
+	urls   []string
+	next   atomic.Uint32
+	index  *outputs.Template
+	client *http.Client
+}
+
+// NewBulkOutput validates cfg, applies defaults and starts the output.
+func NewBulkOutput(cfg Config) (*BulkOutput, error) {
+	urls := make([]string, 0, len(cfg.URLs)+1)
+	for _, u := range append(cfg.URLs, cfg.URL) {
+		if u = strings.TrimRight(strings.TrimSpace(u), "/"); u == "" {
+			continue
+		}
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return nil, fmt.Errorf("invalid url %q: %w", u, err)
+		}
+		urls = append(urls, u)
+	}
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("at least one url is required")
+	}
+	if cfg.Index == "" {
+		cfg.Index = "bibbl-%Y.%m.%d"
+		if cfg.DataStream {
+			cfg.Index = "logs-bibbl-default"
+		}
+	}
+	index, err := outputs.ParseTemplate(cfg.Index)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Compression = strings.ToLower(cfg.Compression); cfg.Compression {
+	case "", "none", "gzip":
+	default:
+		return nil, fmt.Errorf("compression must be gzip or none, got %q", cfg.Compression)
+	}
+	if cfg.APIKey != "" && cfg.Username != "" {
+		return nil, fmt.Errorf("set either apiKey or username/password, not both")
+	}
+	if cfg.TimeField == "" {
+		cfg.TimeField = "timestamp"
+	}
+	if cfg.BatchMaxBytes <= 0 {
+		cfg.BatchMaxBytes = 5 * 1024 * 1024
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 30
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryDelayMs <= 0 {
+		cfg.RetryDelayMs = 500
+	}
+	o := &BulkOutput{
+		cfg:   cfg,
+		urls:  urls,
+		index: index,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.TimeoutSec) * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+				TLSClientConfig:     &tls.Config{InsecureSkipVerify: cfg.InsecureTLS}, // #nosec G402 -- opt-in for self-signed clusters
+			},
+		},
+	}
+	o.Batcher = outputs.NewBatcher("elasticsearch", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.deliver)
+	return o, nil
+}
+
+// NewOutput builds a BulkOutput from a destination config map. It is the
+// factory registered for the "elasticsearch" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewBulkOutput(c)
+}
+
+// bulkItem is one event with its encoded action and source lines.
+type bulkItem struct {
+	event map[string]interface{}
+	lines []byte
+}
+
+// bulkResponse is the part of a _bulk response we look at.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// deliver writes the batch. Items rejected with 429 or 5xx are retried with
+// backoff; items rejected for good (mapping errors and other 4xx) go to the
+// dead-letter store. It fails only while nothing in the batch has been
+// written or dead-lettered, so a retry of the whole batch cannot duplicate
+// anything. Once part of it has been, items still pending after MaxRetries
+// (or a failed retry request) are dead-lettered with the retryable error
+// instead, where they can be replayed.
+func (o *BulkOutput) deliver(events []map[string]interface{}) error {
+	items := make([]bulkItem, 0, len(events))
+	for _, ev := range events {
+		it, err := o.encode(ev)
+		if err != nil {
+			o.DeadLetter([]map[string]interface{}{ev}, outputs.Permanent(0, err))
+			continue
+		}
+		items = append(items, it)
+	}
+	delay := time.Duration(o.cfg.RetryDelayMs) * time.Millisecond
+	for attempt := 0; len(items) > 0; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		retry, err := o.bulk(items)
+		if err != nil {
+			return o.giveUp(len(events), items, err)
+		}
+		if len(retry) > 0 && attempt >= o.cfg.MaxRetries {
+			return o.giveUp(len(events), retry, fmt.Errorf("elasticsearch: %d of %d items still rejected after %d retries", len(retry), len(events), o.cfg.MaxRetries))
+		}
+		items = retry
+	}
+	return nil
+}
+
+// giveUp settles the items of a batch of total events that could not be
+// written: err is returned while they are the whole batch, otherwise they
+// are dead-lettered and the batch counts as delivered.
+func (o *BulkOutput) giveUp(total int, pending []bulkItem, err error) error {
+	if len(pending) == total {
+		return err
+	}
+	events := make([]map[string]interface{}, len(pending))
+	for i, it := range pending {
+		events[i] = it.event
+	}
+	o.DeadLetter(events, err)
+	return nil
+}
+
+func (o *BulkOutput) encode(ev map[string]interface{}) (bulkItem, error) {
+	ts, ok := outputs.EventTime(ev, o.cfg.TimeField)
+	if !ok {
+		ts = time.Now()
+	}
+	meta := map[string]interface{}{"_index": o.index.Execute(ev, ts)}
+	if id := outputs.FieldString(ev, o.cfg.IDField); id != "" {
+		meta["_id"] = id
+	}
+	op := "index"
+	doc := ev
+	if o.cfg.DataStream {
+		op = "create"
+		if _, has := ev["@timestamp"]; !has {
+			doc = make(map[string]interface{}, len(ev)+1)
+			for k, v := range ev {
+				doc[k] = v
+			}
+			doc["@timestamp"] = ts.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	action, err := json.Marshal(map[string]interface{}{op: meta})
+	if err != nil {
+		return bulkItem{}, err
+	}
+	source, err := json.Marshal(doc)
+	if err != nil {
+		return bulkItem{}, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	lines := make([]byte, 0, len(action)+len(source)+2)
+	lines = append(append(append(append(lines, action...), '\n'), source...), '\n')
+	return bulkItem{event: ev, lines: lines}, nil
+}
+
+// bulk sends one _bulk request and returns the items to retry.
+func (o *BulkOutput) bulk(items []bulkItem) ([]bulkItem, error) {
+	var body bytes.Buffer
+	for _, it := range items {
+		body.Write(it.lines)
+	}
+	resp, err := o.post(body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Errors {
+		return nil, nil
+	}
+	if len(resp.Items) != len(items) {
+		return nil, fmt.Errorf("elasticsearch: bulk response has %d items for %d requested", len(resp.Items), len(items))
+	}
+	var retry []bulkItem
+	var rejected []map[string]interface{}
+	var reason string
+	for i, res := range resp.Items {
+		for _, r := range res { // one key: the op name
+			switch {
+			case r.Status >= 200 && r.Status < 300:
+			case r.Status == http.StatusConflict && o.cfg.IDField != "":
+				// Already written by an earlier attempt.
+			case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+				retry = append(retry, items[i])
+			default:
+				rejected = append(rejected, items[i].event)
+				if r.Error != nil {
+					reason = fmt.Sprintf("%s: %s", r.Error.Type, r.Error.Reason)
+				}
+			}
+		}
+	}
+	if len(rejected) > 0 {
+		o.DeadLetter(rejected, outputs.Permanent(http.StatusBadRequest, fmt.Errorf("elasticsearch rejected %d items: %s", len(rejected), reason)))
+	}
+	return retry, nil
+}
+
+func (o *BulkOutput) post(payload []byte) (*bulkResponse, error) {
+	if o.cfg.Compression == "gzip" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(payload); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		payload = buf.Bytes()
+	}
+	path := "/_bulk"
+	if o.cfg.Pipeline != "" {
+		path += "?pipeline=" + url.QueryEscape(o.cfg.Pipeline)
+	}
+	start := int(o.next.Add(1) - 1)
+	var lastErr error
+	for i := range o.urls {
+		base := o.urls[(start+i)%len(o.urls)]
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, base+path, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		if o.cfg.Compression == "gzip" {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		switch {
+		case o.cfg.APIKey != "":
+			req.Header.Set("Authorization", "ApiKey "+o.cfg.APIKey)
+		case o.cfg.Username != "":
+			req.SetBasicAuth(o.cfg.Username, o.cfg.Password)
+		}
+		resp, err := o.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		respBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			msg := respBody
+			if len(msg) > 512 {
+				msg = msg[:512]
+			}
+			return nil, outputs.HTTPError(resp.StatusCode, fmt.Errorf("elasticsearch %s returned status %d: %s", base, resp.StatusCode, strings.TrimSpace(string(msg))))
+		}
+		var br bulkResponse
+		if err := json.Unmarshal(respBody, &br); err != nil {
+			return nil, fmt.Errorf("elasticsearch: decode bulk response: %w", err)
+		}
+		return &br, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,192 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"bibbl/pkg/outputs"
+)
+
+func TestBulkItemErrorsRetriesAndDeadLetters(t *testing.T) {
+	var mu sync.Mutex
+	var actions []map[string]map[string]interface{}
+	stored := map[string]bool{}
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_bulk" || r.Header.Get("Authorization") != "ApiKey abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		var items []map[string]interface{}
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			var action map[string]map[string]interface{}
+			_ = json.Unmarshal(sc.Bytes(), &action)
+			sc.Scan()
+			var doc map[string]interface{}
+			_ = json.Unmarshal(sc.Bytes(), &doc)
+			actions = append(actions, action)
+			id, _ := action["index"]["_id"].(string)
+			status := 201
+			switch {
+			case doc["bad"] == true:
+				items = append(items, map[string]interface{}{"index": map[string]interface{}{"status": 400, "error": map[string]interface{}{"type": "mapper_parsing_exception", "reason": "failed to parse field [bytes]"}}})
+				continue
+			case id == "busy" && calls == 1:
+				status = 429
+			default:
+				stored[id] = true
+			}
+			items = append(items, map[string]interface{}{"index": map[string]interface{}{"status": status}})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+	}))
+	defer srv.Close()
+
+	out, err := NewBulkOutput(Config{URL: srv.URL, Index: "logs-versa-%Y.%m.%d", IDField: "id", APIKey: "abc", RetryDelayMs: 1})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dead []map[string]interface{}
+	var deadErr error
+	out.SetDeadLetter(func(events []map[string]interface{}, err error) { dead, deadErr = events, err })
+
+	err = out.SendBatch([]map[string]interface{}{
+		{"id": "ok", "timestamp": "2024-05-01T10:00:00Z"},
+		{"id": "busy"},
+		{"id": "broken", "bad": true},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if calls != 2 || !stored["ok"] || !stored["busy"] {
+		t.Fatalf("expected the 429 item to be retried once, calls=%d stored=%v", calls, stored)
+	}
+	if got := actions[0]["index"]["_index"]; got != "logs-versa-2024.05.01" {
+		t.Fatalf("index template not applied: %v", got)
+	}
+	if len(dead) != 1 || dead[0]["id"] != "broken" {
+		t.Fatalf("mapping error should be dead-lettered: %v", dead)
+	}
+	if _, permanent := outputs.IsPermanent(deadErr); !permanent {
+		t.Fatalf("dead-letter reason should be permanent: %v", deadErr)
+	}
+}
+
+func TestBulkRetriesExhaustedDeadLetterOnlyPendingItems(t *testing.T) {
+	var mu sync.Mutex
+	writes := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		var items []map[string]interface{}
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			var action map[string]map[string]interface{}
+			_ = json.Unmarshal(sc.Bytes(), &action)
+			sc.Scan()
+			id, _ := action["index"]["_id"].(string)
+			status := 201
+			if id == "busy" {
+				status = 429
+			} else {
+				writes[id]++
+			}
+			items = append(items, map[string]interface{}{"index": map[string]interface{}{"status": status}})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+	}))
+	defer srv.Close()
+
+	out, err := NewBulkOutput(Config{URL: srv.URL, IDField: "id", MaxRetries: 2, RetryDelayMs: 1})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dead [][]map[string]interface{}
+	var deadErr error
+	out.SetDeadLetter(func(events []map[string]interface{}, err error) {
+		dead = append(dead, events)
+		deadErr = err
+	})
+
+	// The written item must not come back for a retry of the whole batch.
+	if err := out.SendBatch([]map[string]interface{}{{"id": "ok"}, {"id": "busy"}}); err != nil {
+		t.Fatalf("a partly written batch should not fail as a whole: %v", err)
+	}
+	if writes["ok"] != 1 {
+		t.Fatalf("accepted item written %d times", writes["ok"])
+	}
+	if len(dead) != 1 || len(dead[0]) != 1 || dead[0][0]["id"] != "busy" {
+		t.Fatalf("only the still-rejected item should be dead-lettered: %v", dead)
+	}
+	if _, permanent := outputs.IsPermanent(deadErr); permanent {
+		t.Fatalf("exhausted retries should stay retryable: %v", deadErr)
+	}
+
+	// Nothing written yet: the whole batch is still safe to retry.
+	dead = nil
+	if err := out.SendBatch([]map[string]interface{}{{"id": "busy"}}); err == nil {
+		t.Fatal("a batch with nothing written should fail for a retry")
+	}
+	if len(dead) != 0 {
+		t.Fatalf("a failed batch must not also be dead-lettered: %v", dead)
+	}
+}
+
+func TestBulkDataStreamAndHTTPErrors(t *testing.T) {
+	var op string
+	var doc map[string]interface{}
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "elastic" || p != "pw" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		sc := bufio.NewScanner(r.Body)
+		sc.Scan()
+		var action map[string]interface{}
+		_ = json.Unmarshal(sc.Bytes(), &action)
+		for k := range action {
+			op = k
+		}
+		sc.Scan()
+		_ = json.Unmarshal(sc.Bytes(), &doc)
+		_, _ = w.Write([]byte(`{"errors":false,"items":[{"create":{"status":201}}]}`))
+	}))
+	defer srv.Close()
+
+	out, err := NewBulkOutput(Config{URL: srv.URL, DataStream: true, Username: "elastic", Password: "pw"})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	if err := out.SendBatch([]map[string]interface{}{{"_raw": "x", "timestamp": 1714557600}}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if op != "create" || doc["@timestamp"] != "2024-05-01T10:00:00Z" {
+		t.Fatalf("data stream writes need op create and @timestamp, got %q %v", op, doc)
+	}
+	status = http.StatusBadRequest
+	if _, permanent := outputs.IsPermanent(out.SendBatch([]map[string]interface{}{{"_raw": "x"}})); !permanent {
+		t.Fatal("a 400 for the whole request should be permanent")
+	}
+	status = http.StatusServiceUnavailable
+	if err := out.SendBatch([]map[string]interface{}{{"_raw": "x"}}); err == nil {
+		t.Fatal("a 503 should fail the batch")
+	} else if _, permanent := outputs.IsPermanent(err); permanent {
+		t.Fatal("a 503 should be retryable")
+	}
+}
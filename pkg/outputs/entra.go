@@ -0,0 +1,90 @@
+package outputs
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// EntraConfig holds the Microsoft Entra ID settings shared by Azure outputs.
+// It is embedded in their configs, so the keys sit at the top level of the
+// destination config.
+type EntraConfig struct {
+	TenantID     string `json:"tenantId"`
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+	// Certificate credentials: a PEM or PKCS#12 file, or inline PEM.
+	CertificateFile      string `json:"certificateFile"`
+	CertificatePEM       string `json:"certificatePem"`
+	CertificatePassword  string `json:"certificatePassword"`
+	SendCertificateChain bool   `json:"sendCertificateChain"` // subject name/issuer auth
+	// AuthorityHost overrides the login endpoint, e.g. for sovereign clouds
+	// (https://login.microsoftonline.us/). Instance discovery is skipped
+	// when it is set.
+	AuthorityHost string `json:"authorityHost"`
+}
+
+// Credential returns a token credential: client secret when clientSecret is
+// set, certificate when a certificate is set, otherwise managed identity
+// (user-assigned when clientId is set). tlsCfg, when non-nil, is used for
+// the token requests.
+func (c EntraConfig) Credential(tlsCfg *tls.Config) (azcore.TokenCredential, error) {
+	opts := azcore.ClientOptions{Cloud: cloud.AzurePublic}
+	if c.AuthorityHost != "" {
+		opts.Cloud = cloud.Configuration{ActiveDirectoryAuthorityHost: c.AuthorityHost}
+	}
+	if tlsCfg != nil {
+		opts.Transport = &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsCfg, TLSHandshakeTimeout: 10 * time.Second},
+		}
+	}
+	custom := c.AuthorityHost != ""
+	switch {
+	case c.ClientSecret != "":
+		if c.TenantID == "" || c.ClientID == "" {
+			return nil, fmt.Errorf("tenantId and clientId are required with clientSecret")
+		}
+		return azidentity.NewClientSecretCredential(c.TenantID, c.ClientID, c.ClientSecret, &azidentity.ClientSecretCredentialOptions{
+			ClientOptions:            opts,
+			DisableInstanceDiscovery: custom,
+		})
+	case c.CertificateFile != "" || c.CertificatePEM != "":
+		if c.TenantID == "" || c.ClientID == "" {
+			return nil, fmt.Errorf("tenantId and clientId are required with a certificate")
+		}
+		data := []byte(c.CertificatePEM)
+		if c.CertificateFile != "" {
+			var err error
+			if data, err = os.ReadFile(c.CertificateFile); err != nil {
+				return nil, fmt.Errorf("read certificateFile: %w", err)
+			}
+		}
+		var password []byte
+		if c.CertificatePassword != "" {
+			password = []byte(c.CertificatePassword)
+		}
+		certs, key, err := azidentity.ParseCertificates(data, password)
+		if err != nil {
+			return nil, fmt.Errorf("parse certificate: %w", err)
+		}
+		return azidentity.NewClientCertificateCredential(c.TenantID, c.ClientID, certs, key, &azidentity.ClientCertificateCredentialOptions{
+			ClientOptions:            opts,
+			DisableInstanceDiscovery: custom,
+			SendCertificateChain:     c.SendCertificateChain,
+		})
+	default:
+		mi := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: opts}
+		if id := strings.TrimSpace(c.ClientID); id != "" {
+			mi.ID = azidentity.ClientID(id)
+		}
+		return azidentity.NewManagedIdentityCredential(mi)
+	}
+}
@@ -0,0 +1,88 @@
+package outputs
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field looks up an event field. Dotted names reach into nested objects
+// ("geo.country") when no top-level field has the literal name.
+func Field(event map[string]interface{}, name string) (interface{}, bool) {
+	if name == "" {
+		return nil, false
+	}
+	if v, ok := event[name]; ok {
+		return v, true
+	}
+	cur := event
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		v, ok := cur[p]
+		if !ok {
+			return nil, false
+		}
+		if i == len(parts)-1 {
+			return v, true
+		}
+		if cur, ok = v.(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// FieldString returns an event field as a string, or "" when it is absent.
+func FieldString(event map[string]interface{}, name string) string {
+	v, ok := Field(event, name)
+	if !ok || v == nil {
+		return ""
+	}
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	default:
+		return fmt.Sprint(t)
+	}
+}
+
+// EventTime reads an event timestamp from field: RFC 3339 text or Unix
+// seconds (fractions allowed, milliseconds detected by magnitude). ok is
+// false when the field is missing or unparseable.
+func EventTime(event map[string]interface{}, field string) (time.Time, bool) {
+	v, ok := Field(event, field)
+	if !ok {
+		return time.Time{}, false
+	}
+	var secs float64
+	switch t := v.(type) {
+	case string:
+		if ts, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return ts, true
+		}
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		secs = f
+	case float64:
+		secs = t
+	case int64:
+		secs = float64(t)
+	case int:
+		secs = float64(t)
+	case time.Time:
+		return t, true
+	default:
+		return time.Time{}, false
+	}
+	if secs > 1e11 { // milliseconds
+		secs /= 1000
+	}
+	whole, frac := math.Modf(secs)
+	return time.Unix(int64(whole), int64(frac*1e9)), true
+}
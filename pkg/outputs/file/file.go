@@ -0,0 +1,665 @@
+// Package file lands events on local disk as NDJSON or raw lines, for sites
+// where logs are collected from the filesystem. It backs the "file"
+// destination type: files are rotated by size and age, optionally
+// compressed, and only appear under their final name once complete.
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"bibbl/pkg/outputs"
+)
+
+// Line formats.
+const (
+	FormatNDJSON = "ndjson"
+	FormatRaw    = "raw"
+)
+
+// Fsync policies.
+const (
+	FsyncBatch    = "batch"    // before a batch is acknowledged
+	FsyncInterval = "interval" // every fsyncIntervalSec
+	FsyncNone     = "none"     // left to the OS; finished files are still synced
+)
+
+// Config holds configuration for a file destination.
+type Config struct {
+	// Path is a template for the file of each event, such as
+	// /var/log/bibbl/${source}/${host}/%Y-%m-%d.ndjson. A timestamp goes
+	// before the extension of every file, so rotations never collide.
+	Path      string `json:"path"`
+	TimeField string `json:"timeField"` // event time for the template, default "timestamp"
+
+	Format   string `json:"format"`   // ndjson (default) | raw
+	RawField string `json:"rawField"` // raw lines: the field to write, default "_raw"; events without it are written as JSON
+
+	// Compression applies to finished files: none (default) | gzip | zstd.
+	Compression string `json:"compression"`
+
+	// A file is finished when it reaches RotateBytes (default 100 MiB) or
+	// has been open RotateSec seconds (default 3600).
+	RotateBytes  int64 `json:"rotateBytes"`
+	RotateSec    int   `json:"rotateSec"`
+	MaxOpenFiles int   `json:"maxOpenFiles"` // default 64; the oldest is finished to open another
+
+	// Atomic (default true) writes to <name>.tmp and renames the finished
+	// file into place, so collectors never see a partial file. Disable it
+	// to let tools tail the live file under its final name.
+	Atomic *bool `json:"atomic"`
+
+	Fsync            string `json:"fsync"` // batch (default) | interval | none
+	FsyncIntervalSec int    `json:"fsyncIntervalSec"`
+
+	// Retention deletes finished files below the fixed directory the path
+	// starts with: beyond MaxFiles newest, or older than MaxAgeHours.
+	MaxFiles    int `json:"maxFiles"`
+	MaxAgeHours int `json:"maxAgeHours"`
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+}
+
+// active is a file being written.
+type active struct {
+	base    string // rendered path template
+	final   string // finished name, before compression
+	path    string // where lines go now: final, or final.tmp
+	f       *os.File
+	w       *bufio.Writer
+	bytes   int64
+	created time.Time
+	dirty   bool // written since the last fsync
+}
+
+// FileOutput writes events to rotating local files.
+type FileOutput struct {
+	*outputs.Batcher
+
+	cfg    Config
+	tmpl   *outputs.Template
+	atomic bool
+	ext    string         // default extension when the path has none
+	root   string         // retention scope
+	own    *regexp.Regexp // this output's file names, relative to root, without the stamp
+
+	mu        sync.Mutex
+	open      map[string]*active
+	finishing []*active // closed, waiting to be renamed and compressed
+	recovered map[string]bool
+	closed    bool
+
+	statsMu    sync.Mutex
+	written    uint64
+	finished   uint64
+	deleted    uint64
+	lastErr    string
+	lastErrAt  time.Time
+	lastFinish time.Time
+
+	kick     chan struct{}
+	stop     chan struct{}
+	loops    sync.WaitGroup
+	stopOnce sync.Once
+}
+
+// NewFileOutput validates cfg, applies defaults and starts the rotation,
+// fsync and retention loops.
+func NewFileOutput(cfg Config) (*FileOutput, error) {
+	if strings.TrimSpace(cfg.Path) == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+	tmpl, err := outputs.ParseTemplate(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	o := &FileOutput{tmpl: tmpl, atomic: cfg.Atomic == nil || *cfg.Atomic}
+	if cfg.TimeField == "" {
+		cfg.TimeField = "timestamp"
+	}
+	switch cfg.Format = strings.ToLower(cfg.Format); cfg.Format {
+	case "", "jsonl", FormatNDJSON:
+		cfg.Format, o.ext = FormatNDJSON, ".ndjson"
+	case FormatRaw:
+		o.ext = ".log"
+	default:
+		return nil, fmt.Errorf("format must be ndjson or raw, got %q", cfg.Format)
+	}
+	if cfg.RawField == "" {
+		cfg.RawField = "_raw"
+	}
+	switch cfg.Compression = strings.ToLower(cfg.Compression); cfg.Compression {
+	case "":
+		cfg.Compression = "none"
+	case "none", "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("compression must be none, gzip or zstd, got %q", cfg.Compression)
+	}
+	if cfg.RotateBytes <= 0 {
+		cfg.RotateBytes = 100 << 20
+	}
+	if cfg.RotateSec <= 0 {
+		cfg.RotateSec = 3600
+	}
+	if cfg.MaxOpenFiles <= 0 {
+		cfg.MaxOpenFiles = 64
+	}
+	switch cfg.Fsync = strings.ToLower(cfg.Fsync); cfg.Fsync {
+	case "":
+		cfg.Fsync = FsyncBatch
+	case FsyncBatch, FsyncInterval, FsyncNone:
+	default:
+		return nil, fmt.Errorf("fsync must be batch, interval or none, got %q", cfg.Fsync)
+	}
+	if cfg.FsyncIntervalSec <= 0 {
+		cfg.FsyncIntervalSec = 1
+	}
+	if cfg.MaxFiles > 0 || cfg.MaxAgeHours > 0 {
+		// Only the literal directory part is fixed; "/logs/fw-%Y" sweeps /logs.
+		o.root = filepath.Dir(tmpl.Prefix() + "x")
+		if abs, err := filepath.Abs(o.root); err != nil || abs == filepath.Dir(abs) {
+			return nil, fmt.Errorf("retention needs the path to start with a fixed directory other than the filesystem root")
+		}
+		prefix := tmpl.Prefix()
+		fixed := prefix[:strings.LastIndexAny(prefix, `/\`)+1]
+		o.own, err = regexp.Compile("^" + strings.TrimPrefix(tmpl.Pattern(), regexp.QuoteMeta(fixed)) + "$")
+		if err != nil {
+			return nil, fmt.Errorf("retention pattern: %w", err)
+		}
+	}
+	o.cfg = cfg
+	o.open = make(map[string]*active)
+	o.recovered = make(map[string]bool)
+	o.kick = make(chan struct{}, 1)
+	o.stop = make(chan struct{})
+	o.Batcher = outputs.NewBatcher("file", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.write)
+	o.loops.Add(2)
+	go o.rotateLoop()
+	go o.finishLoop()
+	return o, nil
+}
+
+// NewOutput builds a FileOutput from a destination config map. It is the
+// factory registered for the "file" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewFileOutput(c)
+}
+
+// write appends events to their files. With the batch fsync policy the
+// lines are on disk before the caller lets go of them.
+func (o *FileOutput) write(events []map[string]interface{}) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return outputs.ErrClosed
+	}
+	touched := map[*active]bool{}
+	var n uint64
+	for _, ev := range events {
+		line, err := o.line(ev)
+		if err != nil {
+			o.DeadLetter([]map[string]interface{}{ev}, outputs.Permanent(0, err))
+			continue
+		}
+		ts, ok := outputs.EventTime(ev, o.cfg.TimeField)
+		if !ok {
+			ts = time.Now()
+		}
+		a, err := o.fileLocked(o.tmpl.Execute(ev, ts))
+		if err != nil {
+			return err
+		}
+		if _, err := a.w.Write(line); err != nil {
+			return fmt.Errorf("write %s: %w", a.path, err)
+		}
+		a.bytes += int64(len(line))
+		a.dirty = true
+		touched[a] = true
+		n++
+	}
+	rotated := false
+	for a := range touched {
+		if o.open[a.base] != a {
+			continue // finished to make room for another file
+		}
+		if err := a.w.Flush(); err != nil {
+			return fmt.Errorf("write %s: %w", a.path, err)
+		}
+		if o.cfg.Fsync == FsyncBatch {
+			if err := a.f.Sync(); err != nil {
+				return fmt.Errorf("sync %s: %w", a.path, err)
+			}
+			a.dirty = false
+		}
+		if a.bytes >= o.cfg.RotateBytes {
+			o.closeLocked(a)
+			rotated = true
+		}
+	}
+	if rotated {
+		o.signal()
+	}
+	o.statsMu.Lock()
+	o.written += n
+	o.statsMu.Unlock()
+	return nil
+}
+
+// line renders one event, newline terminated.
+func (o *FileOutput) line(ev map[string]interface{}) ([]byte, error) {
+	if o.cfg.Format == FormatRaw {
+		if s := outputs.FieldString(ev, o.cfg.RawField); s != "" {
+			s = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(s)
+			return []byte(s + "\n"), nil
+		}
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	return append(b, '\n'), nil
+}
+
+// fileLocked returns the open file for a rendered path, opening one (and
+// finishing the oldest when too many are open) as needed.
+func (o *FileOutput) fileLocked(base string) (*active, error) {
+	if a := o.open[base]; a != nil {
+		return a, nil
+	}
+	if len(o.open) >= o.cfg.MaxOpenFiles {
+		var oldest *active
+		for _, a := range o.open {
+			if oldest == nil || a.created.Before(oldest.created) {
+				oldest = a
+			}
+		}
+		o.closeLocked(oldest)
+		o.signal()
+	}
+	if err := os.MkdirAll(filepath.Dir(base), 0o755); err != nil {
+		return nil, fmt.Errorf("create directory: %w", err)
+	}
+	if !o.recovered[base] {
+		o.recovered[base] = true
+		o.recoverLocked(base)
+	}
+	now := time.Now().UTC()
+	a := &active{base: base, created: now}
+	stem, ext := o.split(base)
+	stamp := now.Format("20060102T150405Z")
+	for i := 0; ; i++ {
+		a.final = stem + "-" + stamp + ext
+		if i > 0 {
+			a.final = stem + "-" + stamp + "-" + strconv.Itoa(i) + ext
+		}
+		if !exists(a.final) && !exists(a.final+".tmp") && !exists(a.final+o.compressedExt()) {
+			break
+		}
+	}
+	a.path = a.final
+	if o.atomic {
+		a.path += ".tmp"
+	}
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open file: %w", err)
+	}
+	a.f, a.w = f, bufio.NewWriterSize(f, 64<<10)
+	o.open[base] = a
+	return a, nil
+}
+
+// split separates a rendered path at the extension of its last element,
+// adding the default extension when it has none.
+func (o *FileOutput) split(base string) (string, string) {
+	dir, name := filepath.Split(base)
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		return dir + name[:i], name[i:]
+	}
+	if name == "" {
+		name = "bibbl"
+	}
+	return dir + name, o.ext
+}
+
+func (o *FileOutput) compressedExt() string {
+	switch o.cfg.Compression {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	}
+	return ""
+}
+
+// closeLocked closes a file and queues it to be finished.
+func (o *FileOutput) closeLocked(a *active) {
+	delete(o.open, a.base)
+	err := a.w.Flush()
+	if serr := a.f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		o.fail(fmt.Errorf("close %s: %w", a.path, err))
+	}
+	o.finishing = append(o.finishing, a)
+}
+
+// finish gives a closed file its final name, compressing it first when
+// configured. The compressed copy is written to a temp name, synced and
+// renamed before the source goes, so a crash leaves one complete file.
+func (o *FileOutput) finish(path, final string) error {
+	if o.cfg.Compression == "none" {
+		if path != final {
+			if err := os.Rename(path, final); err != nil {
+				return err
+			}
+		}
+		return syncDir(filepath.Dir(final))
+	}
+	dst := final + o.compressedExt()
+	if err := compressFile(path, dst, o.cfg.Compression); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func compressFile(src, dst, compression string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	var zw io.WriteCloser
+	if compression == "zstd" {
+		zw, err = zstd.NewWriter(out)
+	} else {
+		zw = gzip.NewWriter(out)
+	}
+	if err == nil {
+		if _, err = io.Copy(zw, in); err == nil {
+			err = zw.Close()
+		}
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// recoverLocked finishes what a previous run left behind for base: temp
+// files it was writing, and with compression on, files it had not
+// compressed yet. Torn last lines are cut off first.
+func (o *FileOutput) recoverLocked(base string) {
+	stem, ext := o.split(base)
+	matches, _ := filepath.Glob(globEscape(stem) + "-*")
+	for _, m := range matches {
+		rest := strings.TrimPrefix(m, stem+"-")
+		switch {
+		case strings.HasSuffix(m, o.compressedExt()+".tmp") && o.compressedExt() != "":
+			_ = os.Remove(m) // an interrupted compression; its source is still there
+		case o.atomic && strings.HasSuffix(rest, ext+".tmp") && isStamp(strings.TrimSuffix(rest, ext+".tmp")):
+			o.recoverFile(m, strings.TrimSuffix(m, ".tmp"))
+		case o.cfg.Compression != "none" && strings.HasSuffix(rest, ext) && isStamp(strings.TrimSuffix(rest, ext)):
+			o.recoverFile(m, m)
+		}
+	}
+}
+
+func (o *FileOutput) recoverFile(path, final string) {
+	if err := truncateTorn(path); err != nil {
+		o.fail(fmt.Errorf("recover %s: %w", path, err))
+		return
+	}
+	if err := o.finish(path, final); err != nil {
+		o.fail(fmt.Errorf("recover %s: %w", path, err))
+		return
+	}
+	log.Printf("file: recovered %s", final)
+}
+
+// truncateTorn cuts a file after its last newline.
+func truncateTorn(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	buf := make([]byte, 64<<10)
+	for end := size; end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		n, err := f.ReadAt(buf[:end-start], start)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if i := strings.LastIndexByte(string(buf[:n]), '\n'); i >= 0 {
+			if start+int64(i)+1 == size {
+				return nil
+			}
+			return f.Truncate(start + int64(i) + 1)
+		}
+		end = start
+	}
+	return f.Truncate(0)
+}
+
+func (o *FileOutput) rotateLoop() {
+	defer o.loops.Done()
+	every := time.Duration(o.cfg.RotateSec) * time.Second / 10
+	every = min(max(every, 100*time.Millisecond), 5*time.Second)
+	rotate := time.NewTicker(every)
+	defer rotate.Stop()
+	sync := time.NewTicker(time.Duration(o.cfg.FsyncIntervalSec) * time.Second)
+	defer sync.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-rotate.C:
+			o.Rotate(time.Duration(o.cfg.RotateSec) * time.Second)
+		case <-sync.C:
+			if o.cfg.Fsync == FsyncInterval {
+				o.syncAll()
+			}
+		}
+	}
+}
+
+// Rotate finishes every open file older than age; 0 finishes all of them.
+func (o *FileOutput) Rotate(age time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	rotated := false
+	for _, a := range o.open {
+		if time.Since(a.created) >= age {
+			o.closeLocked(a)
+			rotated = true
+		}
+	}
+	if rotated {
+		o.signal()
+	}
+}
+
+func (o *FileOutput) syncAll() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, a := range o.open {
+		if !a.dirty {
+			continue
+		}
+		if err := a.f.Sync(); err != nil {
+			o.fail(fmt.Errorf("sync %s: %w", a.path, err))
+			continue
+		}
+		a.dirty = false
+	}
+}
+
+func (o *FileOutput) signal() {
+	select {
+	case o.kick <- struct{}{}:
+	default:
+	}
+}
+
+// finishLoop renames and compresses closed files outside the write lock,
+// then applies retention.
+func (o *FileOutput) finishLoop() {
+	defer o.loops.Done()
+	sweep := time.NewTicker(time.Minute)
+	defer sweep.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		case <-o.kick:
+			o.finishPending()
+		case <-sweep.C:
+		}
+		o.sweep()
+	}
+}
+
+// finishPending finishes closed files oldest first. A file that cannot be
+// finished stays under its temporary name and is retried on restart.
+func (o *FileOutput) finishPending() {
+	o.mu.Lock()
+	pending := o.finishing
+	o.finishing = nil
+	o.mu.Unlock()
+	for _, a := range pending {
+		if err := o.finish(a.path, a.final); err != nil {
+			o.fail(fmt.Errorf("finish %s: %w", a.final, err))
+			continue
+		}
+		o.statsMu.Lock()
+		o.finished++
+		o.lastFinish = time.Now()
+		o.statsMu.Unlock()
+	}
+}
+
+func (o *FileOutput) fail(err error) {
+	log.Printf("file: %v", err)
+	o.statsMu.Lock()
+	o.lastErr, o.lastErrAt = err.Error(), time.Now()
+	o.statsMu.Unlock()
+}
+
+// Health reports writes as the delivery health, turned to error while
+// finishing or retention fails, with the file state in Details.
+func (o *FileOutput) Health() outputs.Health {
+	h := o.Batcher.Health()
+	o.mu.Lock()
+	open, pending := len(o.open), len(o.finishing)
+	o.mu.Unlock()
+	o.statsMu.Lock()
+	defer o.statsMu.Unlock()
+	d := map[string]interface{}{
+		"openFiles":     open,
+		"pendingFinish": pending,
+		"written":       o.written,
+		"finished":      o.finished,
+		"deleted":       o.deleted,
+	}
+	if !o.lastFinish.IsZero() {
+		d["lastFinish"] = o.lastFinish
+	}
+	if o.lastErr != "" && o.lastErrAt.After(o.lastFinish) {
+		d["lastError"] = o.lastErr
+		h.Status = outputs.StatusError
+		h.LastError, h.LastErrorAt = o.lastErr, o.lastErrAt
+	}
+	h.Details = map[string]interface{}{"file": d}
+	return h
+}
+
+// Close writes what is still batched and finishes every open file.
+func (o *FileOutput) Close() error {
+	err := o.Batcher.Close()
+	o.stopOnce.Do(func() {
+		close(o.stop)
+		o.loops.Wait()
+		o.mu.Lock()
+		for _, a := range o.open {
+			o.closeLocked(a)
+		}
+		o.closed = true
+		o.mu.Unlock()
+		o.finishPending()
+		o.sweep()
+	})
+	return err
+}
+
+func exists(p string) bool {
+	_, err := os.Lstat(p)
+	return err == nil
+}
+
+// syncDir makes a rename durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
+
+func globEscape(s string) string {
+	return strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`).Replace(s)
+}
@@ -0,0 +1,234 @@
+package file
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func listFiles(t *testing.T, root string) []string {
+	t.Helper()
+	var out []string
+	_ = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(root, p)
+			out = append(out, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(out)
+	return out
+}
+
+func readAll(t *testing.T, p string) string {
+	t.Helper()
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(p, ".gz"):
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case strings.HasSuffix(p, ".zst"):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotatesBySizeWithTempThenRename(t *testing.T) {
+	dir := t.TempDir()
+	out, err := NewFileOutput(Config{Path: filepath.Join(dir, "${host}", "%Y-%m-%d.ndjson"), Compression: "gzip", RotateBytes: 200})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	ev := func(host string, n int) map[string]interface{} {
+		return map[string]interface{}{"timestamp": "2024-05-01T10:00:00Z", "host": host, "n": n, "pad": strings.Repeat("x", 60)}
+	}
+	if err := out.SendBatch([]map[string]interface{}{ev("fw-1", 1), ev("fw-2", 2)}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	files := listFiles(t, dir)
+	if len(files) != 2 || !strings.HasSuffix(files[0], ".ndjson.tmp") || !strings.HasPrefix(files[0], "fw-1/2024-05-01-") {
+		t.Fatalf("expected one temp file per host, got %v", files)
+	}
+	// The third event pushes fw-1 past rotateBytes.
+	if err := out.SendBatch([]map[string]interface{}{ev("fw-1", 3), ev("fw-1", 4)}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && out.Health().Details["file"].(map[string]interface{})["finished"] != uint64(1) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	files = listFiles(t, filepath.Join(dir, "fw-1"))
+	if len(files) != 1 || !strings.HasSuffix(files[0], ".ndjson.gz") {
+		t.Fatalf("expected the rotated file compressed under its final name, got %v", files)
+	}
+	if got := readAll(t, filepath.Join(dir, "fw-1", files[0])); strings.Count(got, "\n") != 3 || !strings.Contains(got, `"n":3`) {
+		t.Fatalf("unexpected rotated content %q", got)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	for _, f := range listFiles(t, dir) {
+		if !strings.HasSuffix(f, ".ndjson.gz") {
+			t.Fatalf("close should finish every file, found %s", f)
+		}
+	}
+	if got := listFiles(t, filepath.Join(dir, "fw-2")); len(got) != 1 {
+		t.Fatalf("expected fw-2 finished on close, got %v", got)
+	}
+}
+
+func TestRawLinesLiveFileAndTimeRotation(t *testing.T) {
+	dir := t.TempDir()
+	atomic := false
+	out, err := NewFileOutput(Config{Path: filepath.Join(dir, "versa"), Format: FormatRaw, Compression: "zstd", Atomic: &atomic, Fsync: FsyncInterval})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	if err := out.SendBatch([]map[string]interface{}{
+		{"_raw": "<134>1 2024-05-01T10:00:00Z fw-1 versa - - - flow\nsecond"},
+		{"message": "no raw field"},
+	}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	files := listFiles(t, dir)
+	if len(files) != 1 || !strings.HasPrefix(files[0], "versa-") || !strings.HasSuffix(files[0], ".log") {
+		t.Fatalf("expected the live file under its final name, got %v", files)
+	}
+	want := "<134>1 2024-05-01T10:00:00Z fw-1 versa - - - flow second\n{\"message\":\"no raw field\"}\n"
+	if got := readAll(t, filepath.Join(dir, files[0])); got != want {
+		t.Fatalf("unexpected live content %q", got)
+	}
+	out.Rotate(0)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if files = listFiles(t, dir); len(files) == 1 && strings.HasSuffix(files[0], ".log.zst") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(files) != 1 || readAll(t, filepath.Join(dir, files[0])) != want {
+		t.Fatalf("expected one compressed file with the same lines, got %v", files)
+	}
+}
+
+func TestRecoversLeftoverFiles(t *testing.T) {
+	dir := t.TempDir()
+	left := filepath.Join(dir, "fw-20240101T000000Z.ndjson.tmp")
+	if err := os.WriteFile(left, []byte("{\"a\":1}\n{\"a\":2}\n{\"a\":"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "fw-20231231T000000Z.ndjson.gz.tmp"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := NewFileOutput(Config{Path: filepath.Join(dir, "fw.ndjson"), Compression: "gzip"})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	if err := out.SendBatch([]map[string]interface{}{{"a": 3}}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	_ = out.Close()
+	files := listFiles(t, dir)
+	if len(files) != 2 || files[0] != "fw-20240101T000000Z.ndjson.gz" {
+		t.Fatalf("expected the leftover finished and the stale temp removed, got %v", files)
+	}
+	if got := readAll(t, filepath.Join(dir, files[0])); got != "{\"a\":1}\n{\"a\":2}\n" {
+		t.Fatalf("expected the torn line cut, got %q", got)
+	}
+}
+
+func TestRetentionByCountAndAge(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write := func(rel string, age time.Duration) {
+		p := filepath.Join(dir, rel)
+		_ = os.MkdirAll(filepath.Dir(p), 0o755)
+		if err := os.WriteFile(p, []byte("x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Chtimes(p, now.Add(-age), now.Add(-age))
+	}
+	write("fw-1/2024-05-01-20240501T000000Z.ndjson.gz", 200*time.Hour)
+	write("fw-1/2024-05-02-20240502T000000Z.ndjson.gz", 3*time.Hour)
+	write("fw-2/2024-05-02-20240502T000000Z-1.ndjson.gz", 2*time.Hour)
+	write("fw-2/2024-05-03-20240503T000000Z.ndjson.gz", time.Hour)
+	write("fw-2/2024-05-03-20240503T010000Z.ndjson.tmp", 300*time.Hour)
+	write("old/notes.txt", 300*time.Hour)
+	write("gone/2024-04-01-20240401T000000Z.ndjson.gz", 300*time.Hour)
+
+	out, err := NewFileOutput(Config{Path: filepath.Join(dir, "${host}", "%Y-%m-%d.ndjson"), MaxFiles: 2, MaxAgeHours: 100})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	out.sweep()
+	want := []string{
+		"fw-2/2024-05-02-20240502T000000Z-1.ndjson.gz",
+		"fw-2/2024-05-03-20240503T000000Z.ndjson.gz",
+		"fw-2/2024-05-03-20240503T010000Z.ndjson.tmp",
+		"old/notes.txt",
+	}
+	if got := listFiles(t, dir); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("unexpected files after retention\n got %v\nwant %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gone")); !os.IsNotExist(err) {
+		t.Fatalf("expected the emptied directory removed")
+	}
+	if d := out.Health().Details["file"].(map[string]interface{}); d["deleted"] != uint64(3) {
+		t.Fatalf("expected 3 deletions, got %v", d["deleted"])
+	}
+	_ = out.Close()
+
+	if _, err := NewFileOutput(Config{Path: "/${host}/x.ndjson", MaxFiles: 1}); err == nil {
+		t.Fatalf("expected retention from the filesystem root to be rejected")
+	}
+	if _, err := NewFileOutput(Config{Path: filepath.Join(dir, "x"), Fsync: "always"}); err == nil {
+		t.Fatalf("expected an unknown fsync policy to be rejected")
+	}
+}
+
+func TestRetentionLeavesSiblingDestinationsAlone(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-300 * time.Hour)
+	for _, name := range []string{"a-09-20240501T090000Z.ndjson", "a-10-20240501T100000Z.ndjson", "b-09-20240501T090000Z.ndjson"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_ = os.Chtimes(p, old, old)
+	}
+
+	out, err := NewFileOutput(Config{Path: filepath.Join(dir, "a-%H"), MaxFiles: 1, MaxAgeHours: 100})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	out.sweep()
+	if got := listFiles(t, dir); strings.Join(got, ",") != "b-09-20240501T090000Z.ndjson" {
+		t.Fatalf("only a's files should be swept, got %v", got)
+	}
+}
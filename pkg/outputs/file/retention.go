@@ -0,0 +1,116 @@
+package file
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// finishedName matches the names the output gives its files: the stem,
+// the open timestamp with an optional collision counter, the extension.
+var finishedName = regexp.MustCompile(`-\d{8}T\d{6}Z(-\d+)?(\.[^/\\]*)?$`)
+
+// owns reports whether rel, a path under root, is a finished file of this
+// output: with the stamp (and compression suffix) removed it must be an
+// expansion of the path template. Another destination writing under the
+// same directory has a different template, so its files never match.
+func (o *FileOutput) owns(rel string) bool {
+	loc := finishedName.FindStringSubmatchIndex(rel)
+	if loc == nil {
+		return false
+	}
+	stem, ext := rel[:loc[0]], ""
+	if loc[4] >= 0 {
+		ext = rel[loc[4]:loc[5]]
+	}
+	ext = strings.TrimSuffix(strings.TrimSuffix(ext, ".gz"), ".zst")
+	// The base is stem+ext when the template names an extension, else just
+	// the stem with the format's default extension added.
+	return o.own.MatchString(stem+ext) || (ext == o.ext && o.own.MatchString(stem))
+}
+
+var stampPattern = regexp.MustCompile(`^\d{8}T\d{6}Z(-\d+)?$`)
+
+func isStamp(s string) bool { return stampPattern.MatchString(s) }
+
+// sweep applies retention to the finished files under the path's fixed
+// directory. Files being written, temp files and anything the path template
+// could not have produced, such as a sibling destination's files, are left
+// alone.
+func (o *FileOutput) sweep() {
+	if o.root == "" {
+		return
+	}
+	o.mu.Lock()
+	live := map[string]bool{}
+	for _, a := range o.open {
+		live[a.path] = true
+	}
+	for _, a := range o.finishing {
+		live[a.path] = true
+	}
+	o.mu.Unlock()
+
+	type found struct {
+		path string
+		mod  time.Time
+	}
+	var files []found
+	_ = filepath.WalkDir(o.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		name := d.Name()
+		if !d.Type().IsRegular() || strings.HasSuffix(name, ".tmp") || live[p] {
+			return nil
+		}
+		if rel, err := filepath.Rel(o.root, p); err != nil || !o.owns(filepath.ToSlash(rel)) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, found{p, info.ModTime()})
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.After(files[j].mod) })
+	cutoff := time.Now().Add(-time.Duration(o.cfg.MaxAgeHours) * time.Hour)
+	var deleted uint64
+	dirs := map[string]bool{}
+	for i, f := range files {
+		if (o.cfg.MaxFiles > 0 && i >= o.cfg.MaxFiles) || (o.cfg.MaxAgeHours > 0 && f.mod.Before(cutoff)) {
+			if err := os.Remove(f.path); err != nil {
+				o.fail(err)
+				continue
+			}
+			deleted++
+			for d := filepath.Dir(f.path); d != o.root && strings.HasPrefix(d, o.root); d = filepath.Dir(d) {
+				dirs[d] = true
+			}
+		}
+	}
+	if deleted == 0 {
+		return
+	}
+	// Drop the directories that emptied, deepest first, under the write
+	// lock so none goes away between a new file's mkdir and open.
+	var ds []string
+	for d := range dirs {
+		ds = append(ds, d)
+	}
+	sort.Slice(ds, func(i, j int) bool { return len(ds[i]) > len(ds[j]) })
+	o.mu.Lock()
+	for _, d := range ds {
+		_ = os.Remove(d) // fails unless empty
+	}
+	o.mu.Unlock()
+	o.statsMu.Lock()
+	o.deleted += deleted
+	o.statsMu.Unlock()
+}
@@ -0,0 +1,575 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// conn is a connection to one broker. Requests on it are serialized; the
+// producer never has more than one request in flight per broker.
+type conn struct {
+	addr string
+	c    *client
+
+	mu          sync.Mutex
+	nc          net.Conn
+	versions    map[int16]versionRange
+	correlation int32
+}
+
+// call sends one request and returns the response body. build encodes the
+// request body for the negotiated version. With noResponse (acks=0
+// produce) the broker sends nothing back and call returns a nil decoder.
+func (cn *conn) call(key int16, build func(version int16) []byte, noResponse bool) (*decoder, int16, error) {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	if cn.nc == nil {
+		if err := cn.connect(); err != nil {
+			return nil, 0, err
+		}
+	}
+	v, err := cn.version(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	d, err := cn.roundTrip(key, v, build(v), noResponse)
+	if err != nil {
+		cn.closeLocked()
+		return nil, 0, err
+	}
+	return d, v, nil
+}
+
+// version picks the highest version both sides speak.
+func (cn *conn) version(key int16) (int16, error) {
+	ours := supported[key]
+	theirs, ok := cn.versions[key]
+	if !ok {
+		return 0, fmt.Errorf("kafka broker %s does not support API %d", cn.addr, key)
+	}
+	v := min(ours.max, theirs.max)
+	if v < max(ours.min, theirs.min) {
+		return 0, fmt.Errorf("kafka broker %s speaks versions %d-%d of API %d, this client %d-%d",
+			cn.addr, theirs.min, theirs.max, key, ours.min, ours.max)
+	}
+	return v, nil
+}
+
+func (cn *conn) roundTrip(key, version int16, body []byte, noResponse bool) (*decoder, error) {
+	cn.correlation++
+	_ = cn.nc.SetDeadline(time.Now().Add(cn.c.timeout))
+	if _, err := cn.nc.Write(request(key, version, cn.correlation, cn.c.clientID, body)); err != nil {
+		return nil, err
+	}
+	if noResponse {
+		return nil, nil
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(cn.nc, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n < 4 || n > 1<<30 {
+		return nil, fmt.Errorf("kafka broker %s: invalid response size %d", cn.addr, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(cn.nc, buf); err != nil {
+		return nil, err
+	}
+	d := &decoder{b: buf}
+	if id := d.int32(); id != cn.correlation {
+		return nil, fmt.Errorf("kafka broker %s: response for request %d, expected %d", cn.addr, id, cn.correlation)
+	}
+	return d, nil
+}
+
+// connect dials, negotiates API versions and authenticates.
+func (cn *conn) connect() error {
+	d := &net.Dialer{Timeout: min(cn.c.timeout, 10*time.Second), KeepAlive: 30 * time.Second}
+	var err error
+	if cn.c.tlsCfg != nil {
+		cn.nc, err = tls.DialWithDialer(d, "tcp", cn.addr, cn.c.tlsCfg)
+	} else {
+		cn.nc, err = d.Dial("tcp", cn.addr)
+	}
+	if err != nil {
+		cn.nc = nil
+		return fmt.Errorf("kafka dial %s: %w", cn.addr, err)
+	}
+	if err = cn.negotiate(); err == nil && cn.c.sasl != nil {
+		err = cn.authenticate()
+	}
+	if err != nil {
+		cn.closeLocked()
+		return fmt.Errorf("kafka broker %s: %w", cn.addr, err)
+	}
+	return nil
+}
+
+// negotiate sends ApiVersions v0, which every broker answers.
+func (cn *conn) negotiate() error {
+	d, err := cn.roundTrip(apiVersions, 0, nil, false)
+	if err != nil {
+		return err
+	}
+	code := d.int16()
+	versions := map[int16]versionRange{}
+	d.array(func() {
+		k := d.int16()
+		versions[k] = versionRange{d.int16(), d.int16()}
+	})
+	if d.err != nil {
+		return d.err
+	}
+	if e := errorFor(code); e != nil {
+		return e
+	}
+	cn.versions = versions
+	return nil
+}
+
+func (cn *conn) authenticate() error {
+	mech := cn.c.sasl
+	v, err := cn.version(apiSaslHandshake)
+	if err != nil {
+		return err
+	}
+	var body encoder
+	body.string(mech.name())
+	d, err := cn.roundTrip(apiSaslHandshake, v, body.b, false)
+	if err != nil {
+		return err
+	}
+	code := d.int16()
+	var enabled []string
+	d.array(func() { enabled = append(enabled, d.string()) })
+	if d.err != nil {
+		return d.err
+	}
+	if e := errorFor(code); e != nil {
+		return fmt.Errorf("sasl %s (broker enables %v): %w", mech.name(), enabled, e)
+	}
+	av, err := cn.version(apiSaslAuthenticate)
+	if err != nil {
+		return err
+	}
+	return mech.authenticate(func(msg []byte) ([]byte, error) {
+		var body encoder
+		body.bytes(msg)
+		d, err := cn.roundTrip(apiSaslAuthenticate, av, body.b, false)
+		if err != nil {
+			return nil, err
+		}
+		code, message, reply := d.int16(), d.string(), d.bytes()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if e := errorFor(code); e != nil {
+			if message != "" {
+				return nil, fmt.Errorf("sasl %s: %w: %s", mech.name(), e, message)
+			}
+			return nil, fmt.Errorf("sasl %s: %w", mech.name(), e)
+		}
+		return reply, nil
+	})
+}
+
+func (cn *conn) close() {
+	cn.mu.Lock()
+	defer cn.mu.Unlock()
+	cn.closeLocked()
+}
+
+func (cn *conn) closeLocked() {
+	if cn.nc != nil {
+		_ = cn.nc.Close()
+		cn.nc = nil
+	}
+}
+
+// partition is one partition of a topic; leader is -1 while it has none.
+type partition struct {
+	id, leader int32
+}
+
+type topicMeta struct {
+	partitions []partition
+	err        error
+	fetched    time.Time
+}
+
+// client tracks brokers, topic metadata and the idempotent producer id.
+type client struct {
+	seeds      []string
+	clientID   string
+	tlsCfg     *tls.Config
+	sasl       mechanism
+	timeout    time.Duration
+	autoTopic  bool
+	idempotent bool
+
+	mu        sync.Mutex
+	conns     map[string]*conn // by address
+	nodes     map[int32]string // broker id to address
+	topics    map[string]*topicMeta
+	producer  producerState
+	sequences map[topicPartition]int32
+	closed    bool
+}
+
+type topicPartition struct {
+	topic     string
+	partition int32
+}
+
+func (c *client) conn(addr string) (*conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errClientClosed
+	}
+	cn, ok := c.conns[addr]
+	if !ok {
+		cn = &conn{addr: addr, c: c}
+		c.conns[addr] = cn
+	}
+	return cn, nil
+}
+
+var errClientClosed = errors.New("kafka client closed")
+
+// any runs fn against the known brokers, then the seeds, until one
+// answers.
+func (c *client) any(fn func(cn *conn) error) error {
+	c.mu.Lock()
+	addrs := make([]string, 0, len(c.nodes)+len(c.seeds))
+	for _, a := range c.nodes {
+		addrs = append(addrs, a)
+	}
+	addrs = append(addrs, c.seeds...)
+	c.mu.Unlock()
+	var err error
+	for _, a := range addrs {
+		var cn *conn
+		if cn, err = c.conn(a); err != nil {
+			return err
+		}
+		if err = fn(cn); err == nil {
+			return nil
+		}
+		var ke *Error
+		if errors.As(err, &ke) {
+			return err // the cluster answered
+		}
+	}
+	return err
+}
+
+// refresh fetches metadata for topics.
+func (c *client) refresh(topics []string) error {
+	return c.any(func(cn *conn) error {
+		d, v, err := cn.call(apiMetadata, func(v int16) []byte {
+			var e encoder
+			e.int32(int32(len(topics)))
+			for _, t := range topics {
+				e.string(t)
+			}
+			if v >= 4 {
+				e.bool(c.autoTopic)
+			}
+			if v >= 8 {
+				e.bool(false)
+				e.bool(false)
+			}
+			return e.b
+		}, false)
+		if err != nil {
+			return err
+		}
+		if v >= 3 {
+			d.int32() // throttle
+		}
+		nodes := map[int32]string{}
+		d.array(func() {
+			id, host, port := d.int32(), d.string(), d.int32()
+			d.string() // rack
+			nodes[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		})
+		if v >= 2 {
+			d.string() // cluster id
+		}
+		d.int32() // controller
+		metas := map[string]*topicMeta{}
+		d.array(func() {
+			code, name := d.int16(), d.string()
+			d.bool() // internal
+			tm := &topicMeta{fetched: time.Now()}
+			if e := errorFor(code); e != nil {
+				tm.err = e
+			}
+			d.array(func() {
+				d.int16() // partition error: leader -1 says the same
+				p := partition{id: d.int32(), leader: d.int32()}
+				if v >= 7 {
+					d.int32() // leader epoch
+				}
+				d.int32s() // replicas
+				d.int32s() // isr
+				if v >= 5 {
+					d.int32s() // offline
+				}
+				tm.partitions = append(tm.partitions, p)
+			})
+			if v >= 8 {
+				d.int32() // authorized operations
+			}
+			metas[name] = tm
+		})
+		if d.err != nil {
+			return d.err
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for id, addr := range nodes {
+			c.nodes[id] = addr
+		}
+		for _, t := range topics {
+			if tm, ok := metas[t]; ok {
+				c.topics[t] = tm
+			}
+		}
+		return nil
+	})
+}
+
+// metadataMaxAge bounds how long partition leaders are trusted without a
+// produce error calling for a refresh.
+const metadataMaxAge = 5 * time.Minute
+
+// metadata returns the cached partitions of topic, or nil when they have
+// to be fetched.
+func (c *client) metadata(topic string) *topicMeta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tm := c.topics[topic]
+	if tm == nil || time.Since(tm.fetched) > metadataMaxAge {
+		return nil
+	}
+	return tm
+}
+
+// forget drops cached metadata so it is fetched again.
+func (c *client) forget(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.topics, topic)
+}
+
+func (c *client) leader(id int32) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr, ok := c.nodes[id]
+	return addr, ok
+}
+
+// producerID returns the idempotent producer id, requesting one when
+// there is none. Without idempotence it is -1.
+func (c *client) producerID() (producerState, error) {
+	c.mu.Lock()
+	ps := c.producer
+	c.mu.Unlock()
+	if !c.idempotent || ps.id >= 0 {
+		return ps, nil
+	}
+	err := c.any(func(cn *conn) error {
+		d, _, err := cn.call(apiInitProducerID, func(int16) []byte {
+			var e encoder
+			e.nullableString("") // no transactional id
+			e.int32(60000)
+			return e.b
+		}, false)
+		if err != nil {
+			return err
+		}
+		d.int32() // throttle
+		code := d.int16()
+		ps = producerState{id: d.int64(), epoch: d.int16()}
+		if d.err != nil {
+			return d.err
+		}
+		if e := errorFor(code); e != nil {
+			return e
+		}
+		return nil
+	})
+	if err != nil {
+		return ps, fmt.Errorf("kafka init producer id: %w", err)
+	}
+	c.mu.Lock()
+	c.producer = ps
+	c.sequences = map[topicPartition]int32{}
+	c.mu.Unlock()
+	return ps, nil
+}
+
+// resetProducer discards the producer id and its sequence numbers, after
+// which batches are numbered again from zero under a new id.
+func (c *client) resetProducer() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.producer = producerState{id: -1, epoch: -1}
+	c.sequences = map[topicPartition]int32{}
+}
+
+// nextSequence reserves n sequence numbers on tp.
+func (c *client) nextSequence(tp topicPartition, n int) int32 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.sequences[tp]
+	c.sequences[tp] = s + int32(n)
+	return s
+}
+
+// produceRequest is one Produce request to a leader: at most one batch
+// per partition.
+type produceRequest struct {
+	acks    int16
+	timeout time.Duration
+	batches []*batch
+}
+
+// partitionResult is a partition's outcome in a Produce response.
+type partitionResult struct {
+	err     error
+	records []int32 // batch indexes the broker blamed, v8+
+}
+
+// produce sends req to addr and returns the outcome of each batch, keyed
+// by its position in req.batches. A transport error fails every batch.
+func (c *client) produce(addr string, req produceRequest) ([]partitionResult, error) {
+	cn, err := c.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	byTopic := map[string][]int{}
+	var order []string
+	for i, b := range req.batches {
+		if _, ok := byTopic[b.tp.topic]; !ok {
+			order = append(order, b.tp.topic)
+		}
+		byTopic[b.tp.topic] = append(byTopic[b.tp.topic], i)
+	}
+	d, v, err := cn.call(apiProduce, func(int16) []byte {
+		var e encoder
+		e.nullableString("")
+		e.int16(req.acks)
+		e.int32(int32(req.timeout / time.Millisecond))
+		e.int32(int32(len(order)))
+		for _, t := range order {
+			e.string(t)
+			e.int32(int32(len(byTopic[t])))
+			for _, i := range byTopic[t] {
+				e.int32(req.batches[i].tp.partition)
+				e.bytes(req.batches[i].encoded)
+			}
+		}
+		return e.b
+	}, req.acks == 0)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]partitionResult, len(req.batches))
+	if d == nil {
+		return results, nil
+	}
+	found := make([]bool, len(req.batches))
+	d.array(func() {
+		topic := d.string()
+		d.array(func() {
+			p, code := d.int32(), d.int16()
+			d.int64() // base offset
+			d.int64() // log append time
+			if v >= 5 {
+				d.int64() // log start offset
+			}
+			var res partitionResult
+			if v >= 8 {
+				d.array(func() {
+					res.records = append(res.records, d.int32())
+					d.string()
+				})
+				msg := d.string()
+				if e := errorFor(code); e != nil && msg != "" {
+					res.err = fmt.Errorf("%w: %s", e, msg)
+				}
+			}
+			if e := errorFor(code); e != nil && res.err == nil {
+				res.err = e
+			}
+			for _, i := range byTopic[topic] {
+				if req.batches[i].tp.partition == p {
+					results[i], found[i] = res, true
+				}
+			}
+		})
+	})
+	d.int32() // throttle
+	if d.err != nil {
+		cn.close()
+		return nil, d.err
+	}
+	for i, ok := range found {
+		if !ok {
+			results[i].err = errorFor(-1)
+		}
+	}
+	return results, nil
+}
+
+func (c *client) close() {
+	c.mu.Lock()
+	c.closed = true
+	conns := c.conns
+	c.conns = map[string]*conn{}
+	c.mu.Unlock()
+	for _, cn := range conns {
+		cn.close()
+	}
+}
+
+// murmur2 is the hash the Java client's default partitioner applies to
+// record keys, so keyed events land where other producers put them.
+func murmur2(data []byte) int32 {
+	const m = 0x5bd1e995
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	n := len(data) &^ 3
+	for i := 0; i < n; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> 24
+		k *= m
+		h = h*m ^ k
+	}
+	switch len(data) & 3 {
+	case 3:
+		h ^= uint32(data[n+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[n+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[n])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
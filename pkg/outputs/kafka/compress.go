@@ -0,0 +1,183 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// codec is a record batch compression type.
+type codec struct {
+	name     string
+	id       int16 // the attributes bits
+	compress func([]byte) ([]byte, error)
+}
+
+func newCodec(name string) (codec, error) {
+	switch name {
+	case "none":
+		return codec{name, 0, func(b []byte) ([]byte, error) { return b, nil }}, nil
+	case "gzip":
+		return codec{name, 1, gzipCompress}, nil
+	case "snappy":
+		// Raw snappy blocks; the Java client reads them as well as its own
+		// xerial framing.
+		return codec{name, 2, func(b []byte) ([]byte, error) { return snappy.Encode(nil, b), nil }}, nil
+	case "lz4":
+		return codec{name, 3, func(b []byte) ([]byte, error) { return lz4Frame(b), nil }}, nil
+	case "zstd":
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return codec{}, err
+		}
+		return codec{name, 4, func(b []byte) ([]byte, error) { return enc.EncodeAll(b, nil), nil }}, nil
+	}
+	return codec{}, fmt.Errorf("compression must be gzip, snappy, lz4, zstd or none, got %q", name)
+}
+
+func gzipCompress(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// LZ4 frame format (lz4_Frame_format.md), as Kafka expects it since
+// magic 1: independent 64 KiB blocks, no checksums besides the header's.
+const (
+	lz4Magic     = 0x184D2204
+	lz4BlockSize = 64 << 10
+	lz4MinMatch  = 4
+	lz4HashLog   = 14
+	// The last match must start 12 bytes before the end of the block and
+	// the last 5 bytes are always literals.
+	lz4MFLimit      = 12
+	lz4LastLiterals = 5
+)
+
+func lz4Frame(src []byte) []byte {
+	out := binary.LittleEndian.AppendUint32(nil, lz4Magic)
+	desc := []byte{0x60, 0x40} // version 01, independent blocks; 64 KiB max block
+	out = append(out, desc...)
+	out = append(out, byte(xxh32(desc, 0)>>8))
+	var table [1 << lz4HashLog]int32
+	for len(src) > 0 {
+		n := min(len(src), lz4BlockSize)
+		block := lz4Block(src[:n], &table)
+		if len(block) >= n {
+			out = binary.LittleEndian.AppendUint32(out, uint32(n)|1<<31)
+			out = append(out, src[:n]...)
+		} else {
+			out = binary.LittleEndian.AppendUint32(out, uint32(len(block)))
+			out = append(out, block...)
+		}
+		src = src[n:]
+	}
+	return binary.LittleEndian.AppendUint32(out, 0) // end mark
+}
+
+// lz4Block compresses src as one LZ4 block with a greedy single-probe
+// matcher, which is fast and good enough for repetitive log records.
+func lz4Block(src []byte, table *[1 << lz4HashLog]int32) []byte {
+	for i := range table {
+		table[i] = -1
+	}
+	hash := func(i int) uint32 {
+		return binary.LittleEndian.Uint32(src[i:]) * 2654435761 >> (32 - lz4HashLog)
+	}
+	var out []byte
+	anchor := 0
+	for i := 0; i+lz4MFLimit <= len(src); {
+		h := hash(i)
+		ref := int(table[h])
+		table[h] = int32(i)
+		if ref < 0 || i-ref > 0xFFFF || binary.LittleEndian.Uint32(src[ref:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+		n := lz4MinMatch
+		for i+n < len(src)-lz4LastLiterals && src[ref+n] == src[i+n] {
+			n++
+		}
+		out = lz4Sequence(out, src[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	return lz4Sequence(out, src[anchor:], 0, 0)
+}
+
+// lz4Sequence appends literals followed by a match; a zero offset ends the
+// block with literals only.
+func lz4Sequence(out, lit []byte, offset, matchLen int) []byte {
+	token := byte(min(len(lit), 15)) << 4
+	if offset > 0 {
+		token |= byte(min(matchLen-lz4MinMatch, 15))
+	}
+	out = append(out, token)
+	out = lz4Length(out, len(lit))
+	out = append(out, lit...)
+	if offset > 0 {
+		out = binary.LittleEndian.AppendUint16(out, uint16(offset))
+		out = lz4Length(out, matchLen-lz4MinMatch)
+	}
+	return out
+}
+
+// lz4Length appends the continuation bytes of a length of 15 or more.
+func lz4Length(out []byte, n int) []byte {
+	if n < 15 {
+		return out
+	}
+	for n -= 15; n >= 255; n -= 255 {
+		out = append(out, 255)
+	}
+	return append(out, byte(n))
+}
+
+const (
+	xxPrime1 uint32 = 2654435761
+	xxPrime2 uint32 = 2246822519
+	xxPrime3 uint32 = 3266489917
+	xxPrime4 uint32 = 668265263
+	xxPrime5 uint32 = 374761393
+)
+
+// xxh32 is XXH32, used for the LZ4 frame header checksum.
+func xxh32(b []byte, seed uint32) uint32 {
+	n := len(b)
+	var h uint32
+	if n >= 16 {
+		v := [4]uint32{seed + xxPrime1 + xxPrime2, seed + xxPrime2, seed, seed - xxPrime1}
+		for ; len(b) >= 16; b = b[16:] {
+			for i := range v {
+				v[i] = bits.RotateLeft32(v[i]+binary.LittleEndian.Uint32(b[4*i:])*xxPrime2, 13) * xxPrime1
+			}
+		}
+		h = bits.RotateLeft32(v[0], 1) + bits.RotateLeft32(v[1], 7) + bits.RotateLeft32(v[2], 12) + bits.RotateLeft32(v[3], 18)
+	} else {
+		h = seed + xxPrime5
+	}
+	h += uint32(n)
+	for ; len(b) >= 4; b = b[4:] {
+		h = bits.RotateLeft32(h+binary.LittleEndian.Uint32(b)*xxPrime3, 17) * xxPrime4
+	}
+	for _, c := range b {
+		h = bits.RotateLeft32(h+uint32(c)*xxPrime5, 11) * xxPrime1
+	}
+	h ^= h >> 15
+	h *= xxPrime2
+	h ^= h >> 13
+	h *= xxPrime3
+	h ^= h >> 16
+	return h
+}
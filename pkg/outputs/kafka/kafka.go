@@ -0,0 +1,586 @@
+// Package kafka produces events to Apache Kafka, or any broker speaking its
+// protocol (Redpanda, Event Hubs, MSK). It backs the "kafka" destination
+// type with a small native producer: record batches v2, acks and the
+// idempotent producer, gzip/snappy/lz4/zstd, SASL PLAIN and SCRAM, and TLS.
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"time"
+
+	"bibbl/pkg/outputs"
+)
+
+// Acknowledgement levels.
+const (
+	AcksAll    = "all"
+	AcksLeader = "leader"
+	AcksNone   = "none"
+)
+
+// SASL mechanisms.
+const (
+	MechanismPlain       = "PLAIN"
+	MechanismSCRAMSHA256 = "SCRAM-SHA-256"
+	MechanismSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// Config holds configuration for a Kafka destination.
+type Config struct {
+	Brokers []string `json:"brokers"` // seed brokers, host:port
+	// Topic is a template: "logs-${sourcetype}" or "fw-%Y.%m.%d". Events
+	// whose topic renders to an invalid name are dead-lettered.
+	Topic string `json:"topic"`
+	// Key is a template for the record key, such as "${src_ip}". Keyed
+	// records are partitioned like the Java client does, so related events
+	// stay in order on one partition. Without a key each batch sticks to a
+	// random partition.
+	Key       string `json:"key"`
+	TimeField string `json:"timeField"` // record timestamp and topic dates, default "timestamp"
+	ClientID  string `json:"clientId"`  // default "bibbl"
+
+	Acks       string `json:"acks"`       // all (default) | leader | none
+	Idempotent *bool  `json:"idempotent"` // default true with acks=all
+	// Compression is gzip, snappy (default), lz4, zstd or none.
+	Compression string `json:"compression"`
+
+	// ProducerBatchBytes caps one partition's record batch before
+	// compression, default 1000000 (the broker's message.max.bytes).
+	ProducerBatchBytes int `json:"producerBatchBytes"`
+	// LingerMs is how long events wait for a batch to fill; it overrides
+	// flushIntervalSec.
+	LingerMs int `json:"lingerMs"`
+
+	AllowAutoTopicCreation bool `json:"allowAutoTopicCreation"`
+	TimeoutSec             int  `json:"timeoutSec"` // broker ack timeout, default 30
+	MaxRetries             int  `json:"maxRetries"` // default 5
+	RetryDelayMs           int  `json:"retryDelayMs"`
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+
+	SASL SASLConfig        `json:"sasl"`
+	TLS  outputs.TLSConfig `json:"tls"`
+}
+
+// SASLConfig selects SASL authentication. Leave Mechanism empty to connect
+// without it.
+type SASLConfig struct {
+	Mechanism string `json:"mechanism"` // PLAIN | SCRAM-SHA-256 | SCRAM-SHA-512
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+// KafkaOutput produces each event as one JSON record.
+type KafkaOutput struct {
+	*outputs.Batcher
+
+	cfg     Config
+	topic   *outputs.Template
+	key     *outputs.Template
+	acks    int16
+	codec   codec
+	timeout time.Duration
+	client  *client
+
+	mu sync.Mutex // one delivery at a time keeps partitions in order
+}
+
+// NewKafkaOutput validates cfg, applies defaults and starts the output.
+// Brokers are contacted on first delivery.
+func NewKafkaOutput(cfg Config) (*KafkaOutput, error) {
+	var brokers []string
+	for _, b := range cfg.Brokers {
+		for _, s := range strings.Split(b, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				brokers = append(brokers, s)
+			}
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("at least one broker is required")
+	}
+	cfg.Brokers = brokers
+	if strings.TrimSpace(cfg.Topic) == "" {
+		return nil, fmt.Errorf("topic is required")
+	}
+	o := &KafkaOutput{}
+	var err error
+	if o.topic, err = outputs.ParseTemplate(cfg.Topic); err != nil {
+		return nil, err
+	}
+	if cfg.Key != "" {
+		if o.key, err = outputs.ParseTemplate(cfg.Key); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.TimeField == "" {
+		cfg.TimeField = "timestamp"
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "bibbl"
+	}
+	switch cfg.Acks = strings.ToLower(cfg.Acks); cfg.Acks {
+	case "", AcksAll, "-1":
+		cfg.Acks, o.acks = AcksAll, -1
+	case AcksLeader, "1":
+		cfg.Acks, o.acks = AcksLeader, 1
+	case AcksNone, "0":
+		cfg.Acks, o.acks = AcksNone, 0
+	default:
+		return nil, fmt.Errorf("acks must be all, leader or none, got %q", cfg.Acks)
+	}
+	if cfg.Idempotent == nil {
+		idempotent := cfg.Acks == AcksAll
+		cfg.Idempotent = &idempotent
+	}
+	if *cfg.Idempotent && cfg.Acks != AcksAll {
+		return nil, fmt.Errorf("the idempotent producer requires acks=all")
+	}
+	if cfg.Compression = strings.ToLower(cfg.Compression); cfg.Compression == "" {
+		cfg.Compression = "snappy"
+	}
+	if o.codec, err = newCodec(cfg.Compression); err != nil {
+		return nil, err
+	}
+	if cfg.ProducerBatchBytes <= 0 {
+		cfg.ProducerBatchBytes = 1000000
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 30
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 5
+	}
+	if cfg.RetryDelayMs <= 0 {
+		cfg.RetryDelayMs = 250
+	}
+	mech, err := newMechanism(cfg.SASL)
+	if err != nil {
+		return nil, err
+	}
+	if mech != nil && cfg.SASL.Username == "" {
+		return nil, fmt.Errorf("sasl.username is required with sasl.mechanism")
+	}
+	o.timeout = time.Duration(cfg.TimeoutSec) * time.Second
+	o.client = &client{
+		seeds:      cfg.Brokers,
+		clientID:   cfg.ClientID,
+		sasl:       mech,
+		timeout:    o.timeout + 5*time.Second,
+		autoTopic:  cfg.AllowAutoTopicCreation,
+		idempotent: *cfg.Idempotent,
+		conns:      map[string]*conn{},
+		nodes:      map[int32]string{},
+		topics:     map[string]*topicMeta{},
+		producer:   producerState{id: -1, epoch: -1},
+	}
+	if cfg.TLS.Configured() {
+		if o.client.tlsCfg, err = cfg.TLS.Build(); err != nil {
+			return nil, err
+		}
+	}
+	o.cfg = cfg
+	flush := time.Duration(cfg.FlushIntervalSec) * time.Second
+	if cfg.LingerMs > 0 {
+		flush = time.Duration(cfg.LingerMs) * time.Millisecond
+	}
+	o.Batcher = outputs.NewBatcher("kafka", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: flush,
+	}, o.deliver)
+	return o, nil
+}
+
+// NewOutput builds a KafkaOutput from a destination config map. It is the
+// factory registered for the "kafka" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewKafkaOutput(c)
+}
+
+// batch is a run of records for one partition, encoded once so a retry
+// after an unknown outcome resends the same producer sequence and the
+// broker can drop the duplicate.
+type batch struct {
+	tp      topicPartition
+	records []*record
+	encoded []byte
+}
+
+// delivery is the state of one deliver call.
+type delivery struct {
+	o          *KafkaOutput
+	unassigned map[string][]*record
+	queues     map[topicPartition][]*batch // in send order per partition
+	lastErr    error
+}
+
+// deliver produces a batch and waits for the brokers to acknowledge it.
+// Records the cluster can never accept are dead-lettered; other failures
+// are retried with backoff, and when they persist the batch fails so the
+// queue retries it, which can repeat records that were acknowledged.
+func (o *KafkaOutput) deliver(events []map[string]interface{}) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	d := &delivery{o: o, unassigned: map[string][]*record{}, queues: map[topicPartition][]*batch{}}
+	for _, ev := range events {
+		topic, r, err := o.record(ev)
+		if err != nil {
+			o.DeadLetter([]map[string]interface{}{ev}, outputs.Permanent(0, err))
+			continue
+		}
+		d.unassigned[topic] = append(d.unassigned[topic], r)
+	}
+	delay := time.Duration(o.cfg.RetryDelayMs) * time.Millisecond
+	for attempt := 0; ; {
+		ok, err := d.round()
+		if err != nil {
+			o.client.resetProducer()
+			return err
+		}
+		if len(d.unassigned) == 0 && len(d.queues) == 0 {
+			return nil
+		}
+		if ok {
+			continue
+		}
+		if attempt++; attempt > o.cfg.MaxRetries {
+			// Sequences of batches in doubt cannot be reused.
+			o.client.resetProducer()
+			return fmt.Errorf("kafka: %d records undelivered after %d retries: %w", d.pending(), o.cfg.MaxRetries, d.lastErr)
+		}
+		time.Sleep(delay)
+		delay = min(delay*2, 10*time.Second)
+	}
+}
+
+func (o *KafkaOutput) record(ev map[string]interface{}) (string, *record, error) {
+	ts, ok := outputs.EventTime(ev, o.cfg.TimeField)
+	if !ok {
+		ts = time.Now()
+	}
+	topic := o.topic.Execute(ev, ts)
+	if err := validTopic(topic); err != nil {
+		return "", nil, err
+	}
+	value, err := json.Marshal(ev)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	r := &record{value: value, ts: ts, event: ev}
+	if o.key != nil {
+		r.key = []byte(o.key.Execute(ev, ts))
+	}
+	if size := batchHeaderSize + recordOverhead + len(r.key) + len(r.value); size > o.cfg.ProducerBatchBytes {
+		return "", nil, fmt.Errorf("kafka record of %d bytes exceeds producerBatchBytes %d", size, o.cfg.ProducerBatchBytes)
+	}
+	return topic, r, nil
+}
+
+// validTopic applies the broker's rules for topic names, so a bad template
+// value is rejected here rather than retried against the cluster.
+func validTopic(t string) error {
+	if t == "" || t == "." || t == ".." || len(t) > 249 {
+		return fmt.Errorf("invalid kafka topic %q", t)
+	}
+	for _, c := range t {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return fmt.Errorf("invalid kafka topic %q: only letters, digits, '.', '_' and '-' are allowed", t)
+		}
+	}
+	return nil
+}
+
+func (d *delivery) pending() int {
+	n := 0
+	for _, rs := range d.unassigned {
+		n += len(rs)
+	}
+	for _, q := range d.queues {
+		for _, b := range q {
+			n += len(b.records)
+		}
+	}
+	return n
+}
+
+// fail notes a retriable failure of the current round.
+func (d *delivery) fail(err error) {
+	d.lastErr = err
+}
+
+// round fetches the metadata it lacks, assigns records to partitions once
+// their topics are known, then sends the head batch of every partition. It reports whether
+// the round went without retriable failures; a non-nil error ends the
+// delivery.
+func (d *delivery) round() (bool, error) {
+	o, c := d.o, d.o.client
+	ok := true
+	missing := map[string]bool{}
+	for t := range d.unassigned {
+		missing[t] = c.metadata(t) == nil
+	}
+	for tp := range d.queues {
+		missing[tp.topic] = c.metadata(tp.topic) == nil
+	}
+	var refresh []string
+	for t, m := range missing {
+		if m {
+			refresh = append(refresh, t)
+		}
+	}
+	if len(refresh) > 0 {
+		if err := c.refresh(refresh); err != nil {
+			if !retriable(err) {
+				return false, fmt.Errorf("kafka metadata: %w", err)
+			}
+			d.fail(fmt.Errorf("kafka metadata: %w", err))
+			ok = false
+		}
+	}
+	if len(d.unassigned) > 0 {
+		for t, recs := range d.unassigned {
+			tm := c.metadata(t)
+			switch {
+			case tm == nil:
+				ok = false
+				continue
+			case tm.err != nil && isCode(tm.err, 17): // INVALID_TOPIC_EXCEPTION
+				d.deadLetter(recs, fmt.Errorf("kafka topic %s: %w", t, tm.err))
+			case tm.err != nil && !retriable(tm.err):
+				return false, fmt.Errorf("kafka topic %s: %w", t, tm.err)
+			case tm.err != nil || len(tm.partitions) == 0:
+				c.forget(t)
+				d.fail(fmt.Errorf("kafka topic %s: %w", t, orUnknownTopic(tm.err)))
+				ok = false
+				continue
+			default:
+				d.assign(t, tm, recs)
+			}
+			delete(d.unassigned, t)
+		}
+	}
+	if len(d.queues) == 0 {
+		return ok, nil
+	}
+
+	ps, err := c.producerID()
+	if err != nil {
+		if !retriable(err) {
+			return false, err
+		}
+		d.fail(err)
+		return false, nil
+	}
+	byLeader := map[string][]*batch{}
+	for tp, q := range d.queues {
+		b := q[0]
+		if b.encoded == nil {
+			if ps.id >= 0 {
+				ps.sequence = c.nextSequence(tp, len(b.records))
+			}
+			if b.encoded, err = encodeRecordBatch(b.records, o.codec, ps); err != nil {
+				return false, err
+			}
+		}
+		addr, found := "", false
+		if tm := c.metadata(tp.topic); tm != nil {
+			for _, p := range tm.partitions {
+				if p.id == tp.partition && p.leader >= 0 {
+					addr, found = c.leader(p.leader)
+				}
+			}
+		}
+		if !found {
+			c.forget(tp.topic)
+			d.fail(fmt.Errorf("kafka %s/%d: no leader", tp.topic, tp.partition))
+			ok = false
+			continue
+		}
+		byLeader[addr] = append(byLeader[addr], b)
+	}
+
+	type outcome struct {
+		batches []*batch
+		results []partitionResult
+		err     error
+	}
+	outcomes := make(chan outcome, len(byLeader))
+	for addr, batches := range byLeader {
+		go func() {
+			res, err := c.produce(addr, produceRequest{acks: o.acks, timeout: o.timeout, batches: batches})
+			outcomes <- outcome{batches, res, err}
+		}()
+	}
+	var fatal error
+	reset := false
+	for range byLeader {
+		out := <-outcomes
+		for i, b := range out.batches {
+			var res partitionResult
+			if out.err != nil {
+				res.err = out.err
+			} else {
+				res = out.results[i]
+			}
+			switch err := res.err; {
+			case err == nil || isCode(err, 46): // DUPLICATE_SEQUENCE_NUMBER: already written
+				d.pop(b)
+			case isCode(err, 45) || isCode(err, 47) || isCode(err, 59):
+				// OUT_OF_ORDER_SEQUENCE_NUMBER, INVALID_PRODUCER_EPOCH,
+				// UNKNOWN_PRODUCER_ID: start over with a new producer id.
+				reset = true
+				d.fail(fmt.Errorf("kafka %s/%d: %w", b.tp.topic, b.tp.partition, err))
+				ok = false
+			case rejected(err):
+				d.reject(b, res)
+				reset = true
+			case retriable(err):
+				if isCode(err, 3) || isCode(err, 5) || isCode(err, 6) || isCode(err, 74) {
+					c.forget(b.tp.topic)
+				}
+				d.fail(fmt.Errorf("kafka %s/%d: %w", b.tp.topic, b.tp.partition, err))
+				ok = false
+			default:
+				fatal = fmt.Errorf("kafka %s/%d: %w", b.tp.topic, b.tp.partition, err)
+			}
+		}
+	}
+	if reset {
+		c.resetProducer()
+		for _, q := range d.queues {
+			for _, b := range q {
+				b.encoded = nil
+			}
+		}
+	}
+	return ok, fatal
+}
+
+// assign partitions recs of topic t and queues them in batches of at most
+// ProducerBatchBytes.
+func (d *delivery) assign(t string, tm *topicMeta, recs []*record) {
+	var live []int32
+	for _, p := range tm.partitions {
+		if p.leader >= 0 {
+			live = append(live, p.id)
+		}
+	}
+	if len(live) == 0 {
+		live = []int32{tm.partitions[0].id}
+	}
+	sticky := live[rand.IntN(len(live))]
+	for _, r := range recs {
+		tp := topicPartition{t, sticky}
+		if r.key != nil {
+			tp.partition = tm.partitions[int(murmur2(r.key)&0x7fffffff)%len(tm.partitions)].id
+		}
+		q := d.queues[tp]
+		if len(q) == 0 || q[len(q)-1].size()+recordOverhead+len(r.key)+len(r.value) > d.o.cfg.ProducerBatchBytes {
+			q = append(q, &batch{tp: tp})
+		}
+		q[len(q)-1].records = append(q[len(q)-1].records, r)
+		d.queues[tp] = q
+	}
+}
+
+func (b *batch) size() int {
+	n := batchHeaderSize
+	for _, r := range b.records {
+		n += recordOverhead + len(r.key) + len(r.value)
+	}
+	return n
+}
+
+// pop removes a partition's head batch once it is written.
+func (d *delivery) pop(b *batch) {
+	if q := d.queues[b.tp][1:]; len(q) > 0 {
+		d.queues[b.tp] = q
+	} else {
+		delete(d.queues, b.tp)
+	}
+}
+
+// reject dead-letters the records the broker refused. When it named them
+// (Produce v8) the rest of the batch is sent again.
+func (d *delivery) reject(b *batch, res partitionResult) {
+	err := fmt.Errorf("kafka %s/%d: %w", b.tp.topic, b.tp.partition, res.err)
+	if len(res.records) == 0 || len(res.records) >= len(b.records) {
+		d.deadLetter(b.records, err)
+		d.pop(b)
+		return
+	}
+	bad := map[int32]bool{}
+	for _, i := range res.records {
+		bad[i] = true
+	}
+	var keep, drop []*record
+	for i, r := range b.records {
+		if bad[int32(i)] {
+			drop = append(drop, r)
+		} else {
+			keep = append(keep, r)
+		}
+	}
+	d.deadLetter(drop, err)
+	b.records = keep
+}
+
+func (d *delivery) deadLetter(recs []*record, err error) {
+	events := make([]map[string]interface{}, len(recs))
+	for i, r := range recs {
+		events[i] = r.event
+	}
+	d.o.DeadLetter(events, outputs.Permanent(0, err))
+}
+
+// rejected reports whether the broker refused the records themselves, so
+// sending them again cannot succeed.
+func rejected(err error) bool {
+	for _, code := range []int16{10, 17, 18, 32, 87} {
+		// MESSAGE_TOO_LARGE, INVALID_TOPIC_EXCEPTION, RECORD_LIST_TOO_LARGE,
+		// INVALID_TIMESTAMP, INVALID_RECORD
+		if isCode(err, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// retriable reports whether err may clear up by itself: broker errors
+// marked so, and anything that is not a broker error, such as a dropped
+// connection.
+func retriable(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Retriable
+	}
+	return !errors.Is(err, errClientClosed)
+}
+
+func orUnknownTopic(err error) error {
+	if err != nil {
+		return err
+	}
+	return errorFor(3)
+}
+
+// Close flushes what is batched and closes the broker connections.
+func (o *KafkaOutput) Close() error {
+	err := o.Batcher.Close()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.client.close()
+	return err
+}
@@ -0,0 +1,688 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+
+	"bibbl/pkg/outputs"
+)
+
+type fakeRecord struct {
+	key, value []byte
+	ts         time.Time
+	pid        int64
+	seq        int32
+}
+
+// fakeErr is a canned partition error for the next produced batch.
+type fakeErr struct {
+	code    int16
+	records []int32
+}
+
+// fakeBroker is a single-node cluster speaking enough of the protocol for
+// the producer: ApiVersions, Metadata, InitProducerId, Produce and SASL
+// PLAIN / SCRAM-SHA-256. It checks record batch CRCs and producer
+// sequences the way a broker does.
+type fakeBroker struct {
+	t          *testing.T
+	ln         net.Listener
+	partitions int32
+	user, pass string // SASL credentials; empty disables SASL
+
+	mu     sync.Mutex
+	logs   map[topicPartition][]fakeRecord
+	seqs   map[topicPartition]int32
+	pids   int64
+	calls  map[int16]int
+	errs   []fakeErr
+	dropOn int // the produce call answered by dropping the connection after appending
+}
+
+// newFakeBroker starts a broker; user and pass enable SASL. They are set
+// before the accept loop starts because serve reads them unlocked.
+func newFakeBroker(t *testing.T, tlsCfg *tls.Config, user, pass string) *fakeBroker {
+	t.Helper()
+	var ln net.Listener
+	var err error
+	if tlsCfg != nil {
+		ln, err = tls.Listen("tcp", "127.0.0.1:0", tlsCfg)
+	} else {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{t: t, ln: ln, partitions: 3, logs: map[topicPartition][]fakeRecord{},
+		seqs: map[topicPartition]int32{}, calls: map[int16]int{}, user: user, pass: pass}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(c)
+		}
+	}()
+	t.Cleanup(func() { _ = ln.Close() })
+	return b
+}
+
+func (b *fakeBroker) addr() string { return b.ln.Addr().String() }
+
+func (b *fakeBroker) records(topic string) map[int32][]fakeRecord {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := map[int32][]fakeRecord{}
+	for tp, rs := range b.logs {
+		if tp.topic == topic {
+			out[tp.partition] = rs
+		}
+	}
+	return out
+}
+
+func (b *fakeBroker) serve(c net.Conn) {
+	defer c.Close()
+	authed := b.user == ""
+	var scram *scramServer
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(c, size[:]); err != nil {
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return
+		}
+		d := &decoder{b: buf}
+		key, version, correlation := d.int16(), d.int16(), d.int32()
+		d.string() // client id
+		b.mu.Lock()
+		b.calls[key]++
+		b.mu.Unlock()
+		var e encoder
+		switch key {
+		case apiVersions:
+			e.int16(0)
+			apis := [][3]int16{{apiProduce, 3, 9}, {apiMetadata, 0, 12}, {apiSaslHandshake, 0, 1},
+				{apiVersions, 0, 3}, {apiInitProducerID, 0, 4}, {apiSaslAuthenticate, 0, 2}}
+			e.int32(int32(len(apis)))
+			for _, a := range apis {
+				e.int16(a[0])
+				e.int16(a[1])
+				e.int16(a[2])
+			}
+		case apiSaslHandshake:
+			mech := d.string()
+			if mech == MechanismSCRAMSHA256 {
+				scram = &scramServer{user: b.user, pass: b.pass}
+			}
+			if mech != MechanismPlain && scram == nil {
+				e.int16(33)
+			} else {
+				e.int16(0)
+			}
+			e.int32(2)
+			e.string(MechanismPlain)
+			e.string(MechanismSCRAMSHA256)
+		case apiSaslAuthenticate:
+			msg := d.bytes()
+			var reply []byte
+			ok := true
+			if scram != nil {
+				reply, ok, authed = scram.step(msg)
+			} else {
+				ok = string(msg) == "\x00"+b.user+"\x00"+b.pass
+				authed = ok
+			}
+			if ok {
+				e.int16(0)
+				e.int16(-1)
+			} else {
+				e.int16(58)
+				e.string("invalid credentials")
+			}
+			e.bytes(reply)
+			if version >= 1 {
+				e.int64(0)
+			}
+		default:
+			if !authed {
+				return
+			}
+			switch key {
+			case apiMetadata:
+				b.metadata(d, version, &e)
+			case apiInitProducerID:
+				b.mu.Lock()
+				b.pids++
+				e.int32(0)
+				e.int16(0)
+				e.int64(1000 + b.pids)
+				e.int16(0)
+				b.mu.Unlock()
+			case apiProduce:
+				if !b.produce(d, version, &e) {
+					return
+				}
+			default:
+				b.t.Errorf("unexpected api key %d", key)
+				return
+			}
+		}
+		if d.err != nil {
+			b.t.Errorf("api %d v%d: %v", key, version, d.err)
+			return
+		}
+		resp := binary.BigEndian.AppendUint32(nil, uint32(len(e.b)+4))
+		resp = binary.BigEndian.AppendUint32(resp, uint32(correlation))
+		if _, err := c.Write(append(resp, e.b...)); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) metadata(d *decoder, v int16, e *encoder) {
+	var topics []string
+	d.array(func() { topics = append(topics, d.string()) })
+	host, port, _ := net.SplitHostPort(b.addr())
+	p, _ := strconv.Atoi(port)
+	e.int32(0)
+	e.int32(1)
+	e.int32(1)
+	e.string(host)
+	e.int32(int32(p))
+	e.int16(-1)
+	e.int16(-1) // cluster id
+	e.int32(1)
+	e.int32(int32(len(topics)))
+	for _, t := range topics {
+		if strings.HasPrefix(t, "missing") {
+			e.int16(3)
+		} else {
+			e.int16(0)
+		}
+		e.string(t)
+		e.bool(false)
+		if strings.HasPrefix(t, "missing") {
+			e.int32(0)
+		} else {
+			e.int32(b.partitions)
+			for i := int32(0); i < b.partitions; i++ {
+				e.int16(0)
+				e.int32(i)
+				e.int32(1)
+				e.int32(0)
+				e.int32(1)
+				e.int32(1)
+				e.int32(1)
+				e.int32(1)
+				e.int32(0)
+			}
+		}
+		e.int32(0)
+	}
+	e.int32(0)
+}
+
+// produce appends the request's batches and encodes the v8 response. It
+// returns false to drop the connection without answering.
+func (b *fakeBroker) produce(d *decoder, v int16, e *encoder) bool {
+	if v != 8 {
+		b.t.Errorf("produce v%d, want 8", v)
+	}
+	d.string() // transactional id
+	acks := d.int16()
+	d.int32()
+	type part struct {
+		idx  int32
+		code int16
+		errs []int32
+	}
+	var topics []string
+	parts := map[string][]part{}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d.array(func() {
+		name := d.string()
+		topics = append(topics, name)
+		d.array(func() {
+			p := part{idx: d.int32()}
+			records := d.bytes()
+			tp := topicPartition{name, p.idx}
+			if len(b.errs) > 0 {
+				p.code, p.errs = b.errs[0].code, b.errs[0].records
+				b.errs = b.errs[1:]
+			} else {
+				p.code = b.append(tp, records)
+			}
+			parts[name] = append(parts[name], p)
+		})
+	})
+	if acks == 0 {
+		return false
+	}
+	if b.calls[apiProduce] == b.dropOn {
+		return false
+	}
+	e.int32(int32(len(topics)))
+	for _, t := range topics {
+		e.string(t)
+		e.int32(int32(len(parts[t])))
+		for _, p := range parts[t] {
+			e.int32(p.idx)
+			e.int16(p.code)
+			e.int64(0)
+			e.int64(-1)
+			e.int64(0)
+			e.int32(int32(len(p.errs)))
+			for _, i := range p.errs {
+				e.int32(i)
+				e.int16(-1)
+			}
+			e.int16(-1)
+		}
+	}
+	e.int32(0)
+	return true
+}
+
+// append decodes one record batch and checks its producer sequence.
+func (b *fakeBroker) append(tp topicPartition, data []byte) int16 {
+	t := b.t
+	if len(data) < batchHeaderSize || data[16] != 2 {
+		t.Errorf("not a v2 record batch")
+		return 2
+	}
+	if crc := binary.BigEndian.Uint32(data[17:]); crc != crc32.Checksum(data[21:], crc32c) {
+		t.Errorf("batch crc mismatch")
+		return 2
+	}
+	hd := &decoder{b: data[21:batchHeaderSize]}
+	attrs := hd.int16()
+	hd.int32()
+	base := hd.int64()
+	hd.int64()
+	pid, _, seq, count := hd.int64(), hd.int16(), hd.int32(), hd.int32()
+	if pid >= 0 {
+		switch want := b.seqs[tp]; {
+		case seq < want:
+			return 46
+		case seq > want:
+			return 45
+		}
+		b.seqs[tp] = seq + count
+	}
+	payload := decompressBatch(t, attrs&7, data[batchHeaderSize:])
+	r := &decoder{b: payload}
+	for i := int32(0); i < count; i++ {
+		n, k := binary.Varint(r.b)
+		rd := &decoder{b: r.b[k : k+int(n)]}
+		r.b = r.b[k+int(n):]
+		rd.int8()
+		tsDelta := varint(rd)
+		varint(rd)
+		rec := fakeRecord{ts: time.UnixMilli(base + tsDelta), pid: pid, seq: seq + i}
+		rec.key = varBytes(rd)
+		rec.value = varBytes(rd)
+		b.logs[tp] = append(b.logs[tp], rec)
+	}
+	return 0
+}
+
+func varint(d *decoder) int64 {
+	v, n := binary.Varint(d.b)
+	d.b = d.b[n:]
+	return v
+}
+
+func varBytes(d *decoder) []byte {
+	n := varint(d)
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+func decompressBatch(t *testing.T, id int16, b []byte) []byte {
+	t.Helper()
+	var out []byte
+	var err error
+	switch id {
+	case 0:
+		return b
+	case 1:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(b)); err == nil {
+			out, err = io.ReadAll(zr)
+		}
+	case 2:
+		out, err = snappy.Decode(nil, b)
+	case 3:
+		out = lz4Decode(t, b)
+	case 4:
+		var dec *zstd.Decoder
+		if dec, err = zstd.NewReader(nil); err == nil {
+			out, err = dec.DecodeAll(b, nil)
+			dec.Close()
+		}
+	}
+	if err != nil {
+		t.Fatalf("decompress codec %d: %v", id, err)
+	}
+	return out
+}
+
+// lz4Decode reads an LZ4 frame of independent blocks.
+func lz4Decode(t *testing.T, b []byte) []byte {
+	t.Helper()
+	if binary.LittleEndian.Uint32(b) != lz4Magic || byte(xxh32(b[4:6], 0)>>8) != b[6] {
+		t.Fatalf("bad lz4 frame header")
+	}
+	b = b[7:]
+	var out []byte
+	for {
+		n := binary.LittleEndian.Uint32(b)
+		b = b[4:]
+		if n == 0 {
+			return out
+		}
+		if n&(1<<31) != 0 {
+			n &^= 1 << 31
+			out = append(out, b[:n]...)
+			b = b[n:]
+			continue
+		}
+		src := b[:n]
+		b = b[n:]
+		start := len(out)
+		for i := 0; i < len(src); {
+			token := src[i]
+			i++
+			length := func(n int) int {
+				if n == 15 {
+					for {
+						c := src[i]
+						i++
+						n += int(c)
+						if c != 255 {
+							break
+						}
+					}
+				}
+				return n
+			}
+			lit := length(int(token >> 4))
+			out = append(out, src[i:i+lit]...)
+			i += lit
+			if i == len(src) {
+				break
+			}
+			off := int(binary.LittleEndian.Uint16(src[i:]))
+			i += 2
+			ml := length(int(token&15)) + lz4MinMatch
+			if off == 0 || off > len(out)-start {
+				t.Fatalf("lz4 offset %d out of range", off)
+			}
+			for k := 0; k < ml; k++ {
+				out = append(out, out[len(out)-off])
+			}
+		}
+	}
+}
+
+// scramServer is the broker side of SCRAM-SHA-256.
+type scramServer struct {
+	user, pass  string
+	first, serv string
+	salt        []byte
+}
+
+func (s *scramServer) step(msg []byte) (reply []byte, ok, done bool) {
+	if s.serv == "" {
+		s.first = strings.TrimPrefix(string(msg), "n,,")
+		attrs := scramAttrs(s.first)
+		if attrs["n"] != s.user {
+			return nil, false, false
+		}
+		s.salt = []byte("pepper")
+		s.serv = "r=" + attrs["r"] + "srv,s=" + base64.StdEncoding.EncodeToString(s.salt) + ",i=4096"
+		return []byte(s.serv), true, false
+	}
+	final := string(msg)
+	withoutProof, p, _ := strings.Cut(final, ",p=")
+	proof, _ := base64.StdEncoding.DecodeString(p)
+	salted, _ := pbkdf2.Key(sha256.New, s.pass, s.salt, 4096, 32)
+	mac := func(key []byte, m string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(m))
+		return h.Sum(nil)
+	}
+	authMessage := s.first + "," + s.serv + "," + withoutProof
+	storedKey := sha256.Sum256(mac(salted, "Client Key"))
+	sig := mac(storedKey[:], authMessage)
+	if len(proof) != len(sig) {
+		return nil, false, false
+	}
+	for i := range sig {
+		sig[i] ^= proof[i]
+	}
+	if got := sha256.Sum256(sig); got != storedKey {
+		return nil, false, false
+	}
+	return []byte("v=" + base64.StdEncoding.EncodeToString(mac(mac(salted, "Server Key"), authMessage))), true, true
+}
+
+func TestProducesKeyedRecordsWithEachCodec(t *testing.T) {
+	broker := newFakeBroker(t, nil, "", "")
+	events := []map[string]interface{}{
+		{"timestamp": "2024-05-01T10:00:00Z", "sourcetype": "versa", "src": "10.0.0.1", "message": strings.Repeat("allow tcp ", 50)},
+		{"timestamp": "2024-05-01T10:00:01Z", "sourcetype": "versa", "src": "10.0.0.2"},
+		{"timestamp": "2024-05-01T10:00:02Z", "sourcetype": "paloalto", "src": "10.0.0.1"},
+		{"timestamp": "2024-05-01T10:00:03Z", "sourcetype": "bad topic/x"},
+	}
+	for _, codec := range []string{"snappy", "gzip", "lz4", "zstd", "none"} {
+		out, err := NewKafkaOutput(Config{Brokers: []string{broker.addr()}, Topic: "logs-${sourcetype}-" + codec,
+			Key: "${src}", Compression: codec})
+		if err != nil {
+			t.Fatalf("%s: new output: %v", codec, err)
+		}
+		var dead []map[string]interface{}
+		out.SetDeadLetter(func(events []map[string]interface{}, err error) { dead = append(dead, events...) })
+		if err := out.SendBatch(events); err != nil {
+			t.Fatalf("%s: send: %v", codec, err)
+		}
+		_ = out.Close()
+		if len(dead) != 0 {
+			t.Fatalf("%s: unexpected dead letters %v", codec, dead)
+		}
+		versa := broker.records("logs-versa-" + codec)
+		for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+			p := (murmur2([]byte(ip)) & 0x7fffffff) % broker.partitions
+			if len(versa[p]) != 1 || string(versa[p][0].key) != ip || versa[p][0].pid < 0 || versa[p][0].seq != 0 {
+				t.Fatalf("%s: key %s should be on partition %d, got %+v", codec, ip, p, versa)
+			}
+		}
+		var ev map[string]interface{}
+		rec := versa[(murmur2([]byte("10.0.0.1"))&0x7fffffff)%broker.partitions][0]
+		if err := json.Unmarshal(rec.value, &ev); err != nil || ev["message"] != events[0]["message"] {
+			t.Fatalf("%s: value %q: %v", codec, rec.value, err)
+		}
+		if !rec.ts.Equal(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)) {
+			t.Fatalf("%s: record timestamp %v", codec, rec.ts)
+		}
+		// The event with a topic Kafka cannot accept became "logs-bad_topic_x"
+		// after template sanitizing, which is a valid name.
+		if len(broker.records("logs-bad_topic_x-"+codec)) != 1 || len(broker.records("logs-paloalto-"+codec)) != 1 {
+			t.Fatalf("%s: expected one record on each remaining topic", codec)
+		}
+	}
+	if murmur2([]byte("21")) != -973932308 {
+		t.Fatalf("murmur2 does not match the Java partitioner")
+	}
+}
+
+func TestRetriesKeepSequencesAndDeadLetterRejects(t *testing.T) {
+	broker := newFakeBroker(t, nil, "", "")
+	out, err := NewKafkaOutput(Config{Brokers: []string{broker.addr()}, Topic: "%{t}", RetryDelayMs: 1, MaxRetries: 2})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dead []map[string]interface{}
+	var deadErr error
+	out.SetDeadLetter(func(events []map[string]interface{}, err error) { dead, deadErr = append(dead, events...), err })
+	batch := func(n int) []map[string]interface{} {
+		var evs []map[string]interface{}
+		for i := 0; i < n; i++ {
+			evs = append(evs, map[string]interface{}{"t": "fw", "n": float64(i)})
+		}
+		return evs
+	}
+
+	// A leader change, then a reply lost after the write: the batch is
+	// resent with the same sequence and the broker drops the duplicate.
+	broker.errs = []fakeErr{{code: 6}}
+	broker.dropOn = 2
+	if err := out.SendBatch(batch(3)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	recs := broker.records("fw")
+	total := 0
+	for _, rs := range recs {
+		total += len(rs)
+	}
+	if total != 3 || broker.calls[apiMetadata] < 2 {
+		t.Fatalf("expected 3 records once and a metadata refresh, got %d records, %d metadata calls", total, broker.calls[apiMetadata])
+	}
+
+	// The broker names one invalid record: it is dead-lettered, the rest
+	// are produced under a new producer id.
+	broker.errs = []fakeErr{{code: 87, records: []int32{1}}}
+	if err := out.SendBatch(batch(3)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(dead) != 1 || dead[0]["n"] != 1.0 || !strings.Contains(deadErr.Error(), "INVALID_RECORD") {
+		t.Fatalf("expected record 1 dead-lettered, got %v: %v", dead, deadErr)
+	}
+	if pe, ok := outputs.IsPermanent(deadErr); !ok || pe == nil {
+		t.Fatalf("expected a permanent error, got %v", deadErr)
+	}
+	if broker.calls[apiInitProducerID] != 2 {
+		t.Fatalf("expected a new producer id after the reject, got %d", broker.calls[apiInitProducerID])
+	}
+	if total := len(broker.records("fw")); total == 0 {
+		t.Fatalf("no records")
+	}
+
+	// A topic that never appears fails the batch for the queue to retry and
+	// shows in the health status.
+	if err := out.SendBatch([]map[string]interface{}{{"t": "missing"}}); err == nil || !strings.Contains(err.Error(), "UNKNOWN_TOPIC_OR_PARTITION") {
+		t.Fatalf("expected an unknown topic error, got %v", err)
+	}
+	if h := out.Health(); h.Status != outputs.StatusError {
+		t.Fatalf("expected error health, got %+v", h)
+	}
+	if err := out.SendBatch([]map[string]interface{}{{"t": strings.Repeat("x", 300)}}); err != nil {
+		t.Fatalf("an invalid topic should be dead-lettered, got %v", err)
+	}
+	if len(dead) != 2 {
+		t.Fatalf("expected the invalid topic dead-lettered, got %d", len(dead))
+	}
+}
+
+func TestSCRAMOverTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "broker"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, IsCA: true, BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := newFakeBroker(t, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, "bibbl", "s3cret")
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	for _, mech := range []string{MechanismSCRAMSHA256, MechanismPlain} {
+		out, err := NewKafkaOutput(Config{Brokers: []string{broker.addr()}, Topic: "secure", Compression: "zstd",
+			SASL: SASLConfig{Mechanism: mech, Username: "bibbl", Password: "s3cret"}, TLS: outputs.TLSConfig{CAPEM: ca}})
+		if err != nil {
+			t.Fatalf("%s: new output: %v", mech, err)
+		}
+		if err := out.SendBatch([]map[string]interface{}{{"message": mech}}); err != nil {
+			t.Fatalf("%s: send: %v", mech, err)
+		}
+		_ = out.Close()
+	}
+	if n := len(broker.records("secure")); n == 0 {
+		t.Fatalf("no records produced")
+	}
+
+	bad, err := NewKafkaOutput(Config{Brokers: []string{broker.addr()}, Topic: "secure", RetryDelayMs: 1,
+		SASL: SASLConfig{Mechanism: MechanismSCRAMSHA256, Username: "bibbl", Password: "wrong"}, TLS: outputs.TLSConfig{CAPEM: ca}})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer bad.Close()
+	if err := bad.SendBatch([]map[string]interface{}{{"message": "x"}}); err == nil || !strings.Contains(err.Error(), "SASL_AUTHENTICATION_FAILED") {
+		t.Fatalf("expected an authentication failure, got %v", err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	no := false
+	for _, cfg := range []Config{
+		{Topic: "t"},
+		{Brokers: []string{"b:9092"}},
+		{Brokers: []string{"b:9092"}, Topic: "t", Acks: "leader", Idempotent: func() *bool { v := true; return &v }()},
+		{Brokers: []string{"b:9092"}, Topic: "t", Compression: "brotli"},
+		{Brokers: []string{"b:9092"}, Topic: "t", SASL: SASLConfig{Mechanism: "GSSAPI"}},
+	} {
+		if _, err := NewKafkaOutput(cfg); err == nil {
+			t.Fatalf("expected %+v to be rejected", cfg)
+		}
+	}
+	out, err := NewKafkaOutput(Config{Brokers: []string{"a:9092, b:9092"}, Topic: "t", Acks: "leader", Idempotent: &no})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	if len(out.cfg.Brokers) != 2 || out.acks != 1 || out.client.idempotent {
+		t.Fatalf("unexpected config %+v", out.cfg)
+	}
+	if xxh32(nil, 0) != 0x02CC5D05 || xxh32([]byte("a"), 0) != 0x550D7456 {
+		t.Fatalf("xxh32 mismatch")
+	}
+}
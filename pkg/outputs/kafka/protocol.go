@@ -0,0 +1,306 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// The subset of the Kafka protocol a producer needs. Only non-flexible
+// request versions are used, which every broker since 1.0 and through 4.x
+// accepts, so no tagged fields are involved.
+
+// API keys.
+const (
+	apiProduce          int16 = 0
+	apiMetadata         int16 = 3
+	apiSaslHandshake    int16 = 17
+	apiVersions         int16 = 18
+	apiInitProducerID   int16 = 22
+	apiSaslAuthenticate int16 = 36
+)
+
+// versionRange is the span of versions of an API this client can speak.
+type versionRange struct{ min, max int16 }
+
+var supported = map[int16]versionRange{
+	apiProduce:          {3, 8},
+	apiMetadata:         {1, 8},
+	apiSaslHandshake:    {1, 1},
+	apiSaslAuthenticate: {0, 1},
+	apiInitProducerID:   {0, 1},
+}
+
+// Error is an error code returned by a broker.
+type Error struct {
+	Code int16
+	Name string
+	// Retriable errors can succeed when the request is sent again, possibly
+	// after refreshing metadata.
+	Retriable bool
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("kafka error %d (%s)", e.Code, e.Name) }
+
+var errorCodes = map[int16]*Error{
+	-1: {-1, "UNKNOWN_SERVER_ERROR", false},
+	2:  {2, "CORRUPT_MESSAGE", true},
+	3:  {3, "UNKNOWN_TOPIC_OR_PARTITION", true},
+	5:  {5, "LEADER_NOT_AVAILABLE", true},
+	6:  {6, "NOT_LEADER_OR_FOLLOWER", true},
+	7:  {7, "REQUEST_TIMED_OUT", true},
+	10: {10, "MESSAGE_TOO_LARGE", false},
+	13: {13, "NETWORK_EXCEPTION", true},
+	14: {14, "COORDINATOR_LOAD_IN_PROGRESS", true},
+	15: {15, "COORDINATOR_NOT_AVAILABLE", true},
+	17: {17, "INVALID_TOPIC_EXCEPTION", false},
+	18: {18, "RECORD_LIST_TOO_LARGE", false},
+	19: {19, "NOT_ENOUGH_REPLICAS", true},
+	20: {20, "NOT_ENOUGH_REPLICAS_AFTER_APPEND", true},
+	21: {21, "INVALID_REQUIRED_ACKS", false},
+	29: {29, "TOPIC_AUTHORIZATION_FAILED", false},
+	31: {31, "CLUSTER_AUTHORIZATION_FAILED", false},
+	32: {32, "INVALID_TIMESTAMP", false},
+	33: {33, "UNSUPPORTED_SASL_MECHANISM", false},
+	34: {34, "ILLEGAL_SASL_STATE", false},
+	35: {35, "UNSUPPORTED_VERSION", false},
+	45: {45, "OUT_OF_ORDER_SEQUENCE_NUMBER", false},
+	46: {46, "DUPLICATE_SEQUENCE_NUMBER", false},
+	47: {47, "INVALID_PRODUCER_EPOCH", false},
+	53: {53, "TRANSACTIONAL_ID_AUTHORIZATION_FAILED", false},
+	56: {56, "KAFKA_STORAGE_ERROR", true},
+	58: {58, "SASL_AUTHENTICATION_FAILED", false},
+	59: {59, "UNKNOWN_PRODUCER_ID", false},
+	74: {74, "FENCED_LEADER_EPOCH", true},
+	76: {76, "UNSUPPORTED_COMPRESSION_TYPE", false},
+	87: {87, "INVALID_RECORD", false},
+}
+
+// errorFor maps an error code to an *Error, or nil for 0.
+func errorFor(code int16) *Error {
+	if code == 0 {
+		return nil
+	}
+	if e, ok := errorCodes[code]; ok {
+		return e
+	}
+	return &Error{Code: code, Name: "UNKNOWN"}
+}
+
+// isCode reports whether err is the broker error with the given code.
+func isCode(err error, code int16) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// encoder appends big-endian protocol primitives.
+type encoder struct{ b []byte }
+
+func (e *encoder) int8(v int8)   { e.b = append(e.b, byte(v)) }
+func (e *encoder) int16(v int16) { e.b = binary.BigEndian.AppendUint16(e.b, uint16(v)) }
+func (e *encoder) int32(v int32) { e.b = binary.BigEndian.AppendUint32(e.b, uint32(v)) }
+func (e *encoder) int64(v int64) { e.b = binary.BigEndian.AppendUint64(e.b, uint64(v)) }
+func (e *encoder) bool(v bool) {
+	if v {
+		e.int8(1)
+	} else {
+		e.int8(0)
+	}
+}
+func (e *encoder) varint(v int64) { e.b = binary.AppendVarint(e.b, v) }
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+// nullableString writes -1 for the empty string.
+func (e *encoder) nullableString(s string) {
+	if s == "" {
+		e.int16(-1)
+		return
+	}
+	e.string(s)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// varBytes writes a record key or value: a varint length, -1 for nil.
+func (e *encoder) varBytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.b = append(e.b, b...)
+}
+
+// decoder reads big-endian protocol primitives. The first error sticks and
+// later reads return zero values.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+var errShortResponse = errors.New("kafka: truncated response")
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errShortResponse
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool { return d.int8() != 0 }
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// array reads an array length and calls fn for each element.
+func (d *decoder) array(fn func()) {
+	n := d.int32()
+	for i := int32(0); i < n && d.err == nil; i++ {
+		fn()
+	}
+}
+
+func (d *decoder) int32s() []int32 {
+	var v []int32
+	d.array(func() { v = append(v, d.int32()) })
+	return v
+}
+
+// request frames a request with header v1: size, api key, version,
+// correlation id and client id.
+func request(key, version int16, correlation int32, clientID string, body []byte) []byte {
+	e := encoder{b: make([]byte, 4, 14+len(clientID)+len(body))}
+	e.int16(key)
+	e.int16(version)
+	e.int32(correlation)
+	e.nullableString(clientID)
+	e.b = append(e.b, body...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	return e.b
+}
+
+// record is one message to produce.
+type record struct {
+	key, value []byte
+	ts         time.Time
+	event      map[string]interface{}
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// batchHeaderSize is the v2 record batch header up to the record count.
+const batchHeaderSize = 61
+
+// producerState identifies an idempotent batch; id -1 disables it.
+type producerState struct {
+	id       int64
+	epoch    int16
+	sequence int32
+}
+
+// encodeRecordBatch builds a v2 (magic 2) record batch.
+func encodeRecordBatch(records []*record, c codec, ps producerState) ([]byte, error) {
+	base, maxTS := records[0].ts.UnixMilli(), records[0].ts.UnixMilli()
+	for _, r := range records[1:] {
+		base = min(base, r.ts.UnixMilli())
+		maxTS = max(maxTS, r.ts.UnixMilli())
+	}
+	var body encoder
+	for i, r := range records {
+		var rec encoder
+		rec.int8(0) // attributes
+		rec.varint(r.ts.UnixMilli() - base)
+		rec.varint(int64(i))
+		rec.varBytes(r.key)
+		rec.varBytes(r.value)
+		rec.varint(0) // headers
+		body.varint(int64(len(rec.b)))
+		body.b = append(body.b, rec.b...)
+	}
+	payload, err := c.compress(body.b)
+	if err != nil {
+		return nil, err
+	}
+	e := encoder{b: make([]byte, 0, batchHeaderSize+len(payload))}
+	e.int64(0)  // base offset, assigned by the broker
+	e.int32(0)  // batch length, patched below
+	e.int32(-1) // partition leader epoch
+	e.int8(2)   // magic
+	e.int32(0)  // crc, patched below
+	e.int16(c.id)
+	e.int32(int32(len(records) - 1))
+	e.int64(base)
+	e.int64(maxTS)
+	e.int64(ps.id)
+	e.int16(ps.epoch)
+	if ps.id < 0 {
+		e.int32(-1)
+	} else {
+		e.int32(ps.sequence)
+	}
+	e.int32(int32(len(records)))
+	e.b = append(e.b, payload...)
+	binary.BigEndian.PutUint32(e.b[8:], uint32(len(e.b)-12))
+	binary.BigEndian.PutUint32(e.b[17:], crc32.Checksum(e.b[21:], crc32c))
+	return e.b, nil
+}
+
+// recordOverhead bounds the bytes a record adds to an uncompressed batch
+// beyond its key and value.
+const recordOverhead = 5 + 1 + 10 + 5 + 5 + 5 + 1
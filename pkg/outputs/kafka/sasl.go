@@ -0,0 +1,127 @@
+package kafka
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// mechanism runs a SASL exchange; exchange sends one message to the broker
+// and returns its reply.
+type mechanism interface {
+	name() string
+	authenticate(exchange func(msg []byte) ([]byte, error)) error
+}
+
+func newMechanism(c SASLConfig) (mechanism, error) {
+	switch strings.ToUpper(strings.TrimSpace(c.Mechanism)) {
+	case "":
+		return nil, nil
+	case MechanismPlain:
+		return plainAuth{c.Username, c.Password}, nil
+	case MechanismSCRAMSHA256:
+		return scramAuth{MechanismSCRAMSHA256, sha256.New, c.Username, c.Password}, nil
+	case MechanismSCRAMSHA512:
+		return scramAuth{MechanismSCRAMSHA512, sha512.New, c.Username, c.Password}, nil
+	}
+	return nil, fmt.Errorf("sasl.mechanism must be PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512, got %q", c.Mechanism)
+}
+
+// plainAuth is RFC 4616 PLAIN.
+type plainAuth struct{ user, pass string }
+
+func (plainAuth) name() string { return MechanismPlain }
+
+func (a plainAuth) authenticate(exchange func([]byte) ([]byte, error)) error {
+	_, err := exchange([]byte("\x00" + a.user + "\x00" + a.pass))
+	return err
+}
+
+// scramAuth is RFC 5802 SCRAM without channel binding. Usernames and
+// passwords are used as given, without SASLprep.
+type scramAuth struct {
+	mech       string
+	hash       func() hash.Hash
+	user, pass string
+}
+
+func (a scramAuth) name() string { return a.mech }
+
+func (a scramAuth) authenticate(exchange func([]byte) ([]byte, error)) error {
+	nonce := make([]byte, 24)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.user)
+	clientFirstBare := "n=" + user + ",r=" + base64.RawStdEncoding.EncodeToString(nonce)
+	serverFirst, err := exchange([]byte("n,," + clientFirstBare))
+	if err != nil {
+		return err
+	}
+	attrs := scramAttrs(string(serverFirst))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("scram: %s", e)
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter < 1 {
+		return fmt.Errorf("scram: invalid iteration count %q", attrs["i"])
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return fmt.Errorf("scram: invalid salt: %w", err)
+	}
+	if !strings.HasPrefix(attrs["r"], base64.RawStdEncoding.EncodeToString(nonce)) {
+		return fmt.Errorf("scram: server nonce does not extend the client nonce")
+	}
+	salted, err := pbkdf2.Key(a.hash, a.pass, salt, iter, a.hash().Size())
+	if err != nil {
+		return err
+	}
+	clientKey := a.hmac(salted, "Client Key")
+	h := a.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	withoutProof := "c=biws,r=" + attrs["r"]
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + withoutProof
+	proof := a.hmac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverFinal, err := exchange([]byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	attrs = scramAttrs(string(serverFinal))
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("scram: %s", e)
+	}
+	want := a.hmac(a.hmac(salted, "Server Key"), authMessage)
+	if got, err := base64.StdEncoding.DecodeString(attrs["v"]); err != nil || !bytes.Equal(got, want) {
+		return fmt.Errorf("scram: invalid server signature")
+	}
+	return nil
+}
+
+func (a scramAuth) hmac(key []byte, msg string) []byte {
+	m := hmac.New(a.hash, key)
+	m.Write([]byte(msg))
+	return m.Sum(nil)
+}
+
+func scramAttrs(s string) map[string]string {
+	attrs := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
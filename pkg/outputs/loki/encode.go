@@ -0,0 +1,69 @@
+package loki
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// encodeProto writes a logproto.PushRequest and snappy-compresses it, the
+// way Loki expects protobuf pushes:
+//
+//	PushRequest  { repeated StreamAdapter streams = 1; }
+//	StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func encodeProto(streams []*stream) []byte {
+	var req, sb, eb, tb []byte
+	for _, s := range streams {
+		sb = protowire.AppendTag(sb[:0], 1, protowire.BytesType)
+		sb = protowire.AppendString(sb, s.key)
+		for _, e := range s.entries {
+			tb = tb[:0]
+			if sec := e.ts.Unix(); sec != 0 {
+				tb = protowire.AppendTag(tb, 1, protowire.VarintType)
+				tb = protowire.AppendVarint(tb, uint64(sec))
+			}
+			if nanos := e.ts.Nanosecond(); nanos != 0 {
+				tb = protowire.AppendTag(tb, 2, protowire.VarintType)
+				tb = protowire.AppendVarint(tb, uint64(nanos))
+			}
+			eb = protowire.AppendTag(eb[:0], 1, protowire.BytesType)
+			eb = protowire.AppendBytes(eb, tb)
+			eb = protowire.AppendTag(eb, 2, protowire.BytesType)
+			eb = protowire.AppendString(eb, e.line)
+			sb = protowire.AppendTag(sb, 2, protowire.BytesType)
+			sb = protowire.AppendBytes(sb, eb)
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, sb)
+	}
+	return snappy.Encode(nil, req)
+}
+
+type jsonStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// encodeJSON writes the push API's JSON body, timestamps as nanosecond
+// strings.
+func encodeJSON(streams []*stream) ([]byte, error) {
+	body := struct {
+		Streams []jsonStream `json:"streams"`
+	}{Streams: make([]jsonStream, 0, len(streams))}
+	for _, s := range streams {
+		js := jsonStream{Stream: s.labels, Values: make([][2]string, 0, len(s.entries))}
+		for _, e := range s.entries {
+			js.Values = append(js.Values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line})
+		}
+		body.Streams = append(body.Streams, js)
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal push request: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,576 @@
+// Package loki pushes events to Grafana Loki through its push API.
+package loki
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bibbl/pkg/outputs"
+)
+
+// Encodings and out-of-order policies.
+const (
+	EncodingProtobuf = "protobuf" // snappy-compressed logproto.PushRequest
+	EncodingJSON     = "json"
+
+	OutOfOrderAccept  = "accept"  // send as is; Loki 2.4+ takes them within its window
+	OutOfOrderRewrite = "rewrite" // move them up to the newest timestamp sent
+	OutOfOrderDrop    = "drop"    // dead-letter them
+
+	pushPath = "/loki/api/v1/push"
+)
+
+// Config holds configuration for a Loki destination.
+type Config struct {
+	// URL is Loki's base URL (http://loki:3100) or the full push URL.
+	URL      string `json:"url"`
+	Encoding string `json:"encoding"` // protobuf (default) | json
+	TenantID string `json:"tenantId"` // X-Scope-OrgID for multi-tenant Loki
+
+	// Labels maps stream label names to the event fields they are read
+	// from, e.g. {"host": "host", "sourcetype": "sourcetype"}. Events
+	// without the field leave the label out. StaticLabels go on every
+	// stream; without any, streams get job="bibbl".
+	Labels       map[string]string `json:"labels"`
+	StaticLabels map[string]string `json:"staticLabels"`
+
+	// Cardinality guardrails. A label keeps at most MaxLabelValues
+	// distinct values (default 100); further values, and values longer
+	// than MaxLabelValueBytes (default 128), are sent as OverflowValue
+	// (default "_overflow") while the event line keeps the real one.
+	// Fields that are unique per event, like addresses and IDs, are
+	// refused as labels unless AllowHighCardinality is set.
+	MaxLabelValues       int    `json:"maxLabelValues"`
+	MaxLabelValueBytes   int    `json:"maxLabelValueBytes"`
+	OverflowValue        string `json:"overflowValue"`
+	AllowHighCardinality bool   `json:"allowHighCardinality"`
+
+	LineFormat   string `json:"lineFormat"`   // json (default): the event | raw: RawField, JSON when missing
+	RawField     string `json:"rawField"`     // default "_raw"
+	TimeField    string `json:"timeField"`    // default "timestamp"; events without it use the send time
+	MaxLineBytes int    `json:"maxLineBytes"` // default 256 KiB, Loki's max_line_size; longer lines are dead-lettered
+
+	// OutOfOrder decides what happens to an entry older than the newest
+	// one already sent for its stream: accept (default), rewrite or drop.
+	OutOfOrder string `json:"outOfOrder"`
+
+	Username    string            `json:"username"`
+	Password    string            `json:"password"`
+	BearerToken string            `json:"bearerToken"`
+	Headers     map[string]string `json:"headers"`
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+	TimeoutSec       int `json:"timeoutSec"`
+	MaxRetries       int `json:"maxRetries"` // for 429, 5xx and transport errors
+	RetryDelayMs     int `json:"retryDelayMs"`
+
+	TLS outputs.TLSConfig `json:"tls"`
+}
+
+// highCardinality lists field names that are (nearly) unique per event and
+// would create a stream per value.
+var highCardinality = map[string]bool{
+	"_raw": true, "message": true, "msg": true, "timestamp": true, "time": true, "@timestamp": true,
+	"src_ip": true, "dst_ip": true, "src_port": true, "dst_port": true, "source_ip": true, "destination_ip": true,
+	"client_ip": true, "session_id": true, "request_id": true, "trace_id": true, "span_id": true,
+	"id": true, "uuid": true, "url": true, "uri": true, "user": true, "username": true,
+}
+
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type labelField struct{ name, field string }
+
+// LokiOutput delivers batches to one Loki push endpoint.
+type LokiOutput struct {
+	*outputs.Batcher
+
+	cfg    Config
+	push   string
+	labels []labelField
+	static map[string]string
+	client *http.Client
+	json   atomic.Bool // protobuf was refused with 415
+
+	mu        sync.Mutex
+	values    map[string]map[string]struct{} // label -> values given out
+	latest    map[string]time.Time           // stream -> newest timestamp sent
+	overflow  map[string]uint64              // label -> events sent with OverflowValue
+	rewritten uint64
+	dropped   uint64
+	rejected  uint64
+}
+
+// NewLokiOutput validates cfg, applies defaults and starts the output.
+func NewLokiOutput(cfg Config) (*LokiOutput, error) {
+	u, err := url.Parse(strings.TrimSpace(cfg.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an absolute http(s) URL, got %q", cfg.URL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = pushPath
+	}
+	switch cfg.Encoding = strings.ToLower(cfg.Encoding); cfg.Encoding {
+	case "":
+		cfg.Encoding = EncodingProtobuf
+	case EncodingProtobuf, EncodingJSON:
+	default:
+		return nil, fmt.Errorf("encoding must be protobuf or json, got %q", cfg.Encoding)
+	}
+	switch cfg.LineFormat = strings.ToLower(cfg.LineFormat); cfg.LineFormat {
+	case "":
+		cfg.LineFormat = "json"
+	case "json", "raw":
+	default:
+		return nil, fmt.Errorf("lineFormat must be json or raw, got %q", cfg.LineFormat)
+	}
+	switch cfg.OutOfOrder = strings.ToLower(cfg.OutOfOrder); cfg.OutOfOrder {
+	case "":
+		cfg.OutOfOrder = OutOfOrderAccept
+	case OutOfOrderAccept, OutOfOrderRewrite, OutOfOrderDrop:
+	default:
+		return nil, fmt.Errorf("outOfOrder must be accept, rewrite or drop, got %q", cfg.OutOfOrder)
+	}
+	if cfg.BearerToken != "" && cfg.Username != "" {
+		return nil, fmt.Errorf("set either bearerToken or username/password, not both")
+	}
+	o := &LokiOutput{
+		static:   map[string]string{},
+		values:   map[string]map[string]struct{}{},
+		latest:   map[string]time.Time{},
+		overflow: map[string]uint64{},
+	}
+	for name, v := range cfg.StaticLabels {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if v == "" {
+			return nil, fmt.Errorf("static label %q has an empty value", name)
+		}
+		o.static[name] = v
+	}
+	if len(o.static) == 0 {
+		o.static["job"] = "bibbl"
+	}
+	for name, field := range cfg.Labels {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		if _, dup := o.static[name]; dup {
+			return nil, fmt.Errorf("label %q is both static and read from a field", name)
+		}
+		if field = strings.TrimSpace(field); field == "" {
+			return nil, fmt.Errorf("label %q needs a field", name)
+		}
+		leaf := strings.ToLower(field[strings.LastIndexByte(field, '.')+1:])
+		if highCardinality[leaf] && !cfg.AllowHighCardinality {
+			return nil, fmt.Errorf("label %q: field %q is unique per event and would create a stream per value; keep it in the line or set allowHighCardinality", name, field)
+		}
+		o.labels = append(o.labels, labelField{name, field})
+	}
+	sort.Slice(o.labels, func(i, j int) bool { return o.labels[i].name < o.labels[j].name })
+	if cfg.MaxLabelValues <= 0 {
+		cfg.MaxLabelValues = 100
+	}
+	if cfg.MaxLabelValueBytes <= 0 {
+		cfg.MaxLabelValueBytes = 128
+	}
+	if cfg.OverflowValue == "" {
+		cfg.OverflowValue = "_overflow"
+	}
+	if cfg.RawField == "" {
+		cfg.RawField = "_raw"
+	}
+	if cfg.TimeField == "" {
+		cfg.TimeField = "timestamp"
+	}
+	if cfg.MaxLineBytes <= 0 {
+		cfg.MaxLineBytes = 256 * 1024
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 30
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryDelayMs <= 0 {
+		cfg.RetryDelayMs = 500
+	}
+	tlsCfg, err := cfg.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+	o.cfg = cfg
+	o.push = u.String()
+	o.client = &http.Client{
+		Timeout: time.Duration(cfg.TimeoutSec) * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsCfg,
+		},
+	}
+	o.json.Store(cfg.Encoding == EncodingJSON)
+	o.Batcher = outputs.NewBatcher("loki", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.deliver)
+	return o, nil
+}
+
+// NewOutput builds a LokiOutput from a destination config map. It is the
+// factory registered for the "loki" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewLokiOutput(c)
+}
+
+type entry struct {
+	ts   time.Time
+	line string
+	ev   map[string]interface{}
+}
+
+// stream is one label set and its entries, oldest first.
+type stream struct {
+	key     string // {a="x", b="y"}, the way Loki prints it
+	labels  map[string]string
+	entries []entry
+	newest  time.Time
+}
+
+type reject struct {
+	ev  map[string]interface{}
+	err error
+}
+
+// push is one request in the making. Events turned away locally are only
+// dead-lettered once the request went through, so a retried batch does
+// not reject them twice.
+type push struct {
+	streams   []*stream
+	rejects   []reject
+	rewritten uint64
+}
+
+// deliver groups the batch into streams and pushes it.
+func (o *LokiOutput) deliver(events []map[string]interface{}) error {
+	p := o.build(events)
+	if len(p.streams) > 0 {
+		ignored, err := o.send(p.streams)
+		if err != nil {
+			return err
+		}
+		p.rejects = append(p.rejects, ignored...)
+	}
+	o.mu.Lock()
+	for _, s := range p.streams {
+		if s.newest.After(o.latest[s.key]) {
+			o.latest[s.key] = s.newest
+		}
+	}
+	o.rewritten += p.rewritten
+	o.mu.Unlock()
+	for _, r := range p.rejects {
+		o.DeadLetter([]map[string]interface{}{r.ev}, r.err)
+	}
+	return nil
+}
+
+func (o *LokiOutput) build(events []map[string]interface{}) *push {
+	p := &push{}
+	byKey := map[string]*stream{}
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, ev := range events {
+		line, err := o.line(ev)
+		if err != nil {
+			p.rejects = append(p.rejects, reject{ev, err})
+			continue
+		}
+		ts, ok := outputs.EventTime(ev, o.cfg.TimeField)
+		if !ok {
+			ts = now
+		}
+		labels := o.labelsLocked(ev)
+		key := streamKey(labels)
+		s := byKey[key]
+		if s == nil {
+			s = &stream{key: key, labels: labels}
+			byKey[key] = s
+			p.streams = append(p.streams, s)
+		}
+		s.entries = append(s.entries, entry{ts, line, ev})
+	}
+	kept := p.streams[:0]
+	for _, s := range p.streams {
+		sort.SliceStable(s.entries, func(i, j int) bool { return s.entries[i].ts.Before(s.entries[j].ts) })
+		floor := o.latest[s.key]
+		entries := s.entries[:0]
+		for _, e := range s.entries {
+			if e.ts.Before(floor) {
+				switch o.cfg.OutOfOrder {
+				case OutOfOrderRewrite:
+					e.ts = floor
+					p.rewritten++
+				case OutOfOrderDrop:
+					o.dropped++
+					p.rejects = append(p.rejects, reject{e.ev, outputs.Permanent(0, fmt.Errorf("loki: entry at %s is older than %s, the newest sent for stream %s", e.ts.UTC().Format(time.RFC3339Nano), floor.UTC().Format(time.RFC3339Nano), s.key))})
+					continue
+				}
+			}
+			entries = append(entries, e)
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		s.entries = entries
+		s.newest = entries[len(entries)-1].ts
+		kept = append(kept, s)
+	}
+	p.streams = kept
+	return p
+}
+
+// line renders an event as its log line.
+func (o *LokiOutput) line(ev map[string]interface{}) (string, error) {
+	var line string
+	if o.cfg.LineFormat == "raw" {
+		line = strings.TrimRight(outputs.FieldString(ev, o.cfg.RawField), "\r\n")
+	}
+	if line == "" {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return "", outputs.Permanent(0, fmt.Errorf("failed to marshal event: %w", err))
+		}
+		line = string(b)
+	}
+	if len(line) > o.cfg.MaxLineBytes {
+		return "", outputs.Permanent(0, fmt.Errorf("loki: line of %d bytes exceeds maxLineBytes %d", len(line), o.cfg.MaxLineBytes))
+	}
+	return line, nil
+}
+
+// labelsLocked resolves an event's stream labels, applying the
+// cardinality guardrails.
+func (o *LokiOutput) labelsLocked(ev map[string]interface{}) map[string]string {
+	labels := make(map[string]string, len(o.static)+len(o.labels))
+	for k, v := range o.static {
+		labels[k] = v
+	}
+	for _, l := range o.labels {
+		v := outputs.FieldString(ev, l.field)
+		if v == "" {
+			continue
+		}
+		seen := o.values[l.name]
+		if seen == nil {
+			seen = map[string]struct{}{}
+			o.values[l.name] = seen
+		}
+		if _, ok := seen[v]; !ok {
+			if len(v) > o.cfg.MaxLabelValueBytes || len(seen) >= o.cfg.MaxLabelValues {
+				o.overflow[l.name]++
+				v = o.cfg.OverflowValue
+			} else {
+				seen[v] = struct{}{}
+			}
+		}
+		labels[l.name] = v
+	}
+	return labels
+}
+
+// streamKey renders labels as a sorted selector, which is also how Loki
+// names streams in its error messages.
+func streamKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[k]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// send pushes the streams, retrying 429, 5xx and transport errors with
+// exponential backoff (or the server's Retry-After). A 400 naming
+// out-of-order or too-old entries means Loki stored the rest of the
+// request, so it is not retried; the entries it names come back for the
+// dead-letter store.
+func (o *LokiOutput) send(streams []*stream) ([]reject, error) {
+	delay := time.Duration(o.cfg.RetryDelayMs) * time.Millisecond
+	var lastErr error
+	for attempt := 0; attempt <= o.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay = min(delay*2, 30*time.Second)
+		}
+		asJSON := o.json.Load()
+		status, retryAfter, body, err := o.do(streams, asJSON)
+		if err == nil {
+			return nil, nil
+		}
+		lastErr = err
+		switch {
+		case status == http.StatusUnsupportedMediaType && !asJSON:
+			log.Printf("loki: %s does not accept protobuf, falling back to JSON", o.push)
+			o.json.Store(true)
+			attempt--
+			continue
+		case status == http.StatusBadRequest && outOfOrder(body):
+			return o.ignored(streams, body, err), nil
+		case status == 0 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout || status >= 500:
+			if retryAfter > 0 {
+				delay = min(retryAfter, 30*time.Second)
+			}
+			continue
+		}
+		return nil, outputs.HTTPError(status, err)
+	}
+	return nil, fmt.Errorf("failed after %d retries: %w", o.cfg.MaxRetries, lastErr)
+}
+
+// do performs one attempt. status is 0 for transport errors.
+func (o *LokiOutput) do(streams []*stream, asJSON bool) (status int, retryAfter time.Duration, respBody string, err error) {
+	var body []byte
+	contentType := "application/x-protobuf"
+	if asJSON {
+		if body, err = encodeJSON(streams); err != nil {
+			return 0, 0, "", outputs.Permanent(0, err)
+		}
+		contentType = "application/json"
+	} else {
+		body = encodeProto(streams)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, o.push, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range o.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if o.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", o.cfg.TenantID)
+	}
+	switch {
+	case o.cfg.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+o.cfg.BearerToken)
+	case o.cfg.Username != "":
+		req.SetBasicAuth(o.cfg.Username, o.cfg.Password)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, 0, "", nil
+	}
+	if secs, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && secs > 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	respBody = strings.TrimSpace(string(b))
+	return resp.StatusCode, retryAfter, respBody, fmt.Errorf("loki %s returned status %d: %s", o.push, resp.StatusCode, respBody)
+}
+
+func outOfOrder(body string) bool {
+	body = strings.ToLower(body)
+	return strings.Contains(body, "out of order") || strings.Contains(body, "too far behind") || strings.Contains(body, "too old")
+}
+
+// ignored picks the entries a partial rejection names. Loki prints each
+// ignored entry's timestamp and the stream's labels; it truncates long
+// lists, so entries past the cut are counted but cannot be matched.
+func (o *LokiOutput) ignored(streams []*stream, body string, err error) []reject {
+	named := false
+	for _, s := range streams {
+		if strings.Contains(body, s.key) {
+			named = true
+			break
+		}
+	}
+	var out []reject
+	for _, s := range streams {
+		if named && !strings.Contains(body, s.key) {
+			continue
+		}
+		for _, e := range s.entries {
+			if strings.Contains(body, e.ts.UTC().String()) {
+				out = append(out, reject{e.ev, outputs.Permanent(http.StatusBadRequest, err)})
+			}
+		}
+	}
+	n := uint64(len(out))
+	if m := totalIgnored.FindStringSubmatch(body); m != nil {
+		if total, convErr := strconv.ParseUint(m[1], 10, 64); convErr == nil && total > n {
+			n = total
+		}
+	}
+	if n == 0 {
+		n = 1
+	}
+	o.mu.Lock()
+	o.rejected += n
+	o.mu.Unlock()
+	log.Printf("loki: %d entries rejected as out of order or too old: %s", n, body)
+	return out
+}
+
+var totalIgnored = regexp.MustCompile(`total ignored: (\d+)`)
+
+// Health adds the stream and guardrail counters to the delivery health.
+func (o *LokiOutput) Health() outputs.Health {
+	h := o.Batcher.Health()
+	encoding := o.cfg.Encoding
+	if o.json.Load() {
+		encoding = EncodingJSON
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	overflow := make(map[string]uint64, len(o.overflow))
+	for k, v := range o.overflow {
+		overflow[k] = v
+	}
+	h.Details = map[string]interface{}{"loki": map[string]interface{}{
+		"encoding":           encoding,
+		"streams":            len(o.latest),
+		"overflowedLabels":   overflow,
+		"rewritten":          o.rewritten,
+		"droppedOutOfOrder":  o.dropped,
+		"rejectedOutOfOrder": o.rejected,
+	}}
+	return h
+}
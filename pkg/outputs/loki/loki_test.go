@@ -0,0 +1,358 @@
+package loki
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type pushed struct {
+	labels string
+	ts     time.Time
+	line   string
+}
+
+// fakeLoki records pushes in either encoding. respond, when set, picks the
+// answer per request; returning 0 accepts it.
+type fakeLoki struct {
+	mu      sync.Mutex
+	entries []pushed
+	headers []http.Header
+	types   []string
+	respond func(n int, entries []pushed) (int, string)
+}
+
+func (f *fakeLoki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != pushPath {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var got []pushed
+	var err error
+	if r.Header.Get("Content-Type") == "application/x-protobuf" {
+		got, err = decodeProto(body)
+	} else {
+		got, err = decodeJSON(body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.headers = append(f.headers, r.Header.Clone())
+	f.types = append(f.types, r.Header.Get("Content-Type"))
+	n := len(f.headers)
+	respond := f.respond
+	f.mu.Unlock()
+	if respond != nil {
+		if status, msg := respond(n, got); status != 0 {
+			http.Error(w, msg, status)
+			return
+		}
+	}
+	f.mu.Lock()
+	f.entries = append(f.entries, got...)
+	f.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeProto(body []byte) ([]pushed, error) {
+	raw, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, err
+	}
+	var out []pushed
+	for _, s := range fields(raw, 1) {
+		labels := string(fields(s, 1)[0])
+		for _, e := range fields(s, 2) {
+			var sec, nanos uint64
+			ts := fields(e, 1)[0]
+			for len(ts) > 0 {
+				num, _, n := protowire.ConsumeTag(ts)
+				v, m := protowire.ConsumeVarint(ts[n:])
+				if num == 1 {
+					sec = v
+				} else {
+					nanos = v
+				}
+				ts = ts[n+m:]
+			}
+			out = append(out, pushed{labels, time.Unix(int64(sec), int64(nanos)), string(fields(e, 2)[0])})
+		}
+	}
+	return out, nil
+}
+
+// fields returns the length-delimited values of field num in a message.
+func fields(b []byte, num protowire.Number) [][]byte {
+	var out [][]byte
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		b = b[l:]
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		if n == num && typ == protowire.BytesType {
+			v, _ := protowire.ConsumeBytes(b)
+			out = append(out, v)
+		}
+		b = b[l:]
+	}
+	return out
+}
+
+func decodeJSON(body []byte) ([]pushed, error) {
+	var req struct {
+		Streams []jsonStream `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, err
+	}
+	var out []pushed
+	for _, s := range req.Streams {
+		for _, v := range s.Values {
+			ns, err := strconv.ParseInt(v[0], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, pushed{streamKey(s.Stream), time.Unix(0, ns), v[1]})
+		}
+	}
+	return out, nil
+}
+
+type deadLetters struct {
+	mu     sync.Mutex
+	events []map[string]interface{}
+	errs   []error
+}
+
+func (d *deadLetters) add(events []map[string]interface{}, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, events...)
+	d.errs = append(d.errs, err)
+}
+
+func ev(host string, sec int, msg string) map[string]interface{} {
+	return map[string]interface{}{
+		"host":      host,
+		"timestamp": time.Unix(1714557600+int64(sec), 0).UTC().Format(time.RFC3339),
+		"_raw":      msg,
+	}
+}
+
+func TestPushesProtobufStreamsWithGuardrails(t *testing.T) {
+	f := &fakeLoki{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	out, err := NewLokiOutput(Config{
+		URL:            srv.URL,
+		TenantID:       "noc",
+		Username:       "bibbl",
+		Password:       "secret",
+		Labels:         map[string]string{"host": "host"},
+		StaticLabels:   map[string]string{"job": "versa"},
+		LineFormat:     "raw",
+		MaxLabelValues: 2,
+		MaxLineBytes:   64,
+	})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dl deadLetters
+	out.SetDeadLetter(dl.add)
+	if err := out.SendBatch([]map[string]interface{}{
+		ev("fw-1", 2, "second"),
+		ev("fw-1", 1, "first"),
+		ev("fw-2", 1, "other host"),
+		ev("fw-3", 1, "third host"),
+		ev("fw-1", 3, strings.Repeat("x", 100)),
+	}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	want := []pushed{
+		{`{host="fw-1", job="versa"}`, time.Unix(1714557601, 0), "first"},
+		{`{host="fw-1", job="versa"}`, time.Unix(1714557602, 0), "second"},
+		{`{host="fw-2", job="versa"}`, time.Unix(1714557601, 0), "other host"},
+		{`{host="_overflow", job="versa"}`, time.Unix(1714557601, 0), "third host"},
+	}
+	if len(f.entries) != len(want) {
+		t.Fatalf("expected %d entries, got %+v", len(want), f.entries)
+	}
+	for i, w := range want {
+		if g := f.entries[i]; g.labels != w.labels || !g.ts.Equal(w.ts) || g.line != w.line {
+			t.Fatalf("entry %d: got %+v, want %+v", i, g, w)
+		}
+	}
+	h := f.headers[0]
+	if f.types[0] != "application/x-protobuf" || h.Get("X-Scope-OrgID") != "noc" {
+		t.Fatalf("unexpected headers %v", h)
+	}
+	if user, pass, ok := (&http.Request{Header: h}).BasicAuth(); !ok || user != "bibbl" || pass != "secret" {
+		t.Fatalf("expected basic auth, got %q", h.Get("Authorization"))
+	}
+	if len(dl.events) != 1 || !strings.Contains(dl.errs[0].Error(), "maxLineBytes") {
+		t.Fatalf("expected the long line dead-lettered, got %v", dl.errs)
+	}
+	d := out.Health().Details["loki"].(map[string]interface{})
+	if d["overflowedLabels"].(map[string]uint64)["host"] != 1 || d["streams"] != 3 {
+		t.Fatalf("unexpected health details %v", d)
+	}
+}
+
+func TestFallsBackToJSONAndRetries(t *testing.T) {
+	f := &fakeLoki{respond: func(n int, _ []pushed) (int, string) {
+		switch n {
+		case 1:
+			return http.StatusUnsupportedMediaType, "unsupported content type"
+		case 2:
+			return http.StatusTooManyRequests, "ingestion rate limit exceeded"
+		}
+		return 0, ""
+	}}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	out, err := NewLokiOutput(Config{URL: srv.URL + pushPath, BearerToken: "tok", RetryDelayMs: 1})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	if err := out.SendBatch([]map[string]interface{}{ev("fw-1", 1, "a")}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(f.types) != 3 || f.types[0] != "application/x-protobuf" || f.types[2] != "application/json" {
+		t.Fatalf("expected protobuf, then JSON twice, got %v", f.types)
+	}
+	if f.headers[2].Get("Authorization") != "Bearer tok" {
+		t.Fatalf("expected the bearer token, got %q", f.headers[2].Get("Authorization"))
+	}
+	if len(f.entries) != 1 || f.entries[0].labels != `{job="bibbl"}` || !strings.Contains(f.entries[0].line, `"_raw":"a"`) {
+		t.Fatalf("unexpected entries %+v", f.entries)
+	}
+	if out.Health().Details["loki"].(map[string]interface{})["encoding"] != EncodingJSON {
+		t.Fatalf("expected the fallback to stick")
+	}
+
+	f.respond = func(int, []pushed) (int, string) {
+		return http.StatusBadRequest, "error at least one label pair is required per stream"
+	}
+	err = out.SendBatch([]map[string]interface{}{ev("fw-1", 2, "b")})
+	if err == nil || !strings.Contains(err.Error(), "status 400") {
+		t.Fatalf("expected a permanent 400, got %v", err)
+	}
+}
+
+func TestOutOfOrderPolicies(t *testing.T) {
+	for _, policy := range []string{OutOfOrderRewrite, OutOfOrderDrop} {
+		t.Run(policy, func(t *testing.T) {
+			f := &fakeLoki{}
+			srv := httptest.NewServer(f)
+			defer srv.Close()
+			out, err := NewLokiOutput(Config{URL: srv.URL, Labels: map[string]string{"host": "host"}, OutOfOrder: policy})
+			if err != nil {
+				t.Fatalf("new output: %v", err)
+			}
+			defer out.Close()
+			var dl deadLetters
+			out.SetDeadLetter(dl.add)
+			_ = out.SendBatch([]map[string]interface{}{ev("fw-1", 10, "new")})
+			_ = out.SendBatch([]map[string]interface{}{ev("fw-1", 5, "late"), ev("fw-2", 5, "other stream"), ev("fw-1", 11, "newer")})
+			late := time.Unix(1714557605, 0)
+			if policy == OutOfOrderRewrite {
+				late = time.Unix(1714557610, 0)
+			}
+			var lines []string
+			for _, e := range f.entries {
+				lines = append(lines, e.line)
+				if strings.Contains(e.line, "late") && !e.ts.Equal(late) {
+					t.Fatalf("late entry sent at %v", e.ts)
+				}
+			}
+			got := fmt.Sprint(len(lines), len(dl.events))
+			if want := map[string]string{OutOfOrderRewrite: "4 0", OutOfOrderDrop: "3 1"}[policy]; got != want {
+				t.Fatalf("sent/dead-lettered %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestPartialOutOfOrderRejection(t *testing.T) {
+	f := &fakeLoki{}
+	f.respond = func(n int, entries []pushed) (int, string) {
+		if n != 1 {
+			return 0, ""
+		}
+		// Loki stores what it can and lists what it ignored.
+		var kept []pushed
+		var msg strings.Builder
+		for _, e := range entries {
+			if e.line == `{"_raw":"stale","host":"fw-1","timestamp":"2024-05-01T10:00:01Z"}` {
+				fmt.Fprintf(&msg, "entry with timestamp %s ignored, reason: 'entry out of order',\n", e.ts.UTC().String())
+				continue
+			}
+			kept = append(kept, e)
+		}
+		fmt.Fprintf(&msg, "user 'fake', total ignored: 1 out of %d for stream: %s", len(entries), entries[0].labels)
+		f.entries = append(f.entries, kept...)
+		return http.StatusBadRequest, msg.String()
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+	out, err := NewLokiOutput(Config{URL: srv.URL, Labels: map[string]string{"host": "host"}})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dl deadLetters
+	out.SetDeadLetter(dl.add)
+	if err := out.SendBatch([]map[string]interface{}{ev("fw-1", 1, "stale"), ev("fw-1", 2, "fresh")}); err != nil {
+		t.Fatalf("a partial rejection should not fail the batch: %v", err)
+	}
+	if len(f.headers) != 1 || len(f.entries) != 1 || f.entries[0].ts.Unix() != 1714557602 {
+		t.Fatalf("expected one push keeping the fresh entry, got %d pushes, %+v", len(f.headers), f.entries)
+	}
+	if len(dl.events) != 1 || dl.events[0]["_raw"] != "stale" {
+		t.Fatalf("expected the stale entry dead-lettered, got %v", dl.events)
+	}
+	if d := out.Health().Details["loki"].(map[string]interface{}); d["rejectedOutOfOrder"] != uint64(1) {
+		t.Fatalf("unexpected health details %v", d)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	bad := []Config{
+		{URL: "loki:3100"},
+		{URL: "http://loki:3100", Encoding: "snappy"},
+		{URL: "http://loki:3100", Labels: map[string]string{"src": "src_ip"}},
+		{URL: "http://loki:3100", Labels: map[string]string{"bad-name": "host"}},
+		{URL: "http://loki:3100", Labels: map[string]string{"__name__": "host"}},
+		{URL: "http://loki:3100", StaticLabels: map[string]string{"job": ""}},
+		{URL: "http://loki:3100", BearerToken: "t", Username: "u"},
+		{URL: "http://loki:3100", OutOfOrder: "sort"},
+	}
+	for i, c := range bad {
+		if o, err := NewLokiOutput(c); err == nil {
+			o.Close()
+			t.Fatalf("config %d: expected an error", i)
+		}
+	}
+	o, err := NewLokiOutput(Config{URL: "http://loki:3100", Labels: map[string]string{"src": "net.src_ip"}, AllowHighCardinality: true})
+	if err != nil {
+		t.Fatalf("allowHighCardinality should allow the label: %v", err)
+	}
+	o.Close()
+	if o.push != "http://loki:3100"+pushPath {
+		t.Fatalf("unexpected push URL %s", o.push)
+	}
+}
@@ -0,0 +1,199 @@
+package otlplogs
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bibbl/pkg/outputs"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// severityNumbers maps the levels bibbl's parsers normalize to (critical,
+// high, medium, low, debug), syslog keywords and OpenTelemetry's short
+// names to OTLP severity numbers, following the spec's syslog mapping.
+var severityNumbers = map[string]logspb.SeverityNumber{
+	"trace": logspb.SeverityNumber_SEVERITY_NUMBER_TRACE,
+	"debug": logspb.SeverityNumber_SEVERITY_NUMBER_DEBUG,
+	"info":  logspb.SeverityNumber_SEVERITY_NUMBER_INFO, "informational": logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+	"information": logspb.SeverityNumber_SEVERITY_NUMBER_INFO, "low": logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+	"notice": logspb.SeverityNumber_SEVERITY_NUMBER_INFO2,
+	"warn":   logspb.SeverityNumber_SEVERITY_NUMBER_WARN, "warning": logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+	"medium": logspb.SeverityNumber_SEVERITY_NUMBER_WARN,
+	"err":    logspb.SeverityNumber_SEVERITY_NUMBER_ERROR, "error": logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	"high":  logspb.SeverityNumber_SEVERITY_NUMBER_ERROR,
+	"crit":  logspb.SeverityNumber_SEVERITY_NUMBER_ERROR2,
+	"alert": logspb.SeverityNumber_SEVERITY_NUMBER_ERROR3,
+	"fatal": logspb.SeverityNumber_SEVERITY_NUMBER_FATAL, "critical": logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	"emerg": logspb.SeverityNumber_SEVERITY_NUMBER_FATAL, "emergency": logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+	"panic": logspb.SeverityNumber_SEVERITY_NUMBER_FATAL,
+}
+
+// syslogSeverities maps numeric syslog severities 0-7.
+var syslogSeverities = [8]string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+func severity(v interface{}) (logspb.SeverityNumber, string) {
+	var text string
+	switch t := v.(type) {
+	case nil:
+		return logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED, ""
+	case string:
+		text = t
+	default:
+		text = fmt.Sprint(t)
+	}
+	key := strings.ToLower(strings.TrimSpace(text))
+	if n, err := strconv.Atoi(key); err == nil && n >= 0 && n < len(syslogSeverities) {
+		key = syslogSeverities[n]
+	}
+	return severityNumbers[key], text
+}
+
+// request converts a batch to one export request, grouping records by
+// their resource attributes.
+func (o *OTLPOutput) request(events []map[string]interface{}) *collogspb.ExportLogsServiceRequest {
+	req := &collogspb.ExportLogsServiceRequest{}
+	byResource := map[string]*logspb.ScopeLogs{}
+	now := uint64(time.Now().UnixNano())
+	for _, ev := range events {
+		attrs := make([]*commonpb.KeyValue, 0, len(o.static)+len(o.resourceFields))
+		attrs = append(attrs, o.static...)
+		var key strings.Builder
+		for _, rf := range o.resourceFields {
+			v := outputs.FieldString(ev, rf.field)
+			if v == "" {
+				continue
+			}
+			attrs = append(attrs, &commonpb.KeyValue{Key: rf.attr, Value: stringValue(v)})
+			key.WriteString(rf.attr)
+			key.WriteByte('=')
+			key.WriteString(v)
+			key.WriteByte(0)
+		}
+		scope := byResource[key.String()]
+		if scope == nil {
+			scope = &logspb.ScopeLogs{Scope: &commonpb.InstrumentationScope{Name: "bibbl"}}
+			byResource[key.String()] = scope
+			req.ResourceLogs = append(req.ResourceLogs, &logspb.ResourceLogs{
+				Resource:  &resourcepb.Resource{Attributes: attrs},
+				ScopeLogs: []*logspb.ScopeLogs{scope},
+			})
+		}
+		scope.LogRecords = append(scope.LogRecords, o.record(ev, now))
+	}
+	return req
+}
+
+func (o *OTLPOutput) record(ev map[string]interface{}, now uint64) *logspb.LogRecord {
+	rec := &logspb.LogRecord{ObservedTimeUnixNano: now}
+	if ts, ok := outputs.EventTime(ev, o.cfg.TimeField); ok {
+		rec.TimeUnixNano = uint64(ts.UnixNano())
+	}
+	if v, ok := outputs.Field(ev, o.cfg.SeverityField); ok {
+		rec.SeverityNumber, rec.SeverityText = severity(v)
+	}
+	if v, ok := outputs.Field(ev, o.cfg.BodyField); ok {
+		rec.Body = anyValue(v)
+	}
+	keys := make([]string, 0, len(ev))
+	for k := range ev {
+		if !o.skip[k] && !strings.HasPrefix(k, "_") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v := anyValue(ev[k]); v != nil {
+			rec.Attributes = append(rec.Attributes, &commonpb.KeyValue{Key: k, Value: v})
+		}
+	}
+	return rec
+}
+
+func stringValue(s string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+}
+
+// anyValue converts a field value. Whole numbers, which arrive as float64
+// from JSON, become integers; nil values are left out.
+func anyValue(v interface{}) *commonpb.AnyValue {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return stringValue(t)
+	case bool:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: t}}
+	case int:
+		return intValue(int64(t))
+	case int32:
+		return intValue(int64(t))
+	case int64:
+		return intValue(t)
+	case uint32:
+		return intValue(int64(t))
+	case float32:
+		return floatValue(float64(t))
+	case float64:
+		return floatValue(t)
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return intValue(n)
+		}
+		f, _ := t.Float64()
+		return floatValue(f)
+	case []byte:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BytesValue{BytesValue: t}}
+	case time.Time:
+		return stringValue(t.UTC().Format(time.RFC3339Nano))
+	case []string:
+		vals := make([]*commonpb.AnyValue, 0, len(t))
+		for _, s := range t {
+			vals = append(vals, stringValue(s))
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: vals}}}
+	case []interface{}:
+		vals := make([]*commonpb.AnyValue, 0, len(t))
+		for _, e := range t {
+			if av := anyValue(e); av != nil {
+				vals = append(vals, av)
+			}
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: vals}}}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		kvs := make([]*commonpb.KeyValue, 0, len(keys))
+		for _, k := range keys {
+			if av := anyValue(t[k]); av != nil {
+				kvs = append(kvs, &commonpb.KeyValue{Key: k, Value: av})
+			}
+		}
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: kvs}}}
+	case fmt.Stringer:
+		return stringValue(t.String())
+	}
+	return stringValue(fmt.Sprint(v))
+}
+
+func intValue(n int64) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: n}}
+}
+
+func floatValue(f float64) *commonpb.AnyValue {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return intValue(int64(f))
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: f}}
+}
@@ -0,0 +1,289 @@
+// Package otlplogs sends events to an OpenTelemetry Collector (or any OTLP
+// receiver) as OTLP log records, over gRPC or HTTP/protobuf.
+package otlplogs
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bibbl/pkg/outputs"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+)
+
+// Protocols.
+const (
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http" // HTTP/protobuf
+)
+
+// Config holds configuration for an OTLP logs destination.
+type Config struct {
+	// Endpoint is host:4317 for grpc, where https:// or a tls block turns
+	// TLS on, or an http(s) URL for http, where /v1/logs is added when the
+	// URL has no path.
+	Endpoint    string            `json:"endpoint"`
+	Protocol    string            `json:"protocol"`    // grpc (default) | http
+	Headers     map[string]string `json:"headers"`     // values may be vault:// references
+	Compression string            `json:"compression"` // gzip (default) | none
+
+	// ResourceAttributes are set on every record's resource, by default
+	// service.name=bibbl-log-stream. ResourceFields adds resource
+	// attributes from event fields (default host.name from "host");
+	// records are grouped per resource.
+	ResourceAttributes map[string]string `json:"resourceAttributes"`
+	ResourceFields     map[string]string `json:"resourceFields"`
+
+	SeverityField string   `json:"severityField"` // default "severity", as normalized by the parsers
+	BodyField     string   `json:"bodyField"`     // default "_raw"
+	TimeField     string   `json:"timeField"`     // default "timestamp"
+	ExcludeFields []string `json:"excludeFields"` // kept out of the attributes, next to the fields above and "_" metadata
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+	TimeoutSec       int `json:"timeoutSec"`
+	MaxRetries       int `json:"maxRetries"`
+	RetryDelayMs     int `json:"retryDelayMs"`
+	RetryMaxDelayMs  int `json:"retryMaxDelayMs"`
+
+	TLS outputs.TLSConfig `json:"tls"`
+}
+
+type resourceField struct{ attr, field string }
+
+// OTLPOutput delivers batches as OTLP export requests.
+type OTLPOutput struct {
+	*outputs.Batcher
+
+	cfg            Config
+	exp            exporter
+	static         []*commonpb.KeyValue
+	resourceFields []resourceField
+	skip           map[string]bool
+
+	mu          sync.Mutex
+	exported    uint64
+	rejected    uint64
+	lastPartial string
+}
+
+// NewOTLPOutput validates cfg, applies defaults and starts the output.
+func NewOTLPOutput(cfg Config) (*OTLPOutput, error) {
+	switch cfg.Protocol = strings.ToLower(cfg.Protocol); cfg.Protocol {
+	case "":
+		cfg.Protocol = ProtocolGRPC
+	case ProtocolGRPC, ProtocolHTTP:
+	case "http/protobuf":
+		cfg.Protocol = ProtocolHTTP
+	default:
+		return nil, fmt.Errorf("protocol must be grpc or http, got %q", cfg.Protocol)
+	}
+	switch cfg.Compression = strings.ToLower(cfg.Compression); cfg.Compression {
+	case "":
+		cfg.Compression = "gzip"
+	case "gzip", "none":
+	default:
+		return nil, fmt.Errorf("compression must be gzip or none, got %q", cfg.Compression)
+	}
+	if len(cfg.ResourceAttributes) == 0 {
+		cfg.ResourceAttributes = map[string]string{"service.name": "bibbl-log-stream"}
+	}
+	if cfg.ResourceFields == nil {
+		cfg.ResourceFields = map[string]string{"host.name": "host"}
+	}
+	if cfg.SeverityField == "" {
+		cfg.SeverityField = "severity"
+	}
+	if cfg.BodyField == "" {
+		cfg.BodyField = "_raw"
+	}
+	if cfg.TimeField == "" {
+		cfg.TimeField = "timestamp"
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 10
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 5
+	}
+	if cfg.RetryDelayMs <= 0 {
+		cfg.RetryDelayMs = 500
+	}
+	if cfg.RetryMaxDelayMs <= 0 {
+		cfg.RetryMaxDelayMs = 30000
+	}
+	o := &OTLPOutput{cfg: cfg, skip: map[string]bool{cfg.SeverityField: true, cfg.BodyField: true, cfg.TimeField: true}}
+	for _, f := range cfg.ExcludeFields {
+		o.skip[f] = true
+	}
+	for k, v := range cfg.ResourceAttributes {
+		o.static = append(o.static, &commonpb.KeyValue{Key: k, Value: stringValue(v)})
+	}
+	sort.Slice(o.static, func(i, j int) bool { return o.static[i].Key < o.static[j].Key })
+	for attr, field := range cfg.ResourceFields {
+		if attr == "" || field == "" {
+			return nil, fmt.Errorf("resourceFields entries need an attribute and a field")
+		}
+		o.resourceFields = append(o.resourceFields, resourceField{attr, field})
+		o.skip[field] = true
+	}
+	sort.Slice(o.resourceFields, func(i, j int) bool { return o.resourceFields[i].attr < o.resourceFields[j].attr })
+
+	var err error
+	if cfg.Protocol == ProtocolGRPC {
+		o.exp, err = grpcFromConfig(cfg)
+	} else {
+		o.exp, err = httpFromConfig(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.Batcher = outputs.NewBatcher("otlp_logs", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.deliver)
+	return o, nil
+}
+
+// NewOutput builds an OTLPOutput from a destination config map. It is the
+// factory registered for the "otlp_logs" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewOTLPOutput(c)
+}
+
+func grpcFromConfig(cfg Config) (exporter, error) {
+	target := strings.TrimSpace(cfg.Endpoint)
+	useTLS := cfg.TLS.Configured()
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("endpoint must be host:port or an http(s) URL, got %q", cfg.Endpoint)
+		}
+		target, useTLS = u.Host, useTLS || u.Scheme == "https"
+	}
+	if target == "" {
+		return nil, fmt.Errorf("endpoint is required")
+	}
+	var tlsCfg *tls.Config
+	if useTLS {
+		var err error
+		if tlsCfg, err = cfg.TLS.Build(); err != nil {
+			return nil, err
+		}
+	}
+	return newGRPCExporter(target, tlsCfg, cfg.Headers, cfg.Compression)
+}
+
+func httpFromConfig(cfg Config) (exporter, error) {
+	u, err := url.Parse(strings.TrimSpace(cfg.Endpoint))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an absolute http(s) URL with protocol http, got %q", cfg.Endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/logs"
+	}
+	tlsCfg, err := cfg.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &httpExporter{
+		url:         u.String(),
+		headers:     cfg.Headers,
+		compression: cfg.Compression,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.TimeoutSec) * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+				TLSClientConfig:     tlsCfg,
+			},
+		},
+	}, nil
+}
+
+// deliver exports the batch, retrying what the OTLP spec calls retryable
+// with exponential backoff or the server's requested delay. A partial
+// success is final: the receiver kept the accepted records and retrying
+// would duplicate them, so the rejected count is only recorded.
+func (o *OTLPOutput) deliver(events []map[string]interface{}) error {
+	req := o.request(events)
+	delay := time.Duration(o.cfg.RetryDelayMs) * time.Millisecond
+	maxDelay := time.Duration(o.cfg.RetryMaxDelayMs) * time.Millisecond
+	var lastErr error
+	for attempt := 0; attempt <= o.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay = min(delay*2, maxDelay)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.cfg.TimeoutSec)*time.Second)
+		resp, err := o.exp.export(ctx, req)
+		cancel()
+		if err == nil {
+			o.accepted(len(events), resp.GetPartialSuccess())
+			return nil
+		}
+		r, ok := isRetryable(err)
+		if !ok {
+			return err
+		}
+		lastErr = err
+		if r.after > 0 {
+			delay = min(r.after, maxDelay)
+		}
+	}
+	return fmt.Errorf("failed after %d retries: %w", o.cfg.MaxRetries, lastErr)
+}
+
+func (o *OTLPOutput) accepted(n int, partial *collogspb.ExportLogsPartialSuccess) {
+	rejected := min(partial.GetRejectedLogRecords(), int64(n))
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.exported += uint64(n) - uint64(rejected)
+	if rejected > 0 || partial.GetErrorMessage() != "" {
+		o.rejected += uint64(rejected)
+		o.lastPartial = partial.GetErrorMessage()
+		log.Printf("otlp_logs: receiver rejected %d of %d records: %s", rejected, n, partial.GetErrorMessage())
+	}
+}
+
+// Health adds the export counters to the delivery health.
+func (o *OTLPOutput) Health() outputs.Health {
+	h := o.Batcher.Health()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	d := map[string]interface{}{
+		"protocol": o.cfg.Protocol,
+		"exported": o.exported,
+		"rejected": o.rejected,
+	}
+	if o.lastPartial != "" {
+		d["lastPartialError"] = o.lastPartial
+	}
+	h.Details = map[string]interface{}{"otlp": d}
+	return h
+}
+
+// Close flushes pending events and closes the connection.
+func (o *OTLPOutput) Close() error {
+	err := o.Batcher.Close()
+	if cerr := o.exp.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
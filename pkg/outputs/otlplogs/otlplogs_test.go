@@ -0,0 +1,247 @@
+package otlplogs
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bibbl/pkg/outputs"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// fakeCollector answers Export from a script: each call takes the next
+// error, if any, and is otherwise accepted with the configured partial
+// success.
+type fakeCollector struct {
+	collogspb.UnimplementedLogsServiceServer
+	mu       sync.Mutex
+	errs     []error
+	partial  *collogspb.ExportLogsPartialSuccess
+	requests []*collogspb.ExportLogsServiceRequest
+	md       []metadata.MD
+}
+
+func (f *fakeCollector) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.md = append(f.md, md)
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	f.requests = append(f.requests, req)
+	return &collogspb.ExportLogsServiceResponse{PartialSuccess: f.partial}, nil
+}
+
+func startCollector(t *testing.T, f *fakeCollector) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	collogspb.RegisterLogsServiceServer(srv, f)
+	go func() { _ = srv.Serve(ln) }()
+	t.Cleanup(srv.Stop)
+	return ln.Addr().String()
+}
+
+func attrs(kvs []*commonpb.KeyValue) map[string]*commonpb.AnyValue {
+	m := map[string]*commonpb.AnyValue{}
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+var events = []map[string]interface{}{
+	{
+		"timestamp": "2024-05-01T10:00:00Z", "host": "fw-1", "severity": "high", "_raw": "<131>deny tcp",
+		"_parser": "versa_kvp", "src_ip": "10.0.0.1", "dst_port": float64(443), "ratio": 0.5,
+		"blocked": true, "tags": []interface{}{"a", "b"}, "geo": map[string]interface{}{"country": "NL"},
+	},
+	{"timestamp": "2024-05-01T10:00:01Z", "host": "fw-2", "severity": "low", "_raw": "allow udp"},
+	{"host": "fw-1", "severity": "6", "message": "no raw"},
+}
+
+func TestExportsOverGRPCWithRetries(t *testing.T) {
+	f := &fakeCollector{
+		errs:    []error{status.Error(codes.Unavailable, "collector restarting")},
+		partial: &collogspb.ExportLogsPartialSuccess{RejectedLogRecords: 1, ErrorMessage: "attribute limit"},
+	}
+	addr := startCollector(t, f)
+	out, err := NewOTLPOutput(Config{Endpoint: addr, Headers: map[string]string{"x-tenant": "noc"}, RetryDelayMs: 1})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	if err := out.SendBatch(events); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(f.requests) != 1 || len(f.md) != 2 || f.md[1].Get("x-tenant")[0] != "noc" {
+		t.Fatalf("expected one retried export with headers, got %d requests, metadata %v", len(f.requests), f.md)
+	}
+	rls := f.requests[0].ResourceLogs
+	if len(rls) != 2 {
+		t.Fatalf("expected records grouped per host, got %d resources", len(rls))
+	}
+	res := attrs(rls[0].Resource.Attributes)
+	if res["service.name"].GetStringValue() != "bibbl-log-stream" || res["host.name"].GetStringValue() != "fw-1" {
+		t.Fatalf("unexpected resource %v", rls[0].Resource.Attributes)
+	}
+	recs := rls[0].ScopeLogs[0].LogRecords
+	if len(recs) != 2 || rls[0].ScopeLogs[0].Scope.Name != "bibbl" {
+		t.Fatalf("expected fw-1's two records in scope bibbl, got %d", len(recs))
+	}
+	r := recs[0]
+	if r.TimeUnixNano != uint64(time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC).UnixNano()) || r.ObservedTimeUnixNano == 0 {
+		t.Fatalf("unexpected times %d/%d", r.TimeUnixNano, r.ObservedTimeUnixNano)
+	}
+	if r.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_ERROR || r.SeverityText != "high" || r.Body.GetStringValue() != "<131>deny tcp" {
+		t.Fatalf("unexpected severity/body %v %q %v", r.SeverityNumber, r.SeverityText, r.Body)
+	}
+	a := attrs(r.Attributes)
+	for _, k := range []string{"timestamp", "host", "severity", "_raw", "_parser"} {
+		if _, ok := a[k]; ok {
+			t.Fatalf("attribute %q should be left out", k)
+		}
+	}
+	if a["src_ip"].GetStringValue() != "10.0.0.1" || a["dst_port"].GetIntValue() != 443 || a["ratio"].GetDoubleValue() != 0.5 ||
+		!a["blocked"].GetBoolValue() || len(a["tags"].GetArrayValue().GetValues()) != 2 ||
+		a["geo"].GetKvlistValue().GetValues()[0].Value.GetStringValue() != "NL" {
+		t.Fatalf("unexpected attributes %v", r.Attributes)
+	}
+	if n := recs[1].SeverityNumber; n != logspb.SeverityNumber_SEVERITY_NUMBER_INFO || recs[1].Body != nil || recs[1].TimeUnixNano != 0 {
+		t.Fatalf("unexpected third record %v", recs[1])
+	}
+	if rls[1].ScopeLogs[0].LogRecords[0].SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_INFO {
+		t.Fatalf("expected low to map to INFO")
+	}
+	d := out.Health().Details["otlp"].(map[string]interface{})
+	if d["exported"] != uint64(2) || d["rejected"] != uint64(1) || d["lastPartialError"] != "attribute limit" {
+		t.Fatalf("unexpected health details %v", d)
+	}
+}
+
+func TestGRPCStatusClassification(t *testing.T) {
+	withInfo, _ := status.New(codes.ResourceExhausted, "slow down").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Millisecond)})
+	f := &fakeCollector{errs: []error{withInfo.Err()}}
+	addr := startCollector(t, f)
+	out, err := NewOTLPOutput(Config{Endpoint: "http://" + addr, Compression: "none", RetryDelayMs: 1})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	if err := out.SendBatch(events[:1]); err != nil || len(f.requests) != 1 {
+		t.Fatalf("RESOURCE_EXHAUSTED with RetryInfo should be retried: %v", err)
+	}
+	f.errs = []error{status.Error(codes.ResourceExhausted, "quota")}
+	if _, permanent := outputs.IsPermanent(out.SendBatch(events[:1])); !permanent {
+		t.Fatalf("RESOURCE_EXHAUSTED without RetryInfo should be final")
+	}
+	f.errs = []error{status.Error(codes.Unauthenticated, "bad token")}
+	err = out.SendBatch(events[:1])
+	if _, permanent := outputs.IsPermanent(err); err == nil || permanent || len(f.md) != 4 {
+		t.Fatalf("UNAUTHENTICATED should fail without retrying or dead-lettering: %v", err)
+	}
+}
+
+func TestExportsOverHTTPWithTLS(t *testing.T) {
+	var mu sync.Mutex
+	var calls int
+	var got *collogspb.ExportLogsServiceRequest
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "bad request line", http.StatusBadRequest)
+			return
+		}
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(zr)
+		got = &collogspb.ExportLogsServiceRequest{}
+		if err := proto.Unmarshal(body, got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if calls == 3 {
+			st, _ := proto.Marshal(status.New(codes.InvalidArgument, "malformed").Proto())
+			w.Header().Set("Content-Type", "application/x-protobuf")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write(st)
+			return
+		}
+		resp, _ := proto.Marshal(&collogspb.ExportLogsServiceResponse{})
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		_, _ = w.Write(resp)
+	}))
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	out, err := NewOTLPOutput(Config{
+		Endpoint:     srv.URL,
+		Protocol:     "http/protobuf",
+		Headers:      map[string]string{"Authorization": "Bearer tok"},
+		RetryDelayMs: 1,
+		TLS:          outputs.TLSConfig{CAPEM: string(ca)},
+	})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	if err := out.SendBatch(events); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if calls != 2 || got == nil || len(got.ResourceLogs) != 2 {
+		t.Fatalf("expected a retried export of two resources, got %d calls", calls)
+	}
+	err = out.SendBatch(events[:1])
+	if _, permanent := outputs.IsPermanent(err); !permanent || !strings.Contains(err.Error(), "malformed") {
+		t.Fatalf("expected a permanent error carrying the status message, got %v", err)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	bad := []Config{
+		{},
+		{Endpoint: "collector:4317", Protocol: "thrift"},
+		{Endpoint: "collector:4317", Compression: "zstd"},
+		{Endpoint: "collector:4318", Protocol: "http"},
+		{Endpoint: "ftp://collector:4317"},
+	}
+	for i, c := range bad {
+		if o, err := NewOTLPOutput(c); err == nil {
+			o.Close()
+			t.Fatalf("config %d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package otlplogs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"bibbl/pkg/outputs"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	grpcgzip "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// exporter sends one export request over a transport.
+type exporter interface {
+	export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error)
+	close() error
+}
+
+// retryable marks an error the OTLP spec says to retry, with the delay the
+// server asked for, if any.
+type retryable struct {
+	err   error
+	after time.Duration
+}
+
+func (e *retryable) Error() string { return e.err.Error() }
+func (e *retryable) Unwrap() error { return e.err }
+
+// grpcExporter calls LogsService/Export.
+type grpcExporter struct {
+	conn   *grpc.ClientConn
+	client collogspb.LogsServiceClient
+	md     metadata.MD
+	opts   []grpc.CallOption
+}
+
+func newGRPCExporter(target string, tlsCfg *tls.Config, headers map[string]string, compression string) (*grpcExporter, error) {
+	creds := insecure.NewCredentials()
+	if tlsCfg != nil {
+		creds = credentials.NewTLS(tlsCfg)
+	}
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("otlp grpc %s: %w", target, err)
+	}
+	e := &grpcExporter{conn: conn, client: collogspb.NewLogsServiceClient(conn), md: metadata.New(headers)}
+	if compression == "gzip" {
+		e.opts = append(e.opts, grpc.UseCompressor(grpcgzip.Name))
+	}
+	return e, nil
+}
+
+func (e *grpcExporter) export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	resp, err := e.client.Export(metadata.NewOutgoingContext(ctx, e.md), req, e.opts...)
+	if err != nil {
+		return nil, classifyGRPC(err)
+	}
+	return resp, nil
+}
+
+func (e *grpcExporter) close() error { return e.conn.Close() }
+
+// classifyGRPC sorts status codes the way the OTLP spec does: transient
+// codes are retried, RESOURCE_EXHAUSTED only when the server sent
+// RetryInfo, and the rest are final. Authentication failures are a
+// configuration problem, so like other outputs they leave the events
+// queued rather than dead-lettered.
+func classifyGRPC(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return &retryable{err: err}
+	}
+	after, hasInfo := retryDelay(st.Proto())
+	switch st.Code() {
+	case codes.Canceled, codes.DeadlineExceeded, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss:
+		return &retryable{err: err, after: after}
+	case codes.ResourceExhausted:
+		if hasInfo {
+			return &retryable{err: err, after: after}
+		}
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return err
+	}
+	return outputs.Permanent(0, err)
+}
+
+// retryDelay reads the RetryInfo detail of a status.
+func retryDelay(st *spb.Status) (time.Duration, bool) {
+	for _, d := range st.GetDetails() {
+		var info errdetails.RetryInfo
+		if d.MessageIs(&info) && d.UnmarshalTo(&info) == nil {
+			return info.GetRetryDelay().AsDuration(), true
+		}
+	}
+	return 0, false
+}
+
+// httpExporter posts binary protobuf to the collector's /v1/logs.
+type httpExporter struct {
+	url         string
+	headers     map[string]string
+	compression string
+	client      *http.Client
+}
+
+func (e *httpExporter) export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return nil, outputs.Permanent(0, fmt.Errorf("failed to marshal export request: %w", err))
+	}
+	if e.compression == "gzip" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/x-protobuf")
+	if e.compression == "gzip" {
+		hreq.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range e.headers {
+		hreq.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(hreq)
+	if err != nil {
+		return nil, &retryable{err: err}
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		out := &collogspb.ExportLogsServiceResponse{}
+		if len(respBody) > 0 && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-protobuf") {
+			if err := proto.Unmarshal(respBody, out); err != nil {
+				return nil, fmt.Errorf("otlp http %s: decode response: %w", e.url, err)
+			}
+		}
+		return out, nil
+	}
+	// Error bodies are a google.rpc.Status when the server follows the
+	// spec; fall back to the raw text otherwise.
+	msg := strings.TrimSpace(string(respBody))
+	var st spb.Status
+	if proto.Unmarshal(respBody, &st) == nil && st.GetMessage() != "" {
+		msg = st.GetMessage()
+	}
+	err = fmt.Errorf("otlp http %s returned status %d: %s", e.url, resp.StatusCode, msg)
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		r := &retryable{err: err}
+		if secs, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && secs > 0 {
+			r.after = time.Duration(secs) * time.Second
+		}
+		return nil, r
+	}
+	return nil, outputs.HTTPError(resp.StatusCode, err)
+}
+
+func (e *httpExporter) close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+func isRetryable(err error) (*retryable, bool) {
+	var r *retryable
+	ok := errors.As(err, &r)
+	return r, ok
+}
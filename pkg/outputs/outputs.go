@@ -0,0 +1,173 @@
+package outputs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Output is a running destination instance that accepts processed events.
+// Implementations are expected to batch internally; Send should not block on
+// network I/O for longer than it takes to hand the event off.
+type Output interface {
+	Send(event map[string]interface{}) error
+	Flush() error
+	Close() error
+	Health() Health
+}
+
+// BatchSender is implemented by outputs that can deliver a batch
+// synchronously. A nil error means the destination acknowledged every event,
+// which is what lets a durable queue release them.
+type BatchSender interface {
+	SendBatch(events []map[string]interface{}) error
+}
+
+// PermanentError marks a batch the destination rejected outright (a 4xx
+// such as a schema error). Retrying will not help, so the events go to the
+// destination's dead-letter store instead of being retried.
+type PermanentError struct {
+	Status int // HTTP status or protocol code, 0 when not applicable
+	Err    error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent wraps err as a PermanentError.
+func Permanent(status int, err error) error {
+	return &PermanentError{Status: status, Err: err}
+}
+
+// IsPermanent reports whether err (or anything it wraps) is a PermanentError.
+func IsPermanent(err error) (*PermanentError, bool) {
+	var pe *PermanentError
+	ok := errors.As(err, &pe)
+	return pe, ok
+}
+
+// DeadLetterFunc receives events an output gave up on, with the reason.
+type DeadLetterFunc func(events []map[string]interface{}, err error)
+
+// DeadLetterer is implemented by outputs that deliver in the background and
+// can hand events they give up on to a dead-letter store instead of
+// dropping them.
+type DeadLetterer interface {
+	SetDeadLetter(fn DeadLetterFunc)
+}
+
+// BackgroundSender is implemented by outputs that deliver batches from Send
+// in the background. SetBackgroundSender routes those deliveries through fn
+// instead of the output's own SendBatch, so a wrapper such as a circuit
+// breaker sees their results; fn must end up calling the output's SendBatch.
+type BackgroundSender interface {
+	SetBackgroundSender(fn func(events []map[string]interface{}) error)
+}
+
+// Status values reported by Health. They mirror the destination states the UI
+// already understands.
+const (
+	StatusConnected    = "connected"
+	StatusDisconnected = "disconnected"
+	StatusError        = "error"
+)
+
+// Health is a point-in-time view of an output's delivery state.
+type Health struct {
+	Status      string    `json:"status"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastErrorAt time.Time `json:"lastErrorAt,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess,omitempty"`
+	Sent        uint64    `json:"sent"`
+	Failed      uint64    `json:"failed"`
+	// Details carries output-specific state, such as the outcome of
+	// asynchronous ingestion.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Factory builds an Output from a destination's free-form config map.
+type Factory func(cfg map[string]interface{}) (Output, error)
+
+// Registry maps destination types (memDest.Type) to output factories.
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[string]Factory
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{factories: map[string]Factory{}}
+}
+
+// Register adds (or replaces) the factory for a destination type.
+func (r *Registry) Register(typ string, f Factory) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[strings.ToLower(strings.TrimSpace(typ))] = f
+}
+
+// Has reports whether a factory is registered for the type.
+func (r *Registry) Has(typ string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.factories[strings.ToLower(strings.TrimSpace(typ))]
+	return ok
+}
+
+// Types lists the registered destination types in sorted order.
+func (r *Registry) Types() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]string, 0, len(r.factories))
+	for k := range r.factories {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// New builds an output for the given type, resolving vault:// references in
+// cfg first.
+func (r *Registry) New(typ string, cfg map[string]interface{}) (Output, error) {
+	if r == nil {
+		return nil, fmt.Errorf("no output registry")
+	}
+	r.mu.RLock()
+	f, ok := r.factories[strings.ToLower(strings.TrimSpace(typ))]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no output registered for type %q", typ)
+	}
+	resolved, err := resolveRefs(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return f(resolved)
+}
+
+// DecodeConfig converts a destination config map into a typed config struct
+// using its json tags. Numbers that arrive as float64 from the REST API and
+// ints from seeded defaults both decode cleanly.
+func DecodeConfig(cfg map[string]interface{}, out interface{}) error {
+	if cfg == nil {
+		cfg = map[string]interface{}{}
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("encode destination config: %w", err)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("decode destination config: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// tReader decodes Thrift compact structs into maps keyed by field id, which
+// is all the tests need to walk the footer and page headers.
+type tReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *tReader) byte() byte {
+	c := r.b[r.pos]
+	r.pos++
+	return c
+}
+
+func (r *tReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *tReader) varint() int64 {
+	v, n := binary.Varint(r.b[r.pos:])
+	r.pos += n
+	return v
+}
+
+func (r *tReader) readStruct() map[int16]interface{} {
+	m := map[int16]interface{}{}
+	var last int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return m
+		}
+		if d := h >> 4; d != 0 {
+			last += int16(d)
+		} else {
+			last = int16(r.varint())
+		}
+		m[last] = r.value(h & 0x0f)
+	}
+}
+
+func (r *tReader) value(typ byte) interface{} {
+	switch typ {
+	case ctTrue:
+		return true
+	case ctFalse:
+		return false
+	case ctI32, ctI64:
+		return r.varint()
+	case ctBinary:
+		n := int(r.uvarint())
+		v := r.b[r.pos : r.pos+n]
+		r.pos += n
+		return v
+	case ctList:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case ctStruct:
+		return r.readStruct()
+	}
+	panic(fmt.Sprintf("unexpected thrift type %d", typ))
+}
+
+func field(m interface{}, ids ...int16) interface{} {
+	for _, id := range ids {
+		m = m.(map[int16]interface{})[id]
+	}
+	return m
+}
+
+type parsed struct {
+	meta   map[int16]interface{}
+	names  []string
+	phys   []int64
+	groups [][]map[string]interface{}
+}
+
+// readFile decodes a file written by Writer back into rows, one slice per
+// row group. Timestamps come back as int64 microseconds.
+func readFile(t *testing.T, data []byte) parsed {
+	t.Helper()
+	if !bytes.HasPrefix(data, magic) || !bytes.HasSuffix(data, magic) {
+		t.Fatalf("missing PAR1 magic")
+	}
+	n := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	fr := &tReader{b: data[len(data)-8-n : len(data)-8]}
+	p := parsed{meta: fr.readStruct()}
+	if fr.pos != n {
+		t.Fatalf("footer decoded %d of %d bytes", fr.pos, n)
+	}
+	for _, el := range p.meta[2].([]interface{})[1:] {
+		p.names = append(p.names, string(field(el, 4).([]byte)))
+		p.phys = append(p.phys, field(el, 1).(int64))
+	}
+	for _, g := range p.meta[4].([]interface{}) {
+		rows := make([]map[string]interface{}, field(g, 3).(int64))
+		for i := range rows {
+			rows[i] = map[string]interface{}{}
+		}
+		for ci, cc := range field(g, 1).([]interface{}) {
+			md := field(cc, 3)
+			r := &tReader{b: data, pos: int(field(md, 9).(int64))}
+			row := 0
+			for row < len(rows) {
+				ph := r.readStruct()
+				body := data[r.pos : r.pos+int(ph[3].(int64))]
+				r.pos += len(body)
+				payload := decompress(t, field(md, 4).(int64), body)
+				if int64(len(payload)) != ph[2].(int64) {
+					t.Fatalf("page size %d, header says %d", len(payload), ph[2])
+				}
+				count := int(field(ph, 5, 1).(int64))
+				ln := int(binary.LittleEndian.Uint32(payload))
+				defs := decodeLevels(payload[4:4+ln], count)
+				vals := payload[4+ln:]
+				bit := 0
+				for _, d := range defs {
+					if d == 1 {
+						var v interface{}
+						switch p.phys[ci] {
+						case physBoolean:
+							v = vals[bit/8]>>(bit%8)&1 == 1
+							bit++
+						case physInt64:
+							v = int64(binary.LittleEndian.Uint64(vals))
+							vals = vals[8:]
+						case physDouble:
+							v = math.Float64frombits(binary.LittleEndian.Uint64(vals))
+							vals = vals[8:]
+						case physByteArray:
+							l := binary.LittleEndian.Uint32(vals)
+							v = string(vals[4 : 4+l])
+							vals = vals[4+l:]
+						}
+						rows[row][p.names[ci]] = v
+					}
+					row++
+				}
+			}
+		}
+		p.groups = append(p.groups, rows)
+	}
+	return p
+}
+
+func decompress(t *testing.T, codec int64, b []byte) []byte {
+	t.Helper()
+	var out []byte
+	var err error
+	switch codec {
+	case codecNone:
+		return b
+	case codecSnappy:
+		out, err = snappy.Decode(nil, b)
+	case codecZstd:
+		var dec *zstd.Decoder
+		if dec, err = zstd.NewReader(nil); err == nil {
+			out, err = dec.DecodeAll(b, nil)
+			dec.Close()
+		}
+	case codecGzip:
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(bytes.NewReader(b)); err == nil {
+			out, err = io.ReadAll(zr)
+		}
+	}
+	if err != nil {
+		t.Fatalf("decompress codec %d: %v", codec, err)
+	}
+	return out
+}
+
+func decodeLevels(b []byte, n int) []byte {
+	r := &tReader{b: b}
+	var out []byte
+	for len(out) < n {
+		h := r.uvarint()
+		if h&1 == 1 {
+			for g := 0; g < int(h>>1); g++ {
+				c := r.byte()
+				for k := 0; k < 8; k++ {
+					out = append(out, c>>k&1)
+				}
+			}
+			continue
+		}
+		v := r.byte()
+		for k := 0; k < int(h>>1); k++ {
+			out = append(out, v)
+		}
+	}
+	return out[:n]
+}
+
+func TestWriterRoundTrip(t *testing.T) {
+	events := []map[string]interface{}{
+		{"timestamp": "2024-05-01T10:00:00Z", "bytes": json.Number("1500"), "ratio": 0.5, "allowed": true, "src": "10.0.0.1", "tags": []interface{}{"a"}},
+		{"timestamp": "2024-05-01T10:00:01.5Z", "bytes": json.Number("42"), "ratio": json.Number("2"), "allowed": false},
+		{"timestamp": "not a time", "bytes": "n/a", "src": "10.0.0.2", "new": "field"},
+	}
+	schema := InferSchema(events[:2], nil)
+	want := map[string]Type{"allowed": Bool, "bytes": Int64, "ratio": Double, "src": String, "tags": JSON, "timestamp": Timestamp}
+	if len(schema.Columns) != len(want) {
+		t.Fatalf("unexpected columns %+v", schema.Columns)
+	}
+	for _, c := range schema.Columns {
+		if want[c.Name] != c.Type {
+			t.Fatalf("column %s: got %s, want %s", c.Name, c.Type, want[c.Name])
+		}
+	}
+	for _, codec := range []string{"snappy", "zstd", "gzip", "none"} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, schema, Options{Compression: codec})
+		if err != nil {
+			t.Fatalf("%s: new writer: %v", codec, err)
+		}
+		for _, ev := range events {
+			if err := w.Write(ev); err != nil {
+				t.Fatalf("%s: write: %v", codec, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("%s: close: %v", codec, err)
+		}
+		p := readFile(t, buf.Bytes())
+		if p.meta[3].(int64) != 3 || len(p.groups) != 1 {
+			t.Fatalf("%s: expected 3 rows in one row group, got %v rows", codec, p.meta[3])
+		}
+		if last := p.names[len(p.names)-1]; last != ExtraColumn {
+			t.Fatalf("%s: last column is %q", codec, last)
+		}
+		rows := p.groups[0]
+		ts := time.Date(2024, 5, 1, 10, 0, 1, 500e6, time.UTC).UnixMicro()
+		if rows[1]["timestamp"] != ts || rows[0]["bytes"] != int64(1500) || rows[1]["ratio"] != 2.0 ||
+			rows[1]["allowed"] != false || rows[0]["tags"] != `["a"]` {
+			t.Fatalf("%s: unexpected rows %v", codec, rows[:2])
+		}
+		if _, ok := rows[1][ExtraColumn]; ok {
+			t.Fatalf("%s: row without extra fields has %s", codec, ExtraColumn)
+		}
+		var extra map[string]interface{}
+		if err := json.Unmarshal([]byte(rows[2][ExtraColumn].(string)), &extra); err != nil {
+			t.Fatalf("%s: %s: %v", codec, ExtraColumn, err)
+		}
+		if extra["new"] != "field" || extra["bytes"] != "n/a" || extra["timestamp"] != "not a time" || rows[2]["bytes"] != nil {
+			t.Fatalf("%s: mismatched and unknown fields should go to %s, got %v / %v", codec, ExtraColumn, extra, rows[2])
+		}
+	}
+}
+
+func TestWriterSplitsRowGroupsAndPages(t *testing.T) {
+	schema := &Schema{Columns: []Column{{"n", Int64}, {"sparse", String}, {"flag", Bool}}}
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, schema, Options{RowGroupBytes: 8 << 10, PageBytes: 1 << 10})
+	if err != nil {
+		t.Fatalf("new writer: %v", err)
+	}
+	for i := 0; i < 3000; i++ {
+		ev := map[string]interface{}{"n": i, "flag": i%3 == 0}
+		if i%2 == 0 || (i > 1000 && i < 1100) {
+			ev["sparse"] = fmt.Sprint("v", i)
+		}
+		if err := w.Write(ev); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	p := readFile(t, buf.Bytes())
+	if len(p.groups) < 2 {
+		t.Fatalf("expected several row groups, got %d", len(p.groups))
+	}
+	i := 0
+	for gi, rows := range p.groups {
+		stats := field(p.meta[4].([]interface{})[gi], 1).([]interface{})[0]
+		lo := binary.LittleEndian.Uint64(field(stats, 3, 12, 6).([]byte))
+		hi := binary.LittleEndian.Uint64(field(stats, 3, 12, 5).([]byte))
+		if int(lo) != i || int(hi) != i+len(rows)-1 {
+			t.Fatalf("row group %d: stats [%d, %d], want [%d, %d]", gi, lo, hi, i, i+len(rows)-1)
+		}
+		for _, row := range rows {
+			wantSparse := i%2 == 0 || (i > 1000 && i < 1100)
+			if row["n"] != int64(i) || row["flag"] != (i%3 == 0) || (row["sparse"] != nil) != wantSparse {
+				t.Fatalf("row %d: got %v", i, row)
+			}
+			i++
+		}
+	}
+	if i != 3000 {
+		t.Fatalf("read back %d rows, want 3000", i)
+	}
+}
+
+func TestFieldSetSchema(t *testing.T) {
+	fields, err := FieldSet("versa")
+	if err != nil {
+		t.Fatalf("field set: %v", err)
+	}
+	schema := InferSchema([]map[string]interface{}{{"sentOctets": json.Number("10"), "custom": "x"}}, fields)
+	if len(schema.Columns) != len(fields) || schema.Columns[0].Name != fields[0] {
+		t.Fatalf("expected the versa field list as columns, got %d", len(schema.Columns))
+	}
+	for _, c := range schema.Columns {
+		if c.Name == "sentOctets" && c.Type != Int64 || c.Name == "custom" {
+			t.Fatalf("unexpected column %+v", c)
+		}
+	}
+	if _, err := FieldSet("cisco"); err == nil {
+		t.Fatalf("expected an error for an unknown field set")
+	}
+}
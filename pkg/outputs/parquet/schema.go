@@ -0,0 +1,176 @@
+package parquet
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"bibbl/pkg/filters"
+)
+
+// Type is the logical type of a column.
+type Type int
+
+const (
+	String    Type = iota // UTF-8 byte array
+	Int64                 // 64-bit integer
+	Double                // 64-bit float
+	Bool                  // boolean
+	Timestamp             // INT64 microseconds since the epoch, UTC
+	JSON                  // objects and arrays, stored as JSON text
+)
+
+func (t Type) String() string {
+	switch t {
+	case Int64:
+		return "int64"
+	case Double:
+		return "double"
+	case Bool:
+		return "bool"
+	case Timestamp:
+		return "timestamp"
+	case JSON:
+		return "json"
+	}
+	return "string"
+}
+
+// ExtraColumn holds, as a JSON object, the fields of an event that have no
+// column or whose value does not fit its column's type.
+const ExtraColumn = "_extra"
+
+// Inference limits.
+const (
+	SampleSize = 1000 // events InferSchema should be given
+	MaxColumns = 512  // inferred columns; further fields go to ExtraColumn
+)
+
+// Column is one optional top-level column.
+type Column struct {
+	Name string
+	Type Type
+}
+
+// Schema is a flat list of optional columns. Writers append ExtraColumn.
+type Schema struct {
+	Columns []Column
+}
+
+// FieldSet returns the field list of a parser, for schemas that should be
+// stable across files: versa or paloalto.
+func FieldSet(name string) ([]string, error) {
+	switch strings.ToLower(name) {
+	case "versa":
+		return filters.GetCommonVersaFields(), nil
+	case "paloalto", "palo_alto", "pan":
+		return filters.GetCommonPaloAltoFields(), nil
+	}
+	return nil, fmt.Errorf("unknown parquet schema %q (want versa or paloalto)", name)
+}
+
+// InferSchema types columns from sample events. With fields, the columns
+// are exactly those fields in order; without, every field seen in the
+// sample becomes a column, sorted by name. A column whose values disagree
+// is widened: int64 to double, timestamp to string, and anything else to
+// string or JSON.
+func InferSchema(sample []map[string]interface{}, fields []string) *Schema {
+	types := map[string]Type{}
+	for _, ev := range sample {
+		for k, v := range ev {
+			t, ok := kindOf(v)
+			if !ok || k == ExtraColumn {
+				continue
+			}
+			if prev, seen := types[k]; seen {
+				t = widen(prev, t)
+			}
+			types[k] = t
+		}
+	}
+	if fields == nil {
+		for k := range types {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+		if len(fields) > MaxColumns {
+			fields = fields[:MaxColumns]
+		}
+	}
+	s := &Schema{}
+	seen := map[string]bool{ExtraColumn: true}
+	for _, f := range fields {
+		if seen[f] {
+			continue
+		}
+		seen[f] = true
+		s.Columns = append(s.Columns, Column{Name: f, Type: types[f]})
+	}
+	return s
+}
+
+// kindOf returns the column type a value would need; false for nulls.
+func kindOf(v interface{}) (Type, bool) {
+	switch x := v.(type) {
+	case nil:
+		return 0, false
+	case bool:
+		return Bool, true
+	case json.Number:
+		if _, err := x.Int64(); err == nil {
+			return Int64, true
+		}
+		return Double, true
+	case float64, float32:
+		return Double, true
+	case int, int8, int16, int32, int64, uint8, uint16, uint32:
+		return Int64, true
+	case uint, uint64:
+		if toUint(x) > math.MaxInt64 {
+			return Double, true
+		}
+		return Int64, true
+	case string:
+		if _, ok := parseTime(x); ok {
+			return Timestamp, true
+		}
+		return String, true
+	case time.Time:
+		return Timestamp, true
+	}
+	return JSON, true
+}
+
+func widen(a, b Type) Type {
+	switch {
+	case a == b:
+		return a
+	case a == JSON || b == JSON:
+		return JSON
+	case (a == Int64 && b == Double) || (a == Double && b == Int64):
+		return Double
+	}
+	return String
+}
+
+func toUint(v interface{}) uint64 {
+	switch x := v.(type) {
+	case uint:
+		return uint64(x)
+	case uint64:
+		return x
+	}
+	return 0
+}
+
+// parseTime accepts RFC 3339 timestamps, the form events are normalised to.
+func parseTime(s string) (time.Time, bool) {
+	if len(s) < 20 || s[4] != '-' || s[10] != 'T' {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	return t, err == nil
+}
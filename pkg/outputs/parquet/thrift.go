@@ -0,0 +1,98 @@
+package parquet
+
+import "encoding/binary"
+
+// Thrift compact protocol type ids.
+const (
+	ctTrue   = 1
+	ctFalse  = 2
+	ctI32    = 5
+	ctI64    = 6
+	ctBinary = 8
+	ctList   = 9
+	ctStruct = 12
+)
+
+// thrift encodes the Parquet metadata structs with the Thrift compact
+// protocol. Only the parts the writer needs are here.
+type thrift struct {
+	b     []byte
+	last  int16
+	stack []int16
+}
+
+func (t *thrift) field(id int16, typ byte) {
+	if d := id - t.last; d > 0 && d <= 15 {
+		t.b = append(t.b, byte(d)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = binary.AppendVarint(t.b, int64(id))
+	}
+	t.last = id
+}
+
+func (t *thrift) i32(id int16, v int32) {
+	t.field(id, ctI32)
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *thrift) i64(id int16, v int64) {
+	t.field(id, ctI64)
+	t.b = binary.AppendVarint(t.b, v)
+}
+
+func (t *thrift) binary(id int16, v []byte) {
+	t.field(id, ctBinary)
+	t.b = binary.AppendUvarint(t.b, uint64(len(v)))
+	t.b = append(t.b, v...)
+}
+
+func (t *thrift) str(id int16, s string) { t.binary(id, []byte(s)) }
+
+func (t *thrift) boolean(id int16, v bool) {
+	if v {
+		t.field(id, ctTrue)
+	} else {
+		t.field(id, ctFalse)
+	}
+}
+
+// structBegin starts a struct field; close it with structEnd.
+func (t *thrift) structBegin(id int16) {
+	t.field(id, ctStruct)
+	t.push()
+}
+
+// elemBegin starts a struct list element; close it with structEnd.
+func (t *thrift) elemBegin() { t.push() }
+
+func (t *thrift) push() {
+	t.stack = append(t.stack, t.last)
+	t.last = 0
+}
+
+func (t *thrift) structEnd() {
+	t.b = append(t.b, 0)
+	t.last = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+// end terminates the top-level struct.
+func (t *thrift) end() { t.b = append(t.b, 0) }
+
+func (t *thrift) list(id int16, elem byte, n int) {
+	t.field(id, ctList)
+	if n < 15 {
+		t.b = append(t.b, byte(n)<<4|elem)
+	} else {
+		t.b = append(t.b, 0xF0|elem)
+		t.b = binary.AppendUvarint(t.b, uint64(n))
+	}
+}
+
+func (t *thrift) elemI32(v int32) { t.b = binary.AppendVarint(t.b, int64(v)) }
+
+func (t *thrift) elemString(s string) {
+	t.b = binary.AppendUvarint(t.b, uint64(len(s)))
+	t.b = append(t.b, s...)
+}
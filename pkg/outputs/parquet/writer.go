@@ -0,0 +1,634 @@
+// Package parquet writes events as Parquet files for the archive outputs.
+// Columns are flat and optional, typed from a parser field list or from the
+// first events of a file; fields without a column, and values that do not
+// fit their column, are kept as JSON in the ExtraColumn so nothing is lost.
+//
+// Only what archiving needs is implemented: PLAIN values, RLE definition
+// levels, data page v1, snappy/zstd/gzip page compression and column chunk
+// statistics.
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Options tune a Writer.
+type Options struct {
+	// Compression of the data pages: snappy (default), zstd, gzip or none.
+	Compression string
+	// RowGroupBytes is the uncompressed size at which a row group is
+	// written out. Readers split work and skip data by row group.
+	RowGroupBytes int64
+	// PageBytes is the uncompressed size of a data page.
+	PageBytes int
+}
+
+// Defaults.
+const (
+	DefaultRowGroupBytes = 32 << 20
+	DefaultPageBytes     = 1 << 20
+)
+
+var magic = []byte("PAR1")
+
+// Parquet format enum values used by the writer.
+const (
+	physBoolean   = 0
+	physInt64     = 2
+	physDouble    = 5
+	physByteArray = 6
+
+	repOptional = 1
+
+	convUTF8            = 0
+	convTimestampMicros = 10
+
+	encPlain = 0
+	encRLE   = 3
+
+	codecNone   = 0
+	codecSnappy = 1
+	codecGzip   = 2
+	codecZstd   = 6
+
+	pageData = 0
+)
+
+// Writer writes events as rows of one Parquet file.
+type Writer struct {
+	w          io.Writer
+	off        int64
+	opts       Options
+	codec      int32
+	compress   func([]byte) []byte
+	closeCodec func()
+
+	cols  []*column // schema columns, then ExtraColumn
+	index map[string]int
+
+	rows     int64 // in the current row group
+	buffered int64 // uncompressed bytes in the current row group
+	total    int64
+	groups   []rowGroup
+	err      error
+}
+
+type rowGroup struct {
+	chunks                     []chunkMeta
+	offset, rows, bytes, csize int64
+}
+
+type chunkMeta struct {
+	offset, values, nulls, usize, csize int64
+	min, max                            []byte
+}
+
+// NewWriter starts a Parquet file on w with the columns of schema plus
+// ExtraColumn. Close must be called to write the footer.
+func NewWriter(w io.Writer, schema *Schema, opts Options) (*Writer, error) {
+	if opts.RowGroupBytes <= 0 {
+		opts.RowGroupBytes = DefaultRowGroupBytes
+	}
+	if opts.PageBytes <= 0 {
+		opts.PageBytes = DefaultPageBytes
+	}
+	pw := &Writer{w: w, opts: opts, index: map[string]int{}, closeCodec: func() {}}
+	switch strings.ToLower(opts.Compression) {
+	case "", "snappy":
+		pw.codec = codecSnappy
+		pw.compress = func(b []byte) []byte { return snappy.Encode(nil, b) }
+	case "zstd":
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		pw.codec = codecZstd
+		pw.compress = func(b []byte) []byte { return enc.EncodeAll(b, nil) }
+		pw.closeCodec = func() { _ = enc.Close() }
+	case "gzip":
+		pw.codec = codecGzip
+		pw.compress = func(b []byte) []byte {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			_, _ = zw.Write(b)
+			_ = zw.Close()
+			return buf.Bytes()
+		}
+	case "none":
+		pw.codec = codecNone
+		pw.compress = func(b []byte) []byte { return b }
+	default:
+		return nil, fmt.Errorf("parquet compression must be snappy, zstd, gzip or none, got %q", opts.Compression)
+	}
+	for _, c := range schema.Columns {
+		if _, dup := pw.index[c.Name]; dup || c.Name == ExtraColumn {
+			continue
+		}
+		pw.index[c.Name] = len(pw.cols)
+		pw.cols = append(pw.cols, &column{Column: c})
+	}
+	pw.cols = append(pw.cols, &column{Column: Column{Name: ExtraColumn, Type: JSON}})
+	if err := pw.write(magic); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Rows returns the number of rows written so far.
+func (w *Writer) Rows() int64 { return w.total + w.rows }
+
+// Write adds ev as a row.
+func (w *Writer) Write(ev map[string]interface{}) error {
+	if w.err != nil {
+		return w.err
+	}
+	var extra map[string]interface{}
+	n := len(w.cols) - 1
+	for _, c := range w.cols[:n] {
+		v := ev[c.Name]
+		if v == nil {
+			w.buffered += c.addNull()
+			continue
+		}
+		size, ok := c.add(v)
+		if !ok {
+			size = c.addNull()
+			if extra == nil {
+				extra = map[string]interface{}{}
+			}
+			extra[c.Name] = v
+		}
+		w.buffered += size
+	}
+	for k, v := range ev {
+		if _, known := w.index[k]; !known {
+			if extra == nil {
+				extra = map[string]interface{}{}
+			}
+			extra[k] = v
+		}
+	}
+	xc := w.cols[n]
+	if extra == nil {
+		w.buffered += xc.addNull()
+	} else if b, err := json.Marshal(extra); err != nil {
+		w.buffered += xc.addNull()
+	} else {
+		w.buffered += xc.addBytes(b)
+	}
+	w.rows++
+	for _, c := range w.cols {
+		if c.pageBytes() >= w.opts.PageBytes {
+			w.flushPage(c)
+		}
+	}
+	if w.buffered >= w.opts.RowGroupBytes {
+		return w.flushRowGroup()
+	}
+	return nil
+}
+
+// Close writes the last row group and the footer. It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	defer w.closeCodec()
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.flushRowGroup(); err != nil {
+		return err
+	}
+	meta := w.footer()
+	if err := w.write(meta); err != nil {
+		return err
+	}
+	if err := w.write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta)))); err != nil {
+		return err
+	}
+	return w.write(magic)
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.off += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// flushPage turns the buffered values of c into a compressed data page in
+// its column chunk.
+func (w *Writer) flushPage(c *column) {
+	n := len(c.defs)
+	if n == 0 {
+		return
+	}
+	levels := encodeLevels(c.defs)
+	payload := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(levels)+len(c.vals)), uint32(len(levels)))
+	payload = append(payload, levels...)
+	if c.Type == Bool {
+		payload = appendBits(payload, c.bools)
+	} else {
+		payload = append(payload, c.vals...)
+	}
+	body := w.compress(payload)
+
+	var t thrift
+	t.i32(1, pageData)
+	t.i32(2, int32(len(payload)))
+	t.i32(3, int32(len(body)))
+	t.structBegin(5)
+	t.i32(1, int32(n))
+	t.i32(2, encPlain)
+	t.i32(3, encRLE)
+	t.i32(4, encRLE)
+	t.structEnd()
+	t.end()
+	c.chunk.Write(t.b)
+	c.chunk.Write(body)
+	c.usize += int64(len(t.b) + len(payload))
+	c.values += int64(n)
+	c.defs, c.vals, c.bools = c.defs[:0], c.vals[:0], c.bools[:0]
+}
+
+func (w *Writer) flushRowGroup() error {
+	if w.rows == 0 {
+		return nil
+	}
+	g := rowGroup{offset: w.off, rows: w.rows}
+	for _, c := range w.cols {
+		w.flushPage(c)
+		m := chunkMeta{offset: w.off, values: c.values, nulls: c.nulls, usize: c.usize, csize: int64(c.chunk.Len())}
+		m.min, m.max = c.stats()
+		if err := w.write(c.chunk.Bytes()); err != nil {
+			return err
+		}
+		g.bytes += m.usize
+		g.csize += m.csize
+		g.chunks = append(g.chunks, m)
+		c.reset()
+	}
+	w.groups = append(w.groups, g)
+	w.total += w.rows
+	w.rows, w.buffered = 0, 0
+	return nil
+}
+
+// footer encodes the FileMetaData.
+func (w *Writer) footer() []byte {
+	var t thrift
+	t.i32(1, 1)
+	t.list(2, ctStruct, len(w.cols)+1)
+	t.elemBegin()
+	t.str(4, "schema")
+	t.i32(5, int32(len(w.cols)))
+	t.structEnd()
+	for _, c := range w.cols {
+		t.elemBegin()
+		t.i32(1, c.physical())
+		t.i32(3, repOptional)
+		t.str(4, c.Name)
+		switch c.Type {
+		case String, JSON:
+			t.i32(6, convUTF8)
+			t.structBegin(10) // LogicalType
+			t.structBegin(1)  // STRING
+			t.structEnd()
+			t.structEnd()
+		case Timestamp:
+			t.i32(6, convTimestampMicros)
+			t.structBegin(10) // LogicalType
+			t.structBegin(8)  // TIMESTAMP
+			t.boolean(1, true)
+			t.structBegin(2) // unit
+			t.structBegin(2) // MICROS
+			t.structEnd()
+			t.structEnd()
+			t.structEnd()
+			t.structEnd()
+		}
+		t.structEnd()
+	}
+	t.i64(3, w.total)
+	t.list(4, ctStruct, len(w.groups))
+	for _, g := range w.groups {
+		t.elemBegin()
+		t.list(1, ctStruct, len(g.chunks))
+		for i, m := range g.chunks {
+			c := w.cols[i]
+			t.elemBegin()
+			t.i64(2, m.offset)
+			t.structBegin(3) // ColumnMetaData
+			t.i32(1, c.physical())
+			t.list(2, ctI32, 2)
+			t.elemI32(encPlain)
+			t.elemI32(encRLE)
+			t.list(3, ctBinary, 1)
+			t.elemString(c.Name)
+			t.i32(4, w.codec)
+			t.i64(5, m.values)
+			t.i64(6, m.usize)
+			t.i64(7, m.csize)
+			t.i64(9, m.offset)
+			t.structBegin(12) // Statistics
+			t.i64(3, m.nulls)
+			if m.max != nil {
+				t.binary(5, m.max)
+				t.binary(6, m.min)
+			}
+			t.structEnd()
+			t.structEnd()
+			t.structEnd()
+		}
+		t.i64(2, g.bytes)
+		t.i64(3, g.rows)
+		t.i64(5, g.offset)
+		t.i64(6, g.csize)
+		t.structEnd()
+	}
+	t.str(6, "bibbl")
+	// Type-defined ordering makes readers trust min_value/max_value.
+	t.list(7, ctStruct, len(w.cols))
+	for range w.cols {
+		t.elemBegin()
+		t.structBegin(1)
+		t.structEnd()
+		t.structEnd()
+	}
+	t.end()
+	return t.b
+}
+
+// column buffers one column: the current page, and the pages of the current
+// row group's column chunk.
+type column struct {
+	Column
+
+	defs  []byte // definition level per row: 1 value, 0 null
+	vals  []byte // PLAIN-encoded values
+	bools []byte // 0/1 per present value of a Bool column
+
+	chunk                bytes.Buffer
+	values, nulls, usize int64
+
+	hasStats   bool
+	minI, maxI int64
+	minF, maxF float64
+}
+
+func (c *column) physical() int32 {
+	switch c.Type {
+	case Bool:
+		return physBoolean
+	case Int64, Timestamp:
+		return physInt64
+	case Double:
+		return physDouble
+	}
+	return physByteArray
+}
+
+func (c *column) pageBytes() int { return len(c.vals) + len(c.bools)/8 }
+
+func (c *column) addNull() int64 {
+	c.defs = append(c.defs, 0)
+	c.nulls++
+	return 1
+}
+
+// add appends v, converted to the column type, and returns its encoded
+// size; false when v does not fit the column.
+func (c *column) add(v interface{}) (int64, bool) {
+	switch c.Type {
+	case Bool:
+		b, ok := v.(bool)
+		if !ok {
+			return 0, false
+		}
+		var bit byte
+		if b {
+			bit = 1
+		}
+		c.defs = append(c.defs, 1)
+		c.bools = append(c.bools, bit)
+		return 1, true
+	case Int64:
+		n, ok := toInt64(v)
+		if !ok {
+			return 0, false
+		}
+		return c.addInt(n), true
+	case Timestamp:
+		t, ok := toTime(v)
+		if !ok {
+			return 0, false
+		}
+		return c.addInt(t.UnixMicro()), true
+	case Double:
+		f, ok := toFloat(v)
+		if !ok {
+			return 0, false
+		}
+		if !c.hasStats || f < c.minF {
+			c.minF = f
+		}
+		if !c.hasStats || f > c.maxF {
+			c.maxF = f
+		}
+		c.hasStats = true
+		c.defs = append(c.defs, 1)
+		c.vals = binary.LittleEndian.AppendUint64(c.vals, math.Float64bits(f))
+		return 8, true
+	case JSON:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return 0, false
+		}
+		return c.addBytes(b), true
+	}
+	s, ok := toString(v)
+	if !ok {
+		return 0, false
+	}
+	return c.addBytes([]byte(s)), true
+}
+
+func (c *column) addInt(n int64) int64 {
+	if !c.hasStats || n < c.minI {
+		c.minI = n
+	}
+	if !c.hasStats || n > c.maxI {
+		c.maxI = n
+	}
+	c.hasStats = true
+	c.defs = append(c.defs, 1)
+	c.vals = binary.LittleEndian.AppendUint64(c.vals, uint64(n))
+	return 8
+}
+
+func (c *column) addBytes(b []byte) int64 {
+	c.defs = append(c.defs, 1)
+	c.vals = binary.LittleEndian.AppendUint32(c.vals, uint32(len(b)))
+	c.vals = append(c.vals, b...)
+	return int64(4 + len(b))
+}
+
+// stats returns the PLAIN-encoded min and max of numeric columns.
+func (c *column) stats() (min, max []byte) {
+	if !c.hasStats {
+		return nil, nil
+	}
+	switch c.Type {
+	case Int64, Timestamp:
+		return binary.LittleEndian.AppendUint64(nil, uint64(c.minI)), binary.LittleEndian.AppendUint64(nil, uint64(c.maxI))
+	case Double:
+		return binary.LittleEndian.AppendUint64(nil, math.Float64bits(c.minF)), binary.LittleEndian.AppendUint64(nil, math.Float64bits(c.maxF))
+	}
+	return nil, nil
+}
+
+func (c *column) reset() {
+	c.chunk.Reset()
+	c.values, c.nulls, c.usize = 0, 0, 0
+	c.hasStats = false
+}
+
+// encodeLevels encodes definition levels (bit width 1) with the RLE /
+// bit-packing hybrid: runs of 8 or more as RLE, the rest bit-packed.
+func encodeLevels(defs []byte) []byte {
+	var out, packed []byte
+	flush := func() {
+		if len(packed) == 0 {
+			return
+		}
+		groups := (len(packed) + 7) / 8
+		out = binary.AppendUvarint(out, uint64(groups)<<1|1)
+		out = appendBits(out, packed)
+		packed = packed[:0]
+	}
+	for i := 0; i < len(defs); {
+		j := i + 1
+		for j < len(defs) && defs[j] == defs[i] {
+			j++
+		}
+		run := j - i
+		// A bit-packed run holds whole groups of 8, so top it up first.
+		pad := (8 - len(packed)%8) % 8
+		if run-pad >= 8 {
+			for k := 0; k < pad; k++ {
+				packed = append(packed, defs[i])
+			}
+			flush()
+			out = binary.AppendUvarint(out, uint64(run-pad)<<1)
+			out = append(out, defs[i])
+		} else {
+			for k := 0; k < run; k++ {
+				packed = append(packed, defs[i])
+			}
+		}
+		i = j
+	}
+	flush()
+	return out
+}
+
+// appendBits packs 0/1 values LSB first, padding the last byte with zeros.
+func appendBits(out, vals []byte) []byte {
+	for i := 0; i < len(vals); i += 8 {
+		var b byte
+		for k := 0; k < 8 && i+k < len(vals); k++ {
+			b |= vals[i+k] << k
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch x := v.(type) {
+	case json.Number:
+		n, err := x.Int64()
+		return n, err == nil
+	case int:
+		return int64(x), true
+	case int8:
+		return int64(x), true
+	case int16:
+		return int64(x), true
+	case int32:
+		return int64(x), true
+	case int64:
+		return x, true
+	case uint8:
+		return int64(x), true
+	case uint16:
+		return int64(x), true
+	case uint32:
+		return int64(x), true
+	case uint, uint64:
+		n := toUint(x)
+		return int64(n), n <= math.MaxInt64
+	case float64:
+		return int64(x), x == math.Trunc(x) && math.Abs(x) < 1<<63
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch x := v.(type) {
+	case json.Number:
+		f, err := x.Float64()
+		return f, err == nil
+	case float64:
+		return x, true
+	case float32:
+		return float64(x), true
+	}
+	if n, ok := toInt64(v); ok {
+		return float64(n), true
+	}
+	if n := toUint(v); n > 0 {
+		return float64(n), true
+	}
+	return 0, false
+}
+
+func toTime(v interface{}) (time.Time, bool) {
+	switch x := v.(type) {
+	case string:
+		return parseTime(x)
+	case time.Time:
+		return x, true
+	}
+	return time.Time{}, false
+}
+
+func toString(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case json.Number:
+		return x.String(), true
+	case bool:
+		return strconv.FormatBool(x), true
+	case time.Time:
+		return x.UTC().Format(time.RFC3339Nano), true
+	}
+	if f, ok := toFloat(v); ok {
+		return strconv.FormatFloat(f, 'g', -1, 64), true
+	}
+	return "", false
+}
@@ -0,0 +1,305 @@
+// Package s3 archives events to Amazon S3 or any S3-compatible store
+// (MinIO, Ceph, Wasabi). Staging, partitioning and rollover come from
+// package archive; this package signs requests with SigV4 and uploads the
+// sealed objects, with multipart upload for large ones.
+package s3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bibbl/pkg/outputs"
+	"bibbl/pkg/outputs/archive"
+)
+
+const (
+	defaultMultipartThreshold = 16 << 20
+	defaultPartSize           = 8 << 20
+	minPartSize               = 5 << 20 // S3 minimum for all but the last part
+)
+
+// Config holds configuration for an S3 destination. The archive settings
+// (pathTemplate, compression, rollover, staging) sit at the top level.
+type Config struct {
+	Bucket string `json:"bucket"`
+	Region string `json:"region"` // default us-east-1
+	// Endpoint points at an S3-compatible service, e.g. http://minio:9000.
+	// Requests then use path-style URLs unless forcePathStyle is false.
+	Endpoint       string `json:"endpoint"`
+	ForcePathStyle *bool  `json:"forcePathStyle"`
+
+	// Static credentials; AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN are used when they are empty.
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken"`
+
+	StorageClass         string `json:"storageClass"`
+	ServerSideEncryption string `json:"serverSideEncryption"` // AES256 | aws:kms
+	KMSKeyID             string `json:"kmsKeyId"`
+
+	// Objects of MultipartThresholdBytes or more are sent in parts of
+	// PartSizeBytes (at least 5 MiB).
+	MultipartThresholdBytes int64 `json:"multipartThresholdBytes"`
+	PartSizeBytes           int64 `json:"partSizeBytes"`
+	TimeoutSec              int   `json:"timeoutSec"`
+
+	archive.Config
+	TLS outputs.TLSConfig `json:"tls"`
+}
+
+// S3Output archives events into one bucket.
+type S3Output struct {
+	*archive.Writer
+	client *Client
+}
+
+// NewS3Output validates cfg, applies defaults and starts the output.
+func NewS3Output(cfg Config) (*S3Output, error) {
+	client, err := NewClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	w, err := archive.NewWriter("s3", cfg.Config, client)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Output{Writer: w, client: client}, nil
+}
+
+// NewOutput builds an S3Output from a destination config map. It is the
+// factory registered for the "s3" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewS3Output(c)
+}
+
+// Client uploads objects to one bucket.
+type Client struct {
+	cfg       Config
+	base      *url.URL
+	pathStyle bool
+	creds     Credentials
+	http      *http.Client
+	now       func() time.Time
+}
+
+// NewClient validates the bucket, endpoint and credential settings.
+func NewClient(cfg Config) (*Client, error) {
+	if strings.TrimSpace(cfg.Bucket) == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	creds := Credentials{AccessKeyID: cfg.AccessKeyID, SecretAccessKey: cfg.SecretAccessKey, SessionToken: cfg.SessionToken}
+	if creds.AccessKeyID == "" && creds.SecretAccessKey == "" {
+		creds = Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("accessKeyId and secretAccessKey are required (or AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY)")
+	}
+	pathStyle := cfg.Endpoint != "" || strings.Contains(cfg.Bucket, ".")
+	if cfg.ForcePathStyle != nil {
+		pathStyle = *cfg.ForcePathStyle
+	}
+	endpoint := strings.TrimRight(cfg.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+		if !pathStyle {
+			endpoint = "https://" + cfg.Bucket + ".s3." + cfg.Region + ".amazonaws.com"
+		}
+	}
+	base, err := url.Parse(endpoint)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an absolute http(s) URL, got %q", cfg.Endpoint)
+	}
+	if cfg.MultipartThresholdBytes <= 0 {
+		cfg.MultipartThresholdBytes = defaultMultipartThreshold
+	}
+	if cfg.PartSizeBytes <= 0 {
+		cfg.PartSizeBytes = defaultPartSize
+	}
+	cfg.PartSizeBytes = max(cfg.PartSizeBytes, minPartSize)
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 300
+	}
+	tlsCfg, err := cfg.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		cfg:       cfg,
+		base:      base,
+		pathStyle: pathStyle,
+		creds:     creds,
+		now:       time.Now,
+		http: &http.Client{
+			Timeout: time.Duration(cfg.TimeoutSec) * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+				TLSClientConfig:     tlsCfg,
+			},
+		},
+	}, nil
+}
+
+// Upload implements archive.Uploader.
+func (c *Client) Upload(key string, body *os.File, size int64) error {
+	if size < c.cfg.MultipartThresholdBytes {
+		_, _, err := c.do(http.MethodPut, key, nil, io.NewSectionReader(body, 0, size), c.objectHeaders())
+		return err
+	}
+	return c.multipart(key, body, size)
+}
+
+func (c *Client) objectHeaders() map[string]string {
+	h := map[string]string{"Content-Type": "application/octet-stream"}
+	if c.cfg.StorageClass != "" {
+		h["X-Amz-Storage-Class"] = c.cfg.StorageClass
+	}
+	if c.cfg.ServerSideEncryption != "" {
+		h["X-Amz-Server-Side-Encryption"] = c.cfg.ServerSideEncryption
+		if c.cfg.KMSKeyID != "" {
+			h["X-Amz-Server-Side-Encryption-Aws-Kms-Key-Id"] = c.cfg.KMSKeyID
+		}
+	}
+	return h
+}
+
+type completeUpload struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipart uploads body in parts, aborting the upload when a step fails
+// so no orphaned parts are left behind.
+func (c *Client) multipart(key string, body *os.File, size int64) (err error) {
+	resp, _, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, c.objectHeaders())
+	if err != nil {
+		return fmt.Errorf("create multipart upload: %w", err)
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp, &created); err != nil || created.UploadID == "" {
+		return fmt.Errorf("create multipart upload: no upload id in response")
+	}
+	uploadID := created.UploadID
+	defer func() {
+		if err != nil {
+			_, _, _ = c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+		}
+	}()
+
+	var done completeUpload
+	for n, off := 1, int64(0); off < size; n, off = n+1, off+c.cfg.PartSizeBytes {
+		part := io.NewSectionReader(body, off, min(c.cfg.PartSizeBytes, size-off))
+		q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+		_, h, err := c.do(http.MethodPut, key, q, part, nil)
+		if err != nil {
+			return fmt.Errorf("upload part %d: %w", n, err)
+		}
+		done.Parts = append(done.Parts, completePart{PartNumber: n, ETag: h.Get("ETag")})
+	}
+	xmlBody, err := xml.Marshal(done)
+	if err != nil {
+		return err
+	}
+	resp, _, err = c.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(xmlBody),
+		map[string]string{"Content-Type": "application/xml"})
+	if err != nil {
+		return fmt.Errorf("complete multipart upload: %w", err)
+	}
+	// CompleteMultipartUpload can fail after a 200 status.
+	if bytes.Contains(resp, []byte("<Error>")) {
+		return fmt.Errorf("complete multipart upload: %s", errorCode(resp))
+	}
+	return nil
+}
+
+// do sends one signed request and returns the response body and headers.
+func (c *Client) do(method, key string, query url.Values, body io.ReadSeeker, headers map[string]string) ([]byte, http.Header, error) {
+	payloadHash := hashHex(nil)
+	var size int64
+	if body != nil {
+		h := sha256.New()
+		n, err := io.Copy(h, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		payloadHash, size = hex.EncodeToString(h.Sum(nil)), n
+	}
+	u := *c.base
+	p := strings.TrimRight(u.Path, "/")
+	if c.pathStyle {
+		p += "/" + awsEscape(c.cfg.Bucket)
+	}
+	u.RawPath = p + "/" + escapeKey(key)
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	u.RawQuery = canonicalQuery(query)
+
+	var rd io.Reader = http.NoBody
+	if body != nil {
+		rd = body
+	}
+	req, err := http.NewRequest(method, u.String(), rd)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.ContentLength = size
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	signV4(req, c.creds, c.cfg.Region, "s3", payloadHash, c.now())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, outputs.HTTPError(resp.StatusCode,
+			fmt.Errorf("s3 %s %s returned status %d: %s", method, key, resp.StatusCode, errorCode(respBody)))
+	}
+	return respBody, resp.Header, nil
+}
+
+// errorCode extracts Code and Message from an S3 XML error body.
+func errorCode(body []byte) string {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if xml.Unmarshal(body, &e) == nil && e.Code != "" {
+		return strings.TrimSpace(e.Code + " " + e.Message)
+	}
+	return strings.TrimSpace(string(body))
+}
@@ -0,0 +1,150 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Credentials sign requests with AWS Signature Version 4.
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+const (
+	sigAlgorithm  = "AWS4-HMAC-SHA256"
+	amzDateLayout = "20060102T150405Z"
+)
+
+// unsignedHeaders are left out of the signature; proxies and the transport
+// may change them.
+var unsignedHeaders = map[string]bool{
+	"authorization": true, "user-agent": true, "content-length": true,
+	"accept-encoding": true, "expect": true, "connection": true, "x-amzn-trace-id": true,
+}
+
+// signV4 adds the x-amz-date, x-amz-content-sha256, session token and
+// Authorization headers to req. payloadHash is the hex SHA-256 of the body.
+func signV4(req *http.Request, creds Credentials, region, service, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateLayout)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	names := []string{"host"}
+	values := map[string]string{"host": host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if unsignedHeaders[lk] {
+			continue
+		}
+		if _, seen := values[lk]; !seen {
+			names = append(names, lk)
+		}
+		trimmed := make([]string, len(v))
+		for i, s := range v {
+			trimmed[i] = strings.Join(strings.Fields(s), " ")
+		}
+		values[lk] = strings.Join(trimmed, ",")
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, n := range names {
+		canonHeaders.WriteString(n + ":" + values[n] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL.Query()),
+		canonHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	toSign := sigAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", sigAlgorithm+" Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+sig)
+}
+
+func canonicalURI(u *url.URL) string {
+	p := u.EscapedPath()
+	if p == "" {
+		return "/"
+	}
+	return p
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsEscape percent-encodes everything but the RFC 3986 unreserved
+// characters, as SigV4 requires.
+func awsEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+	return b.String()
+}
+
+// escapeKey encodes an object key for the request path, keeping slashes.
+func escapeKey(key string) string {
+	segs := strings.Split(key, "/")
+	for i, s := range segs {
+		segs[i] = awsEscape(s)
+	}
+	return strings.Join(segs, "/")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,86 @@
+package outputs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	resolverMu sync.RWMutex
+	resolver   func(ctx context.Context, ref string) (string, error)
+)
+
+// SetRefResolver installs the resolver for vault:// references in
+// destination configs. Registry.New resolves them before an output is built,
+// so outputs only ever see plaintext values.
+func SetRefResolver(fn func(ctx context.Context, ref string) (string, error)) {
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	resolver = fn
+}
+
+// resolveRefs returns a copy of cfg with every vault:// string, at any
+// depth, replaced by its secret.
+func resolveRefs(cfg map[string]interface{}) (map[string]interface{}, error) {
+	resolverMu.RLock()
+	fn := resolver
+	resolverMu.RUnlock()
+	v, err := resolveValue(fn, cfg)
+	if err != nil {
+		return nil, err
+	}
+	out, _ := v.(map[string]interface{})
+	return out, nil
+}
+
+func resolveValue(fn func(ctx context.Context, ref string) (string, error), v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case string:
+		ref := strings.TrimSpace(t)
+		if !strings.HasPrefix(ref, "vault://") {
+			return t, nil
+		}
+		if fn == nil {
+			return nil, fmt.Errorf("cannot resolve %s: secrets vault is not enabled", ref)
+		}
+		s, err := fn(context.Background(), ref)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %w", ref, err)
+		}
+		return s, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			r, err := resolveValue(fn, val)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case map[string]string:
+		out := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			r, err := resolveValue(fn, val)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = r
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, val := range t {
+			r, err := resolveValue(fn, val)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = r
+		}
+		return out, nil
+	default:
+		return v, nil
+	}
+}
@@ -0,0 +1,423 @@
+// Package splunkhec sends events to Splunk through the HTTP Event Collector.
+package splunkhec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"bibbl/pkg/outputs"
+)
+
+const (
+	modeEvent = "event"
+	modeRaw   = "raw"
+)
+
+// Config holds configuration for a Splunk HEC destination.
+type Config struct {
+	// Endpoints are HEC base URLs (https://splunk:8088); batches go to
+	// them round-robin. URL is shorthand for a single endpoint.
+	Endpoints []string `json:"endpoints"`
+	URL       string   `json:"url"`
+	Token     string   `json:"token"`
+	Mode      string   `json:"mode"` // event (default) | raw
+
+	// Static metadata, overridden per event by the matching *Field.
+	Index           string `json:"index"`
+	Sourcetype      string `json:"sourcetype"`
+	Source          string `json:"source"`
+	Host            string `json:"host"`
+	IndexField      string `json:"indexField"`
+	SourcetypeField string `json:"sourcetypeField"`
+	SourceField     string `json:"sourceField"`
+	HostField       string `json:"hostField"`
+	TimeField       string `json:"timeField"` // default "timestamp"
+
+	Compression      string `json:"compression"` // gzip | none
+	BatchMaxEvents   int    `json:"batchMaxEvents"`
+	BatchMaxBytes    int    `json:"batchMaxBytes"`
+	FlushIntervalSec int    `json:"flushIntervalSec"`
+	TimeoutSec       int    `json:"timeoutSec"`
+
+	// Ack waits for indexer acknowledgement before a batch counts as
+	// delivered. The token must have indexer acknowledgement enabled.
+	Ack           bool   `json:"ack"`
+	AckTimeoutSec int    `json:"ackTimeoutSec"`
+	AckPollMs     int    `json:"ackPollMs"`
+	Channel       string `json:"channel"` // default: random per output
+	InsecureTLS   bool   `json:"insecureSkipVerify"`
+}
+
+// HECOutput delivers batches to one or more HEC endpoints.
+type HECOutput struct {
+	*outputs.Batcher
+
+	cfg       Config
+	endpoints []string
+	next      atomic.Uint32
+	client    *http.Client
+}
+
+// NewHECOutput validates cfg, applies defaults and starts the output.
+func NewHECOutput(cfg Config) (*HECOutput, error) {
+	endpoints := make([]string, 0, len(cfg.Endpoints)+1)
+	for _, e := range append(cfg.Endpoints, cfg.URL) {
+		if e = strings.TrimRight(strings.TrimSpace(e), "/"); e == "" {
+			continue
+		}
+		if _, err := url.ParseRequestURI(e); err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %w", e, err)
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("at least one endpoint (url or endpoints) is required")
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("token is required")
+	}
+	switch cfg.Mode = strings.ToLower(cfg.Mode); cfg.Mode {
+	case "":
+		cfg.Mode = modeEvent
+	case modeEvent, modeRaw:
+	default:
+		return nil, fmt.Errorf("mode must be event or raw, got %q", cfg.Mode)
+	}
+	switch cfg.Compression = strings.ToLower(cfg.Compression); cfg.Compression {
+	case "", "none", "gzip":
+	default:
+		return nil, fmt.Errorf("compression must be gzip or none, got %q", cfg.Compression)
+	}
+	if cfg.TimeField == "" {
+		cfg.TimeField = "timestamp"
+	}
+	if cfg.BatchMaxBytes <= 0 {
+		cfg.BatchMaxBytes = 1024 * 1024 // HEC's default max_content_length is 1MB
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 30
+	}
+	if cfg.AckTimeoutSec <= 0 {
+		cfg.AckTimeoutSec = 60
+	}
+	if cfg.AckPollMs <= 0 {
+		cfg.AckPollMs = 500
+	}
+	if cfg.Channel == "" {
+		cfg.Channel = newChannel()
+	}
+	o := &HECOutput{
+		cfg:       cfg,
+		endpoints: endpoints,
+		client: &http.Client{
+			Timeout: time.Duration(cfg.TimeoutSec) * time.Second,
+			Transport: &http.Transport{
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+				TLSHandshakeTimeout: 10 * time.Second,
+				TLSClientConfig:     &tls.Config{InsecureSkipVerify: cfg.InsecureTLS}, // #nosec G402 -- opt-in for self-signed HEC certs
+			},
+		},
+	}
+	o.Batcher = outputs.NewBatcher("splunkhec", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.deliver)
+	return o, nil
+}
+
+// NewOutput builds an HECOutput from a destination config map. It is the
+// factory registered for the "splunk_hec" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewHECOutput(c)
+}
+
+// deliver sends events in as many requests as BatchMaxBytes requires.
+func (o *HECOutput) deliver(events []map[string]interface{}) error {
+	var reqs []request
+	var err error
+	if o.cfg.Mode == modeRaw {
+		reqs, err = o.rawRequests(events)
+	} else {
+		reqs, err = o.eventRequests(events)
+	}
+	if err != nil {
+		return err
+	}
+	for _, r := range reqs {
+		if err := o.post(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// request is one HEC call: a body and, in raw mode, its metadata query.
+type request struct {
+	path  string
+	query url.Values
+	body  []byte
+}
+
+// metadata resolves index, sourcetype, source and host for an event.
+func (o *HECOutput) metadata(ev map[string]interface{}) (index, sourcetype, source, host string) {
+	pick := func(field, static string) string {
+		if v := outputs.FieldString(ev, field); v != "" {
+			return v
+		}
+		return static
+	}
+	return pick(o.cfg.IndexField, o.cfg.Index), pick(o.cfg.SourcetypeField, o.cfg.Sourcetype),
+		pick(o.cfg.SourceField, o.cfg.Source), pick(o.cfg.HostField, o.cfg.Host)
+}
+
+func (o *HECOutput) eventRequests(events []map[string]interface{}) ([]request, error) {
+	var reqs []request
+	var buf bytes.Buffer
+	for _, ev := range events {
+		index, sourcetype, source, host := o.metadata(ev)
+		env := map[string]interface{}{"event": ev}
+		for k, v := range map[string]string{"index": index, "sourcetype": sourcetype, "source": source, "host": host} {
+			if v != "" {
+				env[k] = v
+			}
+		}
+		if ts, ok := outputs.EventTime(ev, o.cfg.TimeField); ok {
+			env["time"] = float64(ts.UnixMilli()) / 1000
+		}
+		line, err := json.Marshal(env)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal event: %w", err)
+		}
+		if buf.Len() > 0 && buf.Len()+len(line) > o.cfg.BatchMaxBytes {
+			reqs = append(reqs, request{path: "/services/collector/event", body: bytes.Clone(buf.Bytes())})
+			buf.Reset()
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if buf.Len() > 0 {
+		reqs = append(reqs, request{path: "/services/collector/event", body: buf.Bytes()})
+	}
+	return reqs, nil
+}
+
+// rawRequests groups events by metadata, which raw mode can only set per
+// request, and sends each event's _raw text (or its JSON) as one line.
+func (o *HECOutput) rawRequests(events []map[string]interface{}) ([]request, error) {
+	type group struct {
+		query url.Values
+		buf   bytes.Buffer
+	}
+	var order []string
+	groups := map[string]*group{}
+	var reqs []request
+	for _, ev := range events {
+		index, sourcetype, source, host := o.metadata(ev)
+		key := index + "\x00" + sourcetype + "\x00" + source + "\x00" + host
+		g := groups[key]
+		if g == nil {
+			q := url.Values{}
+			for k, v := range map[string]string{"index": index, "sourcetype": sourcetype, "source": source, "host": host} {
+				if v != "" {
+					q.Set(k, v)
+				}
+			}
+			g = &group{query: q}
+			groups[key] = g
+			order = append(order, key)
+		}
+		line, err := rawLine(ev)
+		if err != nil {
+			return nil, err
+		}
+		if g.buf.Len() > 0 && g.buf.Len()+len(line) > o.cfg.BatchMaxBytes {
+			reqs = append(reqs, request{path: "/services/collector/raw", query: g.query, body: bytes.Clone(g.buf.Bytes())})
+			g.buf.Reset()
+		}
+		g.buf.Write(line)
+		g.buf.WriteByte('\n')
+	}
+	for _, key := range order {
+		if g := groups[key]; g.buf.Len() > 0 {
+			reqs = append(reqs, request{path: "/services/collector/raw", query: g.query, body: g.buf.Bytes()})
+		}
+	}
+	return reqs, nil
+}
+
+func rawLine(ev map[string]interface{}) ([]byte, error) {
+	if raw, ok := ev["_raw"].(string); ok {
+		return []byte(strings.TrimRight(raw, "\r\n")), nil
+	}
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal event: %w", err)
+	}
+	return line, nil
+}
+
+// hecResponse is the body HEC answers with.
+type hecResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+// post sends one request, starting at the next endpoint in round-robin
+// order and failing over to the others on transport errors and retryable
+// statuses. With acknowledgement on, it waits for the indexer ack.
+func (o *HECOutput) post(r request) error {
+	body := r.body
+	if o.cfg.Compression == "gzip" {
+		var err error
+		if body, err = gzipBytes(body); err != nil {
+			return err
+		}
+	}
+	start := int(o.next.Add(1) - 1)
+	var lastErr error
+	for i := range o.endpoints {
+		base := o.endpoints[(start+i)%len(o.endpoints)]
+		ackID, err := o.send(base, r, body)
+		if err == nil {
+			if o.cfg.Ack && ackID != nil {
+				return o.waitAck(base, *ackID)
+			}
+			return nil
+		}
+		if _, permanent := outputs.IsPermanent(err); permanent {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+func (o *HECOutput) send(base string, r request, body []byte) (*int64, error) {
+	u := base + r.path
+	if len(r.query) > 0 {
+		u += "?" + r.query.Encode()
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	o.setHeaders(req)
+	if o.cfg.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var hr hecResponse
+	_ = json.Unmarshal(respBody, &hr)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return hr.AckID, nil
+	}
+	err = fmt.Errorf("splunk hec %s returned status %d: %s", base, resp.StatusCode, strings.TrimSpace(string(respBody)))
+	return nil, classify(resp.StatusCode, hr.Code, err)
+}
+
+// classify maps an HEC error to retryable or permanent. Token and
+// acknowledgement problems are configuration errors, not bad events, so
+// they stay retryable and the events wait in the queue until fixed.
+func classify(status, code int, err error) error {
+	switch status {
+	case http.StatusBadRequest:
+		// 6 invalid data format, 12 event field required, 13 event field blank,
+		// 5 no data; anything else (e.g. 10 data channel missing) is config.
+		switch code {
+		case 5, 6, 12, 13, 15:
+			return outputs.Permanent(status, err)
+		}
+		return err
+	}
+	return outputs.HTTPError(status, err)
+}
+
+func (o *HECOutput) setHeaders(req *http.Request) {
+	req.Header.Set("Authorization", "Splunk "+o.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Splunk-Request-Channel", o.cfg.Channel)
+}
+
+// errAckTimeout means HEC accepted a batch but did not confirm it was
+// indexed in time. The batch is retried, so it may be indexed twice.
+var errAckTimeout = errors.New("splunk hec: timed out waiting for indexer acknowledgement")
+
+func (o *HECOutput) waitAck(base string, id int64) error {
+	deadline := time.Now().Add(time.Duration(o.cfg.AckTimeoutSec) * time.Second)
+	poll := time.Duration(o.cfg.AckPollMs) * time.Millisecond
+	payload, _ := json.Marshal(map[string][]int64{"acks": {id}})
+	key := strconv.FormatInt(id, 10)
+	for {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, base+"/services/collector/ack?channel="+url.QueryEscape(o.cfg.Channel), bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		o.setHeaders(req)
+		resp, err := o.client.Do(req)
+		if err == nil {
+			var ar struct {
+				Acks map[string]bool `json:"acks"`
+			}
+			decodeErr := json.NewDecoder(resp.Body).Decode(&ar)
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 || decodeErr != nil {
+				err = fmt.Errorf("splunk hec ack returned status %d", resp.StatusCode)
+			} else if ar.Acks[key] {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("%w: %v", errAckTimeout, err)
+			}
+			return errAckTimeout
+		}
+		time.Sleep(poll)
+	}
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newChannel returns a random UUID for the X-Splunk-Request-Channel header.
+func newChannel() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
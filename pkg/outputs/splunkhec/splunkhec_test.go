@@ -0,0 +1,172 @@
+package splunkhec
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"bibbl/pkg/outputs"
+)
+
+// fakeHEC is a minimal HTTP Event Collector that records what it received
+// and acknowledges every batch on the second ack poll.
+type fakeHEC struct {
+	mu     sync.Mutex
+	events []map[string]interface{}
+	raw    []string
+	query  []string
+	polls  int
+	reject bool
+}
+
+func (f *fakeHEC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Splunk secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = io.WriteString(w, `{"text":"Invalid token","code":4}`)
+		return
+	}
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/services/collector/event":
+		if f.reject {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `{"text":"Invalid data format","code":6}`)
+			return
+		}
+		dec := json.NewDecoder(body)
+		for dec.More() {
+			var ev map[string]interface{}
+			if err := dec.Decode(&ev); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			f.events = append(f.events, ev)
+		}
+		_, _ = io.WriteString(w, `{"text":"Success","code":0,"ackId":7}`)
+	case "/services/collector/raw":
+		f.query = append(f.query, r.URL.RawQuery)
+		sc := bufio.NewScanner(body)
+		for sc.Scan() {
+			f.raw = append(f.raw, sc.Text())
+		}
+		_, _ = io.WriteString(w, `{"text":"Success","code":0}`)
+	case "/services/collector/ack":
+		f.polls++
+		_, _ = io.WriteString(w, `{"acks":{"7":`+map[bool]string{true: "true", false: "false"}[f.polls >= 2]+`}}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeHEC) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.events)
+}
+
+func TestHECEventModeRoundRobinWithAck(t *testing.T) {
+	a, b := &fakeHEC{}, &fakeHEC{}
+	srvA, srvB := httptest.NewServer(a), httptest.NewServer(b)
+	defer srvA.Close()
+	defer srvB.Close()
+
+	out, err := NewHECOutput(Config{
+		Endpoints:   []string{srvA.URL, srvB.URL},
+		Token:       "secret",
+		Index:       "main",
+		IndexField:  "splunk_index",
+		Sourcetype:  "bibbl:json",
+		HostField:   "hostname",
+		Compression: "gzip",
+		Ack:         true,
+		AckPollMs:   10,
+	})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+
+	ev := map[string]interface{}{"_raw": "x", "hostname": "fw01", "timestamp": "2024-05-01T10:00:00Z"}
+	if err := out.SendBatch([]map[string]interface{}{ev}); err != nil {
+		t.Fatalf("first batch: %v", err)
+	}
+	if err := out.SendBatch([]map[string]interface{}{{"_raw": "y", "splunk_index": "fw"}}); err != nil {
+		t.Fatalf("second batch: %v", err)
+	}
+	if a.count() != 1 || b.count() != 1 {
+		t.Fatalf("expected one batch per endpoint, got %d and %d", a.count(), b.count())
+	}
+	got := a.events[0]
+	if got["index"] != "main" || got["host"] != "fw01" || got["sourcetype"] != "bibbl:json" || got["time"] != float64(1714557600) {
+		t.Fatalf("unexpected envelope: %v", got)
+	}
+	if b.events[0]["index"] != "fw" {
+		t.Fatalf("index field should override the static index: %v", b.events[0])
+	}
+	if a.polls < 2 {
+		t.Fatalf("expected ack polling, got %d polls", a.polls)
+	}
+	if h := out.Health(); h.Status != outputs.StatusConnected || h.Sent != 2 {
+		t.Fatalf("unexpected health: %+v", h)
+	}
+
+	a.reject = true
+	b.reject = true
+	err = out.SendBatch([]map[string]interface{}{{"_raw": "bad"}})
+	if _, permanent := outputs.IsPermanent(err); !permanent {
+		t.Fatalf("invalid data format should be permanent, got %v", err)
+	}
+}
+
+func TestHECRawModeAndFailover(t *testing.T) {
+	hec := &fakeHEC{}
+	srv := httptest.NewServer(hec)
+	defer srv.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	out, err := NewHECOutput(Config{Endpoints: []string{down.URL, srv.URL}, Token: "secret", Mode: "raw", Sourcetype: "pan:traffic", SourceField: "src"})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	err = out.SendBatch([]map[string]interface{}{
+		{"_raw": "line one\n", "src": "a"},
+		{"_raw": "line two", "src": "b"},
+		{"_raw": "line three", "src": "a"},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if strings.Join(hec.raw, "|") != "line one|line three|line two" {
+		t.Fatalf("unexpected raw lines: %v", hec.raw)
+	}
+	if len(hec.query) != 2 || !strings.Contains(hec.query[0], "source=a") || !strings.Contains(hec.query[0], "sourcetype=pan%3Atraffic") {
+		t.Fatalf("expected one request per source, got %v", hec.query)
+	}
+
+	bad, _ := NewHECOutput(Config{URL: srv.URL, Token: "wrong"})
+	defer bad.Close()
+	err = bad.SendBatch([]map[string]interface{}{{"_raw": "x"}})
+	if _, permanent := outputs.IsPermanent(err); err == nil || permanent {
+		t.Fatalf("a bad token should be retryable, got %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package sqldb
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// copy loads rows with PostgreSQL's COPY. Upserts copy into a temporary
+// table first, since COPY itself cannot resolve conflicts, and merge it
+// into the target with INSERT ... ON CONFLICT.
+func (o *SQLOutput) copy(ctx context.Context, rows []row) error {
+	conn, err := o.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.Raw(func(driverConn any) error {
+		sc, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("copy needs the pgx driver, got %T", driverConn)
+		}
+		tx, err := sc.Conn().Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = tx.Rollback(ctx) }()
+		target := pgx.Identifier(strings.Split(o.cfg.Table, "."))
+		if len(o.cfg.Key) > 0 {
+			target = pgx.Identifier{"bibbl_copy"}
+			create := fmt.Sprintf("CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", target.Sanitize(), o.d.table(o.cfg.Table))
+			if _, err := tx.Exec(ctx, create); err != nil {
+				return fmt.Errorf("copy into %s: %w", o.cfg.Table, err)
+			}
+		}
+		src := make([][]any, len(rows))
+		for i, r := range rows {
+			src[i] = r.vals
+		}
+		if _, err := tx.CopyFrom(ctx, target, o.cols, pgx.CopyFromRows(src)); err != nil {
+			return fmt.Errorf("copy into %s: %w", o.cfg.Table, err)
+		}
+		if len(o.cfg.Key) > 0 {
+			if _, err := tx.Exec(ctx, o.d.upsertFrom(o.cfg.Table, target.Sanitize(), o.cols, o.cfg.Key)); err != nil {
+				return fmt.Errorf("copy into %s: %w", o.cfg.Table, err)
+			}
+		}
+		return tx.Commit(ctx)
+	})
+}
@@ -0,0 +1,249 @@
+package sqldb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	mssql "github.com/microsoft/go-mssqldb"
+)
+
+// Column types.
+const (
+	TypeText      = "text"
+	TypeInt       = "int"
+	TypeFloat     = "float"
+	TypeBool      = "bool"
+	TypeTimestamp = "timestamp"
+	TypeJSON      = "json"
+)
+
+// dialect holds what differs between the databases: identifier quoting,
+// placeholders, column types, table creation and upsert syntax.
+type dialect struct {
+	driver    string // database/sql driver name
+	maxParams int    // bind parameters per statement
+	maxRows   int    // rows per VALUES list
+	quote     func(string) string
+	param     func(n int) string // 1-based
+	types     map[string]string
+	keyText   string // text type usable in a key
+	dataError func(error) bool
+}
+
+var dialects = map[string]*dialect{
+	"postgres": {
+		driver:    "pgx",
+		maxParams: 65535,
+		maxRows:   1000,
+		quote:     func(s string) string { return `"` + s + `"` },
+		param:     func(n int) string { return fmt.Sprintf("$%d", n) },
+		types: map[string]string{
+			TypeText: "TEXT", TypeInt: "BIGINT", TypeFloat: "DOUBLE PRECISION", TypeBool: "BOOLEAN",
+			TypeTimestamp: "TIMESTAMPTZ", TypeJSON: "JSONB",
+		},
+		keyText: "TEXT",
+		dataError: func(err error) bool {
+			// Class 22 is data exception, 23 integrity constraint violation.
+			var pe *pgconn.PgError
+			return errors.As(err, &pe) && (strings.HasPrefix(pe.Code, "22") || strings.HasPrefix(pe.Code, "23"))
+		},
+	},
+	"mysql": {
+		driver:    "mysql",
+		maxParams: 65535,
+		maxRows:   1000,
+		quote:     func(s string) string { return "`" + s + "`" },
+		param:     func(int) string { return "?" },
+		types: map[string]string{
+			TypeText: "TEXT", TypeInt: "BIGINT", TypeFloat: "DOUBLE", TypeBool: "BOOLEAN",
+			TypeTimestamp: "DATETIME(6)", TypeJSON: "JSON",
+		},
+		keyText: "VARCHAR(255)", // TEXT cannot be a key without a prefix length
+		dataError: func(err error) bool {
+			var me *mysql.MySQLError
+			if !errors.As(err, &me) {
+				return false
+			}
+			switch me.Number {
+			case 1048, 1062, 1264, 1292, 1366, 1406, 1451, 1452, 3140:
+				return true
+			}
+			return false
+		},
+	},
+	"sqlserver": {
+		driver:    "sqlserver",
+		maxParams: 2100 - 1,
+		maxRows:   1000,
+		quote:     func(s string) string { return "[" + s + "]" },
+		param:     func(n int) string { return fmt.Sprintf("@p%d", n) },
+		types: map[string]string{
+			TypeText: "NVARCHAR(MAX)", TypeInt: "BIGINT", TypeFloat: "FLOAT", TypeBool: "BIT",
+			TypeTimestamp: "DATETIMEOFFSET", TypeJSON: "NVARCHAR(MAX)",
+		},
+		keyText: "NVARCHAR(450)", // the widest NVARCHAR an index key takes
+		dataError: func(err error) bool {
+			var me mssql.Error
+			if !errors.As(err, &me) {
+				return false
+			}
+			switch me.Number {
+			case 242, 245, 515, 547, 2601, 2627, 2628, 8114, 8115, 8152:
+				return true
+			}
+			return false
+		},
+	},
+}
+
+func init() { dialects["mssql"] = dialects["sqlserver"] }
+
+// table quotes a table name, schema-qualified or not.
+func (d *dialect) table(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = d.quote(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+// createTable returns the statement creating the table from the column
+// mapping when it does not exist yet, keyed on the upsert key.
+func (d *dialect) createTable(table string, cols []Column, key []string) string {
+	isKey := map[string]bool{}
+	for _, k := range key {
+		isKey[k] = true
+	}
+	defs := make([]string, 0, len(cols)+1)
+	for _, c := range cols {
+		typ := c.SQLType
+		if typ == "" {
+			typ = d.types[c.Type]
+			if isKey[c.Name] && c.Type == TypeText {
+				typ = d.keyText
+			}
+		}
+		def := d.quote(c.Name) + " " + typ
+		if isKey[c.Name] || c.NotNull {
+			def += " NOT NULL"
+		}
+		defs = append(defs, def)
+	}
+	if len(key) > 0 {
+		defs = append(defs, "PRIMARY KEY ("+d.list(key, "")+")")
+	}
+	body := d.table(table) + " (\n  " + strings.Join(defs, ",\n  ") + "\n)"
+	if d.driver == "sqlserver" {
+		return fmt.Sprintf("IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s", d.table(table), body)
+	}
+	return "CREATE TABLE IF NOT EXISTS " + body
+}
+
+// list quotes names, each prefixed with prefix (a table alias).
+func (d *dialect) list(names []string, prefix string) string {
+	out := make([]string, len(names))
+	for i, n := range names {
+		out[i] = prefix + d.quote(n)
+	}
+	return strings.Join(out, ", ")
+}
+
+// values renders rows VALUES tuples of n columns with numbered
+// placeholders.
+func (d *dialect) values(rows, n int) string {
+	var b strings.Builder
+	p := 1
+	for r := 0; r < rows; r++ {
+		if r > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteByte('(')
+		for c := 0; c < n; c++ {
+			if c > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(d.param(p))
+			p++
+		}
+		b.WriteByte(')')
+	}
+	return b.String()
+}
+
+// insert returns a statement writing rows rows, as a plain insert or, with
+// a key, as an upsert that updates the other columns.
+func (d *dialect) insert(table string, cols, key []string, rows int) string {
+	t, names := d.table(table), d.list(cols, "")
+	if len(key) == 0 {
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s", t, names, d.values(rows, len(cols)))
+	}
+	rest := nonKey(cols, key)
+	switch d.driver {
+	case "pgx":
+		return fmt.Sprintf("INSERT INTO %s (%s) VALUES %s %s", t, names, d.values(rows, len(cols)), d.onConflict(key, rest))
+	case "mysql":
+		q := fmt.Sprintf("INSERT INTO %s (%s) VALUES %s ON DUPLICATE KEY UPDATE ", t, names, d.values(rows, len(cols)))
+		if len(rest) == 0 {
+			return q + d.assign(key[:1], "%s")
+		}
+		return q + d.assign(rest, "VALUES(%s)")
+	}
+	on := make([]string, len(key))
+	for i, k := range key {
+		on[i] = "t." + d.quote(k) + " = s." + d.quote(k)
+	}
+	q := fmt.Sprintf("MERGE INTO %s AS t USING (VALUES %s) AS s (%s) ON %s", t, d.values(rows, len(cols)), names, strings.Join(on, " AND "))
+	if len(rest) > 0 {
+		set := make([]string, len(rest))
+		for i, c := range rest {
+			set[i] = "t." + d.quote(c) + " = s." + d.quote(c)
+		}
+		q += " WHEN MATCHED THEN UPDATE SET " + strings.Join(set, ", ")
+	}
+	return q + fmt.Sprintf(" WHEN NOT MATCHED THEN INSERT (%s) VALUES (%s);", names, d.list(cols, "s."))
+}
+
+// upsertFrom merges a PostgreSQL staging table into the target.
+func (d *dialect) upsertFrom(table, src string, cols, key []string) string {
+	names := d.list(cols, "")
+	return fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s %s", d.table(table), names, names, src, d.onConflict(key, nonKey(cols, key)))
+}
+
+func (d *dialect) onConflict(key, rest []string) string {
+	q := "ON CONFLICT (" + d.list(key, "") + ") "
+	if len(rest) == 0 {
+		return q + "DO NOTHING"
+	}
+	return q + "DO UPDATE SET " + d.assign(rest, "EXCLUDED.%s")
+}
+
+func nonKey(cols, key []string) []string {
+	isKey := map[string]bool{}
+	for _, k := range key {
+		isKey[k] = true
+	}
+	var rest []string
+	for _, c := range cols {
+		if !isKey[c] {
+			rest = append(rest, c)
+		}
+	}
+	return rest
+}
+
+// assign renders "col = <format(col)>" pairs.
+func (d *dialect) assign(cols []string, format string) string {
+	out := make([]string, len(cols))
+	for i, c := range cols {
+		out[i] = d.quote(c) + " = " + fmt.Sprintf(format, d.quote(c))
+	}
+	return strings.Join(out, ", ")
+}
+
+// rowsPerStatement is how many rows of n columns one statement can bind.
+func (d *dialect) rowsPerStatement(n int) int {
+	return max(1, min(d.maxRows, d.maxParams/n))
+}
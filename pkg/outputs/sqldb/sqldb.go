@@ -0,0 +1,445 @@
+// Package sqldb writes a mapped subset of event fields to a PostgreSQL,
+// MySQL or SQL Server table through database/sql. It backs the "sql"
+// destination type.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bibbl/pkg/outputs"
+
+	_ "github.com/go-sql-driver/mysql"  // registers "mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"  // registers "pgx"
+	_ "github.com/microsoft/go-mssqldb" // registers "sqlserver"
+)
+
+// Column maps an event field to a table column.
+type Column struct {
+	Name    string `json:"name"`
+	Field   string `json:"field"`   // event field, dotted names allowed; default Name
+	Type    string `json:"type"`    // text (default) | int | float | bool | timestamp | json
+	SQLType string `json:"sqlType"` // column type for createTable instead of the type's default
+	NotNull bool   `json:"notNull"` // events without a value are dead-lettered
+}
+
+// Config holds configuration for a SQL destination.
+type Config struct {
+	Driver  string   `json:"driver"` // postgres | mysql | sqlserver
+	DSN     string   `json:"dsn"`    // the driver's connection string; may be a vault:// reference
+	Table   string   `json:"table"`  // name or schema.name
+	Columns []Column `json:"columns"`
+
+	// Key lists the columns of the unique key rows are upserted on: a row
+	// whose key exists updates the other columns. Without a key rows are
+	// plain inserts.
+	Key         []string `json:"key"`
+	CreateTable bool     `json:"createTable"` // create the table from Columns when missing, keyed on Key
+	// Copy loads PostgreSQL batches with COPY instead of multi-row
+	// inserts, through a temporary table when upserting.
+	Copy bool `json:"copy"`
+
+	MaxOpenConns       int `json:"maxOpenConns"`       // default 4
+	MaxIdleConns       int `json:"maxIdleConns"`       // default 2
+	ConnMaxLifetimeSec int `json:"connMaxLifetimeSec"` // default 1800
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+	TimeoutSec       int `json:"timeoutSec"`
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// open is sql.Open; tests swap in a fake driver.
+var open = sql.Open
+
+// SQLOutput delivers batches to one table.
+type SQLOutput struct {
+	*outputs.Batcher
+
+	cfg  Config
+	d    *dialect
+	db   *sql.DB
+	cols []string
+	key  []int // indexes of the key columns
+
+	mu      sync.Mutex
+	ready   bool // table checked or created
+	written uint64
+	rejects uint64
+}
+
+// NewSQLOutput validates cfg, applies defaults and starts the output. The
+// database is not contacted until the first batch.
+func NewSQLOutput(cfg Config) (*SQLOutput, error) {
+	cfg.Driver = strings.ToLower(strings.TrimSpace(cfg.Driver))
+	d := dialects[cfg.Driver]
+	if d == nil {
+		return nil, fmt.Errorf("driver must be postgres, mysql or sqlserver, got %q", cfg.Driver)
+	}
+	if cfg.DSN == "" {
+		return nil, fmt.Errorf("dsn is required")
+	}
+	for _, part := range strings.Split(cfg.Table, ".") {
+		if !identifier.MatchString(part) {
+			return nil, fmt.Errorf("table must be a name or schema.name of letters, digits and underscores, got %q", cfg.Table)
+		}
+	}
+	if len(cfg.Columns) == 0 {
+		return nil, fmt.Errorf("at least one column is required")
+	}
+	o := &SQLOutput{d: d}
+	index := map[string]int{}
+	for i := range cfg.Columns {
+		c := &cfg.Columns[i]
+		if !identifier.MatchString(c.Name) {
+			return nil, fmt.Errorf("invalid column name %q", c.Name)
+		}
+		if _, dup := index[strings.ToLower(c.Name)]; dup {
+			return nil, fmt.Errorf("column %q is mapped twice", c.Name)
+		}
+		index[strings.ToLower(c.Name)] = i
+		if c.Field == "" {
+			c.Field = c.Name
+		}
+		if c.Type = strings.ToLower(c.Type); c.Type == "" {
+			c.Type = TypeText
+		}
+		if _, ok := d.types[c.Type]; !ok {
+			return nil, fmt.Errorf("column %q: type must be text, int, float, bool, timestamp or json, got %q", c.Name, c.Type)
+		}
+		o.cols = append(o.cols, c.Name)
+	}
+	for j, k := range cfg.Key {
+		i, ok := index[strings.ToLower(k)]
+		if !ok {
+			return nil, fmt.Errorf("key column %q is not in columns", k)
+		}
+		o.key = append(o.key, i)
+		cfg.Key[j] = o.cols[i]
+	}
+	if cfg.Copy && cfg.Driver != "postgres" {
+		return nil, fmt.Errorf("copy is only supported with postgres")
+	}
+	if cfg.MaxOpenConns <= 0 {
+		cfg.MaxOpenConns = 4
+	}
+	if cfg.MaxIdleConns <= 0 {
+		cfg.MaxIdleConns = 2
+	}
+	if cfg.ConnMaxLifetimeSec <= 0 {
+		cfg.ConnMaxLifetimeSec = 1800
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 30
+	}
+	db, err := open(d.driver, cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", cfg.Driver, err)
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(min(cfg.MaxIdleConns, cfg.MaxOpenConns))
+	db.SetConnMaxLifetime(time.Duration(cfg.ConnMaxLifetimeSec) * time.Second)
+	o.cfg, o.db = cfg, db
+	o.Batcher = outputs.NewBatcher("sql", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.deliver)
+	return o, nil
+}
+
+// NewOutput builds an SQLOutput from a destination config map. It is the
+// factory registered for the "sql" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewSQLOutput(c)
+}
+
+type row struct {
+	vals []interface{}
+	ev   map[string]interface{}
+}
+
+type reject struct {
+	ev  map[string]interface{}
+	err error
+}
+
+// deliver writes the batch in one transaction. When the database rejects
+// a value or a constraint, the batch is written again row by row so only
+// the offending events are dead-lettered. A connection failure during
+// that pass leaves the batch to be retried, which can insert the rows
+// before it twice unless the table is upserted on a key.
+func (o *SQLOutput) deliver(events []map[string]interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.cfg.TimeoutSec)*time.Second)
+	defer cancel()
+	if err := o.ensureTable(ctx); err != nil {
+		return err
+	}
+	rows, rejected := o.rows(events)
+	var failed []reject
+	if len(rows) > 0 {
+		err := o.write(ctx, rows)
+		if err != nil && o.d.dataError(err) {
+			failed, err = o.writeEach(ctx, rows)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	o.mu.Lock()
+	o.written += uint64(len(rows) - len(failed))
+	o.rejects += uint64(len(rejected) + len(failed))
+	o.mu.Unlock()
+	for _, r := range append(rejected, failed...) {
+		o.DeadLetter([]map[string]interface{}{r.ev}, r.err)
+	}
+	return nil
+}
+
+// rows converts events to column values; events that do not convert come
+// back as rejects. With a key, only the last row per key is kept: a
+// statement may not touch a row twice, and the last one would win anyway.
+func (o *SQLOutput) rows(events []map[string]interface{}) (rows []row, rejected []reject) {
+	byKey := map[string]int{}
+	for _, ev := range events {
+		vals := make([]interface{}, len(o.cfg.Columns))
+		var err error
+		for i, c := range o.cfg.Columns {
+			if vals[i], err = convert(c, ev); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			for _, k := range o.key {
+				if vals[k] == nil {
+					err = fmt.Errorf("key column %q has no value", o.cols[k])
+					break
+				}
+			}
+		}
+		if err != nil {
+			rejected = append(rejected, reject{ev, outputs.Permanent(0, err)})
+			continue
+		}
+		if len(o.key) > 0 {
+			var kb strings.Builder
+			for _, k := range o.key {
+				fmt.Fprintf(&kb, "%v\x00", vals[k])
+			}
+			if i, ok := byKey[kb.String()]; ok {
+				rows[i] = row{vals, ev}
+				continue
+			}
+			byKey[kb.String()] = len(rows)
+		}
+		rows = append(rows, row{vals, ev})
+	}
+	return rows, rejected
+}
+
+// convert reads a column's value from an event. Missing fields, and empty
+// strings for non-text columns, are NULL.
+func convert(c Column, ev map[string]interface{}) (interface{}, error) {
+	v, ok := outputs.Field(ev, c.Field)
+	if s, isStr := v.(string); isStr && s == "" && c.Type != TypeText {
+		v = nil
+	}
+	if !ok || v == nil {
+		if c.NotNull {
+			return nil, fmt.Errorf("column %q: field %q is missing", c.Name, c.Field)
+		}
+		return nil, nil
+	}
+	bad := func(err error) (interface{}, error) {
+		if err == nil {
+			err = fmt.Errorf("unsupported value %T", v)
+		}
+		return nil, fmt.Errorf("column %q: %v is not a valid %s: %w", c.Name, v, c.Type, err)
+	}
+	switch c.Type {
+	case TypeText:
+		switch t := v.(type) {
+		case string:
+			return t, nil
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(t)
+			if err != nil {
+				return bad(err)
+			}
+			return string(b), nil
+		}
+		return fmt.Sprint(v), nil
+	case TypeInt:
+		switch t := v.(type) {
+		case float64:
+			if t != float64(int64(t)) {
+				return bad(fmt.Errorf("not a whole number"))
+			}
+			return int64(t), nil
+		case int:
+			return int64(t), nil
+		case int64:
+			return t, nil
+		case json.Number:
+			n, err := t.Int64()
+			if err != nil {
+				return bad(err)
+			}
+			return n, nil
+		case string:
+			n, err := strconv.ParseInt(strings.TrimSpace(t), 10, 64)
+			if err != nil {
+				return bad(err)
+			}
+			return n, nil
+		}
+	case TypeFloat:
+		switch t := v.(type) {
+		case float64:
+			return t, nil
+		case int:
+			return float64(t), nil
+		case int64:
+			return float64(t), nil
+		case json.Number:
+			f, err := t.Float64()
+			if err != nil {
+				return bad(err)
+			}
+			return f, nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(t), 64)
+			if err != nil {
+				return bad(err)
+			}
+			return f, nil
+		}
+	case TypeBool:
+		switch t := v.(type) {
+		case bool:
+			return t, nil
+		case float64:
+			return t != 0, nil
+		case int:
+			return t != 0, nil
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(t))
+			if err != nil {
+				return bad(err)
+			}
+			return b, nil
+		}
+	case TypeTimestamp:
+		if ts, ok := outputs.EventTime(ev, c.Field); ok {
+			return ts.UTC(), nil
+		}
+		return bad(fmt.Errorf("unrecognized time format"))
+	case TypeJSON:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return bad(err)
+		}
+		return string(b), nil
+	}
+	return bad(nil)
+}
+
+// ensureTable creates the table on first use when CreateTable is set.
+func (o *SQLOutput) ensureTable(ctx context.Context) error {
+	o.mu.Lock()
+	ready := o.ready
+	o.mu.Unlock()
+	if ready || !o.cfg.CreateTable {
+		return nil
+	}
+	if _, err := o.db.ExecContext(ctx, o.d.createTable(o.cfg.Table, o.cfg.Columns, o.cfg.Key)); err != nil {
+		return fmt.Errorf("create table %s: %w", o.cfg.Table, err)
+	}
+	o.mu.Lock()
+	o.ready = true
+	o.mu.Unlock()
+	return nil
+}
+
+// write stores rows in one transaction, as multi-row statements sized to
+// the database's parameter limit, or with COPY.
+func (o *SQLOutput) write(ctx context.Context, rows []row) error {
+	if o.cfg.Copy {
+		return o.copy(ctx, rows)
+	}
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+	per := o.d.rowsPerStatement(len(o.cols))
+	for start := 0; start < len(rows); start += per {
+		chunk := rows[start:min(start+per, len(rows))]
+		args := make([]interface{}, 0, len(chunk)*len(o.cols))
+		for _, r := range chunk {
+			args = append(args, r.vals...)
+		}
+		if _, err := tx.ExecContext(ctx, o.d.insert(o.cfg.Table, o.cols, o.cfg.Key, len(chunk)), args...); err != nil {
+			return fmt.Errorf("insert into %s: %w", o.cfg.Table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// writeEach stores rows one statement at a time and returns the ones the
+// database refused.
+func (o *SQLOutput) writeEach(ctx context.Context, rows []row) ([]reject, error) {
+	query := o.d.insert(o.cfg.Table, o.cols, o.cfg.Key, 1)
+	var failed []reject
+	for _, r := range rows {
+		_, err := o.db.ExecContext(ctx, query, r.vals...)
+		if err == nil {
+			continue
+		}
+		if !o.d.dataError(err) {
+			return nil, fmt.Errorf("insert into %s: %w", o.cfg.Table, err)
+		}
+		failed = append(failed, reject{r.ev, outputs.Permanent(0, fmt.Errorf("insert into %s: %w", o.cfg.Table, err))})
+	}
+	return failed, nil
+}
+
+// Health adds the row counters and connection pool to the delivery health.
+func (o *SQLOutput) Health() outputs.Health {
+	h := o.Batcher.Health()
+	st := o.db.Stats()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h.Details = map[string]interface{}{"sql": map[string]interface{}{
+		"driver":          o.cfg.Driver,
+		"table":           o.cfg.Table,
+		"rowsWritten":     o.written,
+		"rowsRejected":    o.rejects,
+		"openConnections": st.OpenConnections,
+		"inUse":           st.InUse,
+		"idle":            st.Idle,
+	}}
+	return h
+}
+
+// Close flushes pending events and closes the connection pool.
+func (o *SQLOutput) Close() error {
+	err := o.Batcher.Close()
+	if cerr := o.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,268 @@
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// fakeDriver records statements, with BEGIN, COMMIT and ROLLBACK, and
+// fails the ones fail picks.
+type fakeDriver struct {
+	mu   sync.Mutex
+	log  []string
+	args [][]driver.Value
+	fail func(query string, args []driver.Value) error
+}
+
+func (d *fakeDriver) Open(string) (driver.Conn, error) { return &fakeConn{d}, nil }
+
+func (d *fakeDriver) record(query string, args []driver.Value) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.fail != nil {
+		if err := d.fail(query, args); err != nil {
+			return err
+		}
+	}
+	d.log = append(d.log, query)
+	d.args = append(d.args, args)
+	return nil
+}
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c *fakeConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepare not supported")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, c.d.record("BEGIN", nil) }
+func (c *fakeConn) Commit() error             { return c.d.record("COMMIT", nil) }
+func (c *fakeConn) Rollback() error           { return c.d.record("ROLLBACK", nil) }
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, named []driver.NamedValue) (driver.Result, error) {
+	args := make([]driver.Value, len(named))
+	for i, nv := range named {
+		args[i] = nv.Value
+	}
+	if err := c.d.record(query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+var (
+	fakeMu   sync.Mutex
+	fakeSeq  int
+	fakeByID = map[string]*fakeDriver{}
+)
+
+func init() {
+	sql.Register("sqldbfake", fakeRouter{})
+	open = func(_, dsn string) (*sql.DB, error) { return sql.Open("sqldbfake", dsn) }
+}
+
+// fakeRouter hands each DSN its own fakeDriver.
+type fakeRouter struct{}
+
+func (fakeRouter) Open(dsn string) (driver.Conn, error) {
+	fakeMu.Lock()
+	defer fakeMu.Unlock()
+	return fakeByID[dsn].Open(dsn)
+}
+
+func newFake() (*fakeDriver, string) {
+	fakeMu.Lock()
+	defer fakeMu.Unlock()
+	fakeSeq++
+	dsn := fmt.Sprintf("fake-%d", fakeSeq)
+	d := &fakeDriver{}
+	fakeByID[dsn] = d
+	return d, dsn
+}
+
+type deadLetters struct {
+	mu     sync.Mutex
+	events []map[string]interface{}
+	errs   []string
+}
+
+func (d *deadLetters) add(events []map[string]interface{}, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.events = append(d.events, events...)
+	d.errs = append(d.errs, err.Error())
+}
+
+var authColumns = []Column{
+	{Name: "event_id", Field: "id"},
+	{Name: "user_name", Field: "user", NotNull: true},
+	{Name: "at", Field: "timestamp", Type: "timestamp"},
+	{Name: "attempts", Type: "int"},
+	{Name: "success", Type: "bool"},
+	{Name: "geo", Type: "json"},
+}
+
+func TestUpsertsIntoCreatedTable(t *testing.T) {
+	fake, dsn := newFake()
+	out, err := NewSQLOutput(Config{Driver: "postgres", DSN: dsn, Table: "auth.logins", Columns: authColumns, Key: []string{"EVENT_ID"}, CreateTable: true})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dl deadLetters
+	out.SetDeadLetter(dl.add)
+	batch := []map[string]interface{}{
+		{"id": "a", "user": "alice", "timestamp": "2024-05-01T10:00:00Z", "attempts": float64(1), "success": "false", "geo": map[string]interface{}{"cc": "NL"}},
+		{"id": "b", "user": "bob", "attempts": "3", "success": true},
+		{"id": "a", "user": "alice", "timestamp": "2024-05-01T10:00:05Z", "attempts": float64(2), "success": true},
+		{"user": "no key"},
+		{"id": "c", "user": "carol", "attempts": "many"},
+		{"id": "d"},
+	}
+	if err := out.SendBatch(batch); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	wantCreate := `CREATE TABLE IF NOT EXISTS "auth"."logins" (
+  "event_id" TEXT NOT NULL,
+  "user_name" TEXT NOT NULL,
+  "at" TIMESTAMPTZ,
+  "attempts" BIGINT,
+  "success" BOOLEAN,
+  "geo" JSONB,
+  PRIMARY KEY ("event_id")
+)`
+	wantInsert := `INSERT INTO "auth"."logins" ("event_id", "user_name", "at", "attempts", "success", "geo") VALUES ($1, $2, $3, $4, $5, $6), ($7, $8, $9, $10, $11, $12) ` +
+		`ON CONFLICT ("event_id") DO UPDATE SET "user_name" = EXCLUDED."user_name", "at" = EXCLUDED."at", "attempts" = EXCLUDED."attempts", "success" = EXCLUDED."success", "geo" = EXCLUDED."geo"`
+	if len(fake.log) != 4 || fake.log[0] != wantCreate || fake.log[1] != "BEGIN" || fake.log[2] != wantInsert || fake.log[3] != "COMMIT" {
+		t.Fatalf("unexpected statements:\n%s", strings.Join(fake.log, "\n---\n"))
+	}
+	args := fake.args[2]
+	want := []driver.Value{"a", "alice", time.Date(2024, 5, 1, 10, 0, 5, 0, time.UTC), int64(2), true, nil, "b", "bob", nil, int64(3), true, nil}
+	if fmt.Sprint(args) != fmt.Sprint(want) {
+		t.Fatalf("unexpected args\n got %v\nwant %v", args, want)
+	}
+	if len(dl.events) != 3 || !strings.Contains(strings.Join(dl.errs, "\n"), `"attempts": many is not a valid int`) {
+		t.Fatalf("expected the keyless, unparsable and incomplete events dead-lettered, got %v", dl.errs)
+	}
+
+	// The table is only created once.
+	if err := out.SendBatch(batch[1:2]); err != nil || strings.HasPrefix(fake.log[4], "CREATE") {
+		t.Fatalf("expected no second create, got %v %v", err, fake.log[4:])
+	}
+	d := out.Health().Details["sql"].(map[string]interface{})
+	if d["rowsWritten"] != uint64(3) || d["rowsRejected"] != uint64(3) {
+		t.Fatalf("unexpected health details %v", d)
+	}
+}
+
+func TestSplitsStatementsAtParameterLimit(t *testing.T) {
+	fake, dsn := newFake()
+	cols := []Column{{Name: "id", Type: "int"}, {Name: "user"}, {Name: "ok", Type: "bool"}}
+	out, err := NewSQLOutput(Config{Driver: "sqlserver", DSN: dsn, Table: "logins", Columns: cols, Key: []string{"id"}})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	batch := make([]map[string]interface{}, 1500)
+	for i := range batch {
+		batch[i] = map[string]interface{}{"id": float64(i), "user": "u", "ok": true}
+	}
+	if err := out.SendBatch(batch); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	// 2099 parameters fit 699 rows of three columns.
+	var sizes []int
+	for i, q := range fake.log {
+		if strings.HasPrefix(q, "MERGE") {
+			sizes = append(sizes, len(fake.args[i])/3)
+		}
+	}
+	if fmt.Sprint(sizes) != "[699 699 102]" {
+		t.Fatalf("unexpected statement sizes %v", sizes)
+	}
+	q := fake.log[1]
+	if !strings.HasPrefix(q, "MERGE INTO [logins] AS t USING (VALUES (@p1, @p2, @p3), (@p4, @p5, @p6)") ||
+		!strings.HasSuffix(q, ") AS s ([id], [user], [ok]) ON t.[id] = s.[id] WHEN MATCHED THEN UPDATE SET t.[user] = s.[user], t.[ok] = s.[ok] WHEN NOT MATCHED THEN INSERT ([id], [user], [ok]) VALUES (s.[id], s.[user], s.[ok]);") {
+		t.Fatalf("unexpected merge %q", q[:200]+"..."+q[len(q)-200:])
+	}
+}
+
+func TestRowByRowFallbackOnDataErrors(t *testing.T) {
+	fake, dsn := newFake()
+	fake.fail = func(query string, args []driver.Value) error {
+		for _, a := range args {
+			if a == "too long" {
+				return &mysql.MySQLError{Number: 1406, Message: "Data too long for column 'user'"}
+			}
+			if a == "offline" {
+				return driver.ErrBadConn
+			}
+		}
+		return nil
+	}
+	cols := []Column{{Name: "id", Type: "int"}, {Name: "user"}}
+	out, err := NewSQLOutput(Config{Driver: "mysql", DSN: dsn, Table: "logins", Columns: cols})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dl deadLetters
+	out.SetDeadLetter(dl.add)
+	if err := out.SendBatch([]map[string]interface{}{{"id": 1, "user": "a"}, {"id": 2, "user": "too long"}, {"id": 3, "user": "c"}}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	single := "INSERT INTO `logins` (`id`, `user`) VALUES (?, ?)"
+	if got := strings.Join(fake.log, "|"); got != "BEGIN|ROLLBACK|"+single+"|"+single {
+		t.Fatalf("unexpected statements %s", got)
+	}
+	if len(dl.events) != 1 || dl.events[0]["id"] != 2 || !strings.Contains(dl.errs[0], "Data too long") {
+		t.Fatalf("expected only the long row dead-lettered, got %v", dl.errs)
+	}
+	if err := out.SendBatch([]map[string]interface{}{{"id": 4, "user": "offline"}}); err == nil || len(dl.events) != 1 {
+		t.Fatalf("a connection error should fail the batch, got %v", err)
+	}
+}
+
+func TestDialectsAndValidation(t *testing.T) {
+	cols := []Column{{Name: "id", Type: TypeText}, {Name: "msg", SQLType: "VARCHAR(2000)"}}
+	if got := dialects["mysql"].createTable("logins", cols, []string{"id"}); !strings.Contains(got, "`id` VARCHAR(255) NOT NULL") || !strings.Contains(got, "`msg` VARCHAR(2000)") {
+		t.Fatalf("unexpected mysql table %s", got)
+	}
+	if got := dialects["mssql"].createTable("dbo.logins", cols, nil); !strings.HasPrefix(got, "IF OBJECT_ID(N'[dbo].[logins]', N'U') IS NULL CREATE TABLE [dbo].[logins]") {
+		t.Fatalf("unexpected sqlserver table %s", got)
+	}
+	if got := dialects["mysql"].insert("t", []string{"id"}, []string{"id"}, 1); got != "INSERT INTO `t` (`id`) VALUES (?) ON DUPLICATE KEY UPDATE `id` = `id`" {
+		t.Fatalf("unexpected key-only mysql upsert %s", got)
+	}
+	if got := dialects["postgres"].upsertFrom("t", `"bibbl_copy"`, []string{"id", "v"}, []string{"id"}); got != `INSERT INTO "t" ("id", "v") SELECT "id", "v" FROM "bibbl_copy" ON CONFLICT ("id") DO UPDATE SET "v" = EXCLUDED."v"` {
+		t.Fatalf("unexpected copy merge %s", got)
+	}
+
+	_, dsn := newFake()
+	bad := []Config{
+		{Driver: "oracle", DSN: dsn, Table: "t", Columns: cols},
+		{Driver: "postgres", Table: "t", Columns: cols},
+		{Driver: "postgres", DSN: dsn, Table: "t; DROP TABLE x", Columns: cols},
+		{Driver: "postgres", DSN: dsn, Table: "t"},
+		{Driver: "postgres", DSN: dsn, Table: "t", Columns: []Column{{Name: "a b"}}},
+		{Driver: "postgres", DSN: dsn, Table: "t", Columns: []Column{{Name: "a"}, {Name: "A"}}},
+		{Driver: "postgres", DSN: dsn, Table: "t", Columns: []Column{{Name: "a", Type: "uuid"}}},
+		{Driver: "postgres", DSN: dsn, Table: "t", Columns: cols, Key: []string{"missing"}},
+		{Driver: "mysql", DSN: dsn, Table: "t", Columns: cols, Copy: true},
+	}
+	for i, c := range bad {
+		if o, err := NewSQLOutput(c); err == nil {
+			o.Close()
+			t.Fatalf("config %d: expected an error", i)
+		}
+	}
+}
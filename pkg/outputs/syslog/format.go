@@ -0,0 +1,228 @@
+package syslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"bibbl/pkg/outputs"
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// severities maps syslog keywords, and the levels Palo Alto and Versa put
+// in their severity fields, to syslog severities.
+var severities = map[string]int{
+	"emerg": 0, "emergency": 0, "panic": 0,
+	"alert": 1,
+	"crit":  2, "critical": 2,
+	"err": 3, "error": 3, "high": 3,
+	"warning": 4, "warn": 4, "medium": 4,
+	"notice": 5, "low": 5,
+	"info": 6, "informational": 6, "information": 6,
+	"debug": 7,
+}
+
+func parseFacility(s string) (int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= 23 {
+		return n, nil
+	}
+	if n, ok := facilities[s]; ok {
+		return n, nil
+	}
+	return 0, fmt.Errorf("unknown syslog facility %q", s)
+}
+
+func parseSeverity(v interface{}) (int, bool) {
+	switch t := v.(type) {
+	case string:
+		s := strings.ToLower(strings.TrimSpace(t))
+		if n, err := strconv.Atoi(s); err == nil && n >= 0 && n <= 7 {
+			return n, true
+		}
+		n, ok := severities[s]
+		return n, ok
+	case float64:
+		if t >= 0 && t <= 7 && t == float64(int(t)) {
+			return int(t), true
+		}
+	case int:
+		if t >= 0 && t <= 7 {
+			return t, true
+		}
+	case int64:
+		if t >= 0 && t <= 7 {
+			return int(t), true
+		}
+	}
+	return 0, false
+}
+
+// header holds the values shared by both formats.
+type header struct {
+	pri                           int
+	ts                            time.Time
+	host, app, procID, msgID, msg string
+}
+
+func (o *SyslogOutput) header(ev map[string]interface{}) header {
+	h := header{procID: o.cfg.ProcID, msgID: o.cfg.MsgID}
+	sev := o.severity
+	if v, ok := outputs.Field(ev, o.cfg.SeverityField); ok {
+		if n, ok := parseSeverity(v); ok {
+			sev = n
+		}
+	}
+	h.pri = o.facility*8 + sev
+	var ok bool
+	if h.ts, ok = outputs.EventTime(ev, o.cfg.TimeField); !ok {
+		h.ts = time.Now()
+	}
+	h.host = o.hostname
+	if s := outputs.FieldString(ev, o.cfg.HostnameField); s != "" {
+		h.host = s
+	}
+	h.app = o.cfg.AppName
+	if s := outputs.FieldString(ev, o.cfg.AppNameField); s != "" {
+		h.app = s
+	}
+	if s := outputs.FieldString(ev, o.cfg.MsgIDField); s != "" {
+		h.msgID = s
+	}
+	if o.cfg.MessageFormat != MessageJSON {
+		h.msg = outputs.FieldString(ev, o.cfg.MessageField)
+	}
+	if h.msg == "" {
+		b, _ := json.Marshal(ev)
+		h.msg = string(b)
+	}
+	if o.framing == FramingNewline {
+		h.msg = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ").Replace(h.msg)
+	}
+	return h
+}
+
+// format renders one event as a syslog message, without framing.
+func (o *SyslogOutput) format(ev map[string]interface{}) []byte {
+	h := o.header(ev)
+	var b strings.Builder
+	if o.cfg.Format == FormatRFC3164 {
+		// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PID]: MSG
+		fmt.Fprintf(&b, "<%d>%s %s %s", h.pri, h.ts.Local().Format(time.Stamp), token(h.host, 255), tag(h.app))
+		if h.procID != "" {
+			b.WriteString("[" + token(h.procID, 128) + "]")
+		}
+		b.WriteString(": " + h.msg)
+		return []byte(b.String())
+	}
+	// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ", h.pri, h.ts.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		nilValue(token(h.host, 255)), nilValue(token(h.app, 48)), nilValue(token(h.procID, 128)), nilValue(token(h.msgID, 32)))
+	b.WriteString(o.structuredData(ev))
+	b.WriteString(" " + h.msg)
+	return []byte(b.String())
+}
+
+// structuredData renders the configured fields as one SD-ELEMENT, or the
+// nil value when the event has none of them.
+func (o *SyslogOutput) structuredData(ev map[string]interface{}) string {
+	if len(o.cfg.SDFields) == 0 {
+		return "-"
+	}
+	var params []string
+	for _, f := range o.cfg.SDFields {
+		v, ok := outputs.Field(ev, f)
+		if !ok || v == nil {
+			continue
+		}
+		var s string
+		switch t := v.(type) {
+		case map[string]interface{}, []interface{}:
+			b, _ := json.Marshal(t)
+			s = string(b)
+		default:
+			s = outputs.FieldString(ev, f)
+		}
+		params = append(params, sdName(f)+`="`+sdEscape.Replace(s)+`"`)
+	}
+	if len(params) == 0 {
+		return "-"
+	}
+	return "[" + o.sdID + " " + strings.Join(params, " ") + "]"
+}
+
+var sdEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// sdName makes a field name a valid SD-NAME: printable ASCII without '=',
+// ' ', ']' and '"', at most 32 characters.
+func sdName(s string) string {
+	b := []byte(token(s, 32))
+	for i, c := range b {
+		if c == '=' || c == ']' || c == '"' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// token keeps a header field to printable ASCII without spaces, at most n
+// bytes.
+func token(s string, n int) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c < 33 || c > 126 {
+			b[i] = '_'
+		}
+	}
+	if len(b) > n {
+		b = b[:n]
+	}
+	return string(b)
+}
+
+func nilValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// tag is the RFC 3164 TAG: up to 32 characters of [A-Za-z0-9._/-].
+func tag(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if b.Len() == 32 {
+			break
+		}
+		if r < 128 && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' || r == '/') {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() == 0 {
+		return "bibbl"
+	}
+	return b.String()
+}
+
+// truncate cuts msg to n bytes without splitting a UTF-8 sequence.
+func truncate(msg []byte, n int) []byte {
+	if n <= 0 || len(msg) <= n {
+		return msg
+	}
+	msg = msg[:n]
+	for i := 0; i < utf8.UTFMax && len(msg) > 0; i++ {
+		if r, size := utf8.DecodeLastRune(msg); r != utf8.RuneError || size > 1 {
+			break
+		}
+		msg = msg[:len(msg)-1]
+	}
+	return msg
+}
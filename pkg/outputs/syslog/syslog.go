@@ -0,0 +1,366 @@
+// Package syslog relays events to syslog receivers as RFC 5424 or RFC 3164
+// messages over UDP, TCP or TLS. It backs the "syslog" destination type and
+// speaks the newline framing of bibbl's own syslog input by default.
+package syslog
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bibbl/pkg/outputs"
+)
+
+// Transports.
+const (
+	ProtocolUDP = "udp"
+	ProtocolTCP = "tcp"
+	ProtocolTLS = "tls"
+)
+
+// Message formats.
+const (
+	FormatRFC5424 = "rfc5424"
+	FormatRFC3164 = "rfc3164"
+)
+
+// Stream framings (RFC 6587).
+const (
+	FramingNewline       = "newline"
+	FramingOctetCounting = "octet-counting"
+)
+
+// MSG contents.
+const (
+	MessageField = "field" // the messageField value, or the event as JSON when it is absent
+	MessageJSON  = "json"  // always the event as JSON
+)
+
+// Config holds configuration for a syslog destination.
+type Config struct {
+	Address  string `json:"address"`  // host:port; the port defaults to 514, or 6514 for TLS
+	Protocol string `json:"protocol"` // udp | tcp (default) | tls
+	Format   string `json:"format"`   // rfc5424 (default) | rfc3164
+	Framing  string `json:"framing"`  // newline (default) | octet-counting; TCP and TLS only
+
+	Facility      string `json:"facility"`      // name or number, default local0
+	Severity      string `json:"severity"`      // default severity, default info
+	SeverityField string `json:"severityField"` // event field holding a severity name or number, default "severity"
+	TimeField     string `json:"timeField"`     // default "timestamp"
+
+	Hostname      string `json:"hostname"`      // default: this host's name
+	HostnameField string `json:"hostnameField"` // event field that overrides hostname
+	AppName       string `json:"appName"`       // default "bibbl"
+	AppNameField  string `json:"appNameField"`
+	ProcID        string `json:"procId"`
+	MsgID         string `json:"msgId"`
+	MsgIDField    string `json:"msgIdField"`
+
+	MessageFormat string `json:"messageFormat"` // field (default) | json
+	MessageField  string `json:"messageField"`  // default "message"
+
+	// SDFields are copied into one RFC 5424 structured data element with
+	// the id SDID (default bibbl@32473).
+	SDFields []string `json:"sdFields"`
+	SDID     string   `json:"sdId"`
+
+	// MaxMessageBytes truncates longer messages; default 2048 for UDP and
+	// unlimited for TCP and TLS.
+	MaxMessageBytes int `json:"maxMessageBytes"`
+
+	PoolSize            int `json:"poolSize"` // connections, default 2
+	TimeoutSec          int `json:"timeoutSec"`
+	ReconnectDelayMs    int `json:"reconnectDelayMs"`
+	ReconnectMaxDelayMs int `json:"reconnectMaxDelayMs"`
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+
+	TLS outputs.TLSConfig `json:"tls"`
+}
+
+// SyslogOutput sends events to one syslog receiver.
+type SyslogOutput struct {
+	*outputs.Batcher
+
+	cfg      Config
+	framing  string
+	facility int
+	severity int
+	hostname string
+	sdID     string
+	tlsCfg   *tls.Config
+	timeout  time.Duration
+
+	conns chan net.Conn // the pool; nil entries are slots to dial
+
+	mu        sync.Mutex
+	failures  int
+	nextDial  time.Time
+	closed    bool
+	closeOnce sync.Once
+}
+
+// NewSyslogOutput validates cfg, applies defaults and starts the output.
+// Connections are dialed on first use.
+func NewSyslogOutput(cfg Config) (*SyslogOutput, error) {
+	o := &SyslogOutput{}
+	switch cfg.Protocol = strings.ToLower(cfg.Protocol); cfg.Protocol {
+	case "":
+		cfg.Protocol = ProtocolTCP
+		if cfg.TLS.Enabled {
+			cfg.Protocol = ProtocolTLS
+		}
+	case ProtocolUDP, ProtocolTCP, ProtocolTLS:
+	default:
+		return nil, fmt.Errorf("protocol must be udp, tcp or tls, got %q", cfg.Protocol)
+	}
+	if strings.TrimSpace(cfg.Address) == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+		port := "514"
+		if cfg.Protocol == ProtocolTLS {
+			port = "6514"
+		}
+		cfg.Address = net.JoinHostPort(strings.Trim(cfg.Address, "[]"), port)
+	}
+	switch cfg.Format = strings.ToLower(cfg.Format); cfg.Format {
+	case "", "5424":
+		cfg.Format = FormatRFC5424
+	case FormatRFC5424:
+	case FormatRFC3164, "3164", "bsd":
+		cfg.Format = FormatRFC3164
+	default:
+		return nil, fmt.Errorf("format must be rfc5424 or rfc3164, got %q", cfg.Format)
+	}
+	switch cfg.Framing = strings.ToLower(cfg.Framing); cfg.Framing {
+	case "", "lf", FramingNewline:
+		cfg.Framing = FramingNewline
+	case FramingOctetCounting, "octet_counting", "octet":
+		cfg.Framing = FramingOctetCounting
+	default:
+		return nil, fmt.Errorf("framing must be newline or octet-counting, got %q", cfg.Framing)
+	}
+	o.framing = cfg.Framing
+	if cfg.Protocol == ProtocolUDP {
+		o.framing = "" // one message per datagram
+	}
+	var err error
+	if cfg.Facility == "" {
+		cfg.Facility = "local0"
+	}
+	if o.facility, err = parseFacility(cfg.Facility); err != nil {
+		return nil, err
+	}
+	if cfg.Severity == "" {
+		cfg.Severity = "info"
+	}
+	var ok bool
+	if o.severity, ok = parseSeverity(cfg.Severity); !ok {
+		return nil, fmt.Errorf("unknown syslog severity %q", cfg.Severity)
+	}
+	if cfg.SeverityField == "" {
+		cfg.SeverityField = "severity"
+	}
+	if cfg.TimeField == "" {
+		cfg.TimeField = "timestamp"
+	}
+	if o.hostname = cfg.Hostname; o.hostname == "" {
+		o.hostname, _ = os.Hostname()
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = "bibbl"
+	}
+	switch cfg.MessageFormat = strings.ToLower(cfg.MessageFormat); cfg.MessageFormat {
+	case "":
+		cfg.MessageFormat = MessageField
+	case MessageField, MessageJSON:
+	default:
+		return nil, fmt.Errorf("messageFormat must be field or json, got %q", cfg.MessageFormat)
+	}
+	if cfg.MessageField == "" {
+		cfg.MessageField = "message"
+	}
+	if o.sdID = token(cfg.SDID, 32); o.sdID == "" {
+		o.sdID = "bibbl@32473"
+	}
+	if cfg.MaxMessageBytes == 0 && cfg.Protocol == ProtocolUDP {
+		cfg.MaxMessageBytes = 2048
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 2
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 10
+	}
+	if cfg.ReconnectDelayMs <= 0 {
+		cfg.ReconnectDelayMs = 500
+	}
+	if cfg.ReconnectMaxDelayMs <= 0 {
+		cfg.ReconnectMaxDelayMs = 30000
+	}
+	if cfg.Protocol == ProtocolTLS {
+		if o.tlsCfg, err = cfg.TLS.Build(); err != nil {
+			return nil, err
+		}
+	}
+	o.cfg = cfg
+	o.timeout = time.Duration(cfg.TimeoutSec) * time.Second
+	o.conns = make(chan net.Conn, cfg.PoolSize)
+	for i := 0; i < cfg.PoolSize; i++ {
+		o.conns <- nil
+	}
+	o.Batcher = outputs.NewBatcher("syslog", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.deliver)
+	return o, nil
+}
+
+// NewOutput builds a SyslogOutput from a destination config map. It is the
+// factory registered for the "syslog" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewSyslogOutput(c)
+}
+
+// deliver writes a batch over one pooled connection. A failed write drops
+// the connection and fails the batch so it is retried whole.
+func (o *SyslogOutput) deliver(events []map[string]interface{}) error {
+	conn, err := o.acquire()
+	if err != nil {
+		return err
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(o.timeout))
+	if o.cfg.Protocol == ProtocolUDP {
+		for _, ev := range events {
+			if _, err = conn.Write(truncate(o.format(ev), o.cfg.MaxMessageBytes)); err != nil {
+				break
+			}
+		}
+	} else {
+		var buf []byte
+		for _, ev := range events {
+			msg := truncate(o.format(ev), o.cfg.MaxMessageBytes)
+			if o.framing == FramingOctetCounting {
+				buf = strconv.AppendInt(buf, int64(len(msg)), 10)
+				buf = append(buf, ' ')
+				buf = append(buf, msg...)
+			} else {
+				buf = append(append(buf, msg...), '\n')
+			}
+		}
+		_, err = conn.Write(buf)
+	}
+	o.release(conn, err)
+	if err != nil {
+		return fmt.Errorf("syslog write to %s: %w", o.cfg.Address, err)
+	}
+	return nil
+}
+
+// acquire takes a connection from the pool, dialing one when the slot is
+// empty or its connection was closed by the peer. Dial failures back off
+// exponentially; during the backoff acquire fails without dialing.
+func (o *SyslogOutput) acquire() (net.Conn, error) {
+	conn := <-o.conns
+	if conn != nil && o.cfg.Protocol != ProtocolUDP && !alive(conn) {
+		_ = conn.Close()
+		conn = nil
+	}
+	if conn != nil {
+		return conn, nil
+	}
+	o.mu.Lock()
+	closed, wait := o.closed, time.Until(o.nextDial)
+	o.mu.Unlock()
+	if closed {
+		o.conns <- nil
+		return nil, outputs.ErrClosed
+	}
+	if wait > 0 {
+		o.conns <- nil
+		return nil, fmt.Errorf("syslog %s unreachable, reconnecting in %s", o.cfg.Address, wait.Round(time.Millisecond))
+	}
+	conn, err := o.dial()
+	o.mu.Lock()
+	if err != nil {
+		o.failures++
+		backoff := time.Duration(o.cfg.ReconnectDelayMs) * time.Millisecond << min(o.failures-1, 16)
+		o.nextDial = time.Now().Add(min(backoff, time.Duration(o.cfg.ReconnectMaxDelayMs)*time.Millisecond))
+	} else {
+		o.failures, o.nextDial = 0, time.Time{}
+	}
+	o.mu.Unlock()
+	if err != nil {
+		o.conns <- nil
+		return nil, fmt.Errorf("syslog dial %s: %w", o.cfg.Address, err)
+	}
+	return conn, nil
+}
+
+func (o *SyslogOutput) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: o.timeout, KeepAlive: 30 * time.Second}
+	switch o.cfg.Protocol {
+	case ProtocolUDP:
+		return d.Dial("udp", o.cfg.Address)
+	case ProtocolTLS:
+		return tls.DialWithDialer(d, "tcp", o.cfg.Address, o.tlsCfg)
+	}
+	return d.Dial("tcp", o.cfg.Address)
+}
+
+// release returns conn to the pool, or drops it after a failed write.
+func (o *SyslogOutput) release(conn net.Conn, err error) {
+	o.mu.Lock()
+	closed := o.closed
+	o.mu.Unlock()
+	if err != nil || closed {
+		_ = conn.Close()
+		conn = nil
+	}
+	o.conns <- conn
+}
+
+// alive reports whether the peer still has the connection open. Receivers
+// do not send on syslog streams, so anything but a timeout on an immediate
+// read means the connection is gone.
+func alive(conn net.Conn) bool {
+	_ = conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	_ = conn.SetReadDeadline(time.Time{})
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Close flushes what is batched and closes the pooled connections.
+func (o *SyslogOutput) Close() error {
+	err := o.Batcher.Close()
+	o.closeOnce.Do(func() {
+		o.mu.Lock()
+		o.closed = true
+		o.mu.Unlock()
+		for i := 0; i < o.cfg.PoolSize; i++ {
+			if conn := <-o.conns; conn != nil {
+				_ = conn.Close()
+			}
+		}
+		for i := 0; i < o.cfg.PoolSize; i++ {
+			o.conns <- nil // late sends fail with ErrClosed instead of blocking
+		}
+	})
+	return err
+}
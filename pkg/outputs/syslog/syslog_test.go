@@ -0,0 +1,293 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	syslogin "bibbl/internal/inputs/syslog"
+	"bibbl/pkg/outputs"
+)
+
+type collector struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (c *collector) Handle(m string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.msgs = append(c.msgs, m)
+}
+
+func (c *collector) wait(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		if len(c.msgs) >= n {
+			defer c.mu.Unlock()
+			return append([]string(nil), c.msgs...)
+		}
+		c.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d messages", n)
+	return nil
+}
+
+func serverCert(t *testing.T) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "collector"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// The output's defaults match bibbl's own TLS syslog input.
+func TestRFC5424OverTLSToSyslogInput(t *testing.T) {
+	tlsCert, cert := serverCert(t)
+	var got collector
+	addr := freeAddr(t)
+	in := syslogin.New(addr, &tls.Config{Certificates: []tls.Certificate{tlsCert}}, &got)
+	if err := in.Start(context.Background()); err != nil {
+		t.Fatalf("start input: %v", err)
+	}
+	defer in.Stop()
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	pin := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+
+	out, err := NewSyslogOutput(Config{
+		Address: addr, Protocol: ProtocolTLS, HostnameField: "device", SDFields: []string{"src", "action", "missing"},
+		TLS: outputs.TLSConfig{CAPEM: ca, PinSHA256: []string{base64.StdEncoding.EncodeToString(pin[:])}},
+	})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	err = out.SendBatch([]map[string]interface{}{
+		{"timestamp": "2024-05-01T10:00:00Z", "device": "fw-1", "src": "10.0.0.1", "action": `allow "all"`, "message": "first\nline"},
+		{"timestamp": "2024-05-01T10:00:01Z", "severity": "critical", "n": 2.0},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	msgs := got.wait(t, 2)
+	want := `<134>1 2024-05-01T10:00:00.000000Z fw-1 bibbl - - [bibbl@32473 src="10.0.0.1" action="allow \"all\""] first line`
+	if msgs[0] != want {
+		t.Fatalf("unexpected message\n got %s\nwant %s", msgs[0], want)
+	}
+	if !strings.HasPrefix(msgs[1], "<130>1 2024-05-01T10:00:01.000000Z ") || !strings.HasSuffix(msgs[1], ` - {"n":2,"severity":"critical","timestamp":"2024-05-01T10:00:01Z"}`) {
+		t.Fatalf("expected severity from the event and the event as JSON, got %s", msgs[1])
+	}
+
+	wrongPin := sha256.Sum256([]byte("other key"))
+	pinned, err := NewSyslogOutput(Config{Address: addr, Protocol: ProtocolTLS,
+		TLS: outputs.TLSConfig{CAPEM: ca, PinSHA256: []string{strings.ToUpper(hex.EncodeToString(wrongPin[:]))}}})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer pinned.Close()
+	if err := pinned.SendBatch([]map[string]interface{}{{"message": "x"}}); err == nil || !strings.Contains(err.Error(), "pinSha256") {
+		t.Fatalf("expected the pin to reject the server, got %v", err)
+	}
+}
+
+func TestRFC3164WithOctetCounting(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	frames := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			n, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(n))
+			buf := make([]byte, size)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+			frames <- string(buf)
+		}
+	}()
+
+	out, err := NewSyslogOutput(Config{Address: ln.Addr().String(), Format: FormatRFC3164, Framing: FramingOctetCounting,
+		Facility: "auth", Hostname: "relay", AppName: "pan os", ProcID: "42"})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	ts := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	if err := out.SendBatch([]map[string]interface{}{
+		{"timestamp": ts.Format(time.RFC3339), "severity": "high", "message": "multi\nline"},
+	}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	select {
+	case f := <-frames:
+		want := "<35>" + ts.Local().Format(time.Stamp) + " relay panos[42]: multi\nline"
+		if f != want {
+			t.Fatalf("unexpected frame\n got %q\nwant %q", f, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame received")
+	}
+}
+
+func TestUDPTruncatesLongMessages(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	out, err := NewSyslogOutput(Config{Address: pc.LocalAddr().String(), Protocol: ProtocolUDP, MaxMessageBytes: 120})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	if err := out.SendBatch([]map[string]interface{}{{"message": strings.Repeat("é", 200)}}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	buf := make([]byte, 4096)
+	_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if n > 120 || n < 118 || !strings.HasSuffix(string(buf[:n]), "é") {
+		t.Fatalf("expected a datagram cut at a rune boundary near 120 bytes, got %d bytes", n)
+	}
+}
+
+// lineServer is a newline-framed receiver that can drop its connections
+// and stop listening, like a collector being restarted.
+type lineServer struct {
+	collector
+	ln    net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newLineServer(t *testing.T, addr string) *lineServer {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &lineServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go func() {
+				sc := bufio.NewScanner(conn)
+				for sc.Scan() {
+					s.Handle(sc.Text())
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *lineServer) stop() {
+	_ = s.ln.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+func TestReconnectsWithBackoff(t *testing.T) {
+	srv := newLineServer(t, "127.0.0.1:0")
+	addr := srv.ln.Addr().String()
+	out, err := NewSyslogOutput(Config{Address: addr, PoolSize: 1, ReconnectDelayMs: 60000})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	send := func() error { return out.SendBatch([]map[string]interface{}{{"message": "m"}}) }
+	if err := send(); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	srv.wait(t, 1)
+
+	// The receiver restarts: the pooled connection is dead and replaced.
+	srv.stop()
+	srv2 := newLineServer(t, addr)
+	time.Sleep(50 * time.Millisecond)
+	if err := send(); err != nil {
+		t.Fatalf("send after restart: %v", err)
+	}
+	srv2.wait(t, 1)
+
+	// The receiver is gone: the dial fails, then attempts back off.
+	srv2.stop()
+	time.Sleep(50 * time.Millisecond)
+	if err := send(); err == nil || !strings.Contains(err.Error(), "dial") {
+		t.Fatalf("expected a dial error, got %v", err)
+	}
+	if err := send(); err == nil || !strings.Contains(err.Error(), "reconnecting in") {
+		t.Fatalf("expected the next attempt to wait for the backoff, got %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package outputs
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Template expands index names, topics and object paths from an event and
+// its timestamp. It understands strftime verbs (%Y %m %d %H %M %S %j), the
+// ${yyyy} ${MM} ${dd} ${HH} ${mm} ${ss} tokens used by archive path
+// templates (also written $(yyyy)), and ${field} or %{field} for event
+// fields, dotted names included. Field values have path separators and
+// whitespace replaced so they cannot escape their path segment; missing
+// fields expand to "unknown".
+type Template struct {
+	src   string
+	parts []tmplPart
+}
+
+type tmplPart struct {
+	lit   string
+	verb  string // time layout
+	field string
+}
+
+var timeTokens = map[string]string{
+	"yyyy": "2006", "yy": "06", "MM": "01", "dd": "02", "HH": "15", "mm": "04", "ss": "05",
+}
+
+var strftimeVerbs = map[byte]string{
+	'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'H': "15", 'M': "04", 'S': "05", 'j': "002",
+}
+
+// ParseTemplate compiles a template.
+func ParseTemplate(s string) (*Template, error) {
+	t := &Template{src: s}
+	var lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			t.parts = append(t.parts, tmplPart{lit: lit.String()})
+			lit.Reset()
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case (c == '$' || c == '%') && i+1 < len(s) && (s[i+1] == '{' || (c == '$' && s[i+1] == '(')):
+			closer := byte('}')
+			if s[i+1] == '(' {
+				closer = ')'
+			}
+			end := strings.IndexByte(s[i+2:], closer)
+			if end < 0 {
+				return nil, fmt.Errorf("template %q: unterminated %c%c at offset %d", s, c, s[i+1], i)
+			}
+			name := strings.TrimSpace(s[i+2 : i+2+end])
+			if name == "" {
+				return nil, fmt.Errorf("template %q: empty placeholder at offset %d", s, i)
+			}
+			flush()
+			if layout, ok := timeTokens[name]; ok && c == '$' {
+				t.parts = append(t.parts, tmplPart{verb: layout})
+			} else {
+				t.parts = append(t.parts, tmplPart{field: name})
+			}
+			i += 2 + end
+		case c == '%' && i+1 < len(s):
+			if s[i+1] == '%' {
+				lit.WriteByte('%')
+				i++
+				continue
+			}
+			layout, ok := strftimeVerbs[s[i+1]]
+			if !ok {
+				return nil, fmt.Errorf("template %q: unknown verb %%%c", s, s[i+1])
+			}
+			flush()
+			t.parts = append(t.parts, tmplPart{verb: layout})
+			i++
+		default:
+			lit.WriteByte(c)
+		}
+	}
+	flush()
+	return t, nil
+}
+
+// String returns the template source.
+func (t *Template) String() string { return t.src }
+
+// Static reports whether the template expands to the same text for every
+// event at the same time, i.e. uses no event fields.
+func (t *Template) Static() bool {
+	for _, p := range t.parts {
+		if p.field != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Prefix returns the literal text before the first time or field
+// placeholder, which every expansion starts with.
+func (t *Template) Prefix() string {
+	if len(t.parts) > 0 && t.parts[0].verb == "" && t.parts[0].field == "" {
+		return t.parts[0].lit
+	}
+	return ""
+}
+
+// Pattern returns an unanchored regular expression matching every expansion:
+// literals match themselves, time placeholders match their digits and field
+// placeholders match one path segment.
+func (t *Template) Pattern() string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch {
+		case p.verb != "":
+			fmt.Fprintf(&b, `\d{%d}`, len(p.verb))
+		case p.field != "":
+			b.WriteString(`[^/\\]+`)
+		default:
+			b.WriteString(regexp.QuoteMeta(p.lit))
+		}
+	}
+	return b.String()
+}
+
+// Execute expands the template; times are rendered in UTC.
+func (t *Template) Execute(event map[string]interface{}, ts time.Time) string {
+	ts = ts.UTC()
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch {
+		case p.verb != "":
+			b.WriteString(ts.Format(p.verb))
+		case p.field != "":
+			b.WriteString(sanitizeSegment(FieldString(event, p.field)))
+		default:
+			b.WriteString(p.lit)
+		}
+	}
+	return b.String()
+}
+
+func sanitizeSegment(v string) string {
+	v = strings.TrimSpace(v)
+	if v == "" || v == "." || v == ".." {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ' ', '\t', '\n', '\r', 0:
+			return '_'
+		}
+		return r
+	}, v)
+}
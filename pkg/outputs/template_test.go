@@ -0,0 +1,39 @@
+package outputs
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestTemplateExpansion(t *testing.T) {
+	ts := time.Date(2024, 5, 1, 9, 7, 0, 0, time.UTC)
+	ev := map[string]interface{}{"host": "fw/01", "geo": map[string]interface{}{"country": "NZ"}}
+	cases := map[string]string{
+		"logs-versa-%Y.%m.%d":                "logs-versa-2024.05.01",
+		"bibbl/${yyyy}/${MM}/${dd}/${HH}":    "bibbl/2024/05/01/09",
+		"raw/$(yyyy)/$(MM)/data-$(mm).jsonl": "raw/2024/05/data-07.jsonl",
+		"${host}/%{geo.country}/${missing}":  "fw_01/NZ/unknown",
+		"100%% %j":                           "100% 122",
+	}
+	for src, want := range cases {
+		tmpl, err := ParseTemplate(src)
+		if err != nil {
+			t.Fatalf("parse %q: %v", src, err)
+		}
+		if got := tmpl.Execute(ev, ts); got != want {
+			t.Fatalf("%q: got %q, want %q", src, got, want)
+		}
+		if !regexp.MustCompile("^" + tmpl.Pattern() + "$").MatchString(want) {
+			t.Fatalf("%q: pattern %q does not match %q", src, tmpl.Pattern(), want)
+		}
+	}
+	if tmpl, _ := ParseTemplate("/var/log/bibbl/${host}/%Y.ndjson"); tmpl.Prefix() != "/var/log/bibbl/" {
+		t.Fatalf("unexpected prefix %q", tmpl.Prefix())
+	}
+	for _, bad := range []string{"logs-%Q", "x-${host", "x-${}"} {
+		if _, err := ParseTemplate(bad); err == nil {
+			t.Fatalf("expected %q to be rejected", bad)
+		}
+	}
+}
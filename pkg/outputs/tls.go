@@ -0,0 +1,111 @@
+package outputs
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TLSConfig is the "tls" block shared by network outputs. Certificates and
+// keys are given as file paths or inline PEM; inline values may be vault://
+// references like any other destination setting.
+type TLSConfig struct {
+	Enabled            bool   `json:"enabled"` // for outputs where TLS is optional (syslog, kafka)
+	CAFile             string `json:"caFile"`  // trust only this CA instead of the system pool
+	CAPEM              string `json:"caPem"`
+	CertFile           string `json:"certFile"` // client certificate for mutual TLS
+	CertPEM            string `json:"certPem"`
+	KeyFile            string `json:"keyFile"`
+	KeyPEM             string `json:"keyPem"`
+	ServerName         string `json:"serverName"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify"`
+	// PinSHA256 pins the server chain: the handshake fails unless one of
+	// its certificates has a public key (SubjectPublicKeyInfo) with one of
+	// these SHA-256 digests, base64 or hex encoded.
+	PinSHA256 []string `json:"pinSha256"`
+}
+
+// Configured reports whether any TLS setting was given.
+func (c TLSConfig) Configured() bool {
+	return c.Enabled || c.CAFile != "" || c.CAPEM != "" || c.CertFile != "" || c.CertPEM != "" ||
+		c.ServerName != "" || c.InsecureSkipVerify || len(c.PinSHA256) > 0
+}
+
+// Build returns the client TLS configuration.
+func (c TLSConfig) Build() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify, // #nosec G402 -- explicit opt-in per destination
+	}
+	caPEM := []byte(c.CAPEM)
+	if c.CAFile != "" {
+		data, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls caFile: %w", err)
+		}
+		caPEM = data
+	}
+	if len(caPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("tls ca: no certificates found")
+		}
+		cfg.RootCAs = pool
+	}
+	certPEM, keyPEM := []byte(c.CertPEM), []byte(c.KeyPEM)
+	if c.CertFile != "" {
+		data, err := os.ReadFile(c.CertFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls certFile: %w", err)
+		}
+		certPEM = data
+	}
+	if c.KeyFile != "" {
+		data, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("read tls keyFile: %w", err)
+		}
+		keyPEM = data
+	}
+	if len(certPEM) > 0 || len(keyPEM) > 0 {
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("tls client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(c.PinSHA256) > 0 {
+		pins := map[[sha256.Size]byte]bool{}
+		for _, p := range c.PinSHA256 {
+			p = strings.TrimSpace(strings.TrimPrefix(p, "sha256/"))
+			b, err := base64.StdEncoding.DecodeString(p)
+			if err != nil || len(b) != sha256.Size {
+				b, err = hex.DecodeString(strings.ReplaceAll(p, ":", ""))
+			}
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("tls pinSha256: %q is not a base64 or hex SHA-256 digest", p)
+			}
+			pins[[sha256.Size]byte(b)] = true
+		}
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			// The verified chains include a root the server did not send.
+			certs := append([]*x509.Certificate(nil), cs.PeerCertificates...)
+			for _, chain := range cs.VerifiedChains {
+				certs = append(certs, chain...)
+			}
+			for _, cert := range certs {
+				if pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+			return fmt.Errorf("tls: no certificate in the server chain matches pinSha256")
+		}
+	}
+	return cfg, nil
+}
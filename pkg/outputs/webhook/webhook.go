@@ -0,0 +1,291 @@
+// Package webhook posts events to arbitrary HTTP endpoints such as ticketing
+// and SOAR webhooks. It backs the "http" destination type.
+package webhook
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"bibbl/pkg/outputs"
+)
+
+// Body formats.
+const (
+	FormatJSON      = "json"       // one request per event, body is the event
+	FormatJSONArray = "json_array" // one request per batch, body is an array
+	FormatNDJSON    = "ndjson"     // one request per batch, one event per line
+	FormatTemplate  = "template"   // one request per event, body from Template
+)
+
+// Config holds configuration for an HTTP webhook destination.
+type Config struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`  // default POST
+	Headers     map[string]string `json:"headers"` // values may be vault:// references
+	Format      string            `json:"format"`  // json (default) | json_array | ndjson | template
+	Template    string            `json:"template"`
+	ContentType string            `json:"contentType"`
+	Compression string            `json:"compression"` // gzip | none
+
+	BatchMaxEvents   int `json:"batchMaxEvents"`
+	BatchMaxBytes    int `json:"batchMaxBytes"`
+	FlushIntervalSec int `json:"flushIntervalSec"`
+	TimeoutSec       int `json:"timeoutSec"`
+
+	// RetryStatuses lists the response codes retried with exponential
+	// backoff; other 4xx/5xx answers reject the request for good.
+	RetryStatuses   []int `json:"retryStatuses"`
+	MaxRetries      int   `json:"maxRetries"`
+	RetryDelayMs    int   `json:"retryDelayMs"`
+	RetryMaxDelayMs int   `json:"retryMaxDelayMs"`
+
+	TLS outputs.TLSConfig `json:"tls"`
+}
+
+var defaultRetryStatuses = []int{408, 429, 500, 502, 503, 504}
+
+// WebhookOutput sends events to one HTTP endpoint.
+type WebhookOutput struct {
+	*outputs.Batcher
+
+	cfg    Config
+	tmpl   *template.Template
+	client *http.Client
+}
+
+// templateFuncs are available to body templates, next to the event fields.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"field": func(ev map[string]interface{}, name string) interface{} {
+		v, _ := outputs.Field(ev, name)
+		return v
+	},
+	"default": func(def, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"now":   func() string { return time.Now().UTC().Format(time.RFC3339) },
+}
+
+// NewWebhookOutput validates cfg, applies defaults and starts the output.
+func NewWebhookOutput(cfg Config) (*WebhookOutput, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url must be an absolute http(s) URL, got %q", cfg.URL)
+	}
+	cfg.Method = strings.ToUpper(strings.TrimSpace(cfg.Method))
+	if cfg.Method == "" {
+		cfg.Method = http.MethodPost
+	}
+	o := &WebhookOutput{}
+	switch cfg.Format = strings.ToLower(cfg.Format); cfg.Format {
+	case "":
+		cfg.Format = FormatJSON
+	case FormatJSON, FormatJSONArray, FormatNDJSON:
+	case FormatTemplate:
+		if strings.TrimSpace(cfg.Template) == "" {
+			return nil, fmt.Errorf("template is required with format template")
+		}
+		if o.tmpl, err = template.New("body").Funcs(templateFuncs).Option("missingkey=zero").Parse(cfg.Template); err != nil {
+			return nil, fmt.Errorf("parse template: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("format must be json, json_array, ndjson or template, got %q", cfg.Format)
+	}
+	if cfg.ContentType == "" {
+		switch cfg.Format {
+		case FormatNDJSON:
+			cfg.ContentType = "application/x-ndjson"
+		case FormatTemplate:
+			cfg.ContentType = "text/plain; charset=utf-8"
+		default:
+			cfg.ContentType = "application/json"
+		}
+	}
+	switch cfg.Compression = strings.ToLower(cfg.Compression); cfg.Compression {
+	case "", "none", "gzip":
+	default:
+		return nil, fmt.Errorf("compression must be gzip or none, got %q", cfg.Compression)
+	}
+	if len(cfg.RetryStatuses) == 0 {
+		cfg.RetryStatuses = defaultRetryStatuses
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryDelayMs <= 0 {
+		cfg.RetryDelayMs = 500
+	}
+	if cfg.RetryMaxDelayMs <= 0 {
+		cfg.RetryMaxDelayMs = 30000
+	}
+	if cfg.TimeoutSec <= 0 {
+		cfg.TimeoutSec = 30
+	}
+	tlsCfg, err := cfg.TLS.Build()
+	if err != nil {
+		return nil, err
+	}
+	o.cfg = cfg
+	o.client = &http.Client{
+		Timeout: time.Duration(cfg.TimeoutSec) * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConns:        10,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig:     tlsCfg,
+		},
+	}
+	o.Batcher = outputs.NewBatcher("webhook", outputs.BatchLimits{
+		MaxEvents:     cfg.BatchMaxEvents,
+		MaxBytes:      cfg.BatchMaxBytes,
+		FlushInterval: time.Duration(cfg.FlushIntervalSec) * time.Second,
+	}, o.deliver)
+	return o, nil
+}
+
+// NewOutput builds a WebhookOutput from a destination config map. It is the
+// factory registered for the "http" destination type.
+func NewOutput(cfg map[string]interface{}) (outputs.Output, error) {
+	var c Config
+	if err := outputs.DecodeConfig(cfg, &c); err != nil {
+		return nil, err
+	}
+	return NewWebhookOutput(c)
+}
+
+// deliver sends the batch. Batch formats make one request; per-event
+// formats make one request per event, and an event the endpoint rejects for
+// good is dead-lettered on its own so the rest still go out.
+func (o *WebhookOutput) deliver(events []map[string]interface{}) error {
+	switch o.cfg.Format {
+	case FormatJSONArray:
+		body, err := json.Marshal(events)
+		if err != nil {
+			return fmt.Errorf("failed to marshal batch: %w", err)
+		}
+		return o.request(body)
+	case FormatNDJSON:
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, ev := range events {
+			if err := enc.Encode(ev); err != nil {
+				return fmt.Errorf("failed to marshal event: %w", err)
+			}
+		}
+		return o.request(buf.Bytes())
+	}
+	for _, ev := range events {
+		body, err := o.render(ev)
+		if err == nil {
+			err = o.request(body)
+		}
+		if _, permanent := outputs.IsPermanent(err); permanent {
+			o.DeadLetter([]map[string]interface{}{ev}, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *WebhookOutput) render(ev map[string]interface{}) ([]byte, error) {
+	if o.tmpl == nil {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			return nil, outputs.Permanent(0, fmt.Errorf("failed to marshal event: %w", err))
+		}
+		return body, nil
+	}
+	var buf bytes.Buffer
+	if err := o.tmpl.Execute(&buf, ev); err != nil {
+		return nil, outputs.Permanent(0, fmt.Errorf("render template: %w", err))
+	}
+	return buf.Bytes(), nil
+}
+
+// request sends one body, retrying transport errors and RetryStatuses with
+// exponential backoff (or the server's Retry-After).
+func (o *WebhookOutput) request(body []byte) error {
+	if o.cfg.Compression == "gzip" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	delay := time.Duration(o.cfg.RetryDelayMs) * time.Millisecond
+	maxDelay := time.Duration(o.cfg.RetryMaxDelayMs) * time.Millisecond
+	var lastErr error
+	for attempt := 0; attempt <= o.cfg.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay = min(delay*2, maxDelay)
+		}
+		status, retryAfter, err := o.do(body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if status != 0 && !slices.Contains(o.cfg.RetryStatuses, status) {
+			if status == http.StatusUnauthorized || status == http.StatusForbidden {
+				return err // credentials: wait in the queue until fixed
+			}
+			return outputs.Permanent(status, err)
+		}
+		if retryAfter > 0 {
+			delay = min(retryAfter, maxDelay)
+		}
+	}
+	return fmt.Errorf("failed after %d retries: %w", o.cfg.MaxRetries, lastErr)
+}
+
+// do performs one attempt. status is 0 for transport errors.
+func (o *WebhookOutput) do(body []byte) (status int, retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(context.Background(), o.cfg.Method, o.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", o.cfg.ContentType)
+	if o.cfg.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for k, v := range o.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, 0, nil
+	}
+	if secs, convErr := strconv.Atoi(resp.Header.Get("Retry-After")); convErr == nil && secs > 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	return resp.StatusCode, retryAfter, fmt.Errorf("%s %s returned status %d: %s", o.cfg.Method, o.cfg.URL, resp.StatusCode, strings.TrimSpace(string(respBody)))
+}
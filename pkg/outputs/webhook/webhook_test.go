@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bibbl/pkg/outputs"
+)
+
+func TestWebhookTemplateRetryAndVaultHeader(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("X-Api-Key") != "s3cret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "reject") {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		bodies = append(bodies, string(body))
+	}))
+	defer srv.Close()
+
+	outputs.SetRefResolver(func(_ context.Context, ref string) (string, error) {
+		if ref == "vault://soar#apiKey" {
+			return "s3cret", nil
+		}
+		return "", io.EOF
+	})
+	defer outputs.SetRefResolver(nil)
+	reg := outputs.NewRegistry()
+	reg.Register("http", NewOutput)
+	out, err := reg.New("http", map[string]interface{}{
+		"url":          srv.URL,
+		"headers":      map[string]interface{}{"X-Api-Key": "vault://soar#apiKey"},
+		"format":       "template",
+		"template":     `{"title":"{{.threat_name}} on {{field . "device.name"}}","severity":"{{upper (default "low" .severity)}}"}`,
+		"retryDelayMs": 1,
+	})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	var dead []map[string]interface{}
+	out.(outputs.DeadLetterer).SetDeadLetter(func(events []map[string]interface{}, err error) { dead = append(dead, events...) })
+
+	err = out.(outputs.BatchSender).SendBatch([]map[string]interface{}{
+		{"threat_name": "Eicar", "device": map[string]interface{}{"name": "pa-01"}, "severity": "critical"},
+		{"threat_name": "reject"},
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if len(bodies) != 1 || bodies[0] != `{"title":"Eicar on pa-01","severity":"CRITICAL"}` {
+		t.Fatalf("unexpected bodies after retry: %q", bodies)
+	}
+	if len(dead) != 1 || dead[0]["threat_name"] != "reject" {
+		t.Fatalf("the 422 event should be dead-lettered alone: %v", dead)
+	}
+}
+
+func TestWebhookMutualTLS(t *testing.T) {
+	certPEM, keyPEM, cert := selfSigned(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	srv.StartTLS()
+	defer srv.Close()
+	serverCA := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	noCert, err := NewWebhookOutput(Config{URL: srv.URL, Format: FormatNDJSON, MaxRetries: 1, RetryDelayMs: 1, TLS: outputs.TLSConfig{CAPEM: string(serverCA)}})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer noCert.Close()
+	if err := noCert.SendBatch([]map[string]interface{}{{"a": 1}}); err == nil {
+		t.Fatal("expected the handshake to fail without a client certificate")
+	}
+
+	out, err := NewWebhookOutput(Config{URL: srv.URL, Format: FormatNDJSON, TLS: outputs.TLSConfig{CAPEM: string(serverCA), CertPEM: certPEM, KeyPEM: keyPEM}})
+	if err != nil {
+		t.Fatalf("new output: %v", err)
+	}
+	defer out.Close()
+	if err := out.SendBatch([]map[string]interface{}{{"a": 1}, {"b": 2}}); err != nil {
+		t.Fatalf("send with client certificate: %v", err)
+	}
+}
+
+func selfSigned(t *testing.T) (certPEM, keyPEM string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bibbl-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = x509.ParseCertificate(der)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})), cert
+}
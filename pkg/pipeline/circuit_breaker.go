@@ -7,6 +7,9 @@ import (
 	"time"
 )
 
+// ErrCircuitOpen is returned by Execute while the circuit is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
 // CircuitState represents the current state of a circuit breaker.
 type CircuitState int32
 
@@ -36,7 +39,8 @@ type CircuitBreaker struct {
 	totalSuccess atomic.Uint64
 	totalReject  atomic.Uint64
 
-	mu sync.RWMutex
+	mu      sync.RWMutex
+	lastErr string // Message of the last failure, guarded by mu
 }
 
 // NewCircuitBreaker creates a circuit breaker with the given parameters.
@@ -77,7 +81,7 @@ func (cb *CircuitBreaker) Execute(fn func() error) error {
 			state = StateHalfOpen
 		} else {
 			cb.totalReject.Add(1)
-			return errors.New("circuit breaker open")
+			return ErrCircuitOpen
 		}
 	}
 
@@ -85,7 +89,7 @@ func (cb *CircuitBreaker) Execute(fn func() error) error {
 	err := fn()
 
 	if err != nil {
-		cb.onFailure()
+		cb.onFailure(err)
 		return err
 	}
 
@@ -94,9 +98,12 @@ func (cb *CircuitBreaker) Execute(fn func() error) error {
 }
 
 // onFailure handles a failed execution.
-func (cb *CircuitBreaker) onFailure() {
+func (cb *CircuitBreaker) onFailure(err error) {
 	cb.failures.Add(1)
 	cb.lastFailTime.Store(time.Now().UnixNano())
+	cb.mu.Lock()
+	cb.lastErr = err.Error()
+	cb.mu.Unlock()
 
 	state := CircuitState(cb.state.Load())
 
@@ -148,6 +155,9 @@ type CircuitStats struct {
 	TotalCalls   uint64
 	TotalSuccess uint64
 	TotalReject  uint64
+	LastError    string
+	LastFailure  time.Time // zero until the first failure
+	RetryAt      time.Time // when an open circuit lets a trial call through
 }
 
 func (cb *CircuitBreaker) Stats() CircuitStats {
@@ -160,14 +170,25 @@ func (cb *CircuitBreaker) Stats() CircuitStats {
 		stateName = "half-open"
 	}
 
-	return CircuitStats{
+	cb.mu.RLock()
+	lastErr := cb.lastErr
+	cb.mu.RUnlock()
+	st := CircuitStats{
 		Name:         cb.name,
 		State:        stateName,
 		Failures:     cb.failures.Load(),
 		TotalCalls:   cb.totalCalls.Load(),
 		TotalSuccess: cb.totalSuccess.Load(),
 		TotalReject:  cb.totalReject.Load(),
+		LastError:    lastErr,
+	}
+	if n := cb.lastFailTime.Load(); n > 0 {
+		st.LastFailure = time.Unix(0, n)
+		if state == StateOpen {
+			st.RetryAt = st.LastFailure.Add(cb.timeout)
+		}
 	}
+	return st
 }
 
 // Reset manually resets the circuit breaker to closed state.
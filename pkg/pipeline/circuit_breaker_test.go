@@ -131,6 +131,10 @@ func TestCircuitBreakerStats(t *testing.T) {
 	if stats.Failures != 2 {
 		t.Errorf("Expected 2 failures, got %d", stats.Failures)
 	}
+
+	if stats.LastError != "failure" || stats.LastFailure.IsZero() {
+		t.Errorf("Expected last error to be recorded, got %q at %v", stats.LastError, stats.LastFailure)
+	}
 }
 
 func TestCircuitBreakerReset(t *testing.T) {
@@ -0,0 +1,824 @@
+package queue
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bibbl/pkg/seal"
+)
+
+// FullPolicy decides what Append does when the queue has reached MaxBytes.
+type FullPolicy string
+
+const (
+	// PolicyBlock makes Append wait for the consumer to free space,
+	// pushing back on whoever is producing.
+	PolicyBlock FullPolicy = "block"
+	// PolicyDropOldest evicts the oldest segment, unread records included.
+	PolicyDropOldest FullPolicy = "drop_oldest"
+	// PolicyDropNewest rejects the record being appended.
+	PolicyDropNewest FullPolicy = "drop_newest"
+)
+
+// ParsePolicy maps a config string to a FullPolicy. Empty means PolicyBlock.
+func ParsePolicy(s string) (FullPolicy, error) {
+	switch p := FullPolicy(strings.ToLower(strings.TrimSpace(s))); p {
+	case "":
+		return PolicyBlock, nil
+	case PolicyBlock, PolicyDropOldest, PolicyDropNewest:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown queue full policy %q (want block, drop_oldest or drop_newest)", s)
+}
+
+var (
+	// ErrFull is returned by Append when the record was dropped because the
+	// queue is full.
+	ErrFull = errors.New("queue full")
+	// ErrClosed is returned once the queue has been closed.
+	ErrClosed = errors.New("queue closed")
+	// ErrStaleCursor is returned by Commit for a cursor that was not read
+	// from the current committed position.
+	ErrStaleCursor = errors.New("stale queue cursor")
+	// ErrTampered marks an encrypted segment that failed authentication.
+	// Such segments are never delivered; they are renamed with a
+	// tamperedExt suffix and kept for inspection.
+	ErrTampered = seal.ErrTampered
+
+	errCorrupt = errors.New("corrupt record")
+)
+
+const (
+	defaultMaxBytes     = 1 << 30
+	defaultSegmentBytes = 16 << 20
+	segmentExt          = ".seg"
+	tamperedExt         = ".tampered"
+	cursorFile          = "cursor.json"
+	// recordHeader is length (uint32) + CRC-32C of ts+payload (uint32) + ts (int64 ns).
+	recordHeader = 16
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// DiskConfig configures a DiskQueue.
+type DiskConfig struct {
+	Dir          string
+	MaxBytes     int64 // total on-disk size; default 1 GiB
+	SegmentBytes int64 // segment rotation size; default 16 MiB
+	Policy       FullPolicy
+	// BlockTimeout bounds how long PolicyBlock waits before dropping the
+	// record. Zero waits until space frees up or the queue is closed.
+	BlockTimeout time.Duration
+	// Keys, when set, encrypts new segments with the active key. Segments
+	// written with an older key in the ring stay readable. Plaintext
+	// segments are quarantined as tampered, since anyone with access to
+	// the directory could have written them.
+	Keys *seal.Keyring
+	// AllowPlaintext replays plaintext segments despite Keys, to migrate a
+	// queue written before encryption was turned on.
+	AllowPlaintext bool
+}
+
+func (c *DiskConfig) keyID() string {
+	if c.Keys == nil {
+		return ""
+	}
+	return c.Keys.ActiveID()
+}
+
+func (c *DiskConfig) applyDefaults() {
+	if c.MaxBytes <= 0 {
+		c.MaxBytes = defaultMaxBytes
+	}
+	if c.SegmentBytes <= 0 {
+		c.SegmentBytes = defaultSegmentBytes
+	}
+	if c.SegmentBytes > c.MaxBytes {
+		c.SegmentBytes = c.MaxBytes
+	}
+	if c.Policy == "" {
+		c.Policy = PolicyBlock
+	}
+}
+
+type position struct {
+	seg uint64
+	off int64
+}
+
+// Cursor marks the end of a batch returned by Read. Committing it
+// acknowledges every record in the batch.
+type Cursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+
+	from  position // committed position the batch was read from
+	read  int      // records in the batch
+	index int      // records before Offset within Segment
+	next  int64    // timestamp of the record after the batch, 0 when unknown
+}
+
+type segment struct {
+	seq     uint64
+	size    int64
+	count   int
+	start   int64         // offset of the first record (after the seal header)
+	firstTS int64         // timestamp of the first record
+	sealer  *seal.Segment // nil for plaintext segments
+}
+
+func (s *segment) keyID() string {
+	if s.sealer == nil {
+		return ""
+	}
+	return s.sealer.KeyID()
+}
+
+// DiskQueue is a durable FIFO of append-only segment files. Every record is
+// length-prefixed and checksummed, and optionally sealed with AES-256-GCM. Read is non-destructive; records are only
+// released by Commit, so a batch that was read but never acknowledged is
+// delivered again after a restart (at-least-once). It supports one consumer.
+type DiskQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	cfg  DiskConfig
+
+	segs     []segment // ascending; the last one is written to
+	w        *os.File
+	cursor   position // committed read position, always in segs[0]
+	consumed int      // records before cursor.off in segs[0]
+	depth    int
+	bytes    int64
+	newestTS int64
+	oldestTS int64 // timestamp of the record at the cursor, 0 when unknown
+
+	dropped  uint64
+	corrupt  uint64
+	tampered uint64
+	closed   bool
+}
+
+var _ Queue = (*DiskQueue)(nil)
+
+// OpenDisk opens (or creates) the queue in cfg.Dir. Records after the
+// committed cursor are recovered; a torn write at the tail is truncated.
+func OpenDisk(cfg DiskConfig) (*DiskQueue, error) {
+	if strings.TrimSpace(cfg.Dir) == "" {
+		return nil, fmt.Errorf("queue directory required")
+	}
+	cfg.applyDefaults()
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create queue dir: %w", err)
+	}
+	q := &DiskQueue{cfg: cfg}
+	q.cond = sync.NewCond(&q.mu)
+	if err := q.recover(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *DiskQueue) segPath(seq uint64) string {
+	return filepath.Join(q.cfg.Dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+func (q *DiskQueue) recover() error {
+	entries, err := os.ReadDir(q.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("read queue dir: %w", err)
+	}
+	var seqs []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	var cur position
+	if data, err := os.ReadFile(filepath.Join(q.cfg.Dir, cursorFile)); err == nil {
+		var c Cursor
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("decode queue cursor: %w", err)
+		}
+		cur = position{seg: c.Segment, off: c.Offset}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("read queue cursor: %w", err)
+	}
+
+	// Segments before the cursor were fully acknowledged.
+	for len(seqs) > 0 && seqs[0] < cur.seg {
+		_ = os.Remove(q.segPath(seqs[0]))
+		seqs = seqs[1:]
+	}
+	if len(seqs) == 0 {
+		seq := cur.seg
+		if seq == 0 {
+			seq = 1
+		}
+		seqs = []uint64{seq}
+	}
+	if cur.seg != seqs[0] {
+		cur = position{seg: seqs[0]}
+	}
+
+	for i, seq := range seqs {
+		tail := i == len(seqs)-1
+		stop := int64(-1)
+		if seq == cur.seg {
+			stop = cur.off
+		}
+		res, err := scanSegment(q.segPath(seq), stop, q.cfg.Keys)
+		if tail && errors.Is(err, io.EOF) {
+			// Crashed while writing the seal header of a new segment.
+			if err := os.Truncate(q.segPath(seq), 0); err != nil {
+				return fmt.Errorf("truncate queue segment: %w", err)
+			}
+			res, err = scanResult{}, nil
+		}
+		if err != nil {
+			return err
+		}
+		if tail && res.end < res.size {
+			// Torn write from a crash: drop the partial record.
+			if err := os.Truncate(q.segPath(seq), res.end); err != nil {
+				return fmt.Errorf("truncate queue segment: %w", err)
+			}
+			res.size = res.end
+		}
+		if res.sealer == nil && res.size > 0 && q.cfg.Keys != nil && !q.cfg.AllowPlaintext {
+			path := q.segPath(seq)
+			if err := os.Rename(path, path+tamperedExt); err != nil {
+				return fmt.Errorf("quarantine queue segment: %w", err)
+			}
+			q.tampered += uint64(res.count - res.before)
+			continue
+		}
+		if len(q.segs) == 0 {
+			if seq == cur.seg {
+				q.consumed = res.before
+				cur.off = res.beforeEnd
+				q.oldestTS = res.afterTS
+			} else {
+				// The segment at the cursor was quarantined.
+				cur = position{seg: seq}
+				q.oldestTS = res.firstTS
+			}
+		}
+		q.segs = append(q.segs, segment{seq: seq, size: res.size, count: res.count, start: res.start, firstTS: res.firstTS, sealer: res.sealer})
+		q.bytes += res.size
+		q.depth += res.count
+		if res.lastTS > q.newestTS {
+			q.newestTS = res.lastTS
+		}
+	}
+	if len(q.segs) == 0 {
+		cur = position{seg: seqs[len(seqs)-1] + 1}
+		q.segs = []segment{{seq: cur.seg}}
+	}
+	q.depth -= q.consumed
+	q.cursor = cur
+	if q.oldestTS == 0 {
+		q.oldestTS = q.firstTSFrom(1)
+	}
+
+	return q.openTailLocked()
+}
+
+// openTailLocked opens the last segment for appending. A new, empty segment
+// gets a seal header first when encryption is configured.
+func (q *DiskQueue) openTailLocked() error {
+	tail := &q.segs[len(q.segs)-1]
+	w, err := os.OpenFile(q.segPath(tail.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("open queue segment: %w", err)
+	}
+	if tail.size == 0 && q.cfg.Keys != nil {
+		sealer, err := q.cfg.Keys.NewSegment()
+		if err != nil {
+			w.Close()
+			return err
+		}
+		hdr := sealer.Header()
+		if _, err := w.Write(hdr); err != nil {
+			w.Close()
+			return fmt.Errorf("write queue segment header: %w", err)
+		}
+		tail.sealer = sealer
+		tail.start = int64(len(hdr))
+		tail.size = tail.start
+		q.bytes += tail.start
+	}
+	q.w = w
+	return nil
+}
+
+type scanResult struct {
+	start     int64 // offset of the first record
+	sealer    *seal.Segment
+	size      int64 // file size
+	end       int64 // end of the last valid record
+	count     int   // valid records
+	before    int   // valid records ending at or before the stop offset
+	beforeEnd int64 // end of the last of those
+	firstTS   int64
+	afterTS   int64 // timestamp of the first record past the stop offset
+	lastTS    int64
+}
+
+// scanSegment validates a segment file record by record. With stop >= 0 it
+// also reports how many records end at or before stop. Sealed records are
+// only checksummed here; they are authenticated when read.
+func scanSegment(path string, stop int64, keys *seal.Keyring) (scanResult, error) {
+	var res scanResult
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return res, fmt.Errorf("open queue segment: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return res, err
+	}
+	res.size = info.Size()
+	if res.sealer, err = keys.OpenSegment(f); err != nil {
+		return res, fmt.Errorf("queue segment %s: %w", filepath.Base(path), err)
+	}
+	if res.sealer != nil {
+		res.start = int64(len(res.sealer.Header()))
+	}
+	res.end, res.beforeEnd = res.start, res.start
+	for {
+		_, ts, n, err := readRecord(f, res.end)
+		if err != nil {
+			return res, nil
+		}
+		res.end += n
+		if res.count == 0 {
+			res.firstTS = ts
+		}
+		res.count++
+		res.lastTS = ts
+		if stop >= 0 && res.end <= stop {
+			res.before++
+			res.beforeEnd = res.end
+		} else if res.afterTS == 0 {
+			res.afterTS = ts
+		}
+	}
+}
+
+// readRecord reads and verifies the record at off. It returns errCorrupt for
+// checksum mismatches and io.EOF / io.ErrUnexpectedEOF at or past the end.
+func readRecord(r io.ReaderAt, off int64) ([]byte, int64, int64, error) {
+	var hdr [recordHeader]byte
+	if _, err := r.ReadAt(hdr[:], off); err != nil {
+		return nil, 0, 0, err
+	}
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	sum := binary.BigEndian.Uint32(hdr[4:8])
+	ts := int64(binary.BigEndian.Uint64(hdr[8:16]))
+	data := make([]byte, size)
+	if _, err := r.ReadAt(data, off+recordHeader); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, 0, err
+	}
+	crc := crc32.Update(crc32.Checksum(hdr[8:16], castagnoli), castagnoli, data)
+	if crc != sum {
+		return nil, 0, 0, errCorrupt
+	}
+	return data, ts, int64(recordHeader) + int64(size), nil
+}
+
+// recordTS reads the timestamp from the header of the record at off without
+// verifying or decrypting the record. It returns 0 when there is none.
+func recordTS(r io.ReaderAt, off int64) int64 {
+	var b [8]byte
+	if _, err := r.ReadAt(b[:], off+8); err != nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b[:]))
+}
+
+// firstTSFrom returns the timestamp of the first record in segs[i:], for a
+// cursor at the start of segs[i]. It returns 0 when they are empty.
+func (q *DiskQueue) firstTSFrom(i int) int64 {
+	for ; i < len(q.segs); i++ {
+		if q.segs[i].count > 0 {
+			return q.segs[i].firstTS
+		}
+	}
+	return 0
+}
+
+func tsBytes(ts int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(ts))
+	return b[:]
+}
+
+func encodeRecord(data []byte, ts int64) []byte {
+	buf := make([]byte, recordHeader+len(data))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(ts))
+	copy(buf[recordHeader:], data)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(buf[8:], castagnoli))
+	return buf
+}
+
+// Reconfigure applies new limits and policy to an open queue. The directory
+// cannot change; a new segment size takes effect at the next rotation.
+func (q *DiskQueue) Reconfigure(cfg DiskConfig) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cfg.Dir = q.cfg.Dir
+	cfg.applyDefaults()
+	q.cfg = cfg
+	q.cond.Broadcast()
+}
+
+// Append durably queues one record. When the queue is full the configured
+// policy applies; ErrFull means the record was dropped.
+func (q *DiskQueue) Append(data []byte, ts time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	size := int64(recordHeader + len(data))
+	if q.cfg.Keys != nil {
+		size += seal.Overhead
+	}
+	if size > q.cfg.MaxBytes {
+		q.dropped++
+		return ErrFull
+	}
+	var deadline time.Time
+	var timer *time.Timer
+	for q.bytes+size > q.cfg.MaxBytes {
+		switch q.cfg.Policy {
+		case PolicyDropNewest:
+			q.dropped++
+			return ErrFull
+		case PolicyDropOldest:
+			if err := q.evictOldestLocked(); err != nil {
+				return err
+			}
+		default:
+			if q.cfg.BlockTimeout > 0 {
+				if deadline.IsZero() {
+					deadline = time.Now().Add(q.cfg.BlockTimeout)
+					timer = time.AfterFunc(q.cfg.BlockTimeout, func() {
+						q.mu.Lock()
+						q.cond.Broadcast()
+						q.mu.Unlock()
+					})
+					defer timer.Stop()
+				} else if !time.Now().Before(deadline) {
+					q.dropped++
+					return ErrFull
+				}
+			}
+			q.cond.Wait()
+			if q.closed {
+				return ErrClosed
+			}
+		}
+	}
+	last := &q.segs[len(q.segs)-1]
+	// A key change (or turning encryption on or off) starts a new segment,
+	// so no segment mixes keys.
+	if (last.size > last.start && last.size+size > q.cfg.SegmentBytes) || last.keyID() != q.cfg.keyID() {
+		if err := q.rotateLocked(); err != nil {
+			return err
+		}
+		last = &q.segs[len(q.segs)-1]
+	}
+	if last.sealer != nil {
+		data = last.sealer.Seal(uint64(last.size), data, tsBytes(ts.UnixNano()))
+	}
+	rec := encodeRecord(data, ts.UnixNano())
+	if _, err := q.w.Write(rec); err != nil {
+		return fmt.Errorf("write queue segment: %w", err)
+	}
+	if last.count == 0 {
+		last.firstTS = ts.UnixNano()
+	}
+	if q.depth == 0 {
+		q.oldestTS = ts.UnixNano()
+	}
+	last.size += size
+	last.count++
+	q.bytes += size
+	q.depth++
+	q.newestTS = ts.UnixNano()
+	return nil
+}
+
+func (q *DiskQueue) rotateLocked() error {
+	if err := q.w.Sync(); err != nil {
+		return fmt.Errorf("sync queue segment: %w", err)
+	}
+	if err := q.w.Close(); err != nil {
+		return fmt.Errorf("close queue segment: %w", err)
+	}
+	q.segs = append(q.segs, segment{seq: q.segs[len(q.segs)-1].seq + 1})
+	return q.openTailLocked()
+}
+
+// evictOldestLocked drops the head segment, unread records included.
+func (q *DiskQueue) evictOldestLocked() error {
+	if len(q.segs) == 1 {
+		if err := q.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	head := q.segs[0]
+	unread := head.count - q.consumed
+	q.dropped += uint64(unread)
+	q.depth -= unread
+	q.bytes -= head.size
+	q.segs = q.segs[1:]
+	q.cursor = position{seg: q.segs[0].seq}
+	q.consumed = 0
+	q.oldestTS = q.firstTSFrom(0)
+	if err := os.Remove(q.segPath(head.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("remove queue segment: %w", err)
+	}
+	return q.saveCursorLocked()
+}
+
+// Read returns up to max records from the committed position without
+// consuming them, and the cursor to Commit once they are delivered.
+func (q *DiskQueue) Read(max int) ([]Item, Cursor, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil, Cursor{}, ErrClosed
+	}
+	if max <= 0 {
+		max = 1
+	}
+	for {
+		items, c, corrupt, tampered, err := q.readLocked(max)
+		if err != nil || corrupt < 0 || len(items) > 0 {
+			return items, c, err
+		}
+		// A corrupt record at the committed position: nothing before it is
+		// pending, so skip the rest of its segment and carry on.
+		if err := q.skipCorruptLocked(c, corrupt, tampered); err != nil {
+			return nil, Cursor{}, err
+		}
+	}
+}
+
+// readLocked collects records from the committed position. When it stops at
+// a corrupt record it reports how many records of that segment are lost,
+// and whether the record failed authentication; otherwise corrupt is -1.
+// It also notes the timestamps of the first record and of the one after the
+// batch, so Stats can report the oldest record's age without reading.
+func (q *DiskQueue) readLocked(max int) ([]Item, Cursor, int, bool, error) {
+	c := Cursor{Segment: q.cursor.seg, Offset: q.cursor.off, from: q.cursor, index: q.consumed}
+	var items []Item
+	si := 0
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for len(items) < max {
+		seg := q.segs[si]
+		if c.Offset < seg.start {
+			c.Offset = seg.start
+		}
+		if c.Offset >= seg.size {
+			if si == len(q.segs)-1 {
+				break
+			}
+			si++
+			c.Segment, c.Offset, c.index = q.segs[si].seq, 0, 0
+			if f != nil {
+				f.Close()
+				f = nil
+			}
+			continue
+		}
+		if f == nil {
+			var err error
+			if f, err = os.Open(q.segPath(seg.seq)); err != nil {
+				return nil, c, -1, false, fmt.Errorf("open queue segment: %w", err)
+			}
+		}
+		data, ts, n, err := readRecord(f, c.Offset)
+		if err == nil && seg.sealer != nil {
+			data, err = seg.sealer.Open(uint64(c.Offset), data, tsBytes(ts))
+		}
+		if err != nil {
+			if len(items) > 0 {
+				break
+			}
+			return nil, c, seg.count - c.index, errors.Is(err, ErrTampered), nil
+		}
+		if len(items) == 0 {
+			q.oldestTS = ts
+		}
+		items = append(items, Item{Data: data, TS: time.Unix(0, ts).Unix()})
+		c.Offset += n
+		c.index++
+		c.read++
+	}
+	if seg := q.segs[si]; f != nil && c.Offset < seg.size {
+		c.next = recordTS(f, c.Offset)
+	} else {
+		c.next = q.firstTSFrom(si + 1)
+	}
+	return items, c, -1, false, nil
+}
+
+// skipCorruptLocked gives up on the rest of the segment at the cursor. A
+// segment that failed authentication is moved aside rather than deleted.
+func (q *DiskQueue) skipCorruptLocked(at Cursor, lost int, tampered bool) error {
+	if lost < 1 {
+		lost = 1
+	}
+	if tampered {
+		q.tampered += uint64(lost)
+	} else {
+		q.corrupt += uint64(lost)
+	}
+	q.depth -= lost
+	if q.depth < 0 {
+		q.depth = 0
+	}
+	for i := range q.segs {
+		if q.segs[i].seq != at.Segment {
+			continue
+		}
+		if i == len(q.segs)-1 {
+			// Keep appending past the damage in a fresh segment.
+			if err := q.rotateLocked(); err != nil {
+				return err
+			}
+		}
+		q.segs[i].count = at.index
+		q.cursor = position{seg: at.Segment, off: q.segs[i].size}
+		q.consumed = at.index
+		q.oldestTS = q.firstTSFrom(i + 1)
+		if tampered {
+			path := q.segPath(at.Segment)
+			if err := os.Rename(path, path+tamperedExt); err != nil {
+				return fmt.Errorf("quarantine queue segment: %w", err)
+			}
+		}
+		break
+	}
+	return q.releaseLocked()
+}
+
+// Commit acknowledges every record up to c. Fully consumed segments are
+// deleted and the position is persisted, so a restart resumes right after c.
+func (q *DiskQueue) Commit(c Cursor) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrClosed
+	}
+	if c.from != q.cursor {
+		return ErrStaleCursor
+	}
+	if c.read == 0 {
+		return nil
+	}
+	q.depth -= c.read
+	q.cursor = position{seg: c.Segment, off: c.Offset}
+	q.consumed = c.index
+	// Records appended after the Read are not covered by c.next; the next
+	// Read picks their timestamp up.
+	q.oldestTS = c.next
+	return q.releaseLocked()
+}
+
+// releaseLocked drops segments behind the cursor, saves it and wakes
+// appenders waiting for space.
+func (q *DiskQueue) releaseLocked() error {
+	for len(q.segs) > 1 && (q.segs[0].seq < q.cursor.seg || q.cursor.off >= q.segs[0].size) {
+		head := q.segs[0]
+		q.segs = q.segs[1:]
+		q.bytes -= head.size
+		if q.cursor.seg == head.seq {
+			q.cursor = position{seg: q.segs[0].seq}
+			q.consumed = 0
+		}
+		if err := os.Remove(q.segPath(head.seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove queue segment: %w", err)
+		}
+	}
+	q.cond.Broadcast()
+	return q.saveCursorLocked()
+}
+
+func (q *DiskQueue) saveCursorLocked() error {
+	data, _ := json.Marshal(Cursor{Segment: q.cursor.seg, Offset: q.cursor.off})
+	path := filepath.Join(q.cfg.Dir, cursorFile)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return fmt.Errorf("write queue cursor: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("write queue cursor: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync queue cursor: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("write queue cursor: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("replace queue cursor: %w", err)
+	}
+	return nil
+}
+
+// Enqueue implements Queue. It reports whether the record was stored.
+func (q *DiskQueue) Enqueue(data []byte, ts time.Time) bool {
+	return q.Append(data, ts) == nil
+}
+
+// Dequeue implements Queue by reading and immediately committing, which
+// gives up the at-least-once guarantee; delivery paths use Read and Commit.
+func (q *DiskQueue) Dequeue(max int) []Item {
+	items, c, err := q.Read(max)
+	if err != nil || len(items) == 0 {
+		return nil
+	}
+	if err := q.Commit(c); err != nil {
+		return nil
+	}
+	return items
+}
+
+// Stats reports depth, size and drop counters. OldestUnix is the timestamp of
+// the next unacknowledged record. It only reads counters kept in memory, so
+// it is cheap enough to call on every delivery.
+func (q *DiskQueue) Stats() Stats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := Stats{
+		Depth:    q.depth,
+		Dropped:  q.dropped,
+		Corrupt:  q.corrupt,
+		Tampered: q.tampered,
+		Bytes:    q.bytes,
+		MaxBytes: q.cfg.MaxBytes,
+	}
+	if q.depth > 0 {
+		st.NewestUnix = time.Unix(0, q.newestTS).Unix()
+		if q.oldestTS > 0 {
+			st.OldestUnix = time.Unix(0, q.oldestTS).Unix()
+		}
+	}
+	return st
+}
+
+// Close syncs the write segment and releases blocked appenders. Unread
+// records stay on disk for the next OpenDisk.
+func (q *DiskQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+	q.cond.Broadcast()
+	if err := q.w.Sync(); err != nil {
+		q.w.Close()
+		return err
+	}
+	return q.w.Close()
+}
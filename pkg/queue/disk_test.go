@@ -0,0 +1,299 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bibbl/pkg/seal"
+)
+
+func appendN(t *testing.T, q *DiskQueue, from, n int) {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		if err := q.Append([]byte(fmt.Sprintf("event-%03d", i)), time.Now()); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+}
+
+func TestDiskQueueResumesAtCommittedCursor(t *testing.T) {
+	dir := t.TempDir()
+	q, err := OpenDisk(DiskConfig{Dir: dir, SegmentBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, q, 0, 10)
+
+	items, c, err := q.Read(4)
+	if err != nil || len(items) != 4 {
+		t.Fatalf("read: %v %d", err, len(items))
+	}
+	if err := q.Commit(c); err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	// Read but never acknowledged: must come back after a restart.
+	if items, _, _ := q.Read(3); string(items[0].Data) != "event-004" {
+		t.Fatalf("unexpected record %q", items[0].Data)
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = OpenDisk(DiskConfig{Dir: dir, SegmentBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if st := q.Stats(); st.Depth != 6 {
+		t.Fatalf("expected depth 6 after restart, got %d", st.Depth)
+	}
+	items, c, _ = q.Read(100)
+	if len(items) != 6 || string(items[0].Data) != "event-004" || string(items[5].Data) != "event-009" {
+		t.Fatalf("unexpected replay: %d items starting %q", len(items), items[0].Data)
+	}
+	if err := q.Commit(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Commit(c); !errors.Is(err, ErrStaleCursor) {
+		t.Fatalf("expected stale cursor, got %v", err)
+	}
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if len(segs) != 1 {
+		t.Fatalf("expected consumed segments removed, %d left", len(segs))
+	}
+}
+
+func TestDiskQueueTruncatesTornTail(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := OpenDisk(DiskConfig{Dir: dir})
+	appendN(t, q, 0, 3)
+	q.Close()
+
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	f, _ := os.OpenFile(segs[0], os.O_WRONLY|os.O_APPEND, 0)
+	_, _ = f.Write(encodeRecord([]byte("half-written"), 1)[:10])
+	f.Close()
+
+	q, err := OpenDisk(DiskConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	appendN(t, q, 3, 1)
+	items, _, _ := q.Read(10)
+	if len(items) != 4 || string(items[3].Data) != "event-003" {
+		t.Fatalf("expected torn record dropped, got %d items", len(items))
+	}
+}
+
+func TestDiskQueueSkipsCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := OpenDisk(DiskConfig{Dir: dir, SegmentBytes: 50})
+	appendN(t, q, 0, 4) // two records per segment
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	data, _ := os.ReadFile(segs[0])
+	data[recordHeader] ^= 0xff
+	_ = os.WriteFile(segs[0], data, 0o640)
+
+	items, _, err := q.Read(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || string(items[0].Data) != "event-002" {
+		t.Fatalf("expected corrupt segment skipped, got %d items", len(items))
+	}
+	if st := q.Stats(); st.Corrupt != 2 || st.Depth != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+	q.Close()
+}
+
+func TestDiskQueueFullPolicies(t *testing.T) {
+	rec := int64(recordHeader + len("event-000"))
+
+	q, _ := OpenDisk(DiskConfig{Dir: t.TempDir(), MaxBytes: 3 * rec, SegmentBytes: rec, Policy: PolicyDropNewest})
+	appendN(t, q, 0, 3)
+	if err := q.Append([]byte("event-003"), time.Now()); !errors.Is(err, ErrFull) {
+		t.Fatalf("drop_newest: expected ErrFull, got %v", err)
+	}
+	if items, _, _ := q.Read(10); len(items) != 3 || string(items[0].Data) != "event-000" {
+		t.Fatal("drop_newest must keep the oldest records")
+	}
+	q.Close()
+
+	q, _ = OpenDisk(DiskConfig{Dir: t.TempDir(), MaxBytes: 3 * rec, SegmentBytes: rec, Policy: PolicyDropOldest})
+	appendN(t, q, 0, 5)
+	items, _, _ := q.Read(10)
+	if len(items) != 3 || string(items[0].Data) != "event-002" {
+		t.Fatalf("drop_oldest: got %d items starting %q", len(items), items[0].Data)
+	}
+	if st := q.Stats(); st.Dropped != 2 {
+		t.Fatalf("drop_oldest: expected 2 dropped, got %d", st.Dropped)
+	}
+	q.Close()
+
+	q, _ = OpenDisk(DiskConfig{Dir: t.TempDir(), MaxBytes: 2 * rec, SegmentBytes: rec, Policy: PolicyBlock, BlockTimeout: 2 * time.Second})
+	defer q.Close()
+	appendN(t, q, 0, 2)
+	done := make(chan error, 1)
+	go func() { done <- q.Append([]byte("event-002"), time.Now()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("block: append returned early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, c, _ := q.Read(1)
+	if err := q.Commit(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("block: append after commit: %v", err)
+	}
+}
+
+func TestDiskQueueEncryptedSegments(t *testing.T) {
+	dir := t.TempDir()
+	k1, _ := seal.ParseKeyring("k1:" + strings.Repeat("11", 32))
+	q, err := OpenDisk(DiskConfig{Dir: dir, Keys: k1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, q, 0, 2)
+	q.Close()
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if data, _ := os.ReadFile(segs[0]); bytes.Contains(data, []byte("event-")) {
+		t.Fatal("segment holds plaintext")
+	}
+	if _, err := OpenDisk(DiskConfig{Dir: dir}); !errors.Is(err, seal.ErrUnknownKey) {
+		t.Fatalf("opening without the key: expected ErrUnknownKey, got %v", err)
+	}
+
+	// Rotate: new records use k2 in a new segment, k1 segments stay readable.
+	k2, _ := seal.ParseKeyring("k2:" + strings.Repeat("22", 32) + ",k1:" + strings.Repeat("11", 32))
+	q, err = OpenDisk(DiskConfig{Dir: dir, Keys: k2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendN(t, q, 2, 2)
+	items, _, err := q.Read(10)
+	if err != nil || len(items) != 4 || string(items[0].Data) != "event-000" || string(items[3].Data) != "event-003" {
+		t.Fatalf("read across key rotation: %v %d", err, len(items))
+	}
+	q.Close()
+
+	// Flip a ciphertext byte and fix up the CRC: only authentication catches it.
+	data, _ := os.ReadFile(segs[0])
+	sealer, _ := k2.OpenSegment(bytes.NewReader(data))
+	off := len(sealer.Header())
+	data[off+recordHeader] ^= 0xff
+	binary.BigEndian.PutUint32(data[off+4:off+8], crc32.Checksum(data[off+8:off+recordHeader+int(binary.BigEndian.Uint32(data[off:off+4]))], castagnoli))
+	_ = os.WriteFile(segs[0], data, 0o640)
+
+	q, err = OpenDisk(DiskConfig{Dir: dir, Keys: k2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	items, _, err = q.Read(10)
+	if err != nil || len(items) != 2 || string(items[0].Data) != "event-002" {
+		t.Fatalf("tampered segment must be refused: %v %d", err, len(items))
+	}
+	if st := q.Stats(); st.Tampered != 2 {
+		t.Fatalf("expected 2 tampered records, got %+v", st)
+	}
+	if _, err := os.Stat(segs[0] + tamperedExt); err != nil {
+		t.Fatalf("tampered segment should be kept aside: %v", err)
+	}
+}
+
+func TestDiskQueueTracksOldestRecord(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Unix(1700000000, 0)
+	q, _ := OpenDisk(DiskConfig{Dir: dir, SegmentBytes: 64})
+	if st := q.Stats(); st.OldestUnix != 0 {
+		t.Fatalf("empty queue reports oldest %d", st.OldestUnix)
+	}
+	for i := 0; i < 10; i++ {
+		if err := q.Append([]byte(fmt.Sprintf("event-%03d", i)), base.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldest := func(want int) {
+		t.Helper()
+		if st := q.Stats(); st.OldestUnix != base.Unix()+int64(want) {
+			t.Fatalf("expected oldest at +%ds, got %+ds", want, st.OldestUnix-base.Unix())
+		}
+	}
+	oldest(0)
+	// Commits move it to the next record, within a segment and across one.
+	for _, n := range []int{1, 2, 3} {
+		_, c, _ := q.Read(n)
+		if err := q.Commit(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldest(6)
+	q.Close()
+
+	q, _ = OpenDisk(DiskConfig{Dir: dir, SegmentBytes: 64})
+	defer q.Close()
+	oldest(6)
+	_, c, _ := q.Read(100)
+	if err := q.Commit(c); err != nil {
+		t.Fatal(err)
+	}
+	if st := q.Stats(); st.Depth != 0 || st.OldestUnix != 0 {
+		t.Fatalf("drained queue reports depth %d, oldest %d", st.Depth, st.OldestUnix)
+	}
+	if err := q.Append([]byte("late"), base.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	oldest(60)
+}
+
+func TestDiskQueueRefusesPlaintextSegmentsWhenEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	q, _ := OpenDisk(DiskConfig{Dir: dir})
+	appendN(t, q, 0, 3)
+	q.Close()
+	segs, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	keys, _ := seal.ParseKeyring("k1:" + strings.Repeat("11", 32))
+
+	// Migration: plaintext written before encryption was enabled.
+	q, err := OpenDisk(DiskConfig{Dir: dir, Keys: keys, AllowPlaintext: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, _, _ := q.Read(10); len(items) != 3 {
+		t.Fatalf("allowPlaintext: expected 3 records, got %d", len(items))
+	}
+	q.Close()
+
+	// Otherwise a plaintext segment could be a forgery and is not replayed.
+	q, err = OpenDisk(DiskConfig{Dir: dir, Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if items, _, _ := q.Read(10); len(items) != 0 {
+		t.Fatalf("plaintext segment replayed in an encrypted queue: %d records", len(items))
+	}
+	if st := q.Stats(); st.Tampered != 3 || st.Depth != 0 {
+		t.Fatalf("expected 3 tampered records and nothing pending, got %+v", st)
+	}
+	if _, err := os.Stat(segs[0] + tamperedExt); err != nil {
+		t.Fatalf("plaintext segment should be kept aside: %v", err)
+	}
+	appendN(t, q, 3, 1)
+	if items, _, _ := q.Read(10); len(items) != 1 || string(items[0].Data) != "event-003" {
+		t.Fatalf("queue unusable after quarantine: %d records", len(items))
+	}
+}
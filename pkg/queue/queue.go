@@ -18,6 +18,11 @@ type Stats struct {
     Dropped uint64
     OldestUnix int64
     NewestUnix int64
+    // Disk-backed queues only
+    Corrupt uint64
+    Tampered uint64
+    Bytes int64
+    MaxBytes int64
 }
 
 // Queue interface for different backends.
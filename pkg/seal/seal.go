@@ -0,0 +1,263 @@
+// Package seal encrypts on-disk segments (spill files, queue segments) with
+// AES-256-GCM. Every segment starts with a header naming the key it was
+// written with and a random salt; records are sealed under a per-segment key
+// derived from both, with the record position as nonce, so nonces never
+// repeat and records cannot be moved or reordered without detection.
+package seal
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	magic    = "BSEG"
+	version  = 1
+	saltSize = 16
+	// Overhead is the number of bytes Seal adds to every record.
+	Overhead = 16
+	keySize  = 32
+)
+
+var (
+	// ErrTampered is returned when a sealed record fails authentication:
+	// it was modified, truncated, moved, or written with a different key.
+	ErrTampered = errors.New("sealed data failed authentication")
+	// ErrUnknownKey is returned for segments written with a key ID that is
+	// not in the keyring.
+	ErrUnknownKey = errors.New("unknown encryption key id")
+)
+
+// Keyring holds AES-256 keys by ID. New segments are written with the
+// active (first) key; the others stay available to read older segments,
+// which is how keys are rotated.
+type Keyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// ActiveID returns the ID of the key used for new segments.
+func (k *Keyring) ActiveID() string { return k.active }
+
+var (
+	resolverMu sync.RWMutex
+	resolver   func(ctx context.Context, ref string) (string, error)
+)
+
+// SetRefResolver installs the resolver used for vault:// key references.
+func SetRefResolver(fn func(ctx context.Context, ref string) (string, error)) {
+	resolverMu.Lock()
+	defer resolverMu.Unlock()
+	resolver = fn
+}
+
+func resolveRef(ref string) (string, error) {
+	resolverMu.RLock()
+	fn := resolver
+	resolverMu.RUnlock()
+	if fn == nil {
+		return "", fmt.Errorf("cannot resolve %s: secrets vault is not enabled", ref)
+	}
+	return fn(context.Background(), ref)
+}
+
+// FromEnv loads the keyring from the named environment variable.
+func FromEnv(name string) (*Keyring, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, errors.New("encryption key variable not configured")
+	}
+	spec := os.Getenv(name)
+	if strings.TrimSpace(spec) == "" {
+		return nil, fmt.Errorf("encryption key variable %s is not set", name)
+	}
+	k, err := ParseKeyring(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return k, nil
+}
+
+// ParseKeyring parses a comma separated list of keys, active key first.
+// Each entry is "[id:]key", where key is 32 bytes in base64 or hex, or a
+// vault:// reference to such a value. Without an id, one is derived from
+// the key. The whole spec may also be a single vault:// reference.
+func ParseKeyring(spec string) (*Keyring, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, "vault://") && !strings.Contains(spec, ",") {
+		resolved, err := resolveRef(spec)
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(resolved, ",") || strings.Contains(resolved, ":") {
+			return ParseKeyring(resolved)
+		}
+		spec = resolved
+	}
+	k := &Keyring{keys: map[string][]byte{}}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, raw := "", entry
+		if !strings.HasPrefix(entry, "vault://") {
+			if i := strings.IndexByte(entry, ':'); i >= 0 {
+				id, raw = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+			}
+		}
+		if strings.HasPrefix(raw, "vault://") {
+			resolved, err := resolveRef(raw)
+			if err != nil {
+				return nil, err
+			}
+			raw = strings.TrimSpace(resolved)
+		}
+		key, err := decodeKey(raw)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			sum := sha256.Sum256(key)
+			id = hex.EncodeToString(sum[:4])
+		}
+		if len(id) > 255 {
+			return nil, fmt.Errorf("key id %q too long", id[:16]+"...")
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		k.keys[id] = key
+		if k.active == "" {
+			k.active = id
+		}
+	}
+	if k.active == "" {
+		return nil, errors.New("no encryption key configured")
+	}
+	return k, nil
+}
+
+func decodeKey(s string) ([]byte, error) {
+	if b, err := hex.DecodeString(s); err == nil && len(b) == keySize {
+		return b, nil
+	}
+	for _, enc := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if b, err := enc.DecodeString(s); err == nil && len(b) == keySize {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("encryption key must be %d bytes, base64 or hex encoded", keySize)
+}
+
+// Segment seals and opens the records of one segment.
+type Segment struct {
+	keyID  string
+	header []byte
+	aead   cipher.AEAD
+}
+
+// KeyID returns the ID of the key the segment is sealed with.
+func (s *Segment) KeyID() string { return s.keyID }
+
+// Header returns the bytes that must start the segment file.
+func (s *Segment) Header() []byte { return s.header }
+
+// NewSegment starts a segment under the active key with a fresh salt.
+func (k *Keyring) NewSegment() (*Segment, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("generate segment salt: %w", err)
+	}
+	hdr := make([]byte, 0, len(magic)+2+len(k.active)+saltSize)
+	hdr = append(hdr, magic...)
+	hdr = append(hdr, version, byte(len(k.active)))
+	hdr = append(hdr, k.active...)
+	hdr = append(hdr, salt...)
+	return newSegment(k.active, k.keys[k.active], hdr, salt)
+}
+
+// OpenSegment reads the header at the start of r. It returns (nil, nil)
+// when r does not start with a seal header, i.e. holds plaintext.
+func (k *Keyring) OpenSegment(r io.ReaderAt) (*Segment, error) {
+	var fixed [len(magic) + 2]byte
+	if _, err := r.ReadAt(fixed[:], 0); err != nil || string(fixed[:len(magic)]) != magic {
+		return nil, nil
+	}
+	if fixed[len(magic)] != version {
+		return nil, fmt.Errorf("unsupported segment version %d", fixed[len(magic)])
+	}
+	hdr := make([]byte, len(fixed)+int(fixed[len(magic)+1])+saltSize)
+	if _, err := r.ReadAt(hdr, 0); err != nil {
+		return nil, fmt.Errorf("read segment header: %w", err)
+	}
+	id := string(hdr[len(fixed) : len(hdr)-saltSize])
+	if k == nil {
+		return nil, fmt.Errorf("segment sealed with key %q but no encryption key is configured: %w", id, ErrUnknownKey)
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("segment sealed with key %q: %w", id, ErrUnknownKey)
+	}
+	return newSegment(id, key, hdr, hdr[len(hdr)-saltSize:])
+}
+
+// IsSealed reports whether r starts with a seal header.
+func IsSealed(r io.ReaderAt) bool {
+	var m [len(magic)]byte
+	_, err := r.ReadAt(m[:], 0)
+	return err == nil && string(m[:]) == magic
+}
+
+func newSegment(id string, key, hdr, salt []byte) (*Segment, error) {
+	sub, err := hkdf.Key(sha256.New, key, salt, "bibbl segment v1", keySize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(sub)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Segment{keyID: id, header: hdr, aead: aead}, nil
+}
+
+func (s *Segment) nonce(pos uint64) []byte {
+	n := make([]byte, s.aead.NonceSize())
+	binary.BigEndian.PutUint64(n[len(n)-8:], pos)
+	return n
+}
+
+func (s *Segment) additional(aad []byte) []byte {
+	return append(append(make([]byte, 0, len(s.header)+len(aad)), s.header...), aad...)
+}
+
+// Seal encrypts the record at position pos (unique within the segment,
+// e.g. its file offset). aad is authenticated but not encrypted.
+func (s *Segment) Seal(pos uint64, plaintext, aad []byte) []byte {
+	return s.aead.Seal(nil, s.nonce(pos), plaintext, s.additional(aad))
+}
+
+// Open decrypts and authenticates the record sealed at pos.
+func (s *Segment) Open(pos uint64, ciphertext, aad []byte) ([]byte, error) {
+	out, err := s.aead.Open(nil, s.nonce(pos), ciphertext, s.additional(aad))
+	if err != nil {
+		return nil, ErrTampered
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package seal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte { return bytes.Repeat([]byte{b}, keySize) }
+
+func TestKeyringRotation(t *testing.T) {
+	old, err := ParseKeyring("k1:" + hex.EncodeToString(testKey(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, _ := old.NewSegment()
+	sealed := seg.Seal(42, []byte("secret event"), []byte("ts"))
+	if bytes.Contains(sealed, []byte("secret")) {
+		t.Fatal("plaintext leaked into sealed record")
+	}
+
+	rotated, err := ParseKeyring("k2:" + base64.StdEncoding.EncodeToString(testKey(2)) + ", k1:" + hex.EncodeToString(testKey(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ActiveID() != "k2" {
+		t.Fatalf("first key should be active, got %q", rotated.ActiveID())
+	}
+	reopened, err := rotated.OpenSegment(bytes.NewReader(seg.Header()))
+	if err != nil || reopened.KeyID() != "k1" {
+		t.Fatalf("open with rotated keyring: %v", err)
+	}
+	if got, err := reopened.Open(42, sealed, []byte("ts")); err != nil || string(got) != "secret event" {
+		t.Fatalf("open: %q %v", got, err)
+	}
+	if _, err := reopened.Open(43, sealed, []byte("ts")); !errors.Is(err, ErrTampered) {
+		t.Fatalf("moved record: expected ErrTampered, got %v", err)
+	}
+	sealed[3] ^= 1
+	if _, err := reopened.Open(42, sealed, []byte("ts")); !errors.Is(err, ErrTampered) {
+		t.Fatalf("flipped bit: expected ErrTampered, got %v", err)
+	}
+
+	fresh, _ := ParseKeyring(hex.EncodeToString(testKey(3)))
+	if _, err := fresh.OpenSegment(bytes.NewReader(seg.Header())); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+	if seg, err := fresh.OpenSegment(strings.NewReader(`[{"plain":true}]`)); seg != nil || err != nil {
+		t.Fatal("plaintext input should not be treated as sealed")
+	}
+}
+
+func TestParseKeyringErrors(t *testing.T) {
+	for _, spec := range []string{"", "short", "a:" + hex.EncodeToString(testKey(1)) + ",a:" + hex.EncodeToString(testKey(2))} {
+		if _, err := ParseKeyring(spec); err == nil {
+			t.Fatalf("expected error for %q", spec)
+		}
+	}
+	if _, err := ParseKeyring("vault://secret/bibbl#spill_key"); err == nil {
+		t.Fatal("vault reference without a resolver should fail")
+	}
+	t.Setenv("TEST_SEAL_KEY", "")
+	if _, err := FromEnv("TEST_SEAL_KEY"); err == nil {
+		t.Fatal("empty key variable should fail")
+	}
+}